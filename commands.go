@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/carn181/faustlsp/server"
+)
+
+// Subcommands that can be run from the command line instead of starting the language server
+var commands = map[string]func(ctx context.Context, args []string) int{
+	"graph":  graphCommand,
+	"index":  indexCommand,
+	"doctor": doctorCommand,
+	"docs":   docsCommand,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: faustlsp [command] [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Without a command, faustlsp runs the language server over stdin/stdout.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  graph    export the import dependency graph of a workspace as DOT or JSON")
+	fmt.Fprintln(os.Stderr, "  index    prebuild the symbol index of a workspace so the editor starts with a warm cache")
+	fmt.Fprintln(os.Stderr, "  doctor   check that faust, faustfmt and the workspace configuration are set up correctly")
+	fmt.Fprintln(os.Stderr, "  docs     generate the documentation bundle of the standard libraries from a faustlibraries checkout")
+}
+
+// faustlsp graph [-format dot|json] [-o file] [workspace]
+func graphCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	format := flags.String("format", "dot", "output format (dot | json)")
+	output := flags.String("o", "", "write the graph to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: faustlsp graph [-format dot|json] [-o file] [workspace]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	root := "."
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	}
+
+	s, err := server.IndexWorkspace(ctx, root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp graph:", err)
+		return exitError
+	}
+
+	content, err := server.ExportDependencyGraph(&s.Store.Dependencies, s.Workspace.Root, *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp graph:", err)
+		return exitUsage
+	}
+
+	if *output == "" {
+		fmt.Print(content)
+		return exitOK
+	}
+	if err := os.WriteFile(*output, []byte(content), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp graph:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// faustlsp index [-o file] [workspace]
+func indexCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("index", flag.ContinueOnError)
+	output := flags.String("o", "", "write the index to this file instead of the user cache directory")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: faustlsp index [-o file] [workspace]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	root := "."
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	}
+
+	s, err := server.IndexWorkspace(ctx, root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp index:", err)
+		return exitError
+	}
+
+	path := *output
+	if path == "" {
+		path, err = server.SymbolIndexPath(s.Workspace.Root)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "faustlsp index:", err)
+			return exitError
+		}
+	}
+	if err := s.Store.WriteIndex(s.Workspace.Root, path); err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp index:", err)
+		return exitError
+	}
+	fmt.Printf("Indexed %d files of %s into %s\n", len(s.Store.Cache), s.Workspace.Root, path)
+	return exitOK
+}
+
+// faustlsp doctor [workspace]
+func doctorCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: faustlsp doctor [workspace]")
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	root := "."
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp doctor:", err)
+		return exitError
+	}
+
+	code := exitOK
+	for i, check := range server.Doctor(root) {
+		status := "ok"
+		if !check.OK {
+			status = "FAIL"
+			// The config check comes first, report it with its own exit code
+			if i == 0 {
+				code = exitConfig
+			} else if code == exitOK {
+				code = exitError
+			}
+		}
+		fmt.Printf("[%4s] %-16s %s\n", status, check.Name, check.Detail)
+		if !check.OK && check.Fix != "" {
+			fmt.Printf("       %-16s fix: %s\n", "", check.Fix)
+		}
+	}
+	return code
+}
+
+// faustlsp docs [-version v] [-o file] faustlibraries
+func docsCommand(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("docs", flag.ContinueOnError)
+	version := flags.String("version", "", "faustlibraries version recorded in the bundle, e.g. its git tag")
+	output := flags.String("o", "", "write the bundle to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: faustlsp docs [-version v] [-o file] faustlibraries")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	bundle, err := server.GenerateDocsBundle(flags.Arg(0), *version)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp docs:", err)
+		return exitError
+	}
+	content, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp docs:", err)
+		return exitError
+	}
+	content = append(content, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(content)
+		return exitOK
+	}
+	if err := os.WriteFile(*output, content, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp docs:", err)
+		return exitError
+	}
+	fmt.Fprintf(os.Stderr, "Documented %d functions into %s\n", len(bundle.Docs), *output)
+	return exitOK
+}
@@ -11,7 +11,8 @@ import (
 var Logger *slog.Logger
 
 // Init initializes the logger with a file output.
-func Init() {
+// If the log file can't be created, the logger writes to stderr and the error is returned.
+func Init() error {
 	// TODO: Add option to take log file path from user
 
 	// os.TempDir gives temporary directory of any platform
@@ -24,7 +25,10 @@ func Init() {
 
 	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
-		panic(err)
+		Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			AddSource: true,
+		}))
+		return err
 	}
 
 	// Initialize the logger to write to the file, without flags or prefixes.
@@ -32,5 +36,5 @@ func Init() {
 	Logger = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{
 		AddSource: true,
 	}))
-
+	return nil
 }
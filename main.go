@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -12,18 +13,55 @@ import (
 	"github.com/carn181/faustlsp/transport"
 )
 
+// Exit codes of faustlsp, so that editors and scripts can tell failures apart
+const (
+	exitOK = 0
+	// Runtime error, also used when the client exits without shutdown as required by the LSP spec
+	exitError = 1
+	// Invalid command line usage
+	exitUsage = 2
+	// Invalid workspace configuration
+	exitConfig = 3
+	// Couldn't set up the connection to the client, e.g. because the port is in use
+	exitTransport = 4
+	// Couldn't set up the server's environment, e.g. the temporary directory
+	exitStartup = 5
+)
+
 func main() {
-	logging.Init()
+	err := logging.Init()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp: logging to stderr,", err)
+	}
 
 	logging.Logger.Info("Initialized")
 
 	// Background Context for cancelling
 	ctx, cancel := context.WithCancel(context.Background())
 
+	// Run a subcommand instead of the server if one is given
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			usage()
+			os.Exit(exitUsage)
+		}
+		code := command(ctx, os.Args[2:])
+		cancel()
+		os.Exit(code)
+	}
+
 	var s server.Server
 
 	// Default Transport method is stdin
-	s.Init(transport.Stdin)
+	err = s.Init(transport.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "faustlsp:", err)
+		if errors.Is(err, server.ErrTransport) {
+			os.Exit(exitTransport)
+		}
+		os.Exit(exitStartup)
+	}
 
 	// Handle Signals
 	sigs := make(chan os.Signal, 1)
@@ -33,17 +71,17 @@ func main() {
 		// Cancel when a signal is received
 		<-sigs
 		cancel()
-		fmt.Println("Got Interrupt ")
+		fmt.Fprintln(os.Stderr, "faustlsp: got interrupt")
 		logging.Logger.Info("Got Interrupt")
 	}()
 
 	// Start running server
-	err := s.Run(ctx)
+	err = s.Run(ctx)
 	logging.Logger.Info("Ended")
 
 	if err != nil {
-		os.Exit(1)
-	} else {
-		os.Exit(0)
+		fmt.Fprintln(os.Stderr, "faustlsp:", err)
+		os.Exit(exitError)
 	}
+	os.Exit(exitOK)
 }
@@ -1,7 +1,9 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 
 	. "github.com/carn181/faustlsp/transport"
@@ -23,10 +25,44 @@ type TSParser struct {
 
 var tsParser TSParser
 
-func Init() {
+// The tree-sitter-faust grammar can't be used with this version of go-tree-sitter,
+// or doesn't have the nodes the server's queries expect
+var ErrIncompatibleGrammar = errors.New("incompatible tree-sitter-faust grammar")
+
+const (
+	errorQuery  = "(ERROR) @error\n(MISSING) @missing"
+	importQuery = `
+(file_import filename: (string) @import)
+(definition (identifier) (library filename: (string) @import))
+`
+)
+
+// Loads the Faust grammar. Errors wrap ErrIncompatibleGrammar, in which case
+// ParseTree returns nil and queries find nothing.
+func Init() error {
 	tsParser.language = tree_sitter.NewLanguage(tree_sitter_faust.Language())
 	tsParser.parser = tree_sitter.NewParser()
-	tsParser.parser.SetLanguage(tsParser.language)
+	if err := tsParser.parser.SetLanguage(tsParser.language); err != nil {
+		return fmt.Errorf("%w: grammar ABI version %d, go-tree-sitter supports %d to %d: %w", ErrIncompatibleGrammar,
+			tsParser.language.AbiVersion(), tree_sitter.MIN_COMPATIBLE_LANGUAGE_VERSION, tree_sitter.LANGUAGE_VERSION, err)
+	}
+	// Queries run on every file are compiled once here so that a grammar that renamed their nodes is caught at startup
+	for _, queryStr := range []string{errorQuery, importQuery} {
+		query, err := newQuery(queryStr)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIncompatibleGrammar, err)
+		}
+		query.Close()
+	}
+	return nil
+}
+
+func newQuery(queryStr string) (*tree_sitter.Query, error) {
+	query, err := tree_sitter.NewQuery(tsParser.language, queryStr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't compile query %q: %w", queryStr, err)
+	}
+	return query, nil
 }
 
 type TSQueryResult struct {
@@ -38,6 +74,7 @@ func ParseTree(code []byte) *tree_sitter.Tree {
 	//	tsParser.parser = tree_sitter.NewParser()
 	//	tsParser.parser.SetLanguage(tsParser.language)
 	tsParser.mu.Lock()
+	// Nil if the grammar couldn't be loaded
 	tree := tsParser.parser.Parse(code, nil)
 	//	tsParser.parser.Close()
 	tsParser.parser.Reset()
@@ -46,10 +83,18 @@ func ParseTree(code []byte) *tree_sitter.Tree {
 }
 
 func TSDiagnostics(code []byte, tree *tree_sitter.Tree) []Diagnostic {
-	errorQuery := "(ERROR) @error\n(MISSING) @missing"
-	rslts := GetQueryMatches(errorQuery, code, tree)
-
 	var diagnostics = []Diagnostic{}
+	rslts, err := GetQueryMatches(errorQuery, code, tree)
+	if err != nil {
+		// Not finding syntax errors must not look like a file without any
+		return append(diagnostics, Diagnostic{
+			Message:  fmt.Sprintf("Syntax errors can't be checked: %s", err),
+			Severity: SeverityWarning,
+			Source:   "faustlsp",
+			Code:     "grammar-error",
+		})
+	}
+
 	for _, errors := range rslts.Results {
 		for _, node := range errors {
 			// First named parent node from error
@@ -72,11 +117,13 @@ func TSDiagnostics(code []byte, tree *tree_sitter.Tree) []Diagnostic {
 			end := node.EndPosition()
 
 			var msg string
+			var rule string
 			if node.Kind() != "ERROR" {
 				msg = fmt.Sprintf("Missing '%s' at %d:%d\n", node.GrammarName(), start.Row, start.Column)
+				rule = "missing"
 			} else {
 				msg = fmt.Sprintf("Syntax Error: Unexpected '%s' at %d:%d when parsing inside %s\n", node.Utf8Text(code), start.Row, start.Column, prev.GrammarName())
-
+				rule = "syntax-error"
 			}
 
 			d := Diagnostic{
@@ -89,6 +136,7 @@ func TSDiagnostics(code []byte, tree *tree_sitter.Tree) []Diagnostic {
 				Message:  msg,
 				Severity: DiagnosticSeverity(Error),
 				Source:   "tree-sitter",
+				Code:     rule,
 			}
 			diagnostics = append(diagnostics, d)
 		}
@@ -97,14 +145,174 @@ func TSDiagnostics(code []byte, tree *tree_sitter.Tree) []Diagnostic {
 }
 
 func DocumentSymbols(tree *tree_sitter.Tree, content []byte) []DocumentSymbol {
+	if tree == nil {
+		return []DocumentSymbol{}
+	}
 	cursor := tree.Walk()
 	defer cursor.Close()
 
 	program := DocumentSymbolsRecursive(tree.RootNode(), content)
 	//	fmt.Println(program.Children)
+	if metadata, ok := metadataSymbol(tree.RootNode(), content); ok {
+		return append([]DocumentSymbol{metadata}, program.Children...)
+	}
 	return program.Children
 }
 
+// Groups the declare statements of a program in a Metadata symbol, with a child for each key and its value as detail.
+// Function metadata is named after the function and the key, e.g. "lowpass author".
+func metadataSymbol(program *tree_sitter.Node, content []byte) (DocumentSymbol, bool) {
+	metadata := DocumentSymbol{Name: "Metadata", Kind: Namespace}
+	for i := uint(0); i < program.NamedChildCount(); i++ {
+		node := program.NamedChild(i)
+		name := node.GrammarName()
+		if name != "global_metadata" && name != "function_metadata" {
+			continue
+		}
+		key := node.ChildByFieldName("key")
+		value := node.ChildByFieldName("value")
+		if key == nil || value == nil {
+			continue
+		}
+		symbol := DocumentSymbol{
+			Name:           key.Utf8Text(content),
+			Detail:         strings.Trim(value.Utf8Text(content), `"`),
+			Kind:           Property,
+			Range:          nodeRange(node),
+			SelectionRange: nodeRange(key),
+		}
+		if function := node.ChildByFieldName("function_name"); function != nil {
+			symbol.Name = function.Utf8Text(content) + " " + symbol.Name
+		}
+		if len(metadata.Children) == 0 {
+			metadata.Range.Start = symbol.Range.Start
+			metadata.SelectionRange = symbol.Range
+		}
+		metadata.Range.End = symbol.Range.End
+		metadata.Children = append(metadata.Children, symbol)
+	}
+	return metadata, len(metadata.Children) > 0
+}
+
+// A //=== Section === or //--- Subsection --- comment of faustlibraries
+type sectionHeading struct {
+	title string
+	// 1 for sections, 2 for subsections
+	level int
+	line  uint32
+	width uint32
+}
+
+// Parses line as a section heading. Separators without title and documentation headers of functions,
+// like //---`(fi.lowpass)`---, aren't headings.
+func parseSectionHeading(line string) (sectionHeading, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "//")
+	if !ok || rest == "" {
+		return sectionHeading{}, false
+	}
+	level := 0
+	switch rest[0] {
+	case '=':
+		level = 1
+	case '-':
+		level = 2
+	default:
+		return sectionHeading{}, false
+	}
+	rule := strings.Repeat(rest[:1], 3)
+	if !strings.HasPrefix(rest, rule) || !strings.HasSuffix(rest, rule) {
+		return sectionHeading{}, false
+	}
+	title := strings.TrimSpace(strings.Trim(rest, rest[:1]))
+	if title == "" || strings.Contains(title, "`") {
+		return sectionHeading{}, false
+	}
+	return sectionHeading{title: title, level: level}, true
+}
+
+// Groups top-level symbols under the section and subsection headings preceding them, the way faustlibraries
+// and their documentation are organized
+func SectionSymbols(symbols []DocumentSymbol, content []byte) []DocumentSymbol {
+	headings := []sectionHeading{}
+	for i, line := range strings.Split(string(content), "\n") {
+		if heading, ok := parseSectionHeading(line); ok {
+			heading.line = uint32(i)
+			heading.width = uint32(len(strings.TrimRight(line, "\r")))
+			headings = append(headings, heading)
+		}
+	}
+	if len(headings) == 0 {
+		return symbols
+	}
+
+	grouped := []DocumentSymbol{}
+	var section, subsection *DocumentSymbol
+	add := func(sym DocumentSymbol) {
+		parent := section
+		if subsection != nil {
+			parent = subsection
+		}
+		if parent == nil {
+			grouped = append(grouped, sym)
+			return
+		}
+		parent.Children = append(parent.Children, sym)
+		parent.Range.End = sym.Range.End
+	}
+	closeSubsection := func() {
+		if subsection != nil {
+			sym := *subsection
+			subsection = nil
+			add(sym)
+		}
+	}
+	closeSection := func() {
+		closeSubsection()
+		if section != nil {
+			sym := *section
+			section = nil
+			add(sym)
+		}
+	}
+	open := func(heading sectionHeading) {
+		headingRange := Range{
+			Start: Position{Line: heading.line},
+			End:   Position{Line: heading.line, Character: heading.width},
+		}
+		sym := &DocumentSymbol{Name: heading.title, Kind: Namespace, Range: headingRange, SelectionRange: headingRange}
+		if heading.level == 1 {
+			closeSection()
+			section = sym
+		} else {
+			closeSubsection()
+			subsection = sym
+		}
+	}
+
+	next := 0
+	for _, sym := range symbols {
+		for next < len(headings) && headings[next].line <= sym.Range.Start.Line {
+			open(headings[next])
+			next++
+		}
+		add(sym)
+	}
+	for ; next < len(headings); next++ {
+		open(headings[next])
+	}
+	closeSection()
+	return grouped
+}
+
+func nodeRange(node *tree_sitter.Node) Range {
+	start := node.StartPosition()
+	end := node.EndPosition()
+	return Range{
+		Start: Position{Line: uint32(start.Row), Character: uint32(start.Column)},
+		End:   Position{Line: uint32(end.Row), Character: uint32(end.Column)},
+	}
+}
+
 func DocumentSymbolsRecursiveNoEnvironment(node *tree_sitter.Node, content []byte) DocumentSymbol {
 	name := node.GrammarName()
 	var s DocumentSymbol
@@ -208,13 +416,12 @@ func DocumentSymbolsRecursive(node *tree_sitter.Node, content []byte) DocumentSy
 
 }
 
-func GetImports(code []byte, tree *tree_sitter.Tree) []util.Path {
-	importQuery := `
-(file_import filename: (string) @import)
-(definition (identifier) (library filename: (string) @import))
-`
+func GetImports(code []byte, tree *tree_sitter.Tree) ([]util.Path, error) {
 	paths := []util.Path{}
-	rslts := GetQueryMatches(importQuery, code, tree)
+	rslts, err := GetQueryMatches(importQuery, code, tree)
+	if err != nil {
+		return paths, err
+	}
 	for _, imports := range rslts.Results {
 		for _, imp := range imports {
 			p := imp.Utf8Text(code)
@@ -222,40 +429,26 @@ func GetImports(code []byte, tree *tree_sitter.Tree) []util.Path {
 			paths = append(paths, cleanRelPath)
 		}
 	}
-	return paths
+	return paths, nil
 }
 
-func GetQueryMatches(queryStr string, code []byte, tree *tree_sitter.Tree) TSQueryResult {
-	query, _ := tree_sitter.NewQuery(tsParser.language, queryStr)
-	defer query.Close()
-
-	cursor := tree_sitter.NewQueryCursor()
-	defer cursor.Close()
-
-	matches := cursor.Matches(query, tree.RootNode(), code)
-
-	var result TSQueryResult
-	result.Results = make(map[string][]tree_sitter.Node)
-	for match := matches.Next(); match != nil; match = matches.Next() {
-		for _, capture := range match.Captures {
-			//			fmt.Printf("Match %d, Capture %d (%s): %s\n", match.PatternIndex, capture.Index, query.CaptureNames()[capture.Index], capture.Node.Utf8Text(code))
-
-			// Add to result
-			captureName := query.CaptureNames()[capture.Index]
-			captures, _ := result.Results[captureName]
-			node := capture.Node
-			result.Results[captureName] = append(captures, node)
-		}
+// Runs queryStr on tree. An error is returned if the query doesn't compile with the Faust grammar.
+func GetQueryMatches(queryStr string, code []byte, tree *tree_sitter.Tree) (TSQueryResult, error) {
+	if tree == nil {
+		return TSQueryResult{}, nil
 	}
-
-	return result
+	return GetQueryMatchesFromNode(queryStr, code, tree.RootNode())
 }
 
-func GetQueryMatchesFromNode(queryStr string, code []byte, node *tree_sitter.Node) TSQueryResult {
+// Runs queryStr on the subtree of node. An error is returned if the query doesn't compile with the Faust grammar.
+func GetQueryMatchesFromNode(queryStr string, code []byte, node *tree_sitter.Node) (TSQueryResult, error) {
 	if node == nil {
-		return TSQueryResult{}
+		return TSQueryResult{}, nil
+	}
+	query, err := newQuery(queryStr)
+	if err != nil {
+		return TSQueryResult{}, err
 	}
-	query, _ := tree_sitter.NewQuery(tsParser.language, queryStr)
 	defer query.Close()
 
 	cursor := tree_sitter.NewQueryCursor()
@@ -277,7 +470,7 @@ func GetQueryMatchesFromNode(queryStr string, code []byte, node *tree_sitter.Nod
 		}
 	}
 
-	return result
+	return result, nil
 }
 
 func Close() {
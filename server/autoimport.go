@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Library defining the environments of the standard libraries, like os
+const stdfaustLibrary = "stdfaust.lib"
+
+// Adds an import of stdfaust.lib to completions of a standard library environment, unless content already imports it
+func withStdlibImport(syms []CompletionSym, content []byte, encoding string) []CompletionSym {
+	if len(syms) == 0 {
+		return syms
+	}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return syms
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+	if importsFile(root, content, stdfaustLibrary) {
+		return syms
+	}
+
+	edit := importEdit(content, bindingOffset(root, content, uint(len(content))), fmt.Sprintf("import(%s);\n", strconv.Quote(stdfaustLibrary)), encoding)
+	for i := range syms {
+		syms[i].edits = []transport.TextEdit{edit}
+		syms[i].library = stdfaustLibrary
+	}
+	return syms
+}
+
+// Completions for the top-level definitions of the folder's libraries that can't be reached from f, along with the
+// edits making them reachable: an import of their library, or a library binding when the library defines names that
+// f defines too, as importing it would redefine them. Definitions of libraries f already binds are completed through
+// their binding.
+func (w *Workspace) importCompletions(f *File, snap FileSnapshot, pos transport.Position, store *Store, encoding string) []CompletionSym {
+	f.mu.RLock()
+	path := f.Handle.Path
+	f.mu.RUnlock()
+	if util.IsMemoryPath(path) || snap.Scope == nil {
+		return nil
+	}
+	offset, err := PositionToOffset(pos, string(snap.Content), encoding)
+	if err != nil {
+		return nil
+	}
+	identifier, scope := FindSymbolScopeAtOffset(snap.Content, snap.Scope, offset, encoding)
+	// Members of environments are completed through them
+	if identifier == "" || strings.Contains(identifier, ".") || scope == nil {
+		return nil
+	}
+
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return nil
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+	at := bindingOffset(root, snap.Content, uint(len(snap.Content)))
+	defined := topLevelDefinitionSymbols(snap.Scope)
+
+	completions := []CompletionSym{}
+	for _, target := range w.folderLibraries(path, store) {
+		targetFile, ok := store.Files.GetFromPath(target)
+		if !ok {
+			continue
+		}
+		targetFile.mu.RLock()
+		targetScope := targetFile.Scope
+		targetFile.mu.RUnlock()
+		if targetScope == nil {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Dir(path), target)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		syms := topLevelDefinitionSymbols(targetScope)
+
+		alias, bound := libraryBinding(root, snap.Content, rel)
+		var edits []transport.TextEdit
+		switch {
+		case bound:
+		case slices.ContainsFunc(syms, func(sym *Symbol) bool {
+			return slices.ContainsFunc(defined, func(d *Symbol) bool { return d.Ident == sym.Ident })
+		}):
+			alias = libraryAlias(target, "", snap.Scope, store)
+			edits = []transport.TextEdit{importEdit(snap.Content, at, fmt.Sprintf("%s = library(%s);\n", alias, strconv.Quote(rel)), encoding)}
+		default:
+			edits = []transport.TextEdit{importEdit(snap.Content, at, fmt.Sprintf("import(%s);\n", strconv.Quote(rel)), encoding)}
+		}
+
+		for _, sym := range syms {
+			name := sym.Ident
+			if alias != "" {
+				name = alias + "." + name
+			} else if _, err := FindSymbolDefinition(name, scope, store); err == nil {
+				// Already reachable, or shadowed by a definition of the same name
+				continue
+			}
+			completions = append(completions, CompletionSym{name: name, docs: sym.Docs, edits: edits, library: rel, kind: completionKind(sym, store), file: target})
+		}
+	}
+	return completions
+}
+
+// Definitions and functions of a file scope, once per name
+func topLevelDefinitionSymbols(scope *Scope) []*Symbol {
+	syms := []*Symbol{}
+	for _, sym := range scope.Symbols {
+		switch sym.Kind {
+		case Definition, Function, Case:
+		default:
+			continue
+		}
+		if sym.Ident != "" && !slices.ContainsFunc(syms, func(s *Symbol) bool { return s.Ident == sym.Ident }) {
+			syms = append(syms, sym)
+		}
+	}
+	return syms
+}
+
+// Whether root imports the file named name, e.g. stdfaust.lib
+func importsFile(root *tree_sitter.Node, content []byte, name string) bool {
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() != "file_import" {
+			continue
+		}
+		if filename := node.ChildByFieldName("filename"); filename != nil && stripQuotes(filename.Utf8Text(content)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Edit inserting the line text at offset at, which is the start of a line unless content doesn't end with a line break
+func importEdit(content []byte, at uint, text string, encoding string) transport.TextEdit {
+	if at > 0 && content[at-1] != '\n' {
+		text = "\n" + text
+	}
+	return transport.TextEdit{Range: replaceRange(at, at, string(content), encoding), NewText: text}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Goroutines that run in the background of the server: the diagnostics publisher, the workspace watcher,
+// analysis workers and debounced diagnostics. They share a context that is cancelled when the server stops,
+// and stopping waits for all of them, so that nothing keeps running or publishing after exit.
+// The zero value is ready to use.
+type backgroundTasks struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func (b *backgroundTasks) context() context.Context {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.contextLocked()
+}
+
+func (b *backgroundTasks) contextLocked() context.Context {
+	if b.ctx == nil {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+	}
+	return b.ctx
+}
+
+// Runs f in a new goroutine with the tasks' context, unless the server is stopping. Returns whether f was started.
+func (b *backgroundTasks) Go(f func(ctx context.Context)) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ctx := b.contextLocked()
+	if ctx.Err() != nil {
+		return false
+	}
+	// Added under the lock, so that stop can't start waiting before
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		f(ctx)
+	}()
+	return true
+}
+
+// Closed once the server is stopping
+func (b *backgroundTasks) stopping() <-chan struct{} {
+	return b.context().Done()
+}
+
+// Cancels the context of the tasks and waits for all of them to return. No tasks can be started afterwards.
+// Work that is still pending, like debounced diagnostics and coalesced disk events, is dropped rather than flushed:
+// nothing outlives the server, the replica is removed on exit and compilers are killed, so it would be wasted.
+func (b *backgroundTasks) stop() {
+	b.mu.Lock()
+	b.contextLocked()
+	b.cancel()
+	b.mu.Unlock()
+	b.running.Wait()
+}
+
+// Analyzes f and its imports in the background
+func (s *Server) analyzeInBackground(f *File) {
+	s.background.Go(func(context.Context) {
+		s.analyzeFile(f)
+	})
+}
+
+// Analyzes f and its imports, tracing how long it took
+func (s *Server) analyzeFile(f *File) {
+	start := time.Now()
+	s.Workspace.AnalyzeFile(f, &s.Store)
+	f.mu.RLock()
+	path := f.Handle.Path
+	f.mu.RUnlock()
+	s.logTraceSince(start, "Analyzed "+path, nil)
+}
+
+// Hands a change reported by the client's file watcher to the workspace watcher. Dropped if the server stops before
+// the watcher takes it.
+func (s *Server) queueWatchedFileEvent(event fsnotify.Event) {
+	select {
+	case s.Workspace.watchedFileEvents <- event:
+	case <-s.background.stopping():
+	}
+}
+
+// Hands an editor event to the workspace watcher. Dropped if the server stops before the watcher takes it.
+func (s *Server) queueEditorEvent(event TDEvent) {
+	select {
+	case s.Workspace.TDEvents <- event:
+	case <-s.background.stopping():
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+)
+
+// Cause of the context of a request the client cancelled with $/cancelRequest
+var errRequestCancelled = errors.New("request cancelled")
+
+// Context of the request msg, which $/cancelRequest cancels until done is called. Requests are tracked from the
+// moment they are read, so that they can be cancelled before their handler starts. Notifications get ctx itself.
+func (s *Server) startRequest(ctx context.Context, msg []byte) (context.Context, func()) {
+	var m transport.RequestMessage
+	if json.Unmarshal(msg, &m) != nil || m.ID == nil {
+		return ctx, func() {}
+	}
+	requestCtx, cancel := context.WithCancelCause(ctx)
+	id := fmt.Sprint(m.ID)
+
+	s.requestsMu.Lock()
+	if s.ongoingRequests == nil {
+		s.ongoingRequests = make(map[string]context.CancelCauseFunc)
+	}
+	s.ongoingRequests[id] = cancel
+	s.requestsMu.Unlock()
+
+	return requestCtx, func() {
+		s.requestsMu.Lock()
+		delete(s.ongoingRequests, id)
+		s.requestsMu.Unlock()
+		cancel(nil)
+	}
+}
+
+// Whether the request of ctx was cancelled by the client, rather than by the server stopping
+func requestCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRequestCancelled)
+}
+
+// Handler for $/cancelRequest. Handlers stop at the next point where they check their context, and the request is
+// answered with RequestCancelled. Requests that are already answered are left alone, as the spec allows.
+func CancelRequest(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.CancelParams
+	json.Unmarshal(par, &params)
+
+	id := fmt.Sprint(params.ID)
+	s.requestsMu.Lock()
+	cancel, ok := s.ongoingRequests[id]
+	s.requestsMu.Unlock()
+	if !ok {
+		logging.Logger.Debug("Cancel for a request that isn't running", "id", id)
+		return nil
+	}
+	logging.Logger.Info("Client cancelled request", "id", id)
+	cancel(errRequestCancelled)
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+type CheckSelectionResult struct {
+	// Whether the selection compiled as a process
+	OK bool `json:"ok"`
+	// Message of the compiler when it didn't
+	Error   string `json:"error,omitempty"`
+	Inputs  int    `json:"inputs"`
+	Outputs int    `json:"outputs"`
+	// The temporary file the selection was compiled as
+	Source string `json:"source"`
+}
+
+// Compiles the expression selected by the range given as second argument in the document given as first argument,
+// as the process of a temporary file importing what the document imports. Returns the compiler's error, or the
+// number of inputs and outputs of the expression, to sanity-check a sub-expression without editing the document.
+func CheckSelectionCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	path, err := commandPathArgument(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("missing range argument")
+	}
+	var selection transport.Range
+	if err := json.Unmarshal(args[1], &selection); err != nil {
+		return nil, fmt.Errorf("invalid range argument: %w", err)
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return nil, fmt.Errorf("%s is not open", path)
+	}
+	f.mu.RLock()
+	content := f.Content
+	f.mu.RUnlock()
+
+	start, _ := PositionToOffset(selection.Start, string(content), string(s.Files.encoding))
+	end, _ := PositionToOffset(selection.End, string(content), string(s.Files.encoding))
+	expression := strings.TrimSuffix(strings.TrimSpace(string(content[min(start, end):max(start, end)])), ";")
+	if expression == "" {
+		return nil, fmt.Errorf("nothing selected to check")
+	}
+	source := documentImports(content) + fmt.Sprintf("process = %s;\n", expression)
+
+	progress := s.StartProgress(ctx, "Checking selection", filepath.Base(path), true)
+	defer progress.End("")
+
+	result := CheckSelectionResult{Source: source}
+	io, compileErr, err := s.describeProcess(progress.Context(), path, "check", source, "process")
+	if progress.Context().Err() != nil {
+		return nil, fmt.Errorf("check cancelled")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if compileErr != "" {
+		result.Error = compileErr
+		return result, nil
+	}
+	result.OK, result.Inputs, result.Outputs = true, io.Inputs, io.Outputs
+	return result, nil
+}
+
+// Number of inputs and outputs of a process
+type processIO struct {
+	Inputs  int `json:"inputs"`
+	Outputs int `json:"outputs"`
+}
+
+// Compiles source as a temporary file named after name, finding imports like the document at path does, and returns
+// the number of inputs and outputs of its process named processName. The compiler's message is returned as
+// compileErr when source doesn't compile.
+func (s *Server) describeProcess(ctx context.Context, path util.Path, name string, source string, processName string) (io processIO, compileErr string, err error) {
+	folder := s.Workspace.folderFor(path)
+	if !s.compilerAvailable(folder.compilerCommand()) {
+		return processIO{}, "", fmt.Errorf("%s not found in PATH", folder.Config.Command)
+	}
+	workDir, err := os.MkdirTemp(s.Workspace.tempDir, name+"-")
+	if err != nil {
+		return processIO{}, "", fmt.Errorf("couldn't create working directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	file := filepath.Join(workDir, name+".dsp")
+	if err := os.WriteFile(file, []byte(source), 0640); err != nil {
+		return processIO{}, "", fmt.Errorf("couldn't write %s: %w", name, err)
+	}
+
+	// The JSON description of the process gives its number of inputs and outputs
+	command := folder.compilerCommand()
+	cmdArgs := compilerArgs(folder.Config, file, processName, nil, "-json", "-O", workDir)
+	cmdArgs = append(cmdArgs, s.Workspace.documentIncludeArgs(path, folder)...)
+
+	start := time.Now()
+	errors, err := runCompiler(ctx, folder.Config, command, cmdArgs, workDir, nil)
+	s.logTraceSince(start, "Described the process of "+path, func() string { return command + " " + strings.Join(cmdArgs, " ") + "\n" + errors })
+	if err != nil {
+		if ctx.Err() != nil {
+			return processIO{}, "", ctx.Err()
+		}
+		compileErr = strings.TrimSpace(errors)
+		if compileErr == "" {
+			compileErr = err.Error()
+		}
+		return processIO{}, compileErr, nil
+	}
+
+	description, err := os.ReadFile(file + ".json")
+	if err != nil {
+		return processIO{}, "", fmt.Errorf("%s didn't describe the process: %w", folder.Config.Command, err)
+	}
+	if err := json.Unmarshal(description, &io); err != nil {
+		return processIO{}, "", fmt.Errorf("invalid process description: %w", err)
+	}
+	return io, "", nil
+}
+
+// Imports and library bindings of the top level of content, one per line
+func documentImports(content []byte) string {
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return ""
+	}
+	defer tree.Close()
+
+	var b strings.Builder
+	root := tree.RootNode()
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		switch node.GrammarName() {
+		case "file_import":
+		case "definition":
+			if value := node.ChildByFieldName("value"); value == nil || value.GrammarName() != "library" {
+				continue
+			}
+		default:
+			continue
+		}
+		b.WriteString(node.Utf8Text(content) + "\n")
+	}
+	return b.String()
+}
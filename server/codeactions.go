@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// What code actions are requested for: a document, the range selected in it, and the diagnostics the client shows there
+type codeActionRequest struct {
+	file   *File
+	path   util.Path
+	params transport.CodeActionParams
+}
+
+// A contributor of code actions. Its kind is the most general kind of the actions it offers, so that it isn't asked
+// for actions when the client only wants actions of other kinds.
+type codeActionProvider struct {
+	kind    transport.CodeActionKind
+	actions func(s *Server, req codeActionRequest) []transport.CodeAction
+}
+
+// Providers of code actions, in the order their actions are offered: quick fixes of the code at the range first,
+// then refactorings of the definition at the range, then source actions, which apply to the whole file
+var codeActionProviders = []codeActionProvider{
+	{transport.QuickFix, missingImportFixes},
+	{transport.QuickFix, typoFixes},
+	{transport.QuickFix, unusedDefinitionFixes},
+	{transport.RefactorMove, func(s *Server, req codeActionRequest) []transport.CodeAction {
+		return moveDefinitionActions(s, req.file, req.params.Range)
+	}},
+	{transport.RefactorExtract, func(s *Server, req codeActionRequest) []transport.CodeAction {
+		return optionalAction(extractLibraryAction(s, req.file, req.params.Range))
+	}},
+	{transport.Source, func(s *Server, req codeActionRequest) []transport.CodeAction {
+		return optionalAction(metadataTemplateAction(s, req.file))
+	}},
+	{transport.Source, func(s *Server, req codeActionRequest) []transport.CodeAction {
+		return sortDefinitionsActions(s, req.file)
+	}},
+	{transport.Source, func(s *Server, req codeActionRequest) []transport.CodeAction {
+		// Untitled documents have no folder to create the config in
+		if util.IsMemoryPath(req.path) {
+			return nil
+		}
+		return optionalAction(initConfigAction(s, req.path))
+	}},
+}
+
+// Handler for textDocument/codeAction, gathering the actions of every provider of the kinds the client asks for
+func CodeActions(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.CodeActionParams
+	json.Unmarshal(par, &params)
+
+	actions := []transport.CodeAction{}
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil || !IsFaustFile(path) {
+		return json.Marshal(actions)
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		logging.Logger.Error("File should've been in server file store", "path", path)
+		return json.Marshal(actions)
+	}
+
+	req := codeActionRequest{file: f, path: path, params: params}
+	for _, provider := range codeActionProviders {
+		if !mayOfferKind(provider.kind, params.Context.Only) {
+			continue
+		}
+		for _, action := range provider.actions(s, req) {
+			if requestedKind(action.Kind, params.Context.Only) {
+				actions = append(actions, action)
+			}
+		}
+	}
+	return json.Marshal(actions)
+}
+
+// Whether actions of kind are requested. Kinds are hierarchical, e.g. refactor.extract is a refactor.
+func requestedKind(kind transport.CodeActionKind, only []transport.CodeActionKind) bool {
+	if len(only) == 0 {
+		return true
+	}
+	for _, wanted := range only {
+		if isSubKind(kind, wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a provider of actions of kind may offer requested ones, which can be of a more specific kind
+func mayOfferKind(kind transport.CodeActionKind, only []transport.CodeActionKind) bool {
+	if requestedKind(kind, only) {
+		return true
+	}
+	for _, wanted := range only {
+		if isSubKind(wanted, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSubKind(kind transport.CodeActionKind, parent transport.CodeActionKind) bool {
+	return kind == parent || strings.HasPrefix(string(kind), string(parent)+".")
+}
+
+func optionalAction(action transport.CodeAction, ok bool) []transport.CodeAction {
+	if !ok {
+		return nil
+	}
+	return []transport.CodeAction{action}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// What the code lens of a process is resolved from
+type processLensData struct {
+	URI  transport.DocumentURI `json:"uri"`
+	Name string                `json:"name"`
+}
+
+// Handler for textDocument/codeLens, putting a lens over the process definition of DSP files. Lenses are returned
+// unresolved, as the number of inputs and outputs they show takes a compilation, done by codeLens/resolve for the
+// lenses the client displays.
+func CodeLens(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.CodeLensParams
+	json.Unmarshal(par, &params)
+
+	lenses := []transport.CodeLens{}
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil || !IsDSPFile(path) {
+		return json.Marshal(lenses)
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		logging.Logger.Error("File should've been in server file store", "path", path)
+		return json.Marshal(lenses)
+	}
+	folder := s.Workspace.folderFor(path)
+	if !s.compilerAvailable(folder.compilerCommand()) {
+		return json.Marshal(lenses)
+	}
+	snap := s.Workspace.snapshot(f, &s.Store)
+	if snap.Scope == nil {
+		return json.Marshal(lenses)
+	}
+
+	name := folder.processName(path)
+	for _, sym := range snap.Scope.Symbols {
+		if sym.Ident != name || (sym.Kind != Definition && sym.Kind != Function) {
+			continue
+		}
+		// Lenses span a single line
+		start := sym.Loc.Range.Start
+		lenses = append(lenses, transport.CodeLens{
+			Range: transport.Range{Start: start, End: start},
+			Data:  processLensData{URI: params.TextDocument.URI, Name: name},
+		})
+		break
+	}
+	return json.Marshal(lenses)
+}
+
+// Handler for codeLens/resolve, compiling the current content of the document of a process lens to show the number
+// of inputs and outputs of the process
+func CodeLensResolve(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var lens transport.CodeLens
+	json.Unmarshal(par, &lens)
+
+	raw, _ := json.Marshal(lens.Data)
+	var data processLensData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("invalid code lens data: %w", err)
+	}
+	path, err := util.URI2path(string(data.URI))
+	if err != nil {
+		return nil, err
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return nil, fmt.Errorf("%s is not open", path)
+	}
+	f.mu.RLock()
+	content := string(f.Content)
+	f.mu.RUnlock()
+
+	// The document may have unsaved changes, so its content is compiled from the temporary directory
+	io, compileErr, err := s.describeProcess(ctx, path, "lens", content, data.Name)
+	if err != nil {
+		return nil, err
+	}
+	title := fmt.Sprintf("%s, %s", plural(io.Inputs, "input"), plural(io.Outputs, "output"))
+	if compileErr != "" {
+		title = "Doesn't compile"
+	}
+	// The lens only shows information, so it runs no command
+	lens.Command = &transport.Command{Title: title}
+	return json.Marshal(lens)
+}
+
+// n followed by noun, in the plural unless n is 1
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -1,13 +1,20 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
 )
 
 type FaustError struct {
@@ -45,27 +52,131 @@ func getFaustErrorReportingType(s string) FaustErrorReportingType {
 	return FileError
 }
 
-// TODO: When handling initialize, send diagnostics capability based on whether PATH has faust or some other compiler path provided by project configuration
-func getCompilerDiagnostics(path string, dirPath string, cfg FaustProjectConfig) transport.Diagnostic {
-	cmd := exec.Command(cfg.Command, path, "-pn", cfg.ProcessName)
-	if dirPath != "" {
-		cmd.Dir = dirPath
+// Limits the number of compiler processes running at the same time
+type processLimiter struct {
+	mu      sync.Mutex
+	running int
+	// Closed and replaced whenever a process finishes
+	released chan struct{}
+}
+
+var compilerProcesses processLimiter
+
+// Waits until fewer than limit processes are running, or ctx is cancelled. A limit <= 0 means no limit.
+func (l *processLimiter) acquire(ctx context.Context, limit int) error {
+	for {
+		l.mu.Lock()
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		if limit <= 0 || l.running < limit {
+			l.running++
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (l *processLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	if l.released != nil {
+		close(l.released)
+	}
+	l.released = make(chan struct{})
+}
+
+// Returned by runCompiler when the compiler ran for longer than the compiler_timeout of the config
+var errCompilerTimeout = errors.New("compiler timed out")
+
+// Arguments of the compiler for the process processName of file: options come after the file, followed by the
+// precision flags of cfg and the include directories
+func compilerArgs(cfg FaustProjectConfig, file string, processName string, includeDirs []util.Path, options ...string) []string {
+	args := append([]string{file}, options...)
+	args = append(args, "-pn", processName)
+	args = append(args, cfg.Precision.flags()...)
+	for _, dir := range includeDirs {
+		args = append(args, "-I", dir)
+	}
+	return args
+}
+
+// Runs command with args in workDir once fewer than cfg.MaxCompilers compilers are running, writing its output to
+// stdout if it isn't nil, and returns what it wrote to stderr. The compiler is killed when ctx is cancelled, in which
+// case ctx.Err() is returned, or when it runs for longer than cfg.CompilerTimeout, in which case errCompilerTimeout is.
+func runCompiler(ctx context.Context, cfg FaustProjectConfig, command string, args []string, workDir string, stdout io.Writer) (string, error) {
+	if err := compilerProcesses.acquire(ctx, cfg.MaxCompilers); err != nil {
+		return "", err
+	}
+	defer compilerProcesses.release()
+
+	runCtx := ctx
+	if cfg.CompilerTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, time.Duration(cfg.CompilerTimeout)*time.Millisecond)
+		defer cancel()
 	}
-	var errors strings.Builder
-	cmd.Stderr = &errors
+
+	cmd := exec.CommandContext(runCtx, command, args...)
+	if workDir != "" {
+		cmd.Dir = workDir
+	}
+	// Don't wait for children of a killed compiler that still hold stderr open
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = stdout
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	logging.Logger.Info("Running compiler", "command", cmd.String())
 	err := cmd.Run()
-	faustErrors := errors.String()
+	switch {
+	case ctx.Err() != nil:
+		return stderr.String(), ctx.Err()
+	case runCtx.Err() != nil:
+		return stderr.String(), errCompilerTimeout
+	}
+	return stderr.String(), err
+}
+
+// TODO: When handling initialize, send diagnostics capability based on whether PATH has faust or some other compiler path provided by project configuration
+// Cancelling ctx kills the compiler, in which case no diagnostic is returned.
+// Compilers running for longer than cfg.CompilerTimeout are killed and reported with a diagnostic.
+// The compiler runs in workDir, so that files it may write don't end up in the user's project.
+func getCompilerDiagnostics(ctx context.Context, path string, workDir string, cfg FaustProjectConfig, includeDirs []util.Path) transport.Diagnostic {
+	faustErrors, err := runCompiler(ctx, cfg, cfg.Command, compilerArgs(cfg, path, cfg.ProcessName, includeDirs), workDir, nil)
 	logging.Logger.Info("Return code of faust compiler", "error", err)
 	if err == nil {
 		return transport.Diagnostic{}
 	}
+	if ctx.Err() != nil {
+		logging.Logger.Info("Compiler invocation cancelled", "path", path)
+		return transport.Diagnostic{}
+	}
+	if errors.Is(err, errCompilerTimeout) {
+		logging.Logger.Warn("Compiler timed out", "path", path, "timeout", cfg.CompilerTimeout)
+		return transport.Diagnostic{
+			Range:    transport.Range{},
+			Message:  fmt.Sprintf("%s timed out after %v and was stopped, increase compiler_timeout in %s if compilation takes longer", cfg.Command, time.Duration(cfg.CompilerTimeout)*time.Millisecond, faustConfigFile),
+			Severity: transport.SeverityWarning,
+			Source:   "faustlsp",
+			Code:     "compiler-timeout",
+		}
+	}
 
 	errorType := getFaustErrorReportingType(faustErrors)
 	logging.Logger.Info("Got error from compiler", "path", path, "type", errorType, "output", faustErrors)
 
 	switch errorType {
 	case FileError:
-		error := parseFileError(errors.String())
+		error := parseFileError(faustErrors)
 		logging.Logger.Info("FileError", "error", error)
 		if error.Line > 0 {
 			error.Line -= 1
@@ -89,15 +200,17 @@ func getCompilerDiagnostics(path string, dirPath string, cfg FaustProjectConfig)
 			Message:  error.Message,
 			Severity: transport.DiagnosticSeverity(transport.Error),
 			Source:   "faust",
+			Code:     "compile-error",
 		}
 	case Error:
-		error := parseError(errors.String())
+		error := parseError(faustErrors)
 		logging.Logger.Info("Error", "error", error)
 		return transport.Diagnostic{
 			Range:    transport.Range{},
 			Message:  error.Message,
 			Severity: transport.DiagnosticSeverity(transport.Error),
 			Source:   "faust",
+			Code:     "compile-error",
 		}
 	case NullError:
 		logging.Logger.Info("Unrecognized Error")
@@ -3,7 +3,10 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"unicode"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
@@ -20,37 +23,87 @@ func Completion(ctx context.Context, s *Server, par json.RawMessage) (json.RawMe
 	if err != nil {
 		return []byte("null"), err
 	}
-	results := GetPossibleSymbols(params.Position, handle.Path, &s.Store, string(s.Files.encoding))
-
+	results := []CompletionSym{}
 	replaceRange := transport.Range{}
+	content := ""
+	// Files the document imports itself, whose symbols rank before the ones they import
+	direct := map[util.Path]bool{}
 	f, ok := s.Files.Get(handle)
 	if ok {
-		f.mu.RLock()
-		replaceRange = FindCompletionReplaceRange(params.Position, string(f.Content), string(s.Files.encoding))
+		// Symbols and the range they replace are found in the same content
+		snap := s.Workspace.snapshot(f, &s.Store)
+		content = string(snap.Content)
+		if snap.Scope != nil {
+			for _, sym := range snap.Scope.Symbols {
+				if sym.Kind == Import || sym.Kind == Library {
+					direct[sym.File] = true
+				}
+			}
+		}
+		offset, err := PositionToOffset(params.Position, string(snap.Content), string(s.Files.encoding))
+		if err == nil {
+			if items, ok := declareCompletions(offset, string(snap.Content), string(s.Files.encoding)); ok {
+				return json.Marshal(items)
+			}
+		}
+		results = GetPossibleSymbols(params.Position, snap, &s.Store, string(s.Files.encoding))
+		results = append(results, s.Workspace.importCompletions(f, snap, params.Position, &s.Store, string(s.Files.encoding))...)
+		replaceRange = FindCompletionReplaceRange(params.Position, string(snap.Content), string(s.Files.encoding))
 		logging.Logger.Info("Replace Range", "range", replaceRange)
-		f.mu.RUnlock()
+	} else {
+		logging.Logger.Info("Couldn't find file", "path", handle.Path)
 	}
 	var items = []transport.CompletionItem{}
 	plainText := transport.PlainTextTextFormat
 	for _, sym := range results {
-		items = append(items, transport.CompletionItem{
+		item := transport.CompletionItem{
 			Label: sym.name,
-			Kind:  transport.VariableCompletion,
+			Kind:  sym.kind,
 			//			InsertText: sym.name,
 			InsertTextFormat: &plainText,
 			TextEdit: transport.TextEdit{
 				NewText: sym.name,
 				Range:   replaceRange,
 			},
+			SortText: sortText(symbolRank(sym, handle.Path, direct), sym.name),
+		}
+		if len(sym.edits) > 0 {
+			item.AdditionalTextEdits = sym.edits
+		}
+		if sym.library != "" {
+			item.LabelDetails = &transport.CompletionItemLabelDetails{Description: sym.library}
+		} else if sym.file != "" && sym.file != handle.Path {
+			item.LabelDetails = &transport.CompletionItemLabelDetails{Description: filepath.Base(sym.file)}
+		}
+		if sym.docs.Full != "" {
+			item.Documentation = &transport.Or_CompletionItem_documentation{
+				Value: transport.MarkupContent{
+					Kind:  transport.Markdown,
+					Value: sym.docs.Full,
+				},
+			}
+			item.Detail = strings.TrimSpace(sym.docs.Usage)
+		}
+		items = append(items, item)
+	}
+	if ok {
+		snippets := s.ClientCapabilities.TextDocument.Completion.CompletionItem.SnippetSupport
+		for _, item := range constructCompletions(content, replaceRange, string(s.Files.encoding), snippets) {
+			item.SortText = sortText(rankConstruct, item.Label)
+			items = append(items, item)
+		}
+	}
+	items = rankCompletions(items)
 
-			// Documentation: &transport.Or_CompletionItem_documentation{
-			//	Value: transport.MarkupContent{
-			//		Kind:  "plaintext",
-			//		Value: sym.docs.Full,
-			//	},
-			// },
-			// Detail: sym.docs.Usage,
-		})
+	if ok {
+		var truncated bool
+		typed := typedIdentifier(content, replaceRange, string(s.Files.encoding))
+		items, truncated = limitCompletions(items, typed, s.Workspace.ConfigFor(handle.Path).MaxCompletions)
+		if truncated {
+			// The client asks again as the identifier is typed, for the items that didn't fit
+			logging.Logger.Info("Completion results", "results", items, "incomplete", true)
+			return json.Marshal(transport.CompletionList{IsIncomplete: true, Items: items})
+		}
 	}
 
 	logging.Logger.Info("Completion results", "results", items)
@@ -62,27 +115,96 @@ func Completion(ctx context.Context, s *Server, par json.RawMessage) (json.RawMe
 	return resp, nil
 }
 
-func FindCompletionReplaceRange(pos transport.Position, content, encoding string) transport.Range {
+// Ranks of completions, which are listed in this order. A name completed several times, e.g. through different
+// imports, is only kept with its best rank.
+const (
+	rankCurrentFile = iota
+	rankDirectImport
+	// Keywords and primitives, before the thousands of symbols stdfaust.lib imports
+	rankConstruct
+	rankTransitiveImport
+	// Symbols completed along with an import of their library
+	rankAutoImport
+)
+
+func symbolRank(sym CompletionSym, path util.Path, direct map[util.Path]bool) int {
+	switch {
+	case len(sym.edits) > 0:
+		return rankAutoImport
+	case sym.file == path:
+		return rankCurrentFile
+	case direct[sym.file]:
+		return rankDirectImport
+	}
+	return rankTransitiveImport
+}
+
+// Sorts by rank then by name, which clients sort by as well
+func sortText(rank int, name string) string {
+	return fmt.Sprintf("%d%s", rank, name)
+}
+
+// Sorts items by their sort text, keeping the first item of each label. Definitions of the document shadow the
+// imported ones of the same name, like they do when the document is compiled, and keywords like process are only
+// completed once.
+func rankCompletions(items []transport.CompletionItem) []transport.CompletionItem {
+	slices.SortStableFunc(items, func(a, b transport.CompletionItem) int {
+		return strings.Compare(a.SortText, b.SortText)
+	})
+	seen := map[string]bool{}
+	ranked := []transport.CompletionItem{}
+	for _, item := range items {
+		if !seen[item.Label] {
+			seen[item.Label] = true
+			ranked = append(ranked, item)
+		}
+	}
+	return ranked
+}
 
+// FindCompletionReplaceRange returns the range of the partial identifier
+// typed before pos, which a completion item replaces
+func FindCompletionReplaceRange(pos transport.Position, content, encoding string) transport.Range {
 	offset, err := PositionToOffset(pos, content, encoding)
 	if err != nil {
 		return transport.Range{}
 	}
-	start, end := offset, offset
-	for {
-		logging.Logger.Info("Finding start", "start", start, "char", string(content[start]))
-		if start <= 0 {
-			break
-		}
-		if !unicode.IsLetter(rune(content[start-1])) && !unicode.IsDigit(rune(content[start-1])) {
-			break
-		}
-		start--
-	}
-	startPos, err := OffsetToPosition(start, content, encoding)
-	endPos, err := OffsetToPosition(end, content, encoding)
+	start := identifierStart(content, offset, isIdentRune)
+	startPos, _ := OffsetToPosition(start, content, encoding)
+	endPos, _ := OffsetToPosition(offset, content, encoding)
 	return transport.Range{
 		Start: startPos,
 		End:   endPos,
 	}
 }
+
+// Text of the identifier typed before the position, which replaceRange replaces
+func typedIdentifier(content string, replaceRange transport.Range, encoding string) string {
+	start, err := PositionToOffset(replaceRange.Start, content, encoding)
+	if err != nil {
+		return ""
+	}
+	end, err := PositionToOffset(replaceRange.End, content, encoding)
+	if err != nil || end < start {
+		return ""
+	}
+	return content[start:end]
+}
+
+// Keeps the items whose label, or a member of it like echo in fx.echo, starts with typed regardless of case, and at
+// most max of them when max is positive. Libraries like stdfaust.lib define thousands of symbols, which clients are
+// slow to filter. Returns whether matching items were left out.
+func limitCompletions(items []transport.CompletionItem, typed string, max int) ([]transport.CompletionItem, bool) {
+	typed = strings.ToLower(typed)
+	matching := []transport.CompletionItem{}
+	for _, item := range items {
+		label := strings.ToLower(item.Label)
+		if strings.HasPrefix(label, typed) || strings.Contains(label, "."+typed) {
+			matching = append(matching, item)
+		}
+	}
+	if max > 0 && len(matching) > max {
+		return matching[:max], true
+	}
+	return matching, false
+}
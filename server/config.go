@@ -1,8 +1,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
@@ -10,65 +15,281 @@ import (
 )
 
 type FaustProjectConfig struct {
-	Command             string      `json:"command,omitempty"`
-	Type                string      `json:"type"` // Actually make this enum between Process or Library eventually
-	ProcessName         string      `json:"process_name,omitempty"`
-	ProcessFiles        []util.Path `json:"process_files,omitempty"`
-	IncludeDir          []util.Path `json:"include,omitempty"`
-	CompilerDiagnostics bool        `json:"compiler_diagnostics,omitempty"`
+	Command     string `json:"command,omitempty"`
+	Type        string `json:"type"` // Actually make this enum between Process or Library eventually
+	ProcessName string `json:"process_name,omitempty"`
+	// Process names of files with several entry points, keyed by path or glob relative to the folder root.
+	// Patterns without a slash match the file name in any directory.
+	ProcessNames map[string]string `json:"process_names,omitempty"`
+	ProcessFiles []util.Path       `json:"process_files,omitempty"`
+	IncludeDir   []util.Path       `json:"include,omitempty"`
+	// Faust library directory, overrides the output of `faust -dspdir`
+	LibraryDir          util.Path `json:"library_path,omitempty"`
+	CompilerDiagnostics bool      `json:"compiler_diagnostics,omitempty"`
+	// Milliseconds after which a compiler run for diagnostics is killed
+	CompilerTimeout int `json:"compiler_timeout,omitempty"`
+	// Maximum number of compiler processes running at the same time
+	MaxCompilers int               `json:"max_compilers,omitempty"`
+	Diagnostics  DiagnosticsConfig `json:"diagnostics"`
+	Features     FeaturesConfig    `json:"features"`
+	// Milliseconds after which faustfmt is killed and the document is left as is
+	FormatterTimeout int `json:"formatter_timeout,omitempty"`
+	// Maximum number of completion items returned at once, all of them when not positive
+	MaxCompletions int `json:"max_completions"`
+	// Floating point precision of every compiler invocation: "single", "double" or "quad"
+	Precision Precision `json:"precision,omitempty"`
+	// Target language passed as -lang by faust.compile
+	Target string `json:"target,omitempty"`
+	// Directory faust.compile writes to
+	OutputDir util.Path `json:"output_dir,omitempty"`
+	// Flags added to the compiler invocation of faust.compile
+	ExtraFlags []string `json:"extra_flags,omitempty"`
+	// Globs of files and directories that aren't watched, replicated or analyzed
+	Exclude []string `json:"exclude,omitempty"`
+	// Also exclude the paths ignored by the .gitignore at the folder's root
+	Gitignore bool `json:"gitignore,omitempty"`
+	// Whether the workspace is replicated in a temporary directory, so that unsaved changes can be compiled
+	Replicate bool `json:"replicate"`
+	// Directory where the replica is created instead of the system's temporary directory
+	ReplicaDir util.Path `json:"replica_dir,omitempty"`
+	// Severity of diagnostics keyed by "source/code", code or source, e.g. "tree-sitter" or "faust/compile-error"
+	Severity map[string]SeverityLevel `json:"severity,omitempty"`
+	// faustlibraries version (git tag, branch or commit) whose documentation is used, the freshest one when empty
+	DocsVersion string `json:"docs_version,omitempty"`
+	// URL of the faustlibraries archive faust.updateDocs downloads, {version} is replaced by the version
+	DocsSource string `json:"docs_source,omitempty"`
 }
 
 func (w *Workspace) Rel2Abs(relPath string) util.Path {
 	return filepath.Join(w.Root, relPath)
 }
 
-func (w *Workspace) cleanDiagnostics(s *Server) {
+func (w *Workspace) cleanDiagnostics(ctx context.Context, s *Server) {
 	for _, path := range w.Files {
+		if ctx.Err() != nil {
+			return
+		}
 		f, _ := s.Files.GetFromPath(path)
 		f.mu.RLock()
 		path := f.Handle.Path
 		f.mu.RUnlock()
 		if IsFaustFile(path) {
-			w.DiagnoseFile(path, s)
+			w.DiagnoseFile(ctx, path, s)
 		}
 	}
 }
 
-func (w *Workspace) sendCompilerDiagnostics(s *Server) {
-	for _, filePath := range w.Config.ProcessFiles {
-		path := filepath.Join(w.Root, filePath)
+// Compiles the process files of folder with its config and publishes the errors.
+// Files that aren't compiled anymore lose the diagnostics of the previous run. The run stops when ctx is cancelled.
+func (w *Workspace) sendCompilerDiagnostics(ctx context.Context, s *Server, folder *Folder) {
+	cfg := folder.Config
+	if len(cfg.ProcessFiles) == 0 || !s.compilerAvailable(folder.compilerCommand()) {
+		w.finishCompilerRun(s, folder, nil)
+		return
+	}
+	// Compiling large projects can take a while, so show progress and allow the user to abort.
+	// Compilers still running when the server stops are stopped too.
+	progress := s.StartProgress(ctx, "Compiling", "", true)
+	defer progress.End("")
+
+	// Run the compiler in an empty directory of the temporary area instead of the workspace
+	workDir, err := os.MkdirTemp(w.tempDir, "compile-")
+	if err != nil {
+		logging.Logger.Error("Couldn't create compiler working directory", "error", err)
+		return
+	}
+	defer os.RemoveAll(workDir)
+	// Relative commands are relative to the folder's root rather than the working directory
+	cfg.Command = folder.compilerCommand()
+
+	compiled := make(map[util.Path]bool)
+	for i, filePath := range cfg.ProcessFiles {
+		if progress.Context().Err() != nil {
+			logging.Logger.Info("Compiler diagnostics cancelled")
+			return
+		}
+		path := folder.Rel2Abs(filePath)
 		f, ok := s.Files.GetFromPath(path)
 
 		if ok {
 			f.mu.RLock()
 			tempPath := w.TempDirPath(f.Handle.Path)
+			version := f.Version
 			logging.Logger.Info("Generating Compiler Diagnostics", "temp_path", tempPath)
 			f.mu.RUnlock()
-			if !f.hasSyntaxErrors {
+			if hash, ok := w.readyToCompile(s, f); ok {
 				var diagnosticErrors = []transport.Diagnostic{}
 				uri := util.Path2URI(path)
 				logging.Logger.Info("Generating Compiler Diagnostics", "temp_path", tempPath)
-				diagnosticError := getCompilerDiagnostics(tempPath, w.Root, w.Config)
+				progress.Report(fmt.Sprintf("Compiling %s…", filePath), uint32(i*100/len(cfg.ProcessFiles)))
+				fileCfg := cfg
+				fileCfg.ProcessName = folder.processName(path)
+				start := time.Now()
+				diagnosticError := getCompilerDiagnostics(progress.Context(), tempPath, workDir, fileCfg, w.compilerIncludeDirs(folder))
+				s.logTraceSince(start, fmt.Sprintf("Compiled %s with %s", path, cfg.Command), func() string { return diagnosticError.Message })
+				if progress.Context().Err() != nil {
+					logging.Logger.Info("Compiler diagnostics cancelled", "path", path)
+					return
+				}
 				if diagnosticError.Message != "" {
 					diagnosticErrors = []transport.Diagnostic{diagnosticError}
 				}
 				d := transport.PublishDiagnosticsParams{
 					URI:         transport.DocumentURI(uri),
+					Version:     version,
 					Diagnostics: diagnosticErrors,
 				}
-				s.diagChan <- d
+				s.publishDiagnostics(compilerDiagnostics, d)
+				w.diagStates.record(path, hash, stageCompiler, diagnosticError.Message == "")
+				compiled[path] = true
 			}
 		}
 	}
+	w.finishCompilerRun(s, folder, compiled)
 }
 
-func (c *FaustProjectConfig) UnmarshalJSON(content []byte) error {
-	type Config FaustProjectConfig
-	var cfg = Config{
+// Records the files compiled in a run of folder, and clears the compiler diagnostics of the files compiled
+// in the previous run but not in this one, e.g. because they have syntax errors or aren't process files anymore
+func (w *Workspace) finishCompilerRun(s *Server, folder *Folder, compiled map[util.Path]bool) {
+	w.compiledFilesMu.Lock()
+	if w.compiledFiles == nil {
+		w.compiledFiles = make(map[util.Path]map[util.Path]bool)
+	}
+	previous := w.compiledFiles[folder.Root]
+	w.compiledFiles[folder.Root] = compiled
+	w.compiledFilesMu.Unlock()
+
+	for path := range previous {
+		if !compiled[path] {
+			s.publishDiagnostics(compilerDiagnostics, transport.PublishDiagnosticsParams{
+				URI:         transport.DocumentURI(util.Path2URI(path)),
+				Diagnostics: []transport.Diagnostic{},
+			})
+		}
+	}
+}
+
+// Absolute paths of the config's include directories. Relative paths are relative to the folder's root.
+func (f *Folder) includeDirs() []util.Path {
+	dirs := []util.Path{}
+	for _, dir := range f.Config.IncludeDir {
+		dirs = append(dirs, filepath.Clean(f.Rel2Abs(dir)))
+	}
+	return dirs
+}
+
+// Process name passed as -pn when compiling path. The most specific matching entry of process_names wins,
+// an exact path being more specific than any pattern.
+func (f *Folder) processName(path util.Path) string {
+	rel, err := filepath.Rel(f.Root, path)
+	if err != nil {
+		rel = path
+	}
+	rel = filepath.ToSlash(rel)
+
+	name, best := f.Config.ProcessName, ""
+	for pattern, processName := range f.Config.ProcessNames {
+		pattern = filepath.ToSlash(pattern)
+		if pattern == rel {
+			return processName
+		}
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = filepath.Base(path)
+		}
+		matched, _ := filepath.Match(pattern, target)
+		if matched && (len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			name, best = processName, pattern
+		}
+	}
+	return name
+}
+
+// Directory of the Faust libraries, either from the config or from `faust -dspdir`
+func (f *Folder) libraryDir() util.Path {
+	if f.Config.LibraryDir != "" {
+		return filepath.Clean(f.Rel2Abs(f.Config.LibraryDir))
+	}
+	return GetFaustDSPDir(f.compilerCommand())
+}
+
+// Compiler command of the config. Commands given as a relative path are relative to the folder's root,
+// where the compiler is run.
+func (f *Folder) compilerCommand() string {
+	command := f.Config.Command
+	if strings.ContainsRune(filepath.ToSlash(command), '/') {
+		return f.Rel2Abs(command)
+	}
+	return command
+}
+
+// Include directories passed to the compiler. Directories inside the workspace point to its replica in the
+// temporary directory, so that unsaved changes to libraries in them are compiled too. The folder's root comes last.
+func (w *Workspace) compilerIncludeDirs(folder *Folder) []util.Path {
+	dirs := []util.Path{}
+	includeDirs := folder.includeDirs()
+	// The compiler looks for libraries in its own library directory after the include directories
+	if folder.Config.LibraryDir != "" {
+		includeDirs = append(includeDirs, folder.libraryDir())
+	}
+	for _, dir := range includeDirs {
+		if w.inFolders(dir) {
+			dir = w.TempDirPath(dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	// The compiler doesn't run in the folder's root, so imports relative to it are found through an include directory
+	return append(dirs, folder.Root)
+}
+
+// Floating point precision selected with -single, -double or -quad
+type Precision string
+
+func (p *Precision) UnmarshalJSON(content []byte) error {
+	var precision string
+	if err := json.Unmarshal(content, &precision); err != nil {
+		return err
+	}
+	switch precision {
+	case "", "single", "double", "quad":
+		*p = Precision(precision)
+		return nil
+	}
+	return fmt.Errorf("invalid precision %q, expected \"single\", \"double\" or \"quad\"", precision)
+}
+
+// Compiler flags of the precision, none if the compiler default is used
+func (p Precision) flags() []string {
+	if p == "" {
+		return nil
+	}
+	return []string{"-" + string(p)}
+}
+
+// Built-in defaults, the lowest configuration layer
+func builtinConfig() FaustProjectConfig {
+	return FaustProjectConfig{
 		Command:             "faust",
+		Type:                "process",
 		ProcessName:         "process",
 		CompilerDiagnostics: true,
+		CompilerTimeout:     10000,
+		MaxCompilers:        2,
+		FormatterTimeout:    5000,
+		MaxCompletions:      200,
+		Diagnostics:         defaultDiagnosticsConfig(),
+		Features:            defaultFeaturesConfig(),
+		Target:              "cpp",
+		OutputDir:           "build",
+		Exclude:             defaultExclude(),
+		Replicate:           true,
+		DocsSource:          defaultDocsSource,
 	}
+}
+
+func (c *FaustProjectConfig) UnmarshalJSON(content []byte) error {
+	type Config FaustProjectConfig
+	var cfg = Config(builtinConfig())
 	if err := json.Unmarshal(content, &cfg); err != nil {
 		logging.Logger.Error("Failed to unmarshal FaustProjectConfig", "error", err)
 		return err
@@ -77,37 +298,45 @@ func (c *FaustProjectConfig) UnmarshalJSON(content []byte) error {
 	return nil
 }
 
-func (w *Workspace) parseConfig(content []byte) (FaustProjectConfig, error) {
-	var config FaustProjectConfig
-	err := json.Unmarshal(content, &config)
-	if err != nil {
-		logging.Logger.Error("Invalid Project Config file", "error", err)
-		return FaustProjectConfig{}, err
+// Expands ~ and environment variables in the command and paths, so that configs can be shared across machines
+func (c *FaustProjectConfig) expandPaths() {
+	c.Command = util.ExpandPath(c.Command)
+	for i, path := range c.ProcessFiles {
+		c.ProcessFiles[i] = util.ExpandPath(path)
 	}
-	// If no process files provided, all .dsp files become process
-	if len(config.ProcessFiles) == 0 {
-		config.ProcessFiles = w.getFaustDSPRelativePaths()
+	for i, dir := range c.IncludeDir {
+		c.IncludeDir[i] = util.ExpandPath(dir)
 	}
-	return config, nil
+	c.LibraryDir = util.ExpandPath(c.LibraryDir)
+	c.OutputDir = util.ExpandPath(c.OutputDir)
+	c.ReplicaDir = util.ExpandPath(c.ReplicaDir)
 }
 
-func (w *Workspace) defaultConfig() FaustProjectConfig {
+// Parses the config file of the folder at root
+func (w *Workspace) parseConfig(root util.Path, content []byte) (FaustProjectConfig, error) {
+	return w.mergeConfig(root, content)
+}
+
+func (w *Workspace) defaultConfig(root util.Path) FaustProjectConfig {
 	logging.Logger.Info("Using default config file")
-	var config = FaustProjectConfig{
-		Command:             "faust",
-		Type:                "process",
-		ProcessFiles:        w.getFaustDSPRelativePaths(),
-		CompilerDiagnostics: true,
-	}
+	config, _ := w.mergeConfig(root)
 	return config
 }
 
-func (w *Workspace) getFaustDSPRelativePaths() []util.Path {
+// Paths of the .dsp files in the folder at root, relative to root
+func (w *Workspace) getFaustDSPRelativePaths(root util.Path) []util.Path {
 	var filePaths = []util.Path{}
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	for _, file := range w.Files {
-		if IsDSPFile(file) {
-			filePaths = append(filePaths, file)
+		if !IsDSPFile(file) {
+			continue
+		}
+		if !isInside(root, file) {
+			continue
 		}
+		rel, _ := filepath.Rel(root, file)
+		filePaths = append(filePaths, rel)
 	}
 	return filePaths
 }
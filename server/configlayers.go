@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Settings sent by the client, layered on top of the config file.
+// Precedence: built-in defaults < .faustcfg.json < workspace/didChangeConfiguration < initializationOptions
+type clientConfig struct {
+	mu          sync.Mutex
+	settings    json.RawMessage
+	initOptions json.RawMessage
+}
+
+// Returns the client's layers in increasing precedence
+func (c *clientConfig) layers() []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []json.RawMessage{c.settings, c.initOptions}
+}
+
+// Extracts faustlsp's settings from settings sent by the client.
+// Settings can either be namespaced under "faustlsp" or be the config itself.
+func clientSection(settings any) json.RawMessage {
+	if settings == nil {
+		return nil
+	}
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return nil
+	}
+	var sections map[string]json.RawMessage
+	if json.Unmarshal(content, &sections) != nil {
+		logging.Logger.Error("Ignoring client settings that aren't an object", "settings", string(content))
+		return nil
+	}
+	if section, ok := sections["faustlsp"]; ok {
+		return section
+	}
+	return content
+}
+
+// Builds the config of the folder at root by applying layers on top of the built-in defaults, in increasing precedence.
+// Invalid layers are skipped, and the error of the first one is returned.
+func (w *Workspace) mergeConfig(root util.Path, layers ...json.RawMessage) (FaustProjectConfig, error) {
+	// Decode without the defaults of FaustProjectConfig.UnmarshalJSON, which would reset lower layers
+	type layer FaustProjectConfig
+	cfg := layer(builtinConfig())
+	var firstErr error
+	for _, content := range layers {
+		if len(content) == 0 {
+			continue
+		}
+		next := cfg
+		// Decoding reuses the backing arrays of slices
+		next.ProcessFiles = slices.Clone(cfg.ProcessFiles)
+		next.IncludeDir = slices.Clone(cfg.IncludeDir)
+		next.ExtraFlags = slices.Clone(cfg.ExtraFlags)
+		next.Exclude = slices.Clone(cfg.Exclude)
+		next.ProcessNames = maps.Clone(cfg.ProcessNames)
+		next.Severity = maps.Clone(cfg.Severity)
+		if err := json.Unmarshal(stripComments(content), &next); err != nil {
+			logging.Logger.Error("Invalid Project Config", "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		cfg = next
+	}
+
+	config := FaustProjectConfig(cfg)
+	config.expandPaths()
+	// If no process files provided, all .dsp files become process
+	if len(config.ProcessFiles) == 0 {
+		config.ProcessFiles = w.getFaustDSPRelativePaths(root)
+	}
+	return config, firstErr
+}
+
+// Handler for workspace/didChangeConfiguration
+func DidChangeConfiguration(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.DidChangeConfigurationParams
+	json.Unmarshal(par, &params)
+
+	settings := clientSection(params.Settings)
+	logging.Logger.Info("Got client settings", "settings", string(settings))
+	s.Workspace.client.mu.Lock()
+	s.Workspace.client.settings = settings
+	s.Workspace.client.mu.Unlock()
+
+	s.Workspace.loadConfigFiles(s)
+	s.Workspace.cleanDiagnostics(s.background.context(), s)
+	return nil
+}
+
+type EffectiveConfigParams struct {
+	// File whose folder's config is returned. The config of the workspace root is returned if empty.
+	URI transport.DocumentURI `json:"uri,omitempty"`
+}
+
+type EffectiveConfigResult struct {
+	Folder util.Path          `json:"folder"`
+	Config FaustProjectConfig `json:"config"`
+}
+
+// Handler for the custom faustlsp/effectiveConfig request, which returns the config after merging all layers
+func EffectiveConfig(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params EffectiveConfigParams
+	json.Unmarshal(par, &params)
+
+	path := s.Workspace.Root
+	if params.URI != "" {
+		var err error
+		path, err = util.URI2path(string(params.URI))
+		if err != nil {
+			return nil, err
+		}
+	}
+	folder := s.Workspace.folderFor(path)
+	return json.Marshal(EffectiveConfigResult{Folder: folder.Root, Config: folder.Config})
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Keys allowed in the config file and the Go type of their value, taken from the json tags of FaustProjectConfig
+func configSchema() map[string]reflect.Type {
+	schema := make(map[string]reflect.Type)
+	t := reflect.TypeOf(FaustProjectConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		schema[name] = field.Type
+	}
+	return schema
+}
+
+// Returns the name of a JSON type for error messages
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array of " + strings.TrimPrefix(strings.TrimPrefix(jsonTypeName(t.Elem()), "a "), "an ") + "s"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	}
+	return "a " + t.Kind().String()
+}
+
+// A problem found in the config file. Start and End are byte offsets into the file.
+type configProblem struct {
+	Start    int
+	End      int
+	Message  string
+	Severity transport.DiagnosticSeverity
+}
+
+// Checks the content of the config file for syntax errors, unknown keys, values of the wrong type
+// and paths that don't exist
+func validateConfig(root util.Path, content []byte) []configProblem {
+	problems := []configProblem{}
+	content = stripComments(content)
+
+	var syntaxErr *json.SyntaxError
+	if err := json.Unmarshal(content, &json.RawMessage{}); errors.As(err, &syntaxErr) {
+		offset := int(syntaxErr.Offset)
+		return append(problems, configProblem{Start: offset, End: offset, Message: "Invalid JSON: " + syntaxErr.Error(), Severity: transport.SeverityError})
+	} else if err != nil {
+		return append(problems, configProblem{Message: "Invalid JSON: " + err.Error(), Severity: transport.SeverityError})
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		start, end := valueBounds(content, 0, len(content))
+		return append(problems, configProblem{Start: start, End: end, Message: "The config must be a JSON object", Severity: transport.SeverityError})
+	}
+
+	schema := configSchema()
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key := tok.(string)
+		keyEnd := int(dec.InputOffset())
+		keyStart := bytes.LastIndexByte(content[:keyEnd-1], '"')
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			break
+		}
+		valueEnd := int(dec.InputOffset())
+		valueStart := valueEnd - len(raw)
+
+		valueType, ok := schema[key]
+		if !ok {
+			problems = append(problems, configProblem{Start: keyStart, End: keyEnd, Message: fmt.Sprintf("Unknown key %q", key), Severity: transport.SeverityWarning})
+			continue
+		}
+		if err := json.Unmarshal(raw, reflect.New(valueType).Interface()); err != nil {
+			message := fmt.Sprintf("%q should be %s", key, jsonTypeName(valueType))
+			// Values of the right JSON type can still be invalid, e.g. unknown enum values
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				message = fmt.Sprintf("%q: %s", key, err.Error())
+			}
+			problems = append(problems, configProblem{Start: valueStart, End: valueEnd, Message: message, Severity: transport.SeverityError})
+			continue
+		}
+
+		switch key {
+		case "process_files":
+			problems = append(problems, validateConfigPaths(root, raw, valueStart, false, "Process file")...)
+		case "include":
+			problems = append(problems, validateConfigPaths(root, raw, valueStart, true, "Include directory")...)
+		case "library_path":
+			var path string
+			json.Unmarshal(raw, &path)
+			if problem, ok := validateConfigPath(root, path, true, "Library directory"); !ok {
+				problem.Start, problem.End = valueStart, valueEnd
+				problems = append(problems, problem)
+			}
+		}
+	}
+	return problems
+}
+
+// Checks that every path in the JSON array raw exists. Relative paths are relative to root.
+func validateConfigPaths(root util.Path, raw json.RawMessage, offset int, dir bool, what string) []configProblem {
+	problems := []configProblem{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return problems
+	}
+	for dec.More() {
+		var path string
+		var elem json.RawMessage
+		if err := dec.Decode(&elem); err != nil {
+			break
+		}
+		json.Unmarshal(elem, &path)
+		end := offset + int(dec.InputOffset())
+		start := end - len(elem)
+
+		if problem, ok := validateConfigPath(root, path, dir, what); !ok {
+			problem.Start, problem.End = start, end
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// Checks that path exists, and that it is a directory if dir is true. The problem has no position.
+func validateConfigPath(root util.Path, path string, dir bool, what string) (configProblem, bool) {
+	abs := util.ExpandPath(path)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(root, abs)
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return configProblem{Message: fmt.Sprintf("%s %q not found", what, path), Severity: transport.SeverityError}, false
+	} else if dir && !fi.IsDir() {
+		return configProblem{Message: fmt.Sprintf("%s %q is not a directory", what, path), Severity: transport.SeverityError}, false
+	}
+	return configProblem{}, true
+}
+
+// Returns the bounds of content[start:end] without surrounding whitespace
+func valueBounds(content []byte, start int, end int) (int, int) {
+	trimmed := bytes.TrimSpace(content[start:end])
+	if len(trimmed) == 0 {
+		return start, start
+	}
+	start += bytes.Index(content[start:end], trimmed)
+	return start, start + len(trimmed)
+}
+
+// Blanks out // and /* */ comments outside of strings, so that config files can be commented like the README's
+// example. Comments are replaced by spaces, keeping the offsets of problems in the file.
+func stripComments(content []byte) []byte {
+	stripped := bytes.Clone(content)
+	inString := false
+	for i := 0; i < len(stripped); i++ {
+		switch {
+		case inString:
+			if stripped[i] == '\\' {
+				i++
+			} else if stripped[i] == '"' {
+				inString = false
+			}
+		case stripped[i] == '"':
+			inString = true
+		case bytes.HasPrefix(stripped[i:], []byte("//")):
+			for ; i < len(stripped) && stripped[i] != '\n'; i++ {
+				stripped[i] = ' '
+			}
+		case bytes.HasPrefix(stripped[i:], []byte("/*")):
+			end := bytes.Index(stripped[i+2:], []byte("*/"))
+			if end == -1 {
+				end = len(stripped)
+			} else {
+				end += i + 4
+			}
+			for ; i < end; i++ {
+				// Line breaks are kept for the positions of the following problems
+				if stripped[i] != '\n' {
+					stripped[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+	return stripped
+}
+
+// Converts config problems to diagnostics in the config file
+func configDiagnostics(problems []configProblem, content []byte, encoding string) []transport.Diagnostic {
+	diagnostics := []transport.Diagnostic{}
+	for _, problem := range problems {
+		start, _ := OffsetToPosition(uint(problem.Start), string(content), encoding)
+		end, _ := OffsetToPosition(uint(problem.End), string(content), encoding)
+		diagnostics = append(diagnostics, transport.Diagnostic{
+			Range:    transport.Range{Start: start, End: end},
+			Severity: problem.Severity,
+			Source:   "faustlsp",
+			Message:  problem.Message,
+		})
+	}
+	return diagnostics
+}
+
+// Publishes the problems found in version of the config file, or clears them if there are none
+func publishConfigDiagnostics(s *Server, path util.Path, version int32, problems []configProblem, content []byte) {
+	s.publishDiagnostics(configFileDiagnostics, transport.PublishDiagnosticsParams{
+		URI:         transport.DocumentURI(util.Path2URI(path)),
+		Version:     version,
+		Diagnostics: configDiagnostics(problems, content, string(s.Files.encoding)),
+	})
+}
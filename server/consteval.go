@@ -0,0 +1,280 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Definitions followed at most when evaluating a constant, e.g. through a = b; b = c; …
+const maxConstantDepth = 32
+
+// Value of an expression: a number when it only depends on numbers, its source otherwise, with the constants it uses
+// replaced by their value
+type constantValue struct {
+	number  float64
+	numeric bool
+	text    string
+	// Whether an operation was computed or a constant replaced by its value
+	evaluated bool
+	// Whether it is an operation, which is parenthesized inside other operations
+	compound bool
+}
+
+func numericValue(v float64) constantValue {
+	return constantValue{number: v, numeric: true, text: strconv.FormatFloat(v, 'g', -1, 64)}
+}
+
+type constantEvaluator struct {
+	store *Store
+	// Content and scope of the files definitions are evaluated in, the content of other files is only used when their
+	// scope was analyzed from it
+	sources  map[util.Path]FileSnapshot
+	visiting map[Location]bool
+}
+
+// Evaluator of definitions seen from the document at path, whose content and scope are those of snap
+func newConstantEvaluator(path util.Path, snap FileSnapshot, store *Store) constantEvaluator {
+	e := constantEvaluator{store: store, sources: map[util.Path]FileSnapshot{}, visiting: map[Location]bool{}}
+	if snap.Scope != nil {
+		e.sources[path] = snap
+	}
+	return e
+}
+
+// Evaluates the expression of a definition like ct = 2*ma.PI/ma.SR in hover, following the constants it uses.
+// Returns false when nothing could be computed, e.g. when it isn't arithmetic or already is a number.
+func constantHover(sym Symbol, path util.Path, snap FileSnapshot, store *Store) (string, bool) {
+	if sym.Kind != Definition || sym.Expr == nil {
+		return "", false
+	}
+	e := newConstantEvaluator(path, snap, store)
+	value, ok := e.definition(sym, 0)
+	if !ok || !value.evaluated {
+		return "", false
+	}
+	return "```faust\n" + sym.Ident + " = " + value.text + "\n```", true
+}
+
+// Value of the expression of a definition, false if it isn't a definition whose file is analyzed
+func (e *constantEvaluator) definition(sym Symbol, depth int) (constantValue, bool) {
+	if sym.Kind != Definition || sym.Expr == nil || depth > maxConstantDepth || e.visiting[sym.Loc] {
+		return constantValue{}, false
+	}
+	source, ok := e.source(sym.Loc.File)
+	if !ok || uint(len(source.Content)) < sym.Expr.EndByte() {
+		return constantValue{}, false
+	}
+	e.visiting[sym.Loc] = true
+	defer delete(e.visiting, sym.Loc)
+	return e.eval(sym.Expr, source, depth), true
+}
+
+func (e *constantEvaluator) source(path util.Path) (FileSnapshot, bool) {
+	if source, ok := e.sources[path]; ok {
+		return source, true
+	}
+	source, ok := analyzedSnapshot(path, e.store)
+	if !ok {
+		return FileSnapshot{}, false
+	}
+	e.sources[path] = source
+	return source, true
+}
+
+func (e *constantEvaluator) eval(node *tree_sitter.Node, source FileSnapshot, depth int) constantValue {
+	text := node.Utf8Text(source.Content)
+	symbolic := constantValue{text: strings.Join(strings.Fields(text), " ")}
+	switch node.GrammarName() {
+	case "int", "real":
+		if v, err := strconv.ParseFloat(strings.TrimSuffix(text, "f"), 64); err == nil {
+			value := numericValue(v)
+			value.text = text
+			return value
+		}
+	case "unary_number", "negate_id":
+		operand := namedField(node, "operand")
+		if operand == nil && node.NamedChildCount() > 0 {
+			operand = node.NamedChild(0)
+		}
+		if operand == nil {
+			return symbolic
+		}
+		value := e.eval(operand, source, depth)
+		if operator := node.ChildByFieldName("operator"); operator != nil && operator.Utf8Text(source.Content) == "+" {
+			return value
+		}
+		if value.numeric {
+			negated := numericValue(-value.number)
+			negated.evaluated = value.evaluated
+			return negated
+		}
+		value.text = "-" + parenthesized(value)
+		return value
+	case "identifier", "access":
+		scope := FindLowestScopeContainingRange(source.Scope, ToRange(node))
+		sym, err := FindSymbolDefinition(text, scope, e.store)
+		if err != nil {
+			return symbolic
+		}
+		value, ok := e.definition(sym, depth+1)
+		if !ok || !value.numeric {
+			// Constants that aren't numbers keep their name
+			return symbolic
+		}
+		value.evaluated = true
+		value.compound = false
+		return value
+	case "infix", "prefix":
+		left, operator, right := namedField(node, "left"), node.ChildByFieldName("operator"), namedField(node, "right")
+		if left == nil || operator == nil || right == nil {
+			return symbolic
+		}
+		return binaryConstant(operator.Utf8Text(source.Content), e.eval(left, source, depth), e.eval(right, source, depth), symbolic)
+	case "prim1":
+		primitive, argument := node.ChildByFieldName("primitive"), namedField(node, "argument")
+		if primitive == nil || argument == nil {
+			return symbolic
+		}
+		return functionConstant(primitive.Utf8Text(source.Content), []constantValue{e.eval(argument, source, depth)}, symbolic)
+	case "prim2":
+		primitive := node.ChildByFieldName("primitive")
+		var arguments *tree_sitter.Node
+		for i := range node.NamedChildCount() {
+			if child := node.NamedChild(i); child.GrammarName() == "arguments" {
+				arguments = child
+			}
+		}
+		if primitive == nil || arguments == nil || arguments.NamedChildCount() != 2 {
+			return symbolic
+		}
+		values := []constantValue{}
+		for i := range arguments.NamedChildCount() {
+			values = append(values, e.eval(arguments.NamedChild(i), source, depth))
+		}
+		return functionConstant(primitive.Utf8Text(source.Content), values, symbolic)
+	}
+	return symbolic
+}
+
+// Operations on numbers, by operator. Division is always a float division, like in Faust.
+var constantOperators = map[string]func(a, b float64) (float64, bool){
+	"+":   func(a, b float64) (float64, bool) { return a + b, true },
+	"-":   func(a, b float64) (float64, bool) { return a - b, true },
+	"*":   func(a, b float64) (float64, bool) { return a * b, true },
+	"/":   func(a, b float64) (float64, bool) { return a / b, b != 0 },
+	"%":   func(a, b float64) (float64, bool) { return math.Mod(a, b), b != 0 },
+	"^":   func(a, b float64) (float64, bool) { return math.Pow(a, b), true },
+	"<":   func(a, b float64) (float64, bool) { return boolConstant(a < b), true },
+	"<=":  func(a, b float64) (float64, bool) { return boolConstant(a <= b), true },
+	">":   func(a, b float64) (float64, bool) { return boolConstant(a > b), true },
+	">=":  func(a, b float64) (float64, bool) { return boolConstant(a >= b), true },
+	"==":  func(a, b float64) (float64, bool) { return boolConstant(a == b), true },
+	"!=":  func(a, b float64) (float64, bool) { return boolConstant(a != b), true },
+	"&":   func(a, b float64) (float64, bool) { return float64(int64(a) & int64(b)), true },
+	"|":   func(a, b float64) (float64, bool) { return float64(int64(a) | int64(b)), true },
+	"xor": func(a, b float64) (float64, bool) { return float64(int64(a) ^ int64(b)), true },
+	"<<":  func(a, b float64) (float64, bool) { return float64(int64(a) << int64(b)), b >= 0 },
+	">>":  func(a, b float64) (float64, bool) { return float64(int64(a) >> int64(b)), b >= 0 },
+}
+
+func boolConstant(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func binaryConstant(operator string, left constantValue, right constantValue, symbolic constantValue) constantValue {
+	compute, ok := constantOperators[operator]
+	if !ok {
+		return symbolic
+	}
+	if left.numeric && right.numeric {
+		if v, ok := compute(left.number, right.number); ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			value := numericValue(v)
+			value.evaluated = true
+			return value
+		}
+		return symbolic
+	}
+	return constantValue{
+		text:      parenthesized(left) + " " + operator + " " + parenthesized(right),
+		evaluated: left.evaluated || right.evaluated,
+		compound:  true,
+	}
+}
+
+// Math primitives, by name
+var constantFunctions = map[string]func(args []float64) float64{
+	"exp":       func(args []float64) float64 { return math.Exp(args[0]) },
+	"log":       func(args []float64) float64 { return math.Log(args[0]) },
+	"log10":     func(args []float64) float64 { return math.Log10(args[0]) },
+	"sqrt":      func(args []float64) float64 { return math.Sqrt(args[0]) },
+	"abs":       func(args []float64) float64 { return math.Abs(args[0]) },
+	"floor":     func(args []float64) float64 { return math.Floor(args[0]) },
+	"ceil":      func(args []float64) float64 { return math.Ceil(args[0]) },
+	"rint":      func(args []float64) float64 { return math.RoundToEven(args[0]) },
+	"round":     func(args []float64) float64 { return math.Round(args[0]) },
+	"cos":       func(args []float64) float64 { return math.Cos(args[0]) },
+	"sin":       func(args []float64) float64 { return math.Sin(args[0]) },
+	"tan":       func(args []float64) float64 { return math.Tan(args[0]) },
+	"acos":      func(args []float64) float64 { return math.Acos(args[0]) },
+	"asin":      func(args []float64) float64 { return math.Asin(args[0]) },
+	"atan":      func(args []float64) float64 { return math.Atan(args[0]) },
+	"int":       func(args []float64) float64 { return math.Trunc(args[0]) },
+	"float":     func(args []float64) float64 { return args[0] },
+	"pow":       func(args []float64) float64 { return math.Pow(args[0], args[1]) },
+	"min":       func(args []float64) float64 { return math.Min(args[0], args[1]) },
+	"max":       func(args []float64) float64 { return math.Max(args[0], args[1]) },
+	"fmod":      func(args []float64) float64 { return math.Mod(args[0], args[1]) },
+	"remainder": func(args []float64) float64 { return math.Remainder(args[0], args[1]) },
+	"atan2":     func(args []float64) float64 { return math.Atan2(args[0], args[1]) },
+}
+
+func functionConstant(name string, args []constantValue, symbolic constantValue) constantValue {
+	compute, ok := constantFunctions[name]
+	if !ok {
+		return symbolic
+	}
+	numbers := []float64{}
+	texts := []string{}
+	evaluated := false
+	for _, arg := range args {
+		numbers = append(numbers, arg.number)
+		texts = append(texts, arg.text)
+		evaluated = evaluated || arg.evaluated
+		ok = ok && arg.numeric
+	}
+	if ok {
+		if v := compute(numbers); !math.IsNaN(v) && !math.IsInf(v, 0) {
+			value := numericValue(v)
+			value.evaluated = true
+			return value
+		}
+		return symbolic
+	}
+	return constantValue{text: name + "(" + strings.Join(texts, ", ") + ")", evaluated: evaluated}
+}
+
+func parenthesized(value constantValue) string {
+	if value.compound {
+		return "(" + value.text + ")"
+	}
+	return value.text
+}
+
+// Child of node in field, skipping the parentheses around it, which are part of the field too
+func namedField(node *tree_sitter.Node, field string) *tree_sitter.Node {
+	cursor := node.Walk()
+	defer cursor.Close()
+	for _, child := range node.ChildrenByFieldName(field, cursor) {
+		if child.IsNamed() {
+			return &child
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// A metadata key or option offered as completion inside declare statements
+type declareCompletion struct {
+	label  string
+	detail string
+}
+
+var metadataKeys = []declareCompletion{
+	{"name", "Name of the DSP, used by architecture files e.g. as the window title"},
+	{"author", "Author of the code"},
+	{"version", "Version of the code"},
+	{"license", "License of the code, e.g. MIT or GPL"},
+	{"copyright", "Copyright notice"},
+	{"options", "Option flags of the architecture files, e.g. \"[midi:on][nvoices:8]\""},
+}
+
+var declareOptions = []declareCompletion{
+	{"[midi:on]", "Enables MIDI control"},
+	{"[nvoices:8]", "Number of voices of a polyphonic instrument"},
+	{"[osc:on]", "Enables OSC control"},
+	{"[httpd:on]", "Enables the HTTP interface"},
+}
+
+// Completions for the cursor at offset when it is inside a declare statement: metadata keys where a key is
+// expected and option flags inside the string of declare options. Returns false outside of declare statements.
+// The text before the cursor is used as the statement usually doesn't parse while it is being typed.
+func declareCompletions(offset uint, content string, encoding string) ([]transport.CompletionItem, bool) {
+	if offset > uint(len(content)) {
+		return nil, false
+	}
+	before := content[:offset]
+	statementStart := strings.LastIndex(before, ";") + 1
+	statement := before[statementStart:]
+
+	// Comments between statements aren't part of the declare statement
+	lines := strings.Split(statement, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+			lines[i] = ""
+		}
+	}
+	statement = strings.Join(lines, "\n")
+
+	tokens := strings.Fields(statement)
+	// The declare keyword itself may still be being typed
+	if len(tokens) == 0 || tokens[0] != "declare" || len(tokens) == 1 && !endsWithSpace(statement) {
+		return nil, false
+	}
+
+	if strings.Count(statement, `"`)%2 == 1 {
+		// Inside the value
+		if len(tokens) < 3 || tokens[1] != "options" {
+			return []transport.CompletionItem{}, true
+		}
+		start := uint(strings.LastIndexAny(before, `"]`) + 1)
+		return declareItems(declareOptions, transport.ValueCompletion, replaceRange(start, offset, content, encoding)), true
+	}
+
+	// Tokens before the one being typed
+	typed := tokens
+	if !endsWithSpace(statement) {
+		typed = tokens[:len(tokens)-1]
+	}
+	// declare key or declare function key, the key of global metadata being followed by its value
+	keyExpected := len(typed) == 1 || len(typed) == 2 && !isMetadataKey(typed[1])
+	if !keyExpected {
+		return []transport.CompletionItem{}, true
+	}
+	start := identifierStart(content, offset, isIdentRune)
+	return declareItems(metadataKeys, transport.PropertyCompletion, replaceRange(start, offset, content, encoding)), true
+}
+
+func declareItems(completions []declareCompletion, kind transport.CompletionItemKind, replace transport.Range) []transport.CompletionItem {
+	plainText := transport.PlainTextTextFormat
+	items := []transport.CompletionItem{}
+	for _, c := range completions {
+		items = append(items, transport.CompletionItem{
+			Label:            c.label,
+			Kind:             kind,
+			Detail:           c.detail,
+			InsertTextFormat: &plainText,
+			TextEdit: transport.TextEdit{
+				NewText: c.label,
+				Range:   replace,
+			},
+		})
+	}
+	return items
+}
+
+func isMetadataKey(token string) bool {
+	for _, key := range metadataKeys {
+		if key.label == token {
+			return true
+		}
+	}
+	return false
+}
+
+func endsWithSpace(s string) bool {
+	return len(s) > 0 && strings.TrimRight(s, " \t\r\n") != s
+}
+
+func replaceRange(start uint, end uint, content string, encoding string) transport.Range {
+	startPos, _ := OffsetToPosition(start, content, encoding)
+	endPos, _ := OffsetToPosition(end, content, encoding)
+	return transport.Range{Start: startPos, End: endPos}
+}
+
+// Metadata of the declare block inserted at the top of files, in the order faustlibraries declares them
+var templateMetadata = []string{"name", "author", "copyright", "license", "version"}
+
+// Offers to insert declare statements for the metadata of templateMetadata that f doesn't declare yet
+func metadataTemplateAction(s *Server, f *File) (transport.CodeAction, bool) {
+	f.mu.RLock()
+	path, uri, content := f.Handle.Path, f.Handle.URI, f.Content
+	f.mu.RUnlock()
+
+	declared := declaredMetadata(content)
+	missing := []string{}
+	for _, key := range templateMetadata {
+		if _, ok := declared[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return transport.CodeAction{}, false
+	}
+
+	block := declareBlock(missing, s.Workspace.metadataDefaults(path, &s.Store))
+	if len(content) > 0 {
+		block += "\n"
+	}
+	return transport.CodeAction{
+		Title: "Insert declare metadata",
+		Kind:  transport.Source,
+		Edit: &transport.WorkspaceEdit{
+			Changes: map[transport.DocumentURI][]transport.TextEdit{
+				transport.DocumentURI(uri): {{NewText: block}},
+			},
+		},
+	}, true
+}
+
+// Declare statements of the metadata keys with their values
+func declareBlock(keys []string, values map[string]string) string {
+	var block strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&block, "declare %s %s;\n", key, strconv.Quote(values[key]))
+	}
+	return block.String()
+}
+
+// Global metadata declared in content, keyed by metadata key
+func declaredMetadata(content []byte) map[string]string {
+	metadata := map[string]string{}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return metadata
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() != "global_metadata" {
+			continue
+		}
+		key, value := node.ChildByFieldName("key"), node.ChildByFieldName("value")
+		if key != nil && value != nil {
+			metadata[key.Utf8Text(content)] = stripQuotes(value.Utf8Text(content))
+		}
+	}
+	return metadata
+}
+
+// Values of the metadata template for the file at path. The author comes from git's user.name, falling back to
+// the author declared in the other files of the folder like the copyright and license. Values that can't be
+// found are left empty, except for the name, taken from the file name, the version, and the copyright, made up
+// from the author.
+func (w *Workspace) metadataDefaults(path util.Path, store *Store) map[string]string {
+	values := map[string]string{
+		"name":    strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		"version": "1.0",
+	}
+	root := w.folderFor(path).Root
+
+	others := []util.Path{}
+	contents := map[util.Path][]byte{}
+	for _, f := range store.Files.list() {
+		f.mu.RLock()
+		other, content := f.Handle.Path, f.Content
+		f.mu.RUnlock()
+		if other == path || !IsFaustFile(other) || util.IsMemoryPath(other) || !isInside(root, other) || w.isExcluded(other) {
+			continue
+		}
+		others = append(others, other)
+		contents[other] = content
+	}
+	// Files are visited in a stable order so that the action doesn't change between requests
+	slices.Sort(others)
+	for _, other := range others {
+		declared := declaredMetadata(contents[other])
+		for _, key := range []string{"author", "copyright", "license"} {
+			if _, ok := values[key]; !ok && declared[key] != "" {
+				values[key] = declared[key]
+			}
+		}
+		if values["author"] != "" && values["copyright"] != "" && values["license"] != "" {
+			break
+		}
+	}
+
+	cmd := exec.Command("git", "config", "user.name")
+	cmd.Dir = root
+	if output, err := cmd.Output(); err == nil && strings.TrimSpace(string(output)) != "" {
+		author := strings.TrimSpace(string(output))
+		// The copyright of another author's files doesn't apply
+		if author != values["author"] {
+			delete(values, "copyright")
+		}
+		values["author"] = author
+	}
+	if values["copyright"] == "" && values["author"] != "" {
+		values["copyright"] = fmt.Sprintf("(c) %d %s", time.Now().Year(), values["author"])
+	}
+	return values
+}
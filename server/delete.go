@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Forgets a deleted file, or every file in a deleted directory
+func (workspace *Workspace) deletePath(path util.Path, s *Server) {
+	paths := []util.Path{}
+	workspace.mu.Lock()
+	for _, file := range workspace.Files {
+		if isInside(path, file) {
+			paths = append(paths, file)
+		}
+	}
+	workspace.mu.Unlock()
+	// Files opened by the editor outside of the workspace aren't in the workspace's list
+	if len(paths) == 0 {
+		paths = append(paths, path)
+	}
+
+	importers := workspace.deleteFiles(paths, s)
+	if workspace.replicating() {
+		os.RemoveAll(workspace.TempDirPath(path))
+	}
+
+	for _, file := range paths {
+		if filepath.Base(file) == faustConfigFile {
+			workspace.loadConfigFiles(s)
+			workspace.cleanDiagnostics(s.background.context(), s)
+			break
+		}
+	}
+
+	workspace.reanalyzeImporters(importers, s)
+}
+
+// Removes deleted files and returns the files that imported them, except the deleted ones
+func (workspace *Workspace) deleteFiles(paths []util.Path, s *Server) map[util.Path]struct{} {
+	importers := map[util.Path]struct{}{}
+	for _, file := range paths {
+		for _, importer := range workspace.deleteFile(file, s) {
+			importers[importer] = struct{}{}
+		}
+	}
+	for _, file := range paths {
+		delete(importers, file)
+	}
+	return importers
+}
+
+// Analyzes the importers of deleted files again, as their imports can't be resolved anymore
+func (workspace *Workspace) reanalyzeImporters(importers map[util.Path]struct{}, s *Server) {
+	for importer := range importers {
+		f, ok := s.Files.GetFromPath(importer)
+		if !ok {
+			continue
+		}
+		logging.Logger.Info("Re-analyzing importer of deleted file", "path", importer)
+		s.analyzeInBackground(f)
+		workspace.diagnoseOn(diagnoseSave, importer, s)
+	}
+}
+
+// Removes a deleted file from the File Store, the workspace, the symbol cache and the dependency graph,
+// and clears its diagnostics. Returns the files that imported it.
+func (workspace *Workspace) deleteFile(path util.Path, s *Server) []util.Path {
+	f, ok := s.Files.GetFromPath(path)
+	s.Files.RemoveFromPath(path)
+	workspace.removeFile(path)
+	if ok {
+		f.mu.RLock()
+		hash := f.Hash
+		f.mu.RUnlock()
+		s.Store.forgetScope(hash)
+	}
+
+	importers := s.Store.Dependencies.GetImporters(path)
+	s.Store.Dependencies.RemoveFile(path)
+
+	if IsFaustFile(path) || filepath.Base(path) == faustConfigFile {
+		s.clearDiagnostics(path)
+	}
+	logging.Logger.Info("Removed deleted file", "path", path, "importers", importers)
+	return importers
+}
+
+// Removes the scope parsed from content with this hash from the cache, unless another file still has that content
+func (store *Store) forgetScope(hash [sha256.Size]byte) {
+	store.forgetScopeOf("", hash)
+}
+
+// Like forgetScope, but the file at path doesn't count as having the content, e.g. when it has to be parsed again
+func (store *Store) forgetScopeOf(path util.Path, hash [sha256.Size]byte) {
+	for _, f := range store.Files.list() {
+		f.mu.RLock()
+		shared := f.Hash == hash && f.Handle.Path != path
+		f.mu.RUnlock()
+		if shared {
+			return
+		}
+	}
+	store.mu.Lock()
+	delete(store.Cache, hash)
+	store.mu.Unlock()
+}
+
+// Files and folders whose deletion the client reports with workspace/didDeleteFiles
+var deleteFileFilters = []transport.FileOperationFilter{
+	{Scheme: "file", Pattern: transport.FileOperationPattern{Glob: "**/*.{dsp,lib}"}},
+	{Scheme: "file", Pattern: transport.FileOperationPattern{Glob: "**/" + faustConfigFile}},
+	{Scheme: "file", Pattern: transport.FileOperationPattern{Glob: "**/*", Matches: &folderPattern}},
+}
+
+var folderPattern = transport.FolderPattern
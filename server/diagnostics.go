@@ -1,22 +1,167 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
 )
 
-func (s *Server) GenerateDiagnostics() {
-	s.diagChan = make(chan transport.PublishDiagnosticsParams)
+// Kinds of diagnostics that are generated separately for a file
+type diagnosticsKind int
 
+const (
+	syntaxDiagnostics diagnosticsKind = iota
+	compilerDiagnostics
+	configFileDiagnostics
+	libraryLintDiagnostics
+	unreachableRuleDiagnostics
+	// Clears the diagnostics of every kind, e.g. when the file is closed or deleted
+	clearDiagnostics
+)
+
+// New diagnostics of one kind for a file, which replace the previous diagnostics of that kind
+type diagnosticsUpdate struct {
+	kind   diagnosticsKind
+	params transport.PublishDiagnosticsParams
+}
+
+// Sends diagnostics of a kind to be published
+func (s *Server) publishDiagnostics(kind diagnosticsKind, params transport.PublishDiagnosticsParams) {
+	// No client to publish to when running from the command line
+	if s.diagChan == nil || params.URI == "" {
+		return
+	}
+	select {
+	case s.diagChan <- diagnosticsUpdate{kind: kind, params: params}:
+	case <-s.background.stopping():
+	}
+}
+
+// Sends an empty diagnostics array for path, so that the client removes everything it shows for it
+func (s *Server) clearDiagnostics(path util.Path) {
+	s.Workspace.diagStates.forget(path)
+	s.publishDiagnostics(clearDiagnostics, transport.PublishDiagnosticsParams{URI: transport.DocumentURI(util.Path2URI(path))})
+}
+
+// Publishes the diagnostics of every kind of a file together, as each publication replaces the previous one.
+// A kind that becomes clean removes its diagnostics from the client without affecting the other kinds.
+// Publications carry the newest document version any of the kinds was generated from, so that clients can drop
+// reports that arrive after newer content was sent. Diagnostics generated from content older than that version, e.g.
+// from a compiler that ran while the document was being edited, are dropped rather than published as current.
+func (s *Server) GenerateDiagnostics(ctx context.Context) {
+	published := make(map[transport.DocumentURI]map[diagnosticsKind][]transport.Diagnostic)
+	versions := make(map[transport.DocumentURI]int32)
 	for {
 		logging.Logger.Info("Waiting for diagnostic\n")
 		select {
-		case diag := <-s.diagChan:
+		case <-ctx.Done():
+			return
+		case update := <-s.diagChan:
+			uri := update.params.URI
+			if update.kind != clearDiagnostics && update.params.Version != 0 && update.params.Version < versions[uri] {
+				logging.Logger.Info("Dropping outdated diagnostics", "uri", uri, "version", update.params.Version, "published", versions[uri])
+				continue
+			}
+			if update.kind == clearDiagnostics {
+				delete(published, uri)
+				delete(versions, uri)
+			} else {
+				if published[uri] == nil {
+					published[uri] = make(map[diagnosticsKind][]transport.Diagnostic)
+				}
+				published[uri][update.kind] = update.params.Diagnostics
+			}
+
+			diag := update.params
+			// Diagnostics of content read from disk have no version, versions are forgotten when the document is closed
+			if diag.Version == 0 {
+				diag.Version = versions[uri]
+			}
+			if update.kind != clearDiagnostics {
+				versions[uri] = diag.Version
+			}
+			diag.Diagnostics = []transport.Diagnostic{}
+			for kind := syntaxDiagnostics; kind < clearDiagnostics; kind++ {
+				diag.Diagnostics = append(diag.Diagnostics, published[uri][kind]...)
+			}
+			if len(diag.Diagnostics) == 0 {
+				delete(published, uri)
+			}
+
+			diag = s.Workspace.RemapSeverities(diag)
 			content, _ := json.Marshal(diag)
 			logging.Logger.Info("Writing Diagnostic", "content", string(content))
 			s.Transport.WriteNotif("textDocument/publishDiagnostics", content)
 		}
 	}
 }
+
+// Severity a diagnostic is remapped to in the config, or "off" to hide it
+type SeverityLevel string
+
+const SeverityOff SeverityLevel = "off"
+
+var severityLevels = map[SeverityLevel]transport.DiagnosticSeverity{
+	"error":       transport.SeverityError,
+	"warning":     transport.SeverityWarning,
+	"information": transport.SeverityInformation,
+	"hint":        transport.SeverityHint,
+}
+
+func (l *SeverityLevel) UnmarshalJSON(content []byte) error {
+	var level string
+	if err := json.Unmarshal(content, &level); err != nil {
+		return err
+	}
+	if _, ok := severityLevels[SeverityLevel(level)]; !ok && SeverityLevel(level) != SeverityOff {
+		return fmt.Errorf("invalid severity %q, expected \"error\", \"warning\", \"information\", \"hint\" or \"off\"", level)
+	}
+	*l = SeverityLevel(level)
+	return nil
+}
+
+// Returns the severity configured for a diagnostic. Keys of the form "source/code" are more specific than
+// a code alone, which is more specific than a source.
+func severityFor(mapping map[string]SeverityLevel, d transport.Diagnostic) (SeverityLevel, bool) {
+	keys := []string{}
+	if d.Code != nil {
+		code := fmt.Sprint(d.Code)
+		keys = append(keys, d.Source+"/"+code, code)
+	}
+	keys = append(keys, d.Source)
+	for _, key := range keys {
+		if level, ok := mapping[key]; ok {
+			return level, true
+		}
+	}
+	return "", false
+}
+
+// Applies the severity mapping of the config of the diagnosed file
+func (w *Workspace) RemapSeverities(params transport.PublishDiagnosticsParams) transport.PublishDiagnosticsParams {
+	path, err := util.URI2path(string(params.URI))
+	if err != nil {
+		return params
+	}
+	mapping := w.ConfigFor(path).Severity
+	if len(mapping) == 0 {
+		return params
+	}
+
+	diagnostics := []transport.Diagnostic{}
+	for _, d := range params.Diagnostics {
+		if level, ok := severityFor(mapping, d); ok {
+			if level == SeverityOff {
+				continue
+			}
+			d.Severity = severityLevels[level]
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	params.Diagnostics = diagnostics
+	return params
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Diagnostics of a file are produced in stages, each stage only running once
+// the previous ones passed on the file's current content:
+//   - syntax: tree-sitter finds no syntax errors
+//   - analysis: the symbols and imports of the file are analyzed
+//   - compiler: the compiler accepts the file, only run for process files
+//
+// A file failing a stage loses the diagnostics of the later stages, as they
+// were produced from content that is known to be broken since.
+type diagnosticsStage int
+
+const (
+	stageNone diagnosticsStage = iota
+	stageSyntax
+	stageAnalysis
+	stageCompiler
+)
+
+type fileDiagnosticsState struct {
+	// Content the stages ran on
+	hash [sha256.Size]byte
+	// Last stage that passed on this content
+	passed diagnosticsStage
+}
+
+// Stages passed by each file, keyed by path
+type diagnosticsStates struct {
+	mu    sync.Mutex
+	files map[util.Path]fileDiagnosticsState
+}
+
+// Records whether stage passed on the content with hash. Content that changed starts over from the first stage.
+func (d *diagnosticsStates) record(path util.Path, hash [sha256.Size]byte, stage diagnosticsStage, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.files == nil {
+		d.files = make(map[util.Path]fileDiagnosticsState)
+	}
+	state := d.files[path]
+	if state.hash != hash {
+		state = fileDiagnosticsState{hash: hash}
+	}
+	if !ok {
+		state.passed = min(state.passed, stage-1)
+	} else if stage <= state.passed+1 {
+		state.passed = max(state.passed, stage)
+	}
+	d.files[path] = state
+}
+
+// Whether stage passed on the content with hash
+func (d *diagnosticsStates) passed(path util.Path, hash [sha256.Size]byte, stage diagnosticsStage) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.files[path]
+	return ok && state.hash == hash && state.passed >= stage
+}
+
+func (d *diagnosticsStates) forget(path util.Path) {
+	d.mu.Lock()
+	delete(d.files, path)
+	d.mu.Unlock()
+}
+
+func isSyntaxError(d transport.Diagnostic) bool {
+	return d.Source == "tree-sitter"
+}
+
+// Runs the syntax stage on path and publishes its diagnostics. Returns whether it passed.
+func (w *Workspace) checkSyntax(s *Server, path util.Path) bool {
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return false
+	}
+	params, hash := f.syntaxDiagnostics()
+	passed := !slices.ContainsFunc(params.Diagnostics, isSyntaxError)
+	w.diagStates.record(path, hash, stageSyntax, passed)
+	s.publishDiagnostics(syntaxDiagnostics, params)
+	if !passed {
+		s.publishDiagnostics(compilerDiagnostics, transport.PublishDiagnosticsParams{
+			URI:         params.URI,
+			Version:     params.Version,
+			Diagnostics: []transport.Diagnostic{},
+		})
+	}
+	// Rules of content that doesn't parse may be missing their patterns
+	unreachable := []transport.Diagnostic{}
+	if passed {
+		f.mu.RLock()
+		unreachable = unreachableRules(params.URI, f.Content, string(s.Files.encoding))
+		f.mu.RUnlock()
+	}
+	s.publishDiagnostics(unreachableRuleDiagnostics, transport.PublishDiagnosticsParams{
+		URI:         params.URI,
+		Version:     params.Version,
+		Diagnostics: unreachable,
+	})
+	if IsLibFile(path) {
+		// Lint of content that doesn't parse would report definitions that are only broken
+		lint := []transport.Diagnostic{}
+		if passed {
+			f.mu.RLock()
+			lint = libraryLint(f.Content, string(s.Files.encoding))
+			f.mu.RUnlock()
+		}
+		s.publishDiagnostics(libraryLintDiagnostics, transport.PublishDiagnosticsParams{
+			URI:         params.URI,
+			Version:     params.Version,
+			Diagnostics: lint,
+		})
+	}
+	return passed
+}
+
+// Runs the stages before the compiler on f if they haven't passed on its current content yet.
+// Returns the content's hash and whether the compiler can run on it.
+// The syntax stage's diagnostics are published even when syntax diagnostics are triggered manually,
+// as they replace the compiler's diagnostics of the file.
+func (w *Workspace) readyToCompile(s *Server, f *File) ([sha256.Size]byte, bool) {
+	f.mu.RLock()
+	path, hash := f.Handle.Path, f.Hash
+	f.mu.RUnlock()
+
+	if !w.diagStates.passed(path, hash, stageSyntax) && !w.checkSyntax(s, path) {
+		return hash, false
+	}
+	if !w.diagStates.passed(path, hash, stageAnalysis) {
+		snap := w.snapshot(f, &s.Store)
+		w.diagStates.record(path, snap.Hash, stageAnalysis, snap.Scope != nil)
+	}
+	// The content may have changed in the meantime, the change schedules another run
+	return hash, w.diagStates.passed(path, hash, stageAnalysis)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// When diagnostics are generated
+type DiagnosticsMode string
+
+const (
+	// After every change, debounced by the trigger's delay
+	DiagnoseOnType DiagnosticsMode = "on-type"
+	// When the file is saved
+	DiagnoseOnSave DiagnosticsMode = "on-save"
+	// Only with the faustlsp/diagnose request
+	DiagnoseManual DiagnosticsMode = "manual"
+)
+
+func (m *DiagnosticsMode) UnmarshalJSON(content []byte) error {
+	var mode string
+	if err := json.Unmarshal(content, &mode); err != nil {
+		return err
+	}
+	switch DiagnosticsMode(mode) {
+	case DiagnoseOnType, DiagnoseOnSave, DiagnoseManual:
+		*m = DiagnosticsMode(mode)
+		return nil
+	}
+	return fmt.Errorf("invalid diagnostics mode %q, expected %q, %q or %q", mode, DiagnoseOnType, DiagnoseOnSave, DiagnoseManual)
+}
+
+type DiagnosticsTrigger struct {
+	Mode DiagnosticsMode `json:"mode,omitempty"`
+	// Milliseconds without changes to wait for before diagnosing in on-type mode
+	Delay int `json:"delay,omitempty"`
+}
+
+// Diagnostics trigger policy, separately for tree-sitter and compiler diagnostics
+type DiagnosticsConfig struct {
+	Syntax   DiagnosticsTrigger `json:"syntax"`
+	Compiler DiagnosticsTrigger `json:"compiler"`
+}
+
+func defaultDiagnosticsConfig() DiagnosticsConfig {
+	return DiagnosticsConfig{
+		Syntax: DiagnosticsTrigger{Mode: DiagnoseOnType},
+		// Compiler runs can be expensive, so wait for the user to stop typing
+		Compiler: DiagnosticsTrigger{Mode: DiagnoseOnType, Delay: 500},
+	}
+}
+
+// What caused diagnostics to be requested
+type diagnosticsEvent int
+
+const (
+	diagnoseOpen diagnosticsEvent = iota
+	diagnoseChange
+	diagnoseSave
+)
+
+// Whether a trigger runs for an event. Opening a file counts as both a change and a save.
+func (t DiagnosticsTrigger) runsOn(event diagnosticsEvent) bool {
+	switch t.Mode {
+	case DiagnoseManual:
+		return false
+	case DiagnoseOnSave:
+		return event != diagnoseChange
+	}
+	return true
+}
+
+// Debounce timers of on-type diagnostics
+type diagnosticsTimers struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// Runs f after delay, cancelling the previous run scheduled with the same key if it hasn't started yet
+func (d *diagnosticsTimers) debounce(key string, delay time.Duration, f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timers == nil {
+		d.timers = make(map[string]*time.Timer)
+	}
+	if timer, ok := d.timers[key]; ok {
+		timer.Stop()
+	}
+	d.timers[key] = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		delete(d.timers, key)
+		d.mu.Unlock()
+		f()
+	})
+}
+
+// Cancels all scheduled runs that haven't started yet. They aren't run on shutdown, as their diagnostics couldn't be
+// published anymore.
+func (d *diagnosticsTimers) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, key)
+	}
+}
+
+// Generates the diagnostics of path whose trigger policy allows it for this event
+func (w *Workspace) diagnoseOn(event diagnosticsEvent, path util.Path, s *Server) {
+	if !IsFaustFile(path) {
+		return
+	}
+	folder := w.folderFor(path)
+	policy := folder.Config.Diagnostics
+
+	if policy.Syntax.runsOn(event) {
+		w.schedule(s, event, "syntax:"+path, policy.Syntax.Delay, func() { w.sendSyntaxDiagnostics(path, s) })
+	}
+	// Untitled documents only get syntax diagnostics until they're saved
+	if util.IsMemoryPath(path) {
+		return
+	}
+	// Errors introduced through an imported file show up in the process files importing it,
+	// which can belong to other folders when the file is e.g. in a shared include directory
+	folders := []*Folder{folder}
+	for _, importer := range s.Store.Dependencies.Dependents(path) {
+		dependent := w.folderFor(importer)
+		if !slices.ContainsFunc(folders, func(f *Folder) bool { return f.Root == dependent.Root }) {
+			folders = append(folders, dependent)
+		}
+	}
+	for _, folder := range folders {
+		compiler := folder.Config.Diagnostics.Compiler
+		if folder.Config.CompilerDiagnostics && compiler.runsOn(event) {
+			// Compiler diagnostics cover all process files of the folder, so a change in any file reschedules the same run
+			w.schedule(s, event, "compiler:"+folder.Root, compiler.Delay, func() { w.sendCompilerDiagnostics(s.background.context(), s, folder) })
+		}
+	}
+}
+
+func (w *Workspace) schedule(s *Server, event diagnosticsEvent, key string, delay int, f func()) {
+	if event == diagnoseChange && delay > 0 {
+		// Debounced runs are background tasks, so that they don't start or outlive the server stopping
+		w.diagTimers.debounce(key, time.Duration(delay)*time.Millisecond, func() {
+			s.background.Go(func(context.Context) { f() })
+		})
+		return
+	}
+	f()
+}
+
+func (w *Workspace) sendSyntaxDiagnostics(path util.Path, s *Server) {
+	logging.Logger.Info("Diagnosing File", "path", path)
+	w.checkSyntax(s, path)
+}
+
+type DiagnoseParams struct {
+	// File to diagnose. All files in the workspace are diagnosed if empty.
+	URI transport.DocumentURI `json:"uri,omitempty"`
+}
+
+// Handler for the custom faustlsp/diagnose request, which runs all diagnostics regardless of their trigger policy
+func Diagnose(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params DiagnoseParams
+	json.Unmarshal(par, &params)
+
+	if params.URI == "" {
+		s.Workspace.cleanDiagnostics(ctx, s)
+		return json.Marshal(nil)
+	}
+	path, err := util.URI2path(string(params.URI))
+	if err != nil {
+		return nil, err
+	}
+	s.Workspace.DiagnoseFile(ctx, path, s)
+	return json.Marshal(nil)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Editors save through temporary files, renames and removes, so a single save
+// shows up as a burst of watcher events. Events are held until the workspace
+// has been quiet for a moment and merged per path, so that every changed path
+// is re-read, analyzed, diagnosed and replicated once with its final state.
+
+const (
+	// Time without new events after which the pending ones are handled
+	diskEventsQuiet = 100 * time.Millisecond
+	// Pending events are handled at the latest this long after the first one, even if events keep coming
+	diskEventsMaxWait = time.Second
+)
+
+type pendingDiskEvent struct {
+	ops fsnotify.Op
+	// The first event for the path created it, so it didn't exist before the burst
+	created     bool
+	renamedFrom string
+}
+
+// Watcher events waiting to be merged. Only used from the watcher goroutine.
+type diskEvents struct {
+	pending map[util.Path]*pendingDiskEvent
+	// Paths in the order they first changed, parent directories come before their files
+	order []util.Path
+	first time.Time
+	timer *time.Timer
+}
+
+func (d *diskEvents) add(event fsnotify.Event) {
+	if d.pending == nil {
+		d.pending = make(map[util.Path]*pendingDiskEvent)
+	}
+	p, ok := d.pending[event.Name]
+	if !ok {
+		p = &pendingDiskEvent{created: event.Has(fsnotify.Create)}
+		d.pending[event.Name] = p
+		d.order = append(d.order, event.Name)
+	}
+	p.ops |= event.Op
+	if event.RenamedFrom != "" {
+		p.renamedFrom = event.RenamedFrom
+	}
+
+	now := time.Now()
+	if d.timer == nil {
+		d.first = now
+		d.timer = time.NewTimer(diskEventsQuiet)
+		return
+	}
+	d.timer.Reset(min(diskEventsQuiet, d.first.Add(diskEventsMaxWait).Sub(now)))
+}
+
+// Fires once the pending events should be handled, never if there are none
+func (d *diskEvents) ready() <-chan time.Time {
+	if d.timer == nil {
+		return nil
+	}
+	return d.timer.C
+}
+
+// Returns one event per changed path describing how it differs from before the burst
+func (d *diskEvents) flush() []fsnotify.Event {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	pending, order := d.pending, d.order
+	*d = diskEvents{}
+
+	exists := func(path util.Path) (os.FileInfo, bool) {
+		fi, err := os.Stat(path)
+		return fi, err == nil
+	}
+	// Paths that only existed during the burst, like the temporary file of an atomic save
+	transient := func(path util.Path) bool {
+		p, ok := pending[path]
+		_, found := exists(path)
+		return ok && p.created && !found
+	}
+	// Paths moved to another path of the workspace, which handles the rename
+	movedAway := func(path util.Path) bool {
+		for to, p := range pending {
+			if _, found := exists(to); found && p.renamedFrom == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	events := []fsnotify.Event{}
+	for _, path := range order {
+		p := pending[path]
+		fi, found := exists(path)
+		switch {
+		case found && p.created:
+			event := fsnotify.Event{Name: path, Op: fsnotify.Create}
+			if p.renamedFrom != "" && !transient(p.renamedFrom) {
+				event.RenamedFrom = p.renamedFrom
+			}
+			// Content is read by the write, the create only adds the path
+			if !fi.IsDir() {
+				event.Op |= fsnotify.Write
+			}
+			events = append(events, event)
+		case found && fi.IsDir():
+			// Directories that were removed and created again have to be watched again
+			if p.ops.Has(fsnotify.Remove) || p.ops.Has(fsnotify.Create) {
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			}
+		case found:
+			if p.ops&^fsnotify.Chmod != 0 {
+				events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+			}
+		case !p.created && !movedAway(path):
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		}
+	}
+	return events
+}
+
+// Handler for workspace/didChangeWatchedFiles, handing the changes the client's watcher saw to the workspace watcher
+// as disk events. Their kind only matters within a burst, which is compared to the files on disk once it's over.
+func DidChangeWatchedFiles(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.DidChangeWatchedFilesParams
+	json.Unmarshal(par, &params)
+
+	for _, change := range params.Changes {
+		path, err := util.URI2path(string(change.URI))
+		if err != nil {
+			logging.Logger.Warn("Ignoring watched file change", "uri", change.URI, "error", err)
+			continue
+		}
+		if s.changeHandled(path, change.Type) {
+			continue
+		}
+		event := fsnotify.Event{Name: path}
+		switch change.Type {
+		case transport.Created:
+			event.Op = fsnotify.Create
+		case transport.Deleted:
+			event.Op = fsnotify.Remove
+		default:
+			event.Op = fsnotify.Write
+		}
+		s.queueWatchedFileEvent(event)
+	}
+	return nil
+}
+
+// Whether the workspace watcher already handled the change, which clients usually report after a delay of their own
+func (s *Server) changeHandled(path util.Path, kind transport.FileChangeType) bool {
+	f, known := s.Files.GetFromPath(path)
+	if kind == transport.Deleted {
+		return !known
+	}
+	if !known {
+		return false
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return bytes.Equal(f.Content, content)
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Formats the workspace documentation can be generated in, keyed by the extension of their pages
+var docgenFormats = map[string]string{
+	"markdown": ".md",
+	"html":     ".html",
+}
+
+type DocgenResult struct {
+	// Pages written, the index first
+	Files []transport.DocumentURI `json:"files"`
+}
+
+// A library of the workspace and the page documenting it
+type libraryPage struct {
+	path     util.Path
+	page     util.Path
+	title    string
+	metadata map[string]string
+	symbols  []*Symbol
+}
+
+// Writes a reference of the top-level definitions of the workspace's libraries, with their documentation and links to
+// their source, to the directory given as first argument (a path relative to the workspace root or a URI). One page
+// is written per library, along with an index. The optional second argument is the format, markdown or html.
+func DocgenCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing output directory argument")
+	}
+	var dir string
+	if err := json.Unmarshal(args[0], &dir); err != nil {
+		return nil, fmt.Errorf("invalid output directory argument: %w", err)
+	}
+	if strings.HasPrefix(dir, "file://") {
+		path, err := util.URI2path(dir)
+		if err != nil {
+			return nil, err
+		}
+		dir = path
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.Workspace.Root, dir)
+	}
+	format := "markdown"
+	if len(args) > 1 {
+		if err := json.Unmarshal(args[1], &format); err != nil {
+			return nil, fmt.Errorf("invalid format argument: %w", err)
+		}
+	}
+	ext, ok := docgenFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q, expected markdown or html", format)
+	}
+
+	pages := s.Workspace.libraryPages(dir, ext, &s.Store)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	index := filepath.Join(dir, "index"+ext)
+	written := []util.Path{index}
+	if err := writeDocPage(index, "API Reference", docIndex(pages, dir), ext); err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		if err := os.MkdirAll(filepath.Dir(page.page), 0755); err != nil {
+			return nil, err
+		}
+		if err := writeDocPage(page.page, page.title, libraryDoc(page), ext); err != nil {
+			return nil, err
+		}
+		written = append(written, page.page)
+	}
+
+	result := DocgenResult{Files: []transport.DocumentURI{}}
+	for _, path := range written {
+		result.Files = append(result.Files, transport.DocumentURI(util.Path2URI(path)))
+	}
+	return result, nil
+}
+
+// Libraries of the workspace that define something, sorted by path, with the path of their page in dir
+func (w *Workspace) libraryPages(dir util.Path, ext string, store *Store) []libraryPage {
+	pages := []libraryPage{}
+	for _, f := range store.Files.list() {
+		f.mu.RLock()
+		path, scope, content := f.Handle.Path, f.Scope, f.Content
+		f.mu.RUnlock()
+		if scope == nil || !IsLibFile(path) || util.IsMemoryPath(path) || !w.insideWorkspace(path) || w.isExcluded(path) {
+			continue
+		}
+		symbols := topLevelDefinitionSymbols(scope)
+		if len(symbols) == 0 {
+			continue
+		}
+		rel, err := filepath.Rel(w.Root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(path)
+		}
+		page := libraryPage{
+			path:     path,
+			page:     filepath.Join(dir, strings.TrimSuffix(rel, filepath.Ext(rel))+ext),
+			title:    filepath.ToSlash(rel),
+			metadata: declaredMetadata(content),
+			symbols:  symbols,
+		}
+		if name := page.metadata["name"]; name != "" {
+			page.title = name
+		}
+		pages = append(pages, page)
+	}
+	slices.SortFunc(pages, func(a, b libraryPage) int {
+		return strings.Compare(a.path, b.path)
+	})
+	return pages
+}
+
+// Markdown of the index page, linking to the page of every library
+func docIndex(pages []libraryPage, dir util.Path) string {
+	var b strings.Builder
+	b.WriteString("# API Reference\n\n")
+	if len(pages) == 0 {
+		b.WriteString("No library defines anything.\n")
+	}
+	for _, page := range pages {
+		link, _ := filepath.Rel(dir, page.page)
+		fmt.Fprintf(&b, "* [%s](%s) (`%s`): %d definitions\n", page.title, filepath.ToSlash(link), filepath.Base(page.path), len(page.symbols))
+	}
+	return b.String()
+}
+
+// Markdown of the page of a library: its metadata, then its definitions in the order they are defined
+func libraryDoc(page libraryPage) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", page.title)
+	for _, key := range templateMetadata {
+		if value := page.metadata[key]; value != "" && key != "name" {
+			fmt.Fprintf(&b, "* **%s**: %s\n", key, value)
+		}
+	}
+	source, _ := filepath.Rel(filepath.Dir(page.page), page.path)
+	source = filepath.ToSlash(source)
+
+	symbols := slices.Clone(page.symbols)
+	slices.SortStableFunc(symbols, func(a, b *Symbol) int {
+		return int(a.Loc.Range.Start.Line) - int(b.Loc.Range.Start.Line)
+	})
+	for _, sym := range symbols {
+		fmt.Fprintf(&b, "\n## %s\n\n", sym.Ident)
+		// The Usage section already shows how to call it
+		if !hasUsageSection(sym.Docs.Full) {
+			fmt.Fprintf(&b, "```faust\n%s\n```\n\n", signature(sym))
+		}
+		if sym.Docs.Full != "" {
+			b.WriteString(sym.Docs.Full + "\n\n")
+		}
+		line := sym.Loc.Range.Start.Line + 1
+		fmt.Fprintf(&b, "[%s:%d](%s#L%d)\n", filepath.Base(page.path), line, source, line)
+	}
+	return b.String()
+}
+
+// How a definition is used: its name, followed by its arguments if it is a function
+func signature(sym *Symbol) string {
+	if sym.Kind != Function || sym.Scope == nil {
+		return sym.Ident
+	}
+	arguments := []string{}
+	for _, argument := range sym.Scope.Symbols {
+		if argument.Kind == Identifier {
+			arguments = append(arguments, argument.Ident)
+		}
+	}
+	return sym.Ident + "(" + strings.Join(arguments, ", ") + ")"
+}
+
+// Writes a page from its markdown, converted to a standalone document for html
+func writeDocPage(path util.Path, title string, markdown string, ext string) error {
+	content := markdown
+	if ext == ".html" {
+		content = fmt.Sprintf("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n%s</body>\n</html>\n", html.EscapeString(title), markdownHTML(markdown))
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+var (
+	markdownHeading = regexp.MustCompile(`^(#{1,6}) (.*)$`)
+	inlineCode      = regexp.MustCompile("`([^`]+)`")
+	inlineLink      = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+	inlineBold      = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	autoLink        = regexp.MustCompile(`&lt;(https?://[^&]+)&gt;`)
+)
+
+// Converts the markdown of generated pages to html: headings, code blocks, lists and paragraphs with inline code,
+// links and bold text
+func markdownHTML(markdown string) string {
+	var b strings.Builder
+	inCode, inList, inParagraph := false, false, false
+	closeBlocks := func() {
+		if inList {
+			b.WriteString("</ul>\n")
+			inList = false
+		}
+		if inParagraph {
+			b.WriteString("</p>\n")
+			inParagraph = false
+		}
+	}
+	for _, line := range strings.Split(markdown, "\n") {
+		if fence, ok := strings.CutPrefix(line, "```"); ok {
+			if inCode {
+				b.WriteString("</code></pre>\n")
+			} else {
+				closeBlocks()
+				if fence != "" {
+					fmt.Fprintf(&b, "<pre><code class=\"language-%s\">", html.EscapeString(fence))
+				} else {
+					b.WriteString("<pre><code>")
+				}
+			}
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			b.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			closeBlocks()
+		case markdownHeading.MatchString(trimmed):
+			closeBlocks()
+			match := markdownHeading.FindStringSubmatch(trimmed)
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", len(match[1]), inlineHTML(match[2]), len(match[1]))
+		case strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "- "):
+			if inParagraph {
+				b.WriteString("</p>\n")
+				inParagraph = false
+			}
+			if !inList {
+				b.WriteString("<ul>\n")
+				inList = true
+			}
+			fmt.Fprintf(&b, "<li>%s</li>\n", inlineHTML(trimmed[2:]))
+		default:
+			if inList {
+				b.WriteString("</ul>\n")
+				inList = false
+			}
+			if inParagraph {
+				b.WriteString("\n")
+			} else {
+				b.WriteString("<p>")
+				inParagraph = true
+			}
+			b.WriteString(inlineHTML(trimmed))
+		}
+	}
+	if inCode {
+		b.WriteString("</code></pre>\n")
+	}
+	closeBlocks()
+	return b.String()
+}
+
+func inlineHTML(text string) string {
+	text = html.EscapeString(text)
+	text = inlineCode.ReplaceAllString(text, "<code>$1</code>")
+	text = inlineLink.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = inlineBold.ReplaceAllString(text, "<strong>$1</strong>")
+	return autoLink.ReplaceAllString(text, `<a href="$1">$1</a>`)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Archive of a faustlibraries version on GitHub, which works for tags, branches and commits
+const defaultDocsSource = "https://codeload.github.com/grame-cncm/faustlibraries/tar.gz/{version}"
+
+// faustlibraries version downloaded by faust.updateDocs when none is pinned
+const defaultDocsVersion = "master"
+
+// Limit of the downloaded archive, faustlibraries is a few megabytes
+const maxDocsArchiveSize = 64 << 20
+
+// Limit of each extracted library, as a small archive can decompress to much more than its size
+const maxDocsLibrarySize = 16 << 20
+
+// Directory where downloaded documentation bundles are cached, one file per version
+func docsBundleDir() (util.Path, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "faustlsp", "docs"), nil
+}
+
+// Versions can be branch names like feature/x, which aren't valid file names
+func docsBundlePath(dir util.Path, version string) util.Path {
+	return filepath.Join(dir, url.PathEscape(version)+".json")
+}
+
+// Uses the freshest documentation bundle of the embedded one and the cached ones. If version is pinned, only
+// bundles of that version are considered, the embedded one being used when none was downloaded.
+func loadDocsBundle(version string) {
+	best := stdlib.Embedded()
+	candidates := []*stdlib.Bundle{}
+	if dir, err := docsBundleDir(); err == nil {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			bundle, err := stdlib.Parse(content)
+			if err != nil {
+				logging.Logger.Warn("Ignoring invalid documentation bundle", "path", entry.Name(), "error", err)
+				continue
+			}
+			candidates = append(candidates, bundle)
+		}
+	}
+	for _, bundle := range candidates {
+		if version != "" && bundle.Version != version {
+			continue
+		}
+		if version != "" && best.Version != version || bundle.Generated.After(best.Generated) {
+			best = bundle
+		}
+	}
+	if stdlib.Current() != best {
+		logging.Logger.Info("Using documentation bundle", "version", best.Version, "generated", best.Generated, "functions", len(best.Docs))
+		stdlib.Set(best)
+	}
+}
+
+type UpdateDocsResult struct {
+	Version string    `json:"version"`
+	Path    util.Path `json:"path"`
+	// Number of documented functions
+	Functions int `json:"functions"`
+}
+
+// Downloads the faustlibraries version given as argument, or the one pinned with docs_version, generates its
+// documentation bundle into the user cache directory and uses it for hover and completion
+func UpdateDocsCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	cfg := s.Workspace.folderFor(s.Workspace.Root).Config
+	version := cfg.DocsVersion
+	if len(args) > 0 {
+		if err := json.Unmarshal(args[0], &version); err != nil {
+			return nil, fmt.Errorf("invalid version argument: %w", err)
+		}
+	}
+	if version == "" {
+		version = defaultDocsVersion
+	}
+	if _, err := docsBundleDir(); err != nil {
+		return nil, err
+	}
+
+	progress := s.StartProgress(ctx, "Updating documentation", "faustlibraries "+version, true)
+	defer progress.End("")
+
+	libraries, err := os.MkdirTemp(s.Workspace.tempDir, "faustlibraries-")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create download directory: %w", err)
+	}
+	defer os.RemoveAll(libraries)
+	source := strings.ReplaceAll(cfg.DocsSource, "{version}", url.PathEscape(version))
+	if err := downloadLibraries(progress.Context(), source, libraries); err != nil {
+		if progress.Context().Err() != nil {
+			return nil, fmt.Errorf("documentation update cancelled")
+		}
+		return nil, fmt.Errorf("couldn't download faustlibraries %s: %w", version, err)
+	}
+
+	bundle, err := generateDocsBundle(libraries, version)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate documentation of faustlibraries %s: %w", version, err)
+	}
+	path, err := saveDocsBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	loadDocsBundle(cfg.DocsVersion)
+	return UpdateDocsResult{Version: version, Path: path, Functions: len(bundle.Docs)}, nil
+}
+
+// Writes bundle to the user cache directory, replacing the previous bundle of its version
+func saveDocsBundle(bundle *stdlib.Bundle) (util.Path, error) {
+	dir, err := docsBundleDir()
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(bundle)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	path := docsBundlePath(dir, bundle.Version)
+	return path, os.WriteFile(path, content, 0640)
+}
+
+// Downloads the gzipped tar archive at source and extracts the libraries at its top level into dir
+func downloadLibraries(ctx context.Context, source string, dir util.Path) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", source, resp.Status)
+	}
+
+	archive, err := gzip.NewReader(io.LimitReader(resp.Body, maxDocsArchiveSize))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	files := tar.NewReader(archive)
+	for {
+		header, err := files.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// GitHub archives have everything in a faustlibraries-<version> directory
+		name := strings.TrimPrefix(filepath.ToSlash(header.Name), "./")
+		if _, rest, ok := strings.Cut(name, "/"); ok {
+			name = rest
+		}
+		if header.Typeflag != tar.TypeReg || strings.Contains(name, "/") || filepath.Ext(name) != ".lib" {
+			continue
+		}
+		content, err := io.ReadAll(io.LimitReader(files, maxDocsLibrarySize+1))
+		if err != nil {
+			return err
+		}
+		if len(content) > maxDocsLibrarySize {
+			return fmt.Errorf("%s is larger than %d bytes", name, maxDocsLibrarySize)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0640); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/carn181/faustlsp/util"
+)
+
+// DoctorCheck is the result of a single environment check done by `faustlsp doctor`
+type DoctorCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+	// Actionable fix shown when the check fails
+	Fix string
+}
+
+// Doctor checks whether the environment and the workspace at root are set up correctly for the language server
+func Doctor(root util.Path) []DoctorCheck {
+	checks := []DoctorCheck{}
+
+	cfg, configCheck := doctorConfig(root)
+	checks = append(checks, configCheck)
+	checks = append(checks, doctorExecutable(cfg.Command, "--version",
+		fmt.Sprintf("Install the Faust compiler (https://faust.grame.fr) and make sure %q is in your PATH, or set \"command\" in %s", cfg.Command, faustConfigFile)))
+	checks = append(checks, doctorExecutable("faustfmt", "--version",
+		"Install faustfmt (https://github.com/carn181/faustfmt) and make sure it is in your PATH to enable formatting"))
+	checks = append(checks, doctorDSPDir(root, cfg))
+	return checks
+}
+
+func doctorExecutable(command string, versionFlag string, fix string) DoctorCheck {
+	check := DoctorCheck{Name: command, Fix: fix}
+	path, err := exec.LookPath(command)
+	if err != nil {
+		check.Detail = "not found in PATH"
+		return check
+	}
+	check.OK = true
+	check.Detail = path
+
+	output, err := exec.Command(path, versionFlag).CombinedOutput()
+	if err == nil {
+		version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		if version != "" {
+			check.Detail += " (" + version + ")"
+		}
+	}
+	return check
+}
+
+func doctorDSPDir(root util.Path, cfg FaustProjectConfig) DoctorCheck {
+	command := cfg.Command
+	check := DoctorCheck{
+		Name: "faust -dspdir",
+		Fix:  "Make sure the Faust libraries are installed alongside the compiler, so that imports like \"stdfaust.lib\" resolve",
+	}
+	var dir string
+	if cfg.LibraryDir != "" {
+		folder := Folder{Root: root, Config: cfg}
+		dir = folder.libraryDir()
+		check.Name = "library_path"
+		check.Fix = "Set \"library_path\" in " + faustConfigFile + " to a directory containing the Faust libraries"
+	} else {
+		if _, err := exec.LookPath(command); err != nil {
+			check.Detail = "skipped, " + command + " not found in PATH"
+			return check
+		}
+		output, err := exec.Command(command, "-dspdir").Output()
+		if err != nil {
+			check.Detail = "failed to run: " + err.Error()
+			return check
+		}
+		dir = strings.TrimSpace(string(output))
+	}
+	fi, err := os.Stat(dir)
+	if err != nil || !fi.IsDir() {
+		check.Detail = fmt.Sprintf("%q is not an accessible directory", dir)
+		return check
+	}
+	if !util.IsValidPath(filepath.Join(dir, "stdfaust.lib")) {
+		check.Detail = fmt.Sprintf("%s does not contain stdfaust.lib", dir)
+		return check
+	}
+	check.OK = true
+	check.Detail = dir
+	return check
+}
+
+// Validates the workspace's config file and returns the config the server would use
+func doctorConfig(root util.Path) (FaustProjectConfig, DoctorCheck) {
+	w := Workspace{Root: root}
+	cfg := w.defaultConfig(root)
+	configPath := filepath.Join(root, faustConfigFile)
+	check := DoctorCheck{Name: faustConfigFile}
+
+	content, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		check.OK = true
+		check.Detail = "not found, using defaults"
+		return cfg, check
+	}
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = "Make sure " + configPath + " is readable"
+		return cfg, check
+	}
+
+	problems := validateConfig(root, content)
+	if len(problems) > 0 {
+		messages := []string{}
+		for _, problem := range problems {
+			messages = append(messages, problem.Message)
+		}
+		check.Detail = "invalid config: " + strings.Join(messages, "; ")
+		check.Fix = "Fix " + configPath + ", the server shows these problems as diagnostics in the file"
+		if parsed, err := w.parseConfig(root, content); err == nil {
+			cfg = parsed
+		}
+		return cfg, check
+	}
+	cfg, _ = w.parseConfig(root, content)
+
+	check.OK = true
+	check.Detail = configPath
+	return cfg, check
+}
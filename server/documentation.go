@@ -0,0 +1,97 @@
+package server
+
+import (
+	"strings"
+)
+
+// Sections of the doc comments of faustlibraries, introduced by headings like #### Usage or Where:
+var docSections = []string{"Usage", "Where", "Example", "Reference"}
+
+// Renders the lines of a doc comment as markdown, with its sections under headings of their own and code blocks
+// highlighted as Faust. The rules around the doc comments of faustlibraries, like //---`(os.)osc`---, are left out.
+// The usage is the first line of the Usage section's code, or the first line of the description without one.
+func renderDocumentation(lines []string) Documentation {
+	markdown := []string{}
+	section, usage, description := "", "", ""
+	inCode := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			if !inCode && trimmed == "```" {
+				trimmed = "```faust"
+			}
+			inCode = !inCode
+			markdown = append(markdown, trimmed)
+			continue
+		}
+		if inCode {
+			markdown = append(markdown, line)
+			if section == "Usage" && usage == "" && trimmed != "" {
+				usage = trimmed
+			}
+			continue
+		}
+		if isDocRule(trimmed) {
+			continue
+		}
+		if heading, name, ok := docHeading(trimmed); ok {
+			section = name
+			markdown = append(markdown, "", "#### "+heading, "")
+			continue
+		}
+		switch {
+		case trimmed == "":
+		case section == "":
+			if description == "" {
+				description = trimmed
+			}
+		case section == "Usage" && usage == "":
+			usage = strings.Trim(trimmed, "`")
+		}
+		markdown = append(markdown, trimmed)
+	}
+	if usage == "" {
+		usage = description
+	}
+
+	// Blank lines separate paragraphs and sections, more of them would only add space
+	full := []string{}
+	for _, line := range markdown {
+		if line == "" && (len(full) == 0 || full[len(full)-1] == "") {
+			continue
+		}
+		full = append(full, line)
+	}
+	return Documentation{
+		Full:  strings.TrimSpace(strings.Join(full, "\n")),
+		Usage: usage,
+	}
+}
+
+// Returns the heading of a section line like #### Example test program or Where:, and the section it starts
+func docHeading(line string) (string, string, bool) {
+	heading := strings.TrimSpace(strings.TrimLeft(line, "#"))
+	// Without #, only short lines ending with a colon are headings, so that a sentence starting with Where isn't one
+	if !strings.HasPrefix(line, "#") && (!strings.HasSuffix(heading, ":") || len(strings.Fields(heading)) > 3) {
+		return "", "", false
+	}
+	heading = strings.TrimSpace(strings.TrimSuffix(heading, ":"))
+	first, _, _ := strings.Cut(heading, " ")
+	for _, section := range docSections {
+		if strings.EqualFold(first, section) || strings.EqualFold(first, section+"s") {
+			return heading, section, true
+		}
+	}
+	return "", "", false
+}
+
+// Whether a line is a rule made of dashes or equal signs, which may be around a name like `(os.)osc`
+func isDocRule(line string) bool {
+	if line == "" {
+		return false
+	}
+	if start, end := strings.Index(line, "`"), strings.LastIndex(line, "`"); start != -1 && start < end {
+		line = line[:start] + line[end+1:]
+	}
+	return line != "" && strings.Trim(line, "-=*") == ""
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/util"
+	cp "github.com/otiai10/copy"
+)
+
+// Exclude patterns used when the config doesn't set any
+func defaultExclude() []string {
+	return []string{".git", "build", "node_modules"}
+}
+
+// Returns whether path matches one of the folder's exclude patterns. Patterns without a slash match
+// a file or directory name anywhere in the folder, other patterns match paths relative to the folder's root.
+// Everything inside an excluded directory is excluded too.
+// Paths ignored by the folder's .gitignore are excluded when the gitignore option is set.
+func (f *Folder) excludes(path util.Path) bool {
+	if !isInside(f.Root, path) {
+		return false
+	}
+	rel, err := filepath.Rel(f.Root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+
+	for _, pattern := range f.Config.Exclude {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		hasSlash := strings.Contains(pattern, "/")
+		for i, part := range parts {
+			target := part
+			if hasSlash {
+				target = strings.Join(parts[:i+1], "/")
+			}
+			if matched, _ := filepath.Match(pattern, target); matched {
+				return true
+			}
+		}
+	}
+	return f.gitignored(parts, path)
+}
+
+// Whether path is excluded by the config of the folder it belongs to, or is part of the replica
+func (w *Workspace) isExcluded(path util.Path) bool {
+	if w.replicaDir != "" && isInside(w.replicaDir, path) {
+		return true
+	}
+	return w.folderFor(path).excludes(path)
+}
+
+// Walks the workspace like filepath.Walk, skipping excluded files and directories.
+// Symbolic links are followed when they point inside the workspace, after everything else so that files
+// are visited under their real path when possible. Every file and directory is visited once, so link cycles
+// can't make the walk loop.
+func (w *Workspace) walk(root util.Path, fn filepath.WalkFunc) error {
+	walker := &workspaceWalker{w: w, root: root, fn: fn, visited: make(map[util.Path]bool)}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		real = root
+	}
+	err = walker.walkPath(root, real, true)
+	for len(walker.links) > 0 && (err == nil || err == filepath.SkipDir) {
+		link := walker.links[0]
+		walker.links = walker.links[1:]
+		err = walker.walkPath(link, "", true)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+type workspaceWalker struct {
+	w    *Workspace
+	root util.Path
+	fn   filepath.WalkFunc
+	// Real paths of the files and directories already visited
+	visited map[util.Path]bool
+	// Symbolic links left to follow
+	links []util.Path
+}
+
+// Walks path, whose real path is real. Symbolic links are queued, unless follow is set, and the real path
+// is resolved again for them. Returns filepath.SkipDir only when fn skipped the rest of the parent directory.
+func (ww *workspaceWalker) walkPath(path util.Path, real util.Path, follow bool) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return ww.fn(path, nil, err)
+	}
+	if path != ww.root && ww.w.isExcluded(path) {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		// The root was resolved by walk
+		if path != ww.root {
+			if !follow {
+				ww.links = append(ww.links, path)
+				return nil
+			}
+			var ok bool
+			if real, ok = ww.w.resolveLink(path); !ok {
+				return nil
+			}
+		}
+		if info, err = os.Stat(path); err != nil {
+			return ww.fn(path, nil, err)
+		}
+	}
+	if ww.visited[real] {
+		logging.Logger.Info("Skipping path already visited", "path", path, "real", real)
+		return nil
+	}
+	ww.visited[real] = true
+
+	err = ww.fn(path, info, nil)
+	if !info.IsDir() || err != nil {
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if err = ww.fn(path, info, err); err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		err := ww.walkPath(filepath.Join(path, entry.Name()), filepath.Join(real, entry.Name()), false)
+		if err == filepath.SkipDir {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolves the symbolic link at path. Links that are broken or point outside of every workspace folder
+// aren't followed, as they could lead to huge external trees.
+func (w *Workspace) resolveLink(path util.Path) (util.Path, bool) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		logging.Logger.Info("Skipping broken symbolic link", "path", path, "error", err)
+		return "", false
+	}
+	if !w.insideWorkspace(target) {
+		logging.Logger.Info("Skipping symbolic link pointing outside of the workspace", "path", path, "target", target)
+		return "", false
+	}
+	return target, true
+}
+
+// Whether the real path is inside one of the workspace folders, whose roots may themselves be symbolic links
+func (w *Workspace) insideWorkspace(real util.Path) bool {
+	roots := []util.Path{w.Root}
+	for _, folder := range w.folders() {
+		roots = append(roots, folder.Root)
+	}
+	for _, root := range roots {
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		if root != "" && isInside(root, real) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether path is a symbolic link that the workspace walk wouldn't follow
+func (w *Workspace) skippedLink(path util.Path) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	_, ok := w.resolveLink(path)
+	return !ok
+}
+
+// How the replica copies symbolic links. Relative links inside the workspace still point inside the replica,
+// other links are left out so that nothing outside of the workspace gets copied or written through them.
+func (w *Workspace) replicaLinkAction(src string) cp.SymlinkAction {
+	target, err := os.Readlink(src)
+	if err != nil || filepath.IsAbs(target) {
+		return cp.Skip
+	}
+	if _, ok := w.resolveLink(src); !ok {
+		return cp.Skip
+	}
+	return cp.Shallow
+}
+
+// A pattern of a .gitignore file
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	// Only matches directories
+	dirOnly bool
+	// Matches paths relative to the directory of the .gitignore instead of names
+	anchored bool
+}
+
+// Parses the patterns of a .gitignore file
+func parseGitignore(content []byte) []ignoreRule {
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		// A slash at the beginning or in the middle anchors the pattern
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if rule.pattern != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Reads the .gitignore at the root of the folder
+func loadGitignore(root util.Path) []ignoreRule {
+	content, err := os.ReadFile(filepath.Join(root, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	rules := parseGitignore(content)
+	logging.Logger.Info("Loaded .gitignore", "folder", root, "rules", len(rules))
+	return rules
+}
+
+// Returns whether the path made of parts, relative to the folder root, is ignored by the .gitignore.
+// Like git, files in an ignored directory can't be re-included.
+func (f *Folder) gitignored(parts []string, fullPath util.Path) bool {
+	if !f.Config.Gitignore || len(f.ignore) == 0 {
+		return false
+	}
+	for i := range parts {
+		isDir := i < len(parts)-1
+		if !isDir {
+			fi, err := os.Stat(fullPath)
+			isDir = err == nil && fi.IsDir()
+		}
+		if ignoredBy(f.ignore, parts[:i+1], isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// The last matching rule decides whether a path is ignored
+func ignoredBy(rules []ignoreRule, parts []string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		var matched bool
+		if rule.anchored {
+			matched = matchSegments(strings.Split(rule.pattern, "/"), parts)
+		} else {
+			matched, _ = path.Match(rule.pattern, parts[len(parts)-1])
+		}
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Matches path segments against pattern segments, where ** matches any number of segments
+func matchSegments(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
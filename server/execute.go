@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Commands that clients can run with workspace/executeCommand, keyed by command name
+var executeCommands = map[string]func(context.Context, *Server, []json.RawMessage) (any, error){
+	"faust.checkSelection": CheckSelectionCommand,
+	"faust.compile":        CompileCommand,
+	"faust.docgen":         DocgenCommand,
+	"faust.expand":         ExpandCommand,
+	"faust.extractLibrary": ExtractLibraryCommand,
+	"faust.initConfig":     InitConfigCommand,
+	"faust.updateDocs":     UpdateDocsCommand,
+}
+
+// Names of the commands advertised in executeCommandProvider
+func executeCommandNames() []string {
+	names := []string{}
+	for name := range executeCommands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Handler for workspace/executeCommand
+func ExecuteCommand(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.ExecuteCommandParams
+	json.Unmarshal(par, &params)
+
+	command, ok := executeCommands[params.Command]
+	if !ok {
+		return nil, fmt.Errorf("unknown command: %s", params.Command)
+	}
+	logging.Logger.Info("Executing command", "command", params.Command, "arguments", params.Arguments)
+	result, err := command(ctx, s, params.Arguments)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// Returns the path of the document URI passed as the first argument of a command
+func commandPathArgument(args []json.RawMessage) (util.Path, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing document URI argument")
+	}
+	var uri string
+	if err := json.Unmarshal(args[0], &uri); err != nil {
+		return "", fmt.Errorf("invalid document URI argument: %w", err)
+	}
+	return util.URI2path(uri)
+}
+
+// File extensions of the compiler's output for each target language
+var targetExtensions = map[string]string{
+	"c":      ".c",
+	"cpp":    ".cpp",
+	"cmajor": ".cmajor",
+	"csharp": ".cs",
+	"dlang":  ".d",
+	"interp": ".fbc",
+	"jax":    ".py",
+	"java":   ".java",
+	"julia":  ".jl",
+	"llvm":   ".ll",
+	"rust":   ".rs",
+	"wasm":   ".wasm",
+	"wast":   ".wast",
+}
+
+func targetExtension(target string) string {
+	if ext, ok := targetExtensions[target]; ok {
+		return ext
+	}
+	return "." + target
+}
+
+type CompileResult struct {
+	// Path of the generated file
+	Output util.Path `json:"output"`
+}
+
+// Runs the compiler on the file given as a document URI argument with the target, output directory and
+// extra flags of the folder's config, and returns the path of the generated file
+func CompileCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	path, err := commandPathArgument(args)
+	if err != nil {
+		return nil, err
+	}
+	folder := s.Workspace.folderFor(path)
+	cfg := folder.Config
+	if !s.compilerAvailable(folder.compilerCommand()) {
+		return nil, fmt.Errorf("%s not found in PATH", cfg.Command)
+	}
+
+	outputDir := folder.Rel2Abs(cfg.OutputDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create output directory: %w", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	output := filepath.Join(outputDir, name+targetExtension(cfg.Target))
+
+	includeDirs := folder.includeDirs()
+	if cfg.LibraryDir != "" {
+		includeDirs = append(includeDirs, folder.libraryDir())
+	}
+	cmdArgs := compilerArgs(cfg, path, folder.processName(path), includeDirs, "-lang", cfg.Target, "-o", output)
+	cmdArgs = append(cmdArgs, cfg.ExtraFlags...)
+
+	progress := s.StartProgress(ctx, "Compiling", filepath.Base(path), true)
+	defer progress.End("")
+
+	if errors, err := runCompiler(progress.Context(), cfg, folder.compilerCommand(), cmdArgs, folder.Root, nil); err != nil {
+		if progress.Context().Err() != nil {
+			return nil, fmt.Errorf("compilation cancelled")
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", cfg.Command, err, strings.TrimSpace(errors))
+	}
+	return CompileResult{Output: output}, nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Scheme of the virtual documents showing expanded code
+const expandScheme = "faust-expand"
+
+// Name the selection is defined with when only it is expanded
+const expandProcessName = "faust_expand"
+
+type ExpandResult struct {
+	// Virtual document of the expansion, whose content clients can get with workspace/textDocumentContent
+	URI transport.DocumentURI `json:"uri"`
+	// Expanded Faust code
+	Content string `json:"content"`
+}
+
+// Latest expansion of each document, keyed by the URI of its virtual document
+type expansions struct {
+	mu   sync.Mutex
+	docs map[transport.DocumentURI]string
+}
+
+func (e *expansions) set(uri transport.DocumentURI, content string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.docs == nil {
+		e.docs = make(map[transport.DocumentURI]string)
+	}
+	e.docs[uri] = content
+}
+
+func (e *expansions) get(uri transport.DocumentURI) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	content, ok := e.docs[uri]
+	return content, ok
+}
+
+// URI of the virtual document showing the expansion of the document at uri
+func expansionURI(uri util.URI) transport.DocumentURI {
+	_, rest, _ := strings.Cut(uri, ":")
+	return transport.DocumentURI(expandScheme + ":" + rest)
+}
+
+// Expands the file given as a document URI argument with the compiler's -e option, and returns the resulting
+// Faust code, in which imports, abstractions and pattern matching are resolved. A range can be passed as the
+// second argument to expand only the expression it selects.
+func ExpandCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	path, err := commandPathArgument(args)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return nil, fmt.Errorf("%s is not open", path)
+	}
+	f.mu.RLock()
+	content := string(f.Content)
+	f.mu.RUnlock()
+
+	folder := s.Workspace.folderFor(path)
+	processName := folder.processName(path)
+	if len(args) > 1 {
+		var selection transport.Range
+		if err := json.Unmarshal(args[1], &selection); err != nil {
+			return nil, fmt.Errorf("invalid range argument: %w", err)
+		}
+		start, _ := PositionToOffset(selection.Start, content, string(s.Files.encoding))
+		end, _ := PositionToOffset(selection.End, content, string(s.Files.encoding))
+		expression := strings.TrimSuffix(strings.TrimSpace(content[min(start, end):max(start, end)]), ";")
+		if expression == "" {
+			return nil, fmt.Errorf("nothing selected to expand")
+		}
+		// Definitions of the file stay available to the selected expression
+		content += fmt.Sprintf("\n%s = %s;\n", expandProcessName, expression)
+		processName = expandProcessName
+	}
+
+	if !s.compilerAvailable(folder.compilerCommand()) {
+		return nil, fmt.Errorf("%s not found in PATH", folder.Config.Command)
+	}
+	// The document may have unsaved changes, so its content is expanded from the temporary directory
+	workDir, err := os.MkdirTemp(s.Workspace.tempDir, "expand-")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create working directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	source := filepath.Join(workDir, "expand.dsp")
+	if err := os.WriteFile(source, []byte(content), 0640); err != nil {
+		return nil, fmt.Errorf("couldn't write document: %w", err)
+	}
+
+	cmdArgs := compilerArgs(folder.Config, source, processName, nil, "-e")
+	cmdArgs = append(cmdArgs, s.Workspace.documentIncludeArgs(path, folder)...)
+	cmdArgs = append(cmdArgs, folder.Config.ExtraFlags...)
+
+	progress := s.StartProgress(ctx, "Expanding", filepath.Base(path), true)
+	defer progress.End("")
+
+	var output strings.Builder
+	if errors, err := runCompiler(progress.Context(), folder.Config, folder.compilerCommand(), cmdArgs, workDir, &output); err != nil {
+		if progress.Context().Err() != nil {
+			return nil, fmt.Errorf("expansion cancelled")
+		}
+		return nil, fmt.Errorf("%s failed: %w: %s", folder.Config.Command, err, strings.TrimSpace(errors))
+	}
+
+	uri := expansionURI(util.Path2URI(path))
+	s.expansions.set(uri, output.String())
+	// A virtual document already showing a previous expansion is updated
+	if s.ClientCapabilities.Workspace.TextDocumentContent != nil {
+		if _, err := s.SendRequest("workspace/textDocumentContent/refresh", transport.TextDocumentContentRefreshParams{URI: uri}); err != nil {
+			logging.Logger.Warn("Couldn't refresh expansion", "uri", uri, "error", err)
+		}
+	}
+	return ExpandResult{URI: uri, Content: output.String()}, nil
+}
+
+// Include arguments of the compiler for a copy of the document at path compiled in another directory. Imports relative
+// to the document are found through its directory, before the other include directories.
+func (w *Workspace) documentIncludeArgs(path util.Path, folder *Folder) []string {
+	args := []string{}
+	if !util.IsMemoryPath(path) {
+		dir := filepath.Dir(path)
+		if w.inFolders(dir) && w.replicating() {
+			dir = w.TempDirPath(dir)
+		}
+		args = append(args, "-I", dir)
+	}
+	for _, dir := range w.compilerIncludeDirs(folder) {
+		args = append(args, "-I", dir)
+	}
+	return args
+}
+
+type TextDocumentContentResult struct {
+	Text string `json:"text"`
+}
+
+// Handler for workspace/textDocumentContent, which serves the virtual documents of expansions
+func TextDocumentContent(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.TextDocumentContentParams
+	json.Unmarshal(par, &params)
+
+	content, ok := s.expansions.get(params.URI)
+	if !ok {
+		return nil, fmt.Errorf("no expansion for %s, run faust.expand first", params.URI)
+	}
+	return json.Marshal(TextDocumentContentResult{Text: content})
+}
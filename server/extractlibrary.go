@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// A new library made of definitions selected in a file
+type libraryExtraction struct {
+	path util.Path
+	// Content of the library after its metadata, which is only looked up when it is created
+	body string
+	// Edits of the file the definitions are extracted from, removing them and importing the new library
+	edits []transport.TextEdit
+}
+
+type ExtractLibraryResult struct {
+	// URI of the new library
+	URI transport.DocumentURI `json:"uri"`
+	// Edit of the file the definitions were extracted from. It is applied with workspace/applyEdit when the
+	// client supports it.
+	Edit transport.WorkspaceEdit `json:"edit"`
+}
+
+// Moves the top-level definitions selected by the range given as second argument in the file given as first
+// argument into a new library, named by the optional third argument relative to the file's directory. The library
+// starts with the metadata template.
+// The library is written to disk and analyzed before the file is edited to import it, so that the definitions
+// resolve right away.
+func ExtractLibraryCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	path, err := commandPathArgument(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("missing range argument")
+	}
+	var rng transport.Range
+	if err := json.Unmarshal(args[1], &rng); err != nil {
+		return nil, fmt.Errorf("invalid range argument: %w", err)
+	}
+	name := ""
+	if len(args) > 2 {
+		if err := json.Unmarshal(args[2], &name); err != nil {
+			return nil, fmt.Errorf("invalid library name argument: %w", err)
+		}
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't open", path)
+	}
+
+	extraction, err := planLibraryExtraction(s, f, rng, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(extraction.path); err == nil {
+		return nil, fmt.Errorf("%s already exists", extraction.path)
+	}
+	content := declareBlock(templateMetadata, s.Workspace.metadataDefaults(extraction.path, &s.Store)) + "\n" + extraction.body
+	if err := os.WriteFile(extraction.path, []byte(content), 0644); err != nil {
+		return nil, err
+	}
+
+	// Registered now instead of when the file watcher gets to it, so that the import resolves once the edit is applied
+	s.Files.OpenFromPath(extraction.path)
+	s.Workspace.addFile(extraction.path)
+	if s.Workspace.replicating() {
+		if err := os.WriteFile(s.Workspace.TempDirPath(extraction.path), []byte(content), 0644); err != nil {
+			logging.Logger.Error("Couldn't replicate extracted library", "path", extraction.path, "error", err)
+		}
+	}
+	if library, ok := s.Files.GetFromPath(extraction.path); ok {
+		s.Workspace.AnalyzeFile(library, &s.Store)
+	}
+
+	uri := transport.DocumentURI(util.Path2URI(path))
+	edit := transport.WorkspaceEdit{Changes: map[transport.DocumentURI][]transport.TextEdit{uri: extraction.edits}}
+	if s.ClientCapabilities.Workspace.ApplyEdit {
+		label := "Extract to " + filepath.Base(extraction.path)
+		if _, err := s.SendRequest("workspace/applyEdit", transport.ApplyWorkspaceEditParams{Label: label, Edit: edit}); err != nil {
+			logging.Logger.Error("Couldn't apply extraction edit", "path", path, "error", err)
+		}
+	}
+	return ExtractLibraryResult{URI: transport.DocumentURI(util.Path2URI(extraction.path)), Edit: edit}, nil
+}
+
+// Offers to extract the definitions selected by rng to a new library named after the file
+func extractLibraryAction(s *Server, f *File, rng transport.Range) (transport.CodeAction, bool) {
+	extraction, err := planLibraryExtraction(s, f, rng, "")
+	if err != nil {
+		return transport.CodeAction{}, false
+	}
+	f.mu.RLock()
+	uri := f.Handle.URI
+	f.mu.RUnlock()
+	name := filepath.Base(extraction.path)
+	arguments := []json.RawMessage{}
+	for _, arg := range []any{uri, rng, name} {
+		content, _ := json.Marshal(arg)
+		arguments = append(arguments, content)
+	}
+	title := "Extract to " + name
+	return transport.CodeAction{
+		Title: title,
+		Kind:  transport.RefactorExtract,
+		Command: &transport.Command{
+			Title:     title,
+			Command:   "faust.extractLibrary",
+			Arguments: arguments,
+		},
+	}, true
+}
+
+// Works out the library made of the top-level definitions overlapping rng and the edits of f extracting them.
+// The library imports what f imports. Library bindings of f the definitions
+// use are copied, references to other definitions of f make the extraction fail as they wouldn't resolve.
+// The library is named name, or after f if name is empty.
+func planLibraryExtraction(s *Server, f *File, rng transport.Range, name string) (libraryExtraction, error) {
+	f.mu.RLock()
+	path := f.Handle.Path
+	f.mu.RUnlock()
+	if util.IsMemoryPath(path) {
+		return libraryExtraction{}, errors.New("untitled documents have no directory to create the library in")
+	}
+	snap := s.Workspace.snapshot(f, &s.Store)
+	if snap.Scope == nil {
+		return libraryExtraction{}, fmt.Errorf("%s couldn't be analyzed", path)
+	}
+	encoding := string(s.Files.encoding)
+	selectionStart, err := PositionToOffset(rng.Start, string(snap.Content), encoding)
+	if err != nil {
+		return libraryExtraction{}, err
+	}
+	selectionEnd, err := PositionToOffset(rng.End, string(snap.Content), encoding)
+	if err != nil {
+		return libraryExtraction{}, err
+	}
+	if selectionStart == selectionEnd {
+		return libraryExtraction{}, errors.New("no definitions selected")
+	}
+
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return libraryExtraction{}, parser.ErrIncompatibleGrammar
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+
+	// Top-level statements overlapping the selection, which must all be definitions
+	names := []string{}
+	var start, end uint
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() == "comment" || node.EndByte() <= selectionStart || node.StartByte() >= selectionEnd {
+			continue
+		}
+		ident := definitionName(node)
+		if ident == nil {
+			return libraryExtraction{}, errors.New("only definitions can be extracted")
+		}
+		nodeStart, nodeEnd := definitionBounds(node, snap.Content)
+		if len(names) == 0 {
+			start = nodeStart
+		}
+		end = nodeEnd
+		names = append(names, ident.Utf8Text(snap.Content))
+	}
+	if len(names) == 0 {
+		return libraryExtraction{}, errors.New("no definitions selected")
+	}
+	process := s.Workspace.folderFor(path).processName(path)
+	for _, name := range names {
+		if name == process {
+			return libraryExtraction{}, fmt.Errorf("%s can't be extracted", process)
+		}
+		// Rules of a pattern matching function can't be split
+		for _, node := range topLevelDefinitions(root, snap.Content, name) {
+			if node.StartByte() < start || node.EndByte() > end {
+				return libraryExtraction{}, fmt.Errorf("%s has rules outside of the selection", name)
+			}
+		}
+	}
+
+	// Imports and library bindings the extracted definitions may use
+	header := []string{}
+	for i := range root.NamedChildCount() {
+		if node := root.NamedChild(i); node.GrammarName() == "file_import" {
+			header = append(header, node.Utf8Text(snap.Content))
+		}
+	}
+	extracted := []*tree_sitter.Node{}
+	for i := range root.NamedChildCount() {
+		if node := root.NamedChild(i); node.StartByte() >= start && node.EndByte() <= end && definitionName(node) != nil {
+			extracted = append(extracted, node)
+		}
+	}
+	for _, node := range extracted {
+		for _, ident := range referencedIdentifiers(node, snap.Content) {
+			// Accesses like fx.echo go through the environment they start with, e.g. a library binding
+			text, _, _ := strings.Cut(ident.Utf8Text(snap.Content), ".")
+			sym, err := FindSymbolDefinition(text, FindLowestScopeContainingRange(snap.Scope, ToRange(ident)), &s.Store)
+			if err != nil || sym.Loc.File != path || slices.ContainsFunc(extracted, func(n *tree_sitter.Node) bool {
+				return RangeContains(ToRange(n), sym.Loc.Range)
+			}) {
+				continue
+			}
+			binding, ok := libraryBindingAt(root, snap.Content, sym.Loc.Range)
+			if !ok {
+				return libraryExtraction{}, fmt.Errorf("%s refers to %s, which isn't extracted", definitionName(node).Utf8Text(snap.Content), sym.Ident)
+			}
+			if !slices.Contains(header, binding) {
+				header = append(header, binding)
+			}
+		}
+	}
+
+	if name == "" {
+		name = newLibraryName(path)
+	}
+	libraryPath := filepath.Join(filepath.Dir(path), name)
+
+	var body strings.Builder
+	if len(header) > 0 {
+		body.WriteString(strings.Join(header, "\n") + "\n\n")
+	}
+	body.WriteString(strings.TrimRight(string(snap.Content[start:end]), "\n") + "\n")
+	end = withBlankLine(snap.Content, start, end)
+
+	rel := filepath.ToSlash(name)
+	imported := fmt.Sprintf("import(%s);\n", strconv.Quote(rel))
+	return libraryExtraction{
+		path:  libraryPath,
+		body:  body.String(),
+		edits: removeAndInsert(snap.Content, start, end, bindingOffset(root, snap.Content, start), imported, encoding),
+	}, nil
+}
+
+// Text of the top-level library binding, e.g. fx = library("effects.lib");, defined at rng
+func libraryBindingAt(root *tree_sitter.Node, content []byte, rng transport.Range) (string, bool) {
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() != "definition" {
+			continue
+		}
+		variable, value := node.ChildByFieldName("variable"), node.ChildByFieldName("value")
+		if variable == nil || value == nil || value.GrammarName() != "library" || !RangeContains(ToRange(node), rng) {
+			continue
+		}
+		return node.Utf8Text(content) + ";", true
+	}
+	return "", false
+}
+
+// File name of a library extracted from the file at path that doesn't exist yet, e.g. synth.lib for synth.dsp
+func newLibraryName(path util.Path) string {
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	name := stem + ".lib"
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), name)); os.IsNotExist(err) {
+			return name
+		}
+		name = stem + strconv.Itoa(i) + ".lib"
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+)
+
+// Switches to disable individual features. Compiler diagnostics are toggled with compiler_diagnostics.
+type FeaturesConfig struct {
+	Completion bool `json:"completion"`
+	Formatting bool `json:"formatting"`
+	Hover      bool `json:"hover"`
+	InlayHints bool `json:"inlay_hints"`
+	CodeLens   bool `json:"code_lens"`
+}
+
+func defaultFeaturesConfig() FeaturesConfig {
+	return FeaturesConfig{
+		Completion: true,
+		Formatting: true,
+		Hover:      true,
+		InlayHints: true,
+		CodeLens:   true,
+	}
+}
+
+// A feature that can be toggled in the config, or that can only be registered dynamically
+type feature struct {
+	method  string
+	enabled func(FeaturesConfig) bool
+	// Whether the client can register the feature dynamically
+	dynamic func(transport.ClientCapabilities) bool
+	// Advertises the feature in the capabilities sent in the initialize response
+	advertise func(*transport.ServerCapabilities)
+	// Options sent with client/registerCapability
+	options map[string]any
+}
+
+var faustDocumentSelector = []map[string]string{
+	{"language": "faust"},
+	{"pattern": "**/*.{dsp,lib}"},
+}
+
+var features = []feature{
+	{
+		method:  "textDocument/completion",
+		enabled: func(f FeaturesConfig) bool { return f.Completion },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.TextDocument.Completion.DynamicRegistration
+		},
+		advertise: func(c *transport.ServerCapabilities) {
+			c.CompletionProvider = &transport.CompletionOptions{
+				TriggerCharacters: []string{"."},
+			}
+		},
+		options: map[string]any{"documentSelector": faustDocumentSelector, "triggerCharacters": []string{"."}},
+	},
+	{
+		method:  "textDocument/formatting",
+		enabled: func(f FeaturesConfig) bool { return f.Formatting },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.TextDocument.Formatting != nil && c.TextDocument.Formatting.DynamicRegistration
+		},
+		advertise: func(c *transport.ServerCapabilities) {
+			c.DocumentFormattingProvider = &transport.Or_ServerCapabilities_documentFormattingProvider{Value: true}
+		},
+		options: map[string]any{"documentSelector": faustDocumentSelector},
+	},
+	{
+		method:  "textDocument/onTypeFormatting",
+		enabled: func(f FeaturesConfig) bool { return f.Formatting },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.TextDocument.OnTypeFormatting != nil && c.TextDocument.OnTypeFormatting.DynamicRegistration
+		},
+		advertise: func(c *transport.ServerCapabilities) {
+			c.DocumentOnTypeFormattingProvider = &transport.DocumentOnTypeFormattingOptions{FirstTriggerCharacter: ";", MoreTriggerCharacter: []string{"}"}}
+		},
+		options: map[string]any{"documentSelector": faustDocumentSelector, "firstTriggerCharacter": ";", "moreTriggerCharacter": []string{"}"}},
+	},
+	{
+		method:  "textDocument/hover",
+		enabled: func(f FeaturesConfig) bool { return f.Hover },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.TextDocument.Hover != nil && c.TextDocument.Hover.DynamicRegistration
+		},
+		advertise: func(c *transport.ServerCapabilities) {
+			c.HoverProvider = &transport.Or_ServerCapabilities_hoverProvider{Value: true}
+		},
+		options: map[string]any{"documentSelector": faustDocumentSelector},
+	},
+	{
+		method:  "textDocument/inlayHint",
+		enabled: func(f FeaturesConfig) bool { return f.InlayHints },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.TextDocument.InlayHint != nil && c.TextDocument.InlayHint.DynamicRegistration
+		},
+		advertise: func(c *transport.ServerCapabilities) {
+			c.InlayHintProvider = true
+		},
+		options: map[string]any{"documentSelector": faustDocumentSelector},
+	},
+	{
+		method:  "textDocument/codeLens",
+		enabled: func(f FeaturesConfig) bool { return f.CodeLens },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.TextDocument.CodeLens != nil && c.TextDocument.CodeLens.DynamicRegistration
+		},
+		advertise: func(c *transport.ServerCapabilities) {
+			c.CodeLensProvider = &transport.CodeLensOptions{ResolveProvider: true}
+		},
+		options: map[string]any{"documentSelector": faustDocumentSelector, "resolveProvider": true},
+	},
+	{
+		// Clients watch the files for the server, on top of its own watcher
+		method:  "workspace/didChangeWatchedFiles",
+		enabled: func(f FeaturesConfig) bool { return true },
+		dynamic: func(c transport.ClientCapabilities) bool {
+			return c.Workspace.DidChangeWatchedFiles.DynamicRegistration
+		},
+		// There is no static capability for it
+		advertise: func(c *transport.ServerCapabilities) {},
+		options: map[string]any{"watchers": []map[string]string{
+			{"globPattern": "**/*.dsp"},
+			{"globPattern": "**/*.lib"},
+			{"globPattern": "**/" + faustConfigFile},
+		}},
+	},
+}
+
+// Features currently registered dynamically with the client
+type registrations struct {
+	mu         sync.Mutex
+	registered map[string]bool
+}
+
+// Advertises the features enabled in cfg. Features the client can register dynamically are registered
+// after initialization instead, so that they can be unregistered when the config changes.
+func advertiseFeatures(capabilities *transport.ServerCapabilities, client transport.ClientCapabilities, cfg FaustProjectConfig) {
+	for _, f := range features {
+		if !f.dynamic(client) && f.enabled(cfg.Features) {
+			f.advertise(capabilities)
+		}
+	}
+}
+
+// Reads the config of the workspace at root before the workspace is loaded, to choose the capabilities to advertise
+func (w *Workspace) initialConfig(root string) FaustProjectConfig {
+	content, _ := os.ReadFile(filepath.Join(root, faustConfigFile))
+	cfg, _ := w.mergeConfig(root, append([]json.RawMessage{content}, w.client.layers()...)...)
+	return cfg
+}
+
+// Registers or unregisters the dynamically registered features according to the current config
+func (s *Server) updateRegistrations() {
+	if s.Status != Running {
+		return
+	}
+	cfg := s.Workspace.rootConfig().Features
+
+	register := []transport.Registration{}
+	unregister := []transport.Unregistration{}
+	s.registrations.mu.Lock()
+	if s.registrations.registered == nil {
+		s.registrations.registered = make(map[string]bool)
+	}
+	for _, f := range features {
+		if !f.dynamic(s.ClientCapabilities) {
+			continue
+		}
+		enabled := f.enabled(cfg)
+		if enabled && !s.registrations.registered[f.method] {
+			register = append(register, transport.Registration{ID: f.method, Method: f.method, RegisterOptions: f.options})
+		} else if !enabled && s.registrations.registered[f.method] {
+			unregister = append(unregister, transport.Unregistration{ID: f.method, Method: f.method})
+		}
+		s.registrations.registered[f.method] = enabled
+	}
+	s.registrations.mu.Unlock()
+
+	if len(register) > 0 {
+		logging.Logger.Info("Registering features", "registrations", register)
+		if _, err := s.SendRequest("client/registerCapability", transport.RegistrationParams{Registrations: register}); err != nil {
+			logging.Logger.Error("Couldn't register features", "error", err)
+		}
+	}
+	if len(unregister) > 0 {
+		logging.Logger.Info("Unregistering features", "unregistrations", unregister)
+		if _, err := s.SendRequest("client/unregisterCapability", transport.UnregistrationParams{Unregisterations: unregister}); err != nil {
+			logging.Logger.Error("Couldn't unregister features", "error", err)
+		}
+	}
+}
+
+// Wraps the handler of a feature so that it returns null while the feature is disabled.
+// Clients that can't unregister the feature may still send requests for it.
+func withFeature(enabled func(FeaturesConfig) bool, handler func(context.Context, *Server, json.RawMessage) (json.RawMessage, error)) func(context.Context, *Server, json.RawMessage) (json.RawMessage, error) {
+	return func(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+		if !enabled(s.Workspace.rootConfig().Features) {
+			return json.Marshal(nil)
+		}
+		return handler(ctx, s, par)
+	}
+}
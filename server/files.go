@@ -1,13 +1,15 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
 	"log/slog"
 	"os"
-
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/parser"
@@ -29,12 +31,18 @@ type File struct {
 
 	// Hash for each file. Used for caching scopes.
 	Hash [sha256.Size]byte
+	// Hash of the content Scope was parsed from. Its cache entry is dropped once the file is analyzed again.
+	scopeHash [sha256.Size]byte
+	// Time the last parse and analysis of Content took, without its imports. Scopes found in the cache keep it.
+	analysisDuration time.Duration
 
-	// TODO: Shift away from using this in diagnostics checking step
-	hasSyntaxErrors bool
+	// Version of the document sent by the editor, 0 if the editor doesn't have the file open
+	Version int32
 }
 
 func (f *File) LogValue() slog.Value {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	// Create a map with all file attributes
 	fileAttrs := map[string]any{
 		"Handle": f.Handle,
@@ -49,30 +57,37 @@ func (f *File) DocumentSymbols() []transport.DocumentSymbol {
 	defer f.mu.RUnlock()
 
 	t := parser.ParseTree(f.Content)
+	if t == nil {
+		return []transport.DocumentSymbol{}
+	}
 	defer t.Close()
+	if filepath.Ext(f.Handle.Path) == ".lib" {
+		return parser.SectionSymbols(parser.DocumentSymbols(t, f.Content), f.Content)
+	}
 	return parser.DocumentSymbols(t, f.Content)
 	//	return []transport.DocumentSymbol{}
 }
 
 func (f *File) TSDiagnostics() transport.PublishDiagnosticsParams {
-	logging.Logger.Info("Waiting for lock", "file", f.Handle.Path)
-	f.mu.Lock()
+	d, _ := f.syntaxDiagnostics()
+	return d
+}
 
-	logging.Logger.Info("Got lock", "file", f.Handle.Path)
-	t := parser.ParseTree(f.Content)
+// Syntax diagnostics along with the hash of the content they were found in
+func (f *File) syntaxDiagnostics() (transport.PublishDiagnosticsParams, [sha256.Size]byte) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 
-	errors := parser.TSDiagnostics(f.Content, t)
-	if len(errors) == 0 {
-		f.hasSyntaxErrors = false
-	} else {
-		f.hasSyntaxErrors = true
+	t := parser.ParseTree(f.Content)
+	if t != nil {
+		defer t.Close()
 	}
 	d := transport.PublishDiagnosticsParams{
 		URI:         transport.DocumentURI(f.Handle.URI),
-		Diagnostics: errors,
+		Version:     f.Version,
+		Diagnostics: parser.TSDiagnostics(f.Content, t),
 	}
-	f.mu.Unlock()
-	return d
+	return d, f.Hash
 }
 
 type Files struct {
@@ -107,6 +122,10 @@ func (files *Files) Open(handle util.Handle) {
 		logging.Logger.Info("File already in store", "handle.Path", handle.Path)
 		return
 	}
+	// Only the editor has the content of documents that aren't on disk
+	if util.IsMemoryPath(handle.Path) {
+		return
+	}
 	logging.Logger.Info("Reading contents of file", "handle.Path", handle.Path)
 
 	content, err := os.ReadFile(handle.Path)
@@ -118,6 +137,7 @@ func (files *Files) Open(handle util.Handle) {
 		}
 	}
 
+	content = withoutBOM(content)
 	var file = File{
 		Handle:  handle,
 		Content: content,
@@ -129,6 +149,13 @@ func (files *Files) Open(handle util.Handle) {
 	files.mu.Unlock()
 }
 
+// Content without the byte order mark it may start with. Editors don't show it,
+// while tree-sitter and the compiler would count it as part of the first line and
+// shift every range on it.
+func withoutBOM(content []byte) []byte {
+	return bytes.TrimPrefix(content, []byte(utf8BOM))
+}
+
 func (files *Files) AddFromURI(uri util.URI, content []byte) {
 	handle, err := util.FromURI(uri)
 	if err != nil {
@@ -138,6 +165,7 @@ func (files *Files) AddFromURI(uri util.URI, content []byte) {
 }
 
 func (files *Files) Add(handle util.Handle, content []byte) {
+	content = withoutBOM(content)
 	var file = File{
 		Handle: handle, Content: content, Hash: sha256.Sum256(content),
 	}
@@ -186,40 +214,62 @@ func (files *Files) ModifyFull(path util.Path, content string) {
 	f, ok := files.GetFromPath(path)
 	if !ok {
 		logging.Logger.Error("file to modify not in file store", "path", path)
-		files.mu.Unlock()
 		return
 	}
 
 	files.mu.Lock()
 	f.mu.Lock()
-	f.Content = []byte(content)
+	f.Content = withoutBOM([]byte(content))
 	f.Hash = sha256.Sum256(f.Content)
 	f.mu.Unlock()
 
 	files.mu.Unlock()
 }
 
-func (files *Files) ModifyIncremental(path util.Path, changeRange transport.Range, content string) {
-	logging.Logger.Info("Applying Incremental Change", "path", path)
-
+// Applies the changes of a version of the document at path. The version is checked and the changes are applied in
+// one critical section, so that no other change comes in between. Changes without a range replace the whole content.
+// Returns false if the version isn't newer than the current one, in which case the changes are ignored.
+func (files *Files) ApplyChanges(path util.Path, version int32, changes []transport.TextDocumentContentChangeEvent) bool {
 	f, ok := files.GetFromPath(path)
 	if !ok {
 		logging.Logger.Error("file to modify not in file store", "path", path)
-		files.mu.Unlock()
-		return
+		return true
 	}
-	result := ApplyIncrementalChange(changeRange, content, string(f.Content), string(files.encoding))
-	//	logging.Logger.Info("Before/After Incremental Change", "before", string(f.Content), "after", result)
-	logging.Logger.Info("Incremental Change Parameters ", "range", changeRange, "content", content)
-	logging.Logger.Info("Before/After Incremental Change", "before", string(f.Content), "after", result)
-
-	files.mu.Lock()
 	f.mu.Lock()
-	f.Content = []byte(result)
+	defer f.mu.Unlock()
+	if !f.updateVersion(version) {
+		return false
+	}
+	content := f.Content
+	for _, change := range changes {
+		if change.Range == nil {
+			content = withoutBOM([]byte(change.Text))
+			continue
+		}
+		logging.Logger.Info("Incremental Change Parameters ", "range", change.Range, "content", change.Text)
+		content = []byte(ApplyIncrementalChange(*change.Range, change.Text, string(content), string(files.encoding)))
+	}
+	f.Content = withoutBOM(content)
 	f.Hash = sha256.Sum256(f.Content)
-	f.mu.Unlock()
+	return true
+}
 
-	files.mu.Unlock()
+// Replaces the content of the document at path with its saved text, unless they are the same. Returns whether the
+// content was replaced.
+func (files *Files) resync(path util.Path, text string) bool {
+	f, ok := files.GetFromPath(path)
+	if !ok {
+		return false
+	}
+	saved := withoutBOM([]byte(text))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if bytes.Equal(f.Content, saved) {
+		return false
+	}
+	f.Content = saved
+	f.Hash = sha256.Sum256(f.Content)
+	return true
 }
 
 func (files *Files) CloseFromURI(uri util.URI) {
@@ -245,10 +295,50 @@ func (files *Files) Close(handle util.Handle) {
 		return
 	}
 	f.mu.Lock()
+	// The file now follows the disk again
+	f.Version = 0
 	f.mu.Unlock()
 	files.mu.Unlock()
 }
 
+// Records the version of the document at path sent by the editor. Returns false if the version isn't newer
+// than the current one, in which case the change is a duplicate or arrived out of order and must be ignored.
+func (files *Files) UpdateVersion(path util.Path, version int32) bool {
+	f, ok := files.GetFromPath(path)
+	if !ok {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.updateVersion(version)
+}
+
+// Records version unless it isn't newer than the current one. f.mu must be held.
+func (f *File) updateVersion(version int32) bool {
+	if f.Version != 0 && version <= f.Version {
+		return false
+	}
+	f.Version = version
+	return true
+}
+
+// Moves the file at oldPath to newPath, keeping its content
+func (files *Files) Rename(oldPath util.Path, newPath util.Path) {
+	oldHandle := util.FromPath(oldPath)
+	newHandle := util.FromPath(newPath)
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	f, ok := files.fs[oldHandle]
+	if !ok {
+		return
+	}
+	delete(files.fs, oldHandle)
+	f.mu.Lock()
+	f.Handle = newHandle
+	f.mu.Unlock()
+	files.fs[newHandle] = f
+}
+
 func (files *Files) RemoveFromPath(path util.Path) {
 	handle := util.FromPath(path)
 	files.mu.Lock()
@@ -269,6 +359,17 @@ func (files *Files) Remove(handle util.Handle) {
 	files.mu.Unlock()
 }
 
+// Returns every file in the store, so that they can be locked one at a time without holding the store's lock
+func (files *Files) list() []*File {
+	files.mu.Lock()
+	defer files.mu.Unlock()
+	list := make([]*File, 0, len(files.fs))
+	for _, f := range files.fs {
+		list = append(list, f)
+	}
+	return list
+}
+
 func (files *Files) String() string {
 	str := ""
 	for handle := range files.fs {
@@ -280,16 +381,21 @@ func (files *Files) String() string {
 }
 
 func (files *Files) LogValue() slog.Value {
-	fs := make([]any, 0, len(files.fs))
 	files.mu.Lock()
-	defer files.mu.Unlock()
-
+	faustFiles := make([]*File, 0, len(files.fs))
 	for handle, file := range files.fs {
 		if IsFaustFile(handle.Path) {
-			// Use each file's LogValue method to get its proper representation
-			fileValue := file.LogValue()
-			fs = append(fs, fileValue.Any())
+			faustFiles = append(faustFiles, file)
 		}
 	}
+	// Files are locked one at a time after the store, which may be needed while a file is locked
+	files.mu.Unlock()
+
+	fs := make([]any, 0, len(faustFiles))
+	for _, file := range faustFiles {
+		// Use each file's LogValue method to get its proper representation
+		fileValue := file.LogValue()
+		fs = append(fs, fileValue.Any())
+	}
 	return slog.AnyValue(fs)
 }
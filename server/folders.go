@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// A workspace folder with its own .faustcfg.json.
+// In multi-root setups, compiler settings of a file come from the folder the file belongs to.
+type Folder struct {
+	Root   util.Path
+	Config FaustProjectConfig
+	// Rules of the folder's .gitignore, loaded when Config.Gitignore is set
+	ignore []ignoreRule
+}
+
+// Makes a path from the folder's config absolute. Relative paths are relative to the folder's root.
+func (f *Folder) Rel2Abs(path string) util.Path {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(f.Root, path)
+}
+
+// Returns whether path is root or inside it
+func isInside(root util.Path, path util.Path) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (w *Workspace) folders() []*Folder {
+	w.foldersMu.RLock()
+	defer w.foldersMu.RUnlock()
+	folders := []*Folder{}
+	for _, f := range w.Folders {
+		folder := *f
+		folders = append(folders, &folder)
+	}
+	return folders
+}
+
+// Config of the folder at the workspace root, which is reloaded while other goroutines read it
+func (w *Workspace) rootConfig() FaustProjectConfig {
+	w.foldersMu.RLock()
+	defer w.foldersMu.RUnlock()
+	return w.Config
+}
+
+// Returns a copy of the innermost folder that contains path.
+// Documents opened outside of every folder belong to a folder at their directory, other paths outside of
+// every folder (e.g. system libraries) belong to the folder at the workspace root.
+func (w *Workspace) folderFor(path util.Path) *Folder {
+	w.foldersMu.RLock()
+	defer w.foldersMu.RUnlock()
+
+	var found *Folder
+	for _, folder := range w.Folders {
+		if isInside(folder.Root, path) && (found == nil || len(folder.Root) > len(found.Root)) {
+			found = folder
+		}
+	}
+	if found == nil {
+		for _, external := range w.external {
+			if isInside(external.folder.Root, path) && (found == nil || len(external.folder.Root) > len(found.Root)) {
+				found = external.folder
+			}
+		}
+	}
+	if found == nil {
+		for _, folder := range w.Folders {
+			if folder.Root == w.Root {
+				found = folder
+			}
+		}
+	}
+	if found == nil {
+		return &Folder{Root: w.Root, Config: w.Config}
+	}
+	folder := *found
+	return &folder
+}
+
+// Config of the folder that path belongs to
+func (w *Workspace) ConfigFor(path util.Path) FaustProjectConfig {
+	return w.folderFor(path).Config
+}
+
+// Makes sure the workspace root is one of the folders, as clients without multi-root support only send the root
+func (w *Workspace) addRootFolder() {
+	w.foldersMu.Lock()
+	defer w.foldersMu.Unlock()
+	for _, folder := range w.Folders {
+		if folder.Root == w.Root {
+			return
+		}
+	}
+	w.Folders = append(w.Folders, &Folder{Root: w.Root})
+}
+
+// A folder for documents opened outside of the workspace. Imports are resolved from the documents' directory,
+// and the documents are compiled on their own unless a config file in that directory sets process files.
+type externalFolder struct {
+	folder *Folder
+	// Documents of the folder open in the editor
+	open map[util.Path]bool
+	// Whether the process files are the open .dsp documents
+	implicitProcessFiles bool
+}
+
+// Whether path is outside of the workspace root and of every workspace folder
+func (w *Workspace) isExternal(path util.Path) bool {
+	return !util.IsMemoryPath(path) && !w.inFolders(path)
+}
+
+// Whether path is inside the workspace root or one of the workspace folders
+func (w *Workspace) inFolders(path util.Path) bool {
+	if isInside(w.Root, path) {
+		return true
+	}
+	for _, folder := range w.folders() {
+		if isInside(folder.Root, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether path is the root of a workspace folder
+func (w *Workspace) isFolderRoot(path util.Path) bool {
+	for _, folder := range w.folders() {
+		if folder.Root == path {
+			return true
+		}
+	}
+	return path == w.Root
+}
+
+// Registers a document opened in the editor if it is outside of the workspace. Returns whether it is.
+func (w *Workspace) openExternal(path util.Path) bool {
+	if !w.isExternal(path) {
+		return false
+	}
+	dir := filepath.Dir(path)
+	// Read before locking, the config file of the directory takes precedence over the defaults
+	cfg := w.initialConfig(dir)
+
+	w.foldersMu.Lock()
+	defer w.foldersMu.Unlock()
+	if w.external == nil {
+		w.external = make(map[util.Path]*externalFolder)
+	}
+	external, ok := w.external[dir]
+	if !ok {
+		external = &externalFolder{
+			folder:               &Folder{Root: dir, Config: cfg},
+			open:                 make(map[util.Path]bool),
+			implicitProcessFiles: len(cfg.ProcessFiles) == 0,
+		}
+		w.external[dir] = external
+		logging.Logger.Info("Opened document outside of the workspace", "path", path, "folder", dir)
+	}
+	external.open[path] = true
+	external.updateProcessFiles()
+	return true
+}
+
+// Unregisters a document outside of the workspace closed in the editor, and its folder once no document
+// of it is open anymore. Returns whether the document was outside of the workspace.
+func (w *Workspace) closeExternal(path util.Path) bool {
+	w.foldersMu.Lock()
+	defer w.foldersMu.Unlock()
+	external, ok := w.external[filepath.Dir(path)]
+	if !ok || !external.open[path] {
+		return false
+	}
+	delete(external.open, path)
+	if len(external.open) == 0 {
+		delete(w.external, filepath.Dir(path))
+	} else {
+		external.updateProcessFiles()
+	}
+	return true
+}
+
+func (e *externalFolder) updateProcessFiles() {
+	if !e.implicitProcessFiles {
+		return
+	}
+	files := []util.Path{}
+	for path := range e.open {
+		if IsDSPFile(path) {
+			files = append(files, filepath.Base(path))
+		}
+	}
+	slices.Sort(files)
+	e.folder.Config.ProcessFiles = files
+}
+
+// Sets the workspace folders sent by the client in initialize
+func (w *Workspace) setFolders(folders []transport.WorkspaceFolder) {
+	w.foldersMu.Lock()
+	defer w.foldersMu.Unlock()
+	w.Folders = []*Folder{}
+	for _, folder := range folders {
+		root, err := util.URI2path(string(folder.URI))
+		if err != nil {
+			logging.Logger.Error("Invalid workspace folder", "uri", folder.URI, "error", err)
+			continue
+		}
+		w.Folders = append(w.Folders, &Folder{Root: root})
+	}
+}
+
+// Sets the config of folder along with the ignore rules it enables, and returns the updated folder. Folders are
+// replaced rather than modified, so that the ones other goroutines got from folders() or folderFor can still be read.
+func (w *Workspace) setFolderConfig(folder *Folder, cfg FaustProjectConfig) *Folder {
+	updated := &Folder{Root: folder.Root, Config: cfg}
+	if cfg.Gitignore {
+		updated.ignore = loadGitignore(folder.Root)
+	}
+	w.foldersMu.Lock()
+	defer w.foldersMu.Unlock()
+	for i, f := range w.Folders {
+		if f.Root == folder.Root {
+			w.Folders[i] = updated
+		}
+	}
+	if folder.Root == w.Root {
+		w.Config = cfg
+	}
+	return updated
+}
+
+// Handler for workspace/didChangeWorkspaceFolders
+func WorkspaceFoldersChange(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.DidChangeWorkspaceFoldersParams
+	json.Unmarshal(par, &params)
+
+	w := &s.Workspace
+	w.foldersMu.Lock()
+	removed := []util.Path{}
+	for _, folder := range params.Event.Removed {
+		root, err := util.URI2path(string(folder.URI))
+		if err != nil {
+			continue
+		}
+		for i, folder := range w.Folders {
+			if folder.Root == root {
+				w.Folders = append(w.Folders[:i], w.Folders[i+1:]...)
+				removed = append(removed, root)
+				break
+			}
+		}
+	}
+	added := []*Folder{}
+	for _, folder := range params.Event.Added {
+		root, err := util.URI2path(string(folder.URI))
+		if err != nil {
+			continue
+		}
+		added = append(added, &Folder{Root: root})
+	}
+	w.Folders = append(w.Folders, added...)
+	w.foldersMu.Unlock()
+
+	for _, root := range removed {
+		logging.Logger.Info("Removed workspace folder", "folder", root)
+	}
+	for _, folder := range added {
+		logging.Logger.Info("Added workspace folder", "folder", folder.Root)
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		// Removed folders are forgotten first, so that a folder removed and added again is indexed again.
+		// Indexing loads the configs once the folders' files are known.
+		s.background.Go(func(ctx context.Context) {
+			for _, root := range removed {
+				w.forgetFolder(s, root)
+			}
+			if len(added) > 0 {
+				w.indexFolders(ctx, s, added)
+			}
+		})
+	}
+	return nil
+}
+
+// Forgets the files of a folder removed from the workspace and clears their diagnostics, then stops watching and
+// replicating it. Paths still inside the workspace root or another folder are kept. Documents open in the editor are
+// kept too, as documents outside of the workspace.
+func (w *Workspace) forgetFolder(s *Server, root util.Path) {
+	if w.inFolders(root) {
+		return
+	}
+	w.mu.Lock()
+	files := slices.Clone(w.Files)
+	watcher := w.watcher
+	w.mu.Unlock()
+
+	paths := []util.Path{}
+	for _, path := range files {
+		if !isInside(root, path) || w.inFolders(path) {
+			continue
+		}
+		if f, ok := s.Files.GetFromPath(path); ok {
+			f.mu.RLock()
+			open := f.Version != 0
+			f.mu.RUnlock()
+			if open {
+				w.removeFile(path)
+				w.openExternal(path)
+				continue
+			}
+		}
+		paths = append(paths, path)
+	}
+	importers := w.deleteFiles(paths, s)
+
+	if watcher != nil {
+		for _, path := range watcher.WatchList() {
+			if isInside(root, path) && !w.inFolders(path) {
+				watcher.Remove(path)
+			}
+		}
+	}
+	if w.replicating() {
+		nested := false
+		for _, folder := range w.folders() {
+			nested = nested || isInside(root, folder.Root)
+		}
+		// The replicas of folders inside the removed one are still used
+		if nested {
+			for _, path := range paths {
+				os.Remove(w.TempDirPath(path))
+			}
+		} else {
+			os.RemoveAll(w.TempDirPath(root))
+		}
+	}
+	w.reanalyzeImporters(importers, s)
+}
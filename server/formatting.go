@@ -7,14 +7,18 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
 	"github.com/carn181/faustlsp/util"
 )
 
-func Format(content []byte, indent string) ([]byte, error) {
+// Formats content with faustfmt. Cancelling ctx or running for longer than
+// timeout kills faustfmt, a timeout of 0 lets it run until ctx is done.
+func Format(ctx context.Context, content []byte, indent string, timeout time.Duration) ([]byte, error) {
 	// TODO: Allow to take faustExec and customQueryFile from config file
 	faustExec := "faustfmt"
 
@@ -24,16 +28,31 @@ func Format(content []byte, indent string) ([]byte, error) {
 		return []byte{}, errors.New("Couldn't find " + faustExec + " in PATH")
 	}
 
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// Setup faustfmt command with input
 	var errs strings.Builder
 	var output bytes.Buffer
-	cmd := exec.Command(faustExec, "-i", indent)
+	cmd := exec.CommandContext(runCtx, faustExec, "-i", indent)
 	cmd.Stdin = bytes.NewBuffer(content)
 	cmd.Stderr = &errs
 	cmd.Stdout = &output
+	// Don't wait for children of a killed formatter that still hold its output open
+	cmd.WaitDelay = time.Second
 
 	// Run faustfmt command
 	err = cmd.Run()
+	if ctx.Err() != nil {
+		return []byte{}, ctx.Err()
+	}
+	if runCtx.Err() != nil {
+		return []byte{}, fmt.Errorf("%s timed out after %v and was stopped, increase formatter_timeout in %s if formatting takes longer", faustExec, timeout, faustConfigFile)
+	}
 	if err != nil {
 		return []byte{}, fmt.Errorf("faustfmt error: %s, Stderr: %s", err, errs.String())
 	}
@@ -64,23 +83,29 @@ func Formatting(ctx context.Context, s *Server, par json.RawMessage) (json.RawMe
 	}
 
 	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return []byte("null"), nil
+	}
+	f.mu.RLock()
 	content := f.Content
-	var output []byte
-	if ok {
-		output, err = Format(content, GetIndent(params))
-		if err != nil {
-			logging.Logger.Error("Format error", "error", err)
+	f.mu.RUnlock()
+
+	timeout := time.Duration(s.Workspace.folderFor(path).Config.FormatterTimeout) * time.Millisecond
+	output, err := Format(ctx, content, GetIndent(params), timeout)
+	if err != nil {
+		logging.Logger.Error("Format error", "error", err)
+		// A failed run leaves the document untouched instead of replacing it with nothing
+		if ctx.Err() == nil {
+			s.showMessage(transport.Warning, "Couldn't format "+filepath.Base(path)+": "+err.Error())
 		}
+		return []byte("null"), nil
 	}
 	logging.Logger.Info("Got this for formatting", "output", string(output))
 
-	endPos := transport.Position{Line: 0, Character: 0}
-	if ok {
-		endPos, err = getDocumentEndPosition(string(content), string(s.Files.encoding))
-		if err != nil {
-			logging.Logger.Error("OffsetToPosition error", "error", err)
-			endPos = transport.Position{Line: 0, Character: 0}
-		}
+	endPos, err := getDocumentEndPosition(string(content), string(s.Files.encoding))
+	if err != nil {
+		logging.Logger.Error("OffsetToPosition error", "error", err)
+		endPos = transport.Position{Line: 0, Character: 0}
 	}
 
 	edit := transport.TextEdit{
@@ -88,7 +113,8 @@ func Formatting(ctx context.Context, s *Server, par json.RawMessage) (json.RawMe
 			Start: transport.Position{Line: 0, Character: 0},
 			End:   endPos,
 		},
-		NewText: string(output),
+		// The range starts after a byte order mark the editor keeps, so the text mustn't add another one
+		NewText: string(withoutBOM(output)),
 	}
 	resultBytes, err := json.Marshal([]transport.TextEdit{edit})
 
@@ -4,12 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/parser"
 	"github.com/carn181/faustlsp/transport"
 	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
 )
 
 func GetDefinition(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
@@ -27,60 +31,27 @@ func GetDefinition(ctx context.Context, s *Server, par json.RawMessage) (json.Ra
 	f, ok := s.Files.GetFromPath(path)
 	if !ok {
 		logging.Logger.Error("File should've been in server file store", "path", path)
+		return []byte("null"), nil
 	}
+	// The position only points at the right symbol in the content the scope was analyzed from
+	snap := s.Workspace.snapshot(f, &s.Store)
 
-	offset, err := PositionToOffset(params.Position, string(f.Content), string(s.Files.encoding))
+	offset, err := PositionToOffset(params.Position, string(snap.Content), string(s.Files.encoding))
 	if err != nil {
 		return []byte{}, err
 	}
 
-	ident, scope := FindSymbolScope(f.Content, f.Scope, offset)
+	ident, scope := FindSymbolScope(snap.Content, snap.Scope, offset)
 
-	logging.Logger.Info("Got symbol at Location", "symbol", ident, "scope_exists", f.Scope != nil)
+	logging.Logger.Info("Got symbol at Location", "symbol", ident, "scope_exists", snap.Scope != nil)
 
 	if ident == "" {
 		// Couldn't find symbol to lookup
 		return []byte("null"), nil
 	}
 
-	var loc Location
-	identSplit := strings.Split(ident, ".")
-
-	if len(identSplit) > 1 {
-		logging.Logger.Info("Resolving library symbol", "symbol", identSplit)
-		for i := range len(identSplit) - 1 {
-			libIdent := identSplit[i]
-
-			// Resolve as Environment
-			sym, err := FindEnvironmentIdent(libIdent, scope, &s.Store)
-			logging.Logger.Info("Resolved environment", "env", libIdent, "sym", sym.Ident, "loc", sym.Loc)
-			if err == nil {
-				loc = sym.Loc
-				scope = sym.Scope
-				continue
-			}
-
-			// Resolve as Library if not resolved as environment
-			file, err := FindLibraryIdent(libIdent, scope, &s.Store)
-			if err != nil {
-				break
-			}
-			logging.Logger.Info("Resolved library environment", "env", libIdent, "location", file)
-			f, ok := s.Store.Files.GetFromPath(file)
-			if ok {
-				f.mu.RLock()
-				logging.Logger.Info("Setting New Scope to", "path", file)
-				scope = f.Scope
-				f.mu.RUnlock()
-				if scope == nil {
-					break
-				}
-			}
-		}
-	}
-	ident = identSplit[len(identSplit)-1]
-
-	loc, err = FindDefinition(ident, scope, &s.Store)
+	sym, err := FindSymbolDefinition(ident, scope, &s.Store)
+	loc := sym.Loc
 
 	logging.Logger.Info("Got definition as", "location", loc, "error", err)
 	if err == nil {
@@ -112,58 +83,53 @@ func Hover(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage
 	f, ok := s.Files.GetFromPath(path)
 	if !ok {
 		logging.Logger.Error("File should've been in server file store", "path", path)
+		return []byte("null"), nil
 	}
+	// The position only points at the right symbol in the content the scope was analyzed from
+	snap := s.Workspace.snapshot(f, &s.Store)
 
-	offset, err := PositionToOffset(params.Position, string(f.Content), string(s.Files.encoding))
+	offset, err := PositionToOffset(params.Position, string(snap.Content), string(s.Files.encoding))
 	if err != nil {
 		return []byte{}, err
 	}
 
-	ident, scope := FindSymbolScope(f.Content, f.Scope, offset)
+	ident, scope := FindSymbolScope(snap.Content, snap.Scope, offset)
 
-	logging.Logger.Info("Got symbol at Location", "symbol", ident, "scope_exists", f.Scope != nil)
+	logging.Logger.Info("Got symbol at Location", "symbol", ident, "scope_exists", snap.Scope != nil)
 
 	if ident == "" {
+		// Primitives aren't symbols, their documentation comes with the server
+		if p, ok := primitiveAt(snap.Content, offset); ok {
+			return json.Marshal(transport.Hover{
+				Contents: transport.MarkupContent{
+					Kind:  transport.Markdown,
+					Value: p.markdown(),
+				},
+			})
+		}
 		// Couldn't find symbol to lookup
 		return []byte("null"), nil
 	}
 
-	identSplit := strings.Split(ident, ".")
-
-	if len(identSplit) > 1 {
-		logging.Logger.Info("Resolving library symbol", "symbol", identSplit)
-		for i := range len(identSplit) - 1 {
-			libIdent := identSplit[i]
-
-			// Resolve as Environment
-			sym, err := FindEnvironmentIdent(libIdent, scope, &s.Store)
-			logging.Logger.Info("Resolved environment", "env", libIdent, "sym", sym.Ident, "loc", sym.Loc)
-			if err == nil {
-				scope = sym.Scope
-				continue
-			}
-
-			// Resolve as Library if not resolved as environment
-			file, err := FindLibraryIdent(libIdent, scope, &s.Store)
-			if err != nil {
-				break
-			}
-			logging.Logger.Info("Resolved library environment", "env", libIdent, "location", file)
-			f, ok := s.Store.Files.GetFromPath(file)
-			if ok {
-				f.mu.RLock()
-				logging.Logger.Info("Setting New Scope to", "path", file)
-				scope = f.Scope
-				f.mu.RUnlock()
-				if scope == nil {
-					break
-				}
-			}
+	sym, err := FindSymbolDefinition(ident, scope, &s.Store)
+	docs := sym.Docs.Full
+	if libraryDoc, ok := libraryDocs(ident, sym, err); ok {
+		docs, err = libraryDoc.Full, nil
+	}
+	if err == nil && sym.Kind == Identifier && !strings.Contains(ident, ".") {
+		if iterationDoc, ok := iterationDocs(sym, scope, snap.Content, &s.Store); ok {
+			docs = iterationDoc
 		}
 	}
-	ident = identSplit[len(identSplit)-1]
-
-	docs, err := FindDocs(ident, scope, &s.Store)
+	if err == nil {
+		if source, ok := definitionSource(sym, path, snap, &s.Store); ok {
+			docs = strings.TrimSpace(docs + "\n\n```faust\n" + source + "\n```")
+		}
+		if value, ok := constantHover(sym, path, snap, &s.Store); ok {
+			docs = strings.TrimSpace(value + "\n\n" + docs)
+		}
+		docs = strings.TrimSpace(docs + "\n\n" + definedAt(ident, sym, s.Workspace.folderFor(path).Root))
+	}
 
 	logging.Logger.Info("Got docs as", "documentation", docs, "error", err)
 	if err == nil {
@@ -182,12 +148,109 @@ func Hover(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage
 	return []byte("null"), nil
 }
 
+// Definitions longer than this are cut in hover, their documentation is what matters
+const maxSourceLines = 20
+
+// Code of the definition or function sym, e.g. osc(freq) = freq : sin; with the lines after the first one
+// unindented by the indentation of the first one
+func definitionSource(sym Symbol, path util.Path, snap FileSnapshot, store *Store) (string, bool) {
+	if sym.Kind != Definition && sym.Kind != Function {
+		return "", false
+	}
+	source, ok := snap, sym.Loc.File == path && snap.Scope != nil
+	if !ok {
+		source, ok = analyzedSnapshot(sym.Loc.File, store)
+	}
+	if !ok {
+		return "", false
+	}
+	// Ranges of symbols are in bytes, like the nodes they come from
+	lines := GetLineIndices(string(source.Content))
+	start, end := sym.Loc.Range.Start, sym.Loc.Range.End
+	if int(end.Line) >= len(lines) {
+		return "", false
+	}
+	from, to := lines[start.Line]+uint(start.Character), lines[end.Line]+uint(end.Character)
+	// The range of the definitions of letrec environments is their name
+	if sym.Expr != nil {
+		to = max(to, sym.Expr.EndByte())
+	}
+	if from > to || to > uint(len(source.Content)) {
+		return "", false
+	}
+
+	code := strings.Split(string(source.Content[from:to])+";", "\n")
+	for i := 1; i < len(code); i++ {
+		trimmed := strings.TrimLeft(code[i], " \t")
+		code[i] = code[i][min(int(start.Character), len(code[i])-len(trimmed)):]
+	}
+	if len(code) > maxSourceLines {
+		code = append(code[:maxSourceLines], "…")
+	}
+	return strings.Join(code, "\n"), true
+}
+
+// Where sym, named ident where it is used, is defined, e.g. `os.osc` is defined on line 57 of oscillators.lib. Files of
+// the folder at root, the one of the hovered document, are named relative to it.
+func definedAt(ident string, sym Symbol, root util.Path) string {
+	file := sym.Loc.File
+	if rel, err := filepath.Rel(root, file); err == nil && !strings.HasPrefix(rel, "..") {
+		file = rel
+	}
+	return fmt.Sprintf("`%s` is defined on line %d of %s", ident, sym.Loc.Range.Start.Line+1, filepath.ToSlash(file))
+}
+
+// Describes sym when it is the variable of a par, seq, sum or prod iteration around scope: the values it takes and
+// where the iteration count is defined. Iterations being local, they are in content, from which scope was analyzed.
+func iterationDocs(sym Symbol, scope *Scope, content []byte, store *Store) (string, bool) {
+	for ; scope != nil && scope.Parent != nil; scope = scope.Parent {
+		var iteration *Symbol
+		for _, candidate := range scope.Parent.Symbols {
+			if candidate.Kind == Iteration && candidate.Scope == scope {
+				iteration = candidate
+				break
+			}
+		}
+		if iteration == nil || len(scope.Symbols) == 0 || scope.Symbols[0].Loc != sym.Loc || iteration.Expr == nil {
+			continue
+		}
+		node := iteration.Expr.Parent()
+		kind, count := node.ChildByFieldName("type"), node.ChildByFieldName("num_iters")
+		if kind == nil || count == nil {
+			return "", false
+		}
+		countText := count.Utf8Text(content)
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "```faust\n%s(%s, %s, …)\n```\n", kind.Utf8Text(content), sym.Ident, countText)
+		if n, err := strconv.Atoi(countText); err == nil {
+			fmt.Fprintf(&b, "Iteration variable of the %s on line %d, from 0 to %d", kind.Utf8Text(content), iteration.Loc.Range.Start.Line+1, n-1)
+		} else {
+			fmt.Fprintf(&b, "Iteration variable of the %s on line %d, from 0 to `%s` - 1", kind.Utf8Text(content), iteration.Loc.Range.Start.Line+1, countText)
+		}
+		// The count is evaluated where the iteration is, outside of its scope
+		if count.GrammarName() == "identifier" || count.GrammarName() == "access" {
+			if definition, err := FindSymbolDefinition(countText, scope.Parent, store); err == nil {
+				where := fmt.Sprintf("line %d", definition.Loc.Range.Start.Line+1)
+				if definition.Loc.File != iteration.Loc.File {
+					where += " of " + filepath.Base(definition.Loc.File)
+				}
+				fmt.Fprintf(&b, "\n\n`%s` is defined on %s", countText, where)
+			}
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// Finds the references of a symbol in the document it is used in. Identifiers with the same name only
+// count as references when they resolve to the same definition, so that e.g. the arguments of a case rule
+// are only found in that rule.
 func GetReferences(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
-	// TODO: Work on this function
-	var params transport.DefinitionParams
+	var params transport.ReferenceParams
 	json.Unmarshal(par, &params)
 
-	logging.Logger.Info("Goto Definition Request", "params", params)
+	logging.Logger.Info("References Request", "params", params)
 	path, err := util.URI2path(string(params.TextDocument.URI))
 	if err != nil {
 		logging.Logger.Error("Uri2path error", "error", err)
@@ -197,137 +260,206 @@ func GetReferences(ctx context.Context, s *Server, par json.RawMessage) (json.Ra
 	f, ok := s.Files.GetFromPath(path)
 	if !ok {
 		logging.Logger.Error("File should've been in server file store", "path", path)
+		return []byte("null"), nil
 	}
+	// The position only points at the right symbol in the content the scope was analyzed from
+	snap := s.Workspace.snapshot(f, &s.Store)
 
-	offset, err := PositionToOffset(params.Position, string(f.Content), string(s.Files.encoding))
+	offset, err := PositionToOffset(params.Position, string(snap.Content), string(s.Files.encoding))
 	if err != nil {
 		return []byte{}, err
 	}
 
-	ident, scope := FindSymbolScope(f.Content, f.Scope, offset)
-
-	logging.Logger.Info("Got symbol at Location", "symbol", ident, "scope", f.Scope == nil)
-
+	ident, scope := FindSymbolScope(snap.Content, snap.Scope, offset)
 	if ident == "" {
 		// Couldn't find symbol to lookup
 		return []byte("null"), nil
 	}
+	definition, err := FindSymbolDefinition(ident, scope, &s.Store)
+	if err != nil {
+		logging.Logger.Info("Couldn't resolve symbol for references", "symbol", ident, "error", err)
+		return []byte("null"), nil
+	}
 
-	var loc Location
-	identSplit := strings.Split(ident, ".")
-	if len(identSplit) > 1 {
-		logging.Logger.Info("Resolving library symbol", "symbol", identSplit)
-		for _, libIdent := range identSplit {
-			// Resolve as Environment
-			sym, err := FindEnvironmentIdent(ident, scope, &s.Store)
-			logging.Logger.Info("Resolved environment", "env", libIdent, "sym", sym.Ident, "loc", sym.Loc)
-			if err == nil {
-				loc = sym.Loc
-				scope = sym.Scope
+	locations := []transport.Location{}
+	for _, file := range referenceFiles(path, definition, &s.Store) {
+		// Symbols used across large workspaces are searched in many files
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		uri := params.TextDocument.URI
+		fileSnap := snap
+		if file != path {
+			// Other files are searched as they were last analyzed, their scope only matches that content
+			var ok bool
+			if fileSnap, ok = analyzedSnapshot(file, &s.Store); !ok {
 				continue
 			}
-
-			// Resolve as Library if not resolved as environment
-			file, err := FindLibraryIdent(libIdent, scope, &s.Store)
-			if err != nil {
-				break
-			}
-			logging.Logger.Info("Resolved library environment", "env", libIdent, "location", file)
-			f, ok := s.Store.Files.GetFromPath(file)
-			if ok {
-				f.mu.RLock()
-				logging.Logger.Info("Setting New Scope to", "path", file)
-				scope = f.Scope
-				f.mu.RUnlock()
-				if scope == nil {
-					break
-				}
+			uri = transport.DocumentURI(util.Path2URI(file))
+		}
+		for _, occurrence := range symbolOccurrences(fileSnap, definition, &s.Store) {
+			if !params.Context.IncludeDeclaration && occurrence.declaration {
+				continue
 			}
+			locations = append(locations, transport.Location{URI: uri, Range: occurrence.Range})
 		}
 	}
-	ident = identSplit[len(identSplit)-1]
-
-	loc, err = FindDefinition(ident, scope, &s.Store)
-
-	logging.Logger.Info("Got definition as", "location", loc, "error", err)
-	if err == nil {
-		// Find references using location
-		// FindReferences(loc, store) (Location[], error)
-		// Parse file tree for references (parse new tree and query pure identifiers)
-		// Go through scopes and check their expressions for references if it contains same symbol definition and remove from this file tree
-		// Do same for all importers till no other importers (avoid cycles too)
-		//		startFile := loc.File
-		//		importers := s.Store.Dependencies.GetImporters(startFile)
+	return json.Marshal(locations)
+}
 
-		fileLocation := transport.Location{
-			URI:   transport.DocumentURI(util.Path2URI(loc.File)),
-			Range: loc.Range,
-		}
-		result, err := json.Marshal(fileLocation)
-		if err == nil {
-			return result, nil
+// Files that can refer to definition: the file defining it, the one it is used in, and the files importing the file
+// defining it, directly or through other files, in that order
+func referenceFiles(path util.Path, definition Symbol, store *Store) []util.Path {
+	files := []util.Path{definition.Loc.File}
+	if path != definition.Loc.File {
+		files = append(files, path)
+	}
+	dependents := store.Dependencies.Dependents(definition.Loc.File)
+	slices.Sort(dependents)
+	for _, dependent := range dependents {
+		if !slices.Contains(files, dependent) {
+			files = append(files, dependent)
 		}
 	}
-
-	return []byte("null"), nil
+	return files
 }
 
-func RefQuery(ident string) string {
-	return fmt.Sprintf(`
-((identifier) @l
-	(#eq? @l %s)
-)`, ident)
-}
+// Highlights the occurrences of the symbol at the position in its document, with the same scoping as references:
+// a definition of a with or letrec environment isn't confused with a symbol of the same name outside of it
+func DocumentHighlights(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.DocumentHighlightParams
+	json.Unmarshal(par, &params)
 
-func GetRefsForFile(ident string, path util.Path, store *Store) []Location {
-	f, ok := store.Files.GetFromPath(path)
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+	f, ok := s.Files.GetFromPath(path)
 	if !ok {
-		return []Location{}
+		logging.Logger.Error("File should've been in server file store", "path", path)
+		return []byte("null"), nil
 	}
+	snap := s.Workspace.snapshot(f, &s.Store)
 
-	locations := []Location{}
-
-	// Parse through Scope
-	tree := parser.ParseTree(f.Content)
-	defer tree.Close()
-	results := parser.GetQueryMatches(RefQuery(ident), f.Content, tree)
+	offset, err := PositionToOffset(params.Position, string(snap.Content), string(s.Files.encoding))
+	if err != nil {
+		return []byte{}, err
+	}
+	ident, scope := FindSymbolScope(snap.Content, snap.Scope, offset)
+	if ident == "" {
+		return []byte("null"), nil
+	}
+	definition, err := FindSymbolDefinition(ident, scope, &s.Store)
+	if err != nil {
+		return []byte("null"), nil
+	}
 
-	totalRefs := make(map[transport.Range]struct{})
-	for _, result := range results.Results {
-		for _, refs := range result {
-			totalRefs[ToRange(&refs)] = struct{}{}
+	highlights := []transport.DocumentHighlight{}
+	for _, occurrence := range symbolOccurrences(snap, definition, &s.Store) {
+		kind := transport.Read
+		if occurrence.declaration {
+			kind = transport.Write
 		}
+		highlights = append(highlights, transport.DocumentHighlight{Range: occurrence.Range, Kind: kind})
 	}
+	return json.Marshal(highlights)
+}
 
-	//	CleanUpRefs(ident, , currentRefs map[transport.Range]struct{}, content []byte)
-
-	return locations
+// A use or the declaration of a symbol in a document
+type occurrence struct {
+	Range       transport.Range
+	declaration bool
 }
 
-func CleanUpRefs(ident string, symbol *Symbol, currentRefs map[transport.Range]struct{}, content []byte) {
-	// 1) Check if definition of same identifier exists
-	defined := false
-	for _, child := range symbol.Scope.Symbols {
-		if child.Ident == ident {
-			defined = true
+// Finds the names in the document of snap that resolve to definition, either alone or at the end of an access like
+// lib.foo. Each of them is resolved from the scope it is in, so that same-named symbols of other scopes, like
+// arguments, rules or local environments, aren't counted.
+func symbolOccurrences(snap FileSnapshot, definition Symbol, store *Store) []occurrence {
+	occurrences := []occurrence{}
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil || snap.Scope == nil {
+		return occurrences
+	}
+	defer tree.Close()
+
+	for _, node := range nameNodes(tree.RootNode(), snap.Content, definition.Ident) {
+		names, ok := accessNames(node)
+		if !ok {
+			continue
+		}
+		qualified := []string{}
+		for _, name := range names {
+			qualified = append(qualified, name.Utf8Text(snap.Content))
 		}
+		sym, err := FindSymbolDefinition(strings.Join(qualified, "."), FindLowestScopeContainingRange(snap.Scope, ToRange(node)), store)
+		if err != nil || sym.Loc != definition.Loc {
+			continue
+		}
+		name := names[len(names)-1]
+		occurrences = append(occurrences, occurrence{Range: ToRange(name), declaration: declares(name, definition)})
 	}
+	return occurrences
+}
 
-	if defined {
-		results := parser.GetQueryMatchesFromNode(RefQuery(ident), content, symbol.Expr)
-		for _, resultType := range results.Results {
-			for _, result := range resultType {
-				delete(currentRefs, ToRange(&result))
-			}
+// Identifiers spelled name under node, and accesses like lib.name whose last name it is
+func nameNodes(node *tree_sitter.Node, content []byte, name string) []*tree_sitter.Node {
+	switch node.GrammarName() {
+	case "identifier":
+		if node.Utf8Text(content) == name {
+			return []*tree_sitter.Node{node}
+		}
+		return nil
+	case "access":
+		nodes := []*tree_sitter.Node{}
+		if definition := node.ChildByFieldName("definition"); definition != nil && definition.Utf8Text(content) == name {
+			nodes = append(nodes, node)
 		}
+		// The environment can refer to the symbol too, like in name.foo
+		if environment := node.ChildByFieldName("environment"); environment != nil {
+			nodes = append(nodes, nameNodes(environment, content, name)...)
+		}
+		return nodes
+	}
+	nodes := []*tree_sitter.Node{}
+	for i := uint(0); i < node.NamedChildCount(); i++ {
+		nodes = append(nodes, nameNodes(node.NamedChild(i), content, name)...)
 	}
+	return nodes
+}
 
-	for _, child := range symbol.Scope.Symbols {
-		if child.Scope != nil {
-			CleanUpRefs(ident, child, currentRefs, content)
+// Identifiers and accesses like lib.foo spelled ident under node
+func identifierNodes(node *tree_sitter.Node, content []byte, ident string) []*tree_sitter.Node {
+	switch node.GrammarName() {
+	case "identifier":
+		if node.Utf8Text(content) == ident {
+			return []*tree_sitter.Node{node}
+		}
+		return nil
+	case "access":
+		if node.Utf8Text(content) == ident {
+			return []*tree_sitter.Node{node}
 		}
+		// The definition accessed is a different symbol than one with the same name in scope
+		environment := node.ChildByFieldName("environment")
+		if environment == nil {
+			return nil
+		}
+		return identifierNodes(environment, content, ident)
+	}
+	nodes := []*tree_sitter.Node{}
+	for i := uint(0); i < node.NamedChildCount(); i++ {
+		nodes = append(nodes, identifierNodes(node.NamedChild(i), content, ident)...)
 	}
+	return nodes
 }
 
-// Parse current scope, add to found references list.
-// Iterate through child scope recursively, remove from references list if found in child scope and scope has definition of same reference
+// Whether node is the identifier the symbol is declared with. Arguments and environments are located at their
+// identifier, definitions and functions at the whole definition starting with it.
+func declares(node *tree_sitter.Node, sym Symbol) bool {
+	if ToRange(node) == sym.Loc.Range {
+		return true
+	}
+	parent := node.Parent()
+	return parent != nil && ToRange(parent) == sym.Loc.Range && node.StartByte() == parent.StartByte()
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/carn181/faustlsp/util"
+)
+
+// DependencyEdge is a single import relationship in the DependencyGraph.
+// Library is the identifier the file was bound to for library() imports and empty for import() statements.
+type DependencyEdge struct {
+	From    util.Path `json:"from"`
+	To      util.Path `json:"to"`
+	Library string    `json:"library,omitempty"`
+}
+
+// DependencyGraphJSON is the JSON export format of the DependencyGraph
+type DependencyGraphJSON struct {
+	Nodes []util.Path      `json:"nodes"`
+	Edges []DependencyEdge `json:"edges"`
+}
+
+// Edges returns all import relationships sorted by importer and then by imported file
+func (dg *DependencyGraph) Edges() []DependencyEdge {
+	dg.mu.RLock()
+	defer dg.mu.RUnlock()
+
+	edges := []DependencyEdge{}
+	for imported, importers := range dg.importedBy {
+		// Unresolved imports are stored with an empty path
+		if imported == "" {
+			continue
+		}
+		for importer, library := range importers {
+			edges = append(edges, DependencyEdge{From: importer, To: imported, Library: library})
+		}
+	}
+	slices.SortFunc(edges, func(a, b DependencyEdge) int {
+		if c := strings.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		return strings.Compare(a.To, b.To)
+	})
+	return edges
+}
+
+// Nodes returns every file that takes part in an import relationship, sorted
+func (dg *DependencyGraph) Nodes() []util.Path {
+	nodes := []util.Path{}
+	for _, edge := range dg.Edges() {
+		nodes = append(nodes, edge.From, edge.To)
+	}
+	slices.Sort(nodes)
+	return slices.Compact(nodes)
+}
+
+// JSON exports the graph with paths relative to root where possible
+func (dg *DependencyGraph) JSON(root util.Path) ([]byte, error) {
+	graph := DependencyGraphJSON{Nodes: []util.Path{}, Edges: []DependencyEdge{}}
+	for _, node := range dg.Nodes() {
+		graph.Nodes = append(graph.Nodes, graphNodeName(node, root))
+	}
+	for _, edge := range dg.Edges() {
+		edge.From = graphNodeName(edge.From, root)
+		edge.To = graphNodeName(edge.To, root)
+		graph.Edges = append(graph.Edges, edge)
+	}
+	return json.MarshalIndent(graph, "", "  ")
+}
+
+// DOT exports the graph in Graphviz DOT format with paths relative to root where possible.
+// Library imports are labelled with the identifier they are bound to.
+func (dg *DependencyGraph) DOT(root util.Path) string {
+	var b strings.Builder
+	b.WriteString("digraph faust {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box];\n")
+	for _, node := range dg.Nodes() {
+		fmt.Fprintf(&b, "\t%q;\n", graphNodeName(node, root))
+	}
+	for _, edge := range dg.Edges() {
+		fmt.Fprintf(&b, "\t%q -> %q", graphNodeName(edge.From, root), graphNodeName(edge.To, root))
+		if edge.Library != "" {
+			fmt.Fprintf(&b, " [label=%q]", edge.Library)
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Files inside the workspace are shown relative to it, everything else (e.g. system libraries) keeps its absolute path
+func graphNodeName(path util.Path, root util.Path) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+type DependencyGraphParams struct {
+	// Possible values: dot | json. Defaults to dot.
+	Format string `json:"format,omitempty"`
+}
+
+type DependencyGraphResult struct {
+	Format  string `json:"format"`
+	Content string `json:"content"`
+}
+
+// ExportDependencyGraph renders the dependency graph in the requested format
+func ExportDependencyGraph(dg *DependencyGraph, root util.Path, format string) (string, error) {
+	switch format {
+	case "", "dot":
+		return dg.DOT(root), nil
+	case "json":
+		content, err := dg.JSON(root)
+		return string(content), err
+	default:
+		return "", fmt.Errorf("unknown dependency graph format: %s", format)
+	}
+}
+
+// Handler for the custom faustlsp/dependencyGraph request
+func DependencyGraphExport(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params DependencyGraphParams
+	json.Unmarshal(par, &params)
+
+	content, err := ExportDependencyGraph(&s.Store.Dependencies, s.Workspace.Root, params.Format)
+	if err != nil {
+		return []byte("null"), err
+	}
+	format := params.Format
+	if format == "" {
+		format = "dot"
+	}
+	return json.Marshal(DependencyGraphResult{Format: format, Content: content})
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Bump when the on-disk format changes so that old indexes get ignored
+const symbolIndexVersion = 4
+
+// SymbolIndex is the persistent form of the Store's scope cache.
+// Scopes are keyed by the hex encoded hash of the file content they were parsed from, just like Store.Cache.
+type SymbolIndex struct {
+	Version int                       `json:"version"`
+	Root    util.Path                 `json:"root"`
+	Scopes  map[string][]indexedScope `json:"scopes"`
+}
+
+// Scope trees are flattened in pre-order, and pointers between scopes are replaced by indices into that list (-1 for nil).
+// Tree-sitter nodes (Symbol.Expr) can't be stored, so symbols loaded from an index don't have them.
+type indexedScope struct {
+	Parent  int             `json:"parent"`
+	Symbols []indexedSymbol `json:"symbols"`
+	Range   transport.Range `json:"range"`
+}
+
+type indexedSymbol struct {
+	Kind       SymbolKind      `json:"kind"`
+	Loc        Location        `json:"loc"`
+	Ident      string          `json:"ident,omitempty"`
+	Scope      int             `json:"scope"`
+	Children   []indexedSymbol `json:"children,omitempty"`
+	Expression int             `json:"expression"`
+	File       util.Path       `json:"file,omitempty"`
+	Docs       Documentation   `json:"docs"`
+}
+
+// SymbolIndexPath is where the persistent index of the workspace at root is stored
+func SymbolIndexPath(root util.Path) (util.Path, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	rootHash := sha256.Sum256([]byte(root))
+	name := hex.EncodeToString(rootHash[:8]) + ".json"
+	return filepath.Join(cacheDir, "faustlsp", "index", name), nil
+}
+
+// WriteIndex writes all cached scopes of the store to path
+func (store *Store) WriteIndex(root util.Path, path util.Path) error {
+	index := SymbolIndex{
+		Version: symbolIndexVersion,
+		Root:    root,
+		Scopes:  make(map[string][]indexedScope),
+	}
+
+	store.mu.Lock()
+	for hash, scope := range store.Cache {
+		index.Scopes[hex.EncodeToString(hash[:])] = flattenScope(scope)
+	}
+	store.mu.Unlock()
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0640)
+}
+
+// LoadIndex adds the scopes stored in the index at path to the store's cache.
+// Returns the number of scopes loaded.
+func (store *Store) LoadIndex(root util.Path, path util.Path) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var index SymbolIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		return 0, err
+	}
+	if index.Version != symbolIndexVersion {
+		return 0, fmt.Errorf("symbol index version %d is not supported (expected %d)", index.Version, symbolIndexVersion)
+	}
+	if index.Root != root {
+		return 0, fmt.Errorf("symbol index was built for %s, not %s", index.Root, root)
+	}
+
+	loaded := 0
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for key, scopes := range index.Scopes {
+		var hash [sha256.Size]byte
+		decoded, err := hex.DecodeString(key)
+		if err != nil || len(decoded) != sha256.Size {
+			logging.Logger.Warn("Ignoring invalid hash in symbol index", "hash", key)
+			continue
+		}
+		copy(hash[:], decoded)
+		scope := unflattenScope(scopes)
+		if scope == nil {
+			continue
+		}
+		if _, ok := store.Cache[hash]; !ok {
+			store.Cache[hash] = scope
+			loaded++
+		}
+	}
+	return loaded, nil
+}
+
+func flattenScope(root *Scope) []indexedScope {
+	indices := make(map[*Scope]int)
+	scopes := []*Scope{}
+
+	var collect func(scope *Scope)
+	collect = func(scope *Scope) {
+		indices[scope] = len(scopes)
+		scopes = append(scopes, scope)
+		for _, child := range scope.Children {
+			if child != nil {
+				collect(child)
+			}
+		}
+	}
+	collect(root)
+
+	index := func(scope *Scope) int {
+		if scope == nil {
+			return -1
+		}
+		i, ok := indices[scope]
+		if !ok {
+			return -1
+		}
+		return i
+	}
+
+	var flattenSymbol func(sym *Symbol) indexedSymbol
+	flattenSymbol = func(sym *Symbol) indexedSymbol {
+		flat := indexedSymbol{
+			Kind:       sym.Kind,
+			Loc:        sym.Loc,
+			Ident:      sym.Ident,
+			Scope:      index(sym.Scope),
+			Expression: index(sym.Expression),
+			File:       sym.File,
+			Docs:       sym.Docs,
+		}
+		for i := range sym.Children {
+			flat.Children = append(flat.Children, flattenSymbol(&sym.Children[i]))
+		}
+		return flat
+	}
+
+	flattened := make([]indexedScope, len(scopes))
+	for i, scope := range scopes {
+		flat := indexedScope{
+			Parent:  index(scope.Parent),
+			Symbols: []indexedSymbol{},
+			Range:   scope.Range,
+		}
+		// The root scope's parent is never part of the index
+		if i == 0 {
+			flat.Parent = -1
+		}
+		for _, sym := range scope.Symbols {
+			flat.Symbols = append(flat.Symbols, flattenSymbol(sym))
+		}
+		flattened[i] = flat
+	}
+	return flattened
+}
+
+func unflattenScope(flattened []indexedScope) *Scope {
+	if len(flattened) == 0 {
+		return nil
+	}
+
+	// Create scopes first, in order, so that children are appended to parents in their original order
+	scopes := make([]*Scope, len(flattened))
+	for i, flat := range flattened {
+		var parent *Scope
+		if flat.Parent >= 0 && flat.Parent < i {
+			parent = scopes[flat.Parent]
+		}
+		scopes[i] = NewScope(parent, flat.Range)
+	}
+
+	scope := func(i int) *Scope {
+		if i < 0 || i >= len(scopes) {
+			return nil
+		}
+		return scopes[i]
+	}
+
+	var unflattenSymbol func(flat indexedSymbol) Symbol
+	unflattenSymbol = func(flat indexedSymbol) Symbol {
+		sym := Symbol{
+			Kind:       flat.Kind,
+			Loc:        flat.Loc,
+			Ident:      flat.Ident,
+			Scope:      scope(flat.Scope),
+			Expression: scope(flat.Expression),
+			File:       flat.File,
+			Docs:       flat.Docs,
+		}
+		for _, child := range flat.Children {
+			sym.Children = append(sym.Children, unflattenSymbol(child))
+		}
+		return sym
+	}
+
+	for i, flat := range flattened {
+		for _, flatSym := range flat.Symbols {
+			sym := unflattenSymbol(flatSym)
+			scopes[i].addSymbol(&sym)
+		}
+	}
+	return scopes[0]
+}
+
+// Loads the persistent index of the workspace if `faustlsp index` has been run for it
+func (store *Store) loadWorkspaceIndex(root util.Path) {
+	path, err := SymbolIndexPath(root)
+	if err != nil {
+		return
+	}
+	if !util.IsValidPath(path) {
+		logging.Logger.Info("No symbol index for workspace", "root", root)
+		return
+	}
+	loaded, err := store.LoadIndex(root, path)
+	if err != nil {
+		logging.Logger.Warn("Couldn't load symbol index", "path", path, "error", err)
+		return
+	}
+	logging.Logger.Info("Loaded symbol index", "path", path, "scopes", loaded)
+}
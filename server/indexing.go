@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/carn181/faustlsp/logging"
+)
+
+// Symbol count changes smaller than this (in percent) don't trigger an indexing status update
+const indexingStatusThreshold = 10
+
+type IndexingState string
+
+const (
+	IndexingStarted  IndexingState = "started"
+	IndexingFinished IndexingState = "finished"
+	// Sent after background indexing when re-analysis changed the symbol count significantly
+	IndexingUpdated IndexingState = "updated"
+)
+
+// Params of the custom faustlsp/indexingStatus notification
+type IndexingStatusParams struct {
+	State   IndexingState `json:"state"`
+	Files   int           `json:"files"`
+	Symbols int           `json:"symbols"`
+}
+
+// Tracks running analyses so that clients can be told when background indexing starts and finishes
+type indexingTracker struct {
+	mu sync.Mutex
+	// Number of files currently being analyzed or queued for analysis
+	active int
+	// True while the initial indexing of the workspace is running
+	background bool
+	// Symbol count sent in the last notification
+	lastSymbols int
+	// Sends the status to the client. Nil when there's no client (e.g. command line tools).
+	notify func(IndexingStatusParams)
+}
+
+// Starts background indexing of the workspace. Counts as an analysis itself, so it finishes once
+// endAnalysis has been called for it and no other analysis is running anymore.
+func (store *Store) startIndexing() {
+	store.indexing.mu.Lock()
+	store.indexing.active++
+	store.indexing.background = true
+	notify := store.indexing.notify
+	store.indexing.mu.Unlock()
+
+	if notify != nil {
+		files, symbols := store.countSymbols()
+		notify(IndexingStatusParams{State: IndexingStarted, Files: files, Symbols: symbols})
+	}
+}
+
+func (store *Store) beginAnalysis() {
+	store.indexing.mu.Lock()
+	store.indexing.active++
+	store.indexing.mu.Unlock()
+}
+
+func (store *Store) endAnalysis() {
+	store.indexing.mu.Lock()
+	store.indexing.active--
+	if store.indexing.active > 0 || store.indexing.notify == nil {
+		store.indexing.mu.Unlock()
+		return
+	}
+	state := IndexingUpdated
+	if store.indexing.background {
+		state = IndexingFinished
+		store.indexing.background = false
+	}
+	lastSymbols := store.indexing.lastSymbols
+	notify := store.indexing.notify
+	store.indexing.mu.Unlock()
+
+	files, symbols := store.countSymbols()
+	if state == IndexingUpdated && !significantChange(lastSymbols, symbols) {
+		return
+	}
+
+	store.indexing.mu.Lock()
+	store.indexing.lastSymbols = symbols
+	store.indexing.mu.Unlock()
+	notify(IndexingStatusParams{State: state, Files: files, Symbols: symbols})
+}
+
+func significantChange(before int, after int) bool {
+	diff := after - before
+	if diff < 0 {
+		diff = -diff
+	}
+	if before == 0 {
+		return diff > 0
+	}
+	return diff*100/before >= indexingStatusThreshold
+}
+
+// Returns the number of analyzed files and the number of symbols in them
+func (store *Store) countSymbols() (int, int) {
+	files := store.Files.list()
+
+	analyzed, symbols := 0, 0
+	for _, f := range files {
+		f.mu.RLock()
+		if f.Scope != nil {
+			analyzed++
+			symbols += countScopeSymbols(f.Scope)
+		}
+		f.mu.RUnlock()
+	}
+	return analyzed, symbols
+}
+
+func countScopeSymbols(scope *Scope) int {
+	count := 0
+	for _, sym := range scope.Symbols {
+		if sym.Ident != "" {
+			count++
+		}
+	}
+	for _, child := range scope.Children {
+		count += countScopeSymbols(child)
+	}
+	return count
+}
+
+func (s *Server) sendIndexingStatus(status IndexingStatusParams) {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	logging.Logger.Info("Indexing status", "status", status)
+	err = s.Transport.WriteNotif("faustlsp/indexingStatus", content)
+	if err != nil {
+		logging.Logger.Error("Couldn't send indexing status", "error", err)
+	}
+}
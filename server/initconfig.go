@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+type InitConfigResult struct {
+	// URI of the created config file, for clients to open it
+	URI transport.DocumentURI `json:"uri"`
+}
+
+// Writes a commented default config file in the folder given as an optional URI argument, the workspace root by
+// default. Fails if the folder already has one.
+func InitConfigCommand(ctx context.Context, s *Server, args []json.RawMessage) (any, error) {
+	root := s.Workspace.Root
+	if len(args) > 0 {
+		path, err := commandPathArgument(args)
+		if err != nil {
+			return nil, err
+		}
+		root = path
+	}
+	path := filepath.Join(root, faustConfigFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+	if err := os.WriteFile(path, scaffoldConfig(s.Workspace.getFaustDSPRelativePaths(root), compilers.probe(s.Workspace.folderFor(root).compilerCommand())), 0644); err != nil {
+		return nil, err
+	}
+	// The file watcher loads the new config
+	return InitConfigResult{URI: transport.DocumentURI(util.Path2URI(path))}, nil
+}
+
+// Content of a new config file listing the .dsp files of the folder as process files, along with the compiler found
+// in PATH. Only the main options are written, with comments explaining them.
+func scaffoldConfig(dspFiles []util.Path, compiler compilerProbe) []byte {
+	cfg := builtinConfig()
+	quote := func(v any) string {
+		content, _ := json.Marshal(v)
+		return string(content)
+	}
+	// Paths are written with forward slashes, like in the README, so that the config can be shared across systems
+	processFiles := []string{}
+	for _, file := range dspFiles {
+		processFiles = append(processFiles, filepath.ToSlash(file))
+	}
+
+	var b strings.Builder
+	b.WriteString("{\n")
+	if compiler.path != "" {
+		fmt.Fprintf(&b, "  // Faust compiler executable, found at %s\n", compiler.path)
+	} else {
+		b.WriteString("  // Faust compiler executable. It wasn't found in PATH, set its full path here if it isn't installed there\n")
+	}
+	fmt.Fprintf(&b, "  \"command\": %s,\n", quote(cfg.Command))
+	b.WriteString("  // Files that have top-level processes defined, every .dsp file if empty\n")
+	fmt.Fprintf(&b, "  \"process_files\": %s,\n", quote(processFiles))
+	b.WriteString("  // Process name passed as -pn to the compiler\n")
+	fmt.Fprintf(&b, "  \"process_name\": %s,\n", quote(cfg.ProcessName))
+	b.WriteString("  // Extra library directories, passed as -I to the compiler and used to resolve imports\n")
+	b.WriteString("  \"include\": [],\n")
+	if compiler.dspDir != "" {
+		fmt.Fprintf(&b, "  // Faust library directory, overrides the compiler's %s\n", compiler.dspDir)
+		b.WriteString("  // \"library_path\": \"faustlibraries\",\n")
+	}
+	b.WriteString("  // Show compiler errors as diagnostics\n")
+	fmt.Fprintf(&b, "  \"compiler_diagnostics\": %s,\n", quote(cfg.CompilerDiagnostics))
+	b.WriteString("  // Files and directories that aren't watched, replicated or analyzed\n")
+	fmt.Fprintf(&b, "  \"exclude\": %s\n", quote(cfg.Exclude))
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+// Offers to create a config file in the folder of path when it has none
+func initConfigAction(s *Server, path util.Path) (transport.CodeAction, bool) {
+	root := s.Workspace.folderFor(path).Root
+	if _, err := os.Stat(filepath.Join(root, faustConfigFile)); !os.IsNotExist(err) {
+		return transport.CodeAction{}, false
+	}
+	title := "Create " + faustConfigFile
+	folder, _ := json.Marshal(util.Path2URI(root))
+	return transport.CodeAction{
+		Title: title,
+		Kind:  transport.Source,
+		Command: &transport.Command{
+			Title:     title,
+			Command:   "faust.initConfig",
+			Arguments: []json.RawMessage{folder},
+		},
+	}, true
+}
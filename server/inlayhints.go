@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Minimum number of numeric arguments a call needs to get parameter name hints
+const minHintedArguments = 2
+
+// Shows the parameter names of calls to functions defined in Faust code, like fi.resonlp(fc: 2000, Q: 5, gain: 0.9),
+// when several of their arguments are numbers whose meaning isn't obvious from the call itself, and the values taken
+// by the variables of par, seq, sum and prod iterations, like par(i: 0..3, 4, …)
+func InlayHints(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.InlayHintParams
+	json.Unmarshal(par, &params)
+
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		logging.Logger.Error("File should've been in server file store", "path", path)
+		return []byte("null"), nil
+	}
+	snap := s.Workspace.snapshot(f, &s.Store)
+	if snap.Scope == nil {
+		return []byte("null"), nil
+	}
+
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return []byte("null"), nil
+	}
+	defer tree.Close()
+
+	hints := []transport.InlayHint{}
+	var visit func(node *tree_sitter.Node)
+	visit = func(node *tree_sitter.Node) {
+		switch node.GrammarName() {
+		case "function_call":
+			hints = append(hints, callHints(node, snap, &s.Store, params.Range, string(s.Files.encoding))...)
+		case "iteration":
+			if hint, ok := iterationHint(node, path, snap, &s.Store, params.Range, string(s.Files.encoding)); ok {
+				hints = append(hints, hint)
+			}
+		}
+		for i := uint(0); i < node.NamedChildCount(); i++ {
+			visit(node.NamedChild(i))
+		}
+	}
+	visit(tree.RootNode())
+
+	return json.Marshal(hints)
+}
+
+// Parameter name hints for the numeric arguments of call that are within visible
+func callHints(call *tree_sitter.Node, snap FileSnapshot, store *Store, visible transport.Range, encoding string) []transport.InlayHint {
+	callee := call.ChildByFieldName("callee")
+	if callee == nil {
+		return nil
+	}
+	var arguments *tree_sitter.Node
+	for i := uint(0); i < call.NamedChildCount(); i++ {
+		if child := call.NamedChild(i); child.GrammarName() == "arguments" {
+			arguments = child
+		}
+	}
+	if arguments == nil {
+		return nil
+	}
+
+	numeric := 0
+	for i := uint(0); i < arguments.NamedChildCount(); i++ {
+		if isNumber(arguments.NamedChild(i)) {
+			numeric++
+		}
+	}
+	if numeric < minHintedArguments {
+		return nil
+	}
+
+	scope := FindLowestScopeContainingRange(snap.Scope, ToRange(callee))
+	sym, err := FindSymbolDefinition(callee.Utf8Text(snap.Content), scope, store)
+	if err != nil || sym.Kind != Function || sym.Scope == nil {
+		return nil
+	}
+	// Calls with more arguments than parameters call the result of the function, so the names wouldn't match
+	parameters := sym.Scope.Symbols
+	if arguments.NamedChildCount() > uint(len(parameters)) {
+		return nil
+	}
+
+	hints := []transport.InlayHint{}
+	for i := uint(0); i < arguments.NamedChildCount(); i++ {
+		argument := arguments.NamedChild(i)
+		if !isNumber(argument) {
+			continue
+		}
+		position, err := OffsetToPosition(argument.StartByte(), string(snap.Content), encoding)
+		if err != nil || !rangeContainsPosition(visible, position) {
+			continue
+		}
+		hints = append(hints, transport.InlayHint{
+			Position:     position,
+			Label:        []transport.InlayHintLabelPart{{Value: parameters[i].Ident + ":"}},
+			Kind:         transport.Parameter,
+			PaddingRight: true,
+		})
+	}
+	return hints
+}
+
+// Values taken by the variable of iteration, shown after it. Counts that are constants are evaluated, other counts
+// are shown as they are written, as long as they are a name.
+func iterationHint(iteration *tree_sitter.Node, path util.Path, snap FileSnapshot, store *Store, visible transport.Range, encoding string) (transport.InlayHint, bool) {
+	variable, count := iteration.ChildByFieldName("current_iter"), namedField(iteration, "num_iters")
+	if variable == nil || count == nil {
+		return transport.InlayHint{}, false
+	}
+	position, err := OffsetToPosition(variable.EndByte(), string(snap.Content), encoding)
+	if err != nil || !rangeContainsPosition(visible, position) {
+		return transport.InlayHint{}, false
+	}
+
+	var label string
+	e := newConstantEvaluator(path, snap, store)
+	if value := e.eval(count, snap, 0); value.numeric {
+		n := int(value.number)
+		if n <= 0 {
+			return transport.InlayHint{}, false
+		}
+		label = fmt.Sprintf(": 0..%d", n-1)
+	} else if count.GrammarName() == "identifier" || count.GrammarName() == "access" {
+		label = fmt.Sprintf(": 0..%s-1", count.Utf8Text(snap.Content))
+	} else {
+		return transport.InlayHint{}, false
+	}
+	return transport.InlayHint{
+		Position: position,
+		Label:    []transport.InlayHintLabelPart{{Value: label}},
+		Kind:     transport.Type,
+	}, true
+}
+
+func isNumber(node *tree_sitter.Node) bool {
+	switch node.GrammarName() {
+	case "int", "real", "unary_number":
+		return true
+	}
+	return false
+}
+
+func rangeContainsPosition(r transport.Range, pos transport.Position) bool {
+	return RangeContains(r, transport.Range{Start: pos, End: pos})
+}
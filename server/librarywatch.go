@@ -0,0 +1,179 @@
+package server
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/util"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Version of the documentation bundle generated from the installed libraries when they change
+const installedDocsVersion = "installed"
+
+// The Faust libraries are installed outside of the workspace, in `faust -dspdir` or the library_path of the config,
+// and can change while the server is running, e.g. when a package is installed or faust is updated. Their directories
+// are watched along with the workspace, so that the libraries the workspace imports follow them.
+
+// Library directories of the folders, with their subdirectories, that are watched besides the workspace.
+// Only used from the watcher goroutine.
+type libraryWatch struct {
+	dirs map[util.Path]bool
+}
+
+// Watches the library directories of the folders, which change with the config or when faust is installed, and
+// stops watching the ones no folder uses anymore. Directories inside the workspace are already watched.
+// Nothing is watched without a watcher.
+func (l *libraryWatch) update(w *Workspace, watcher *fsnotify.Watcher) {
+	if watcher == nil {
+		return
+	}
+	if l.dirs == nil {
+		l.dirs = make(map[util.Path]bool)
+	}
+	current := map[util.Path]bool{}
+	for _, folder := range w.folders() {
+		dir := folder.libraryDir()
+		if dir == "" || w.inFolders(dir) || !util.IsValidPath(dir) {
+			continue
+		}
+		current[dir] = true
+		if l.dirs[dir] {
+			continue
+		}
+		logging.Logger.Info("Watching library directory", "path", dir)
+		watchTree(dir, watcher)
+		l.dirs[dir] = true
+	}
+	for dir := range l.dirs {
+		if current[dir] {
+			continue
+		}
+		logging.Logger.Info("No longer watching library directory", "path", dir)
+		for _, path := range watcher.WatchList() {
+			if isInside(dir, path) && !w.inFolders(path) {
+				watcher.Remove(path)
+			}
+		}
+		delete(l.dirs, dir)
+	}
+}
+
+// Library directory path is inside, empty if it isn't in a watched one
+func (l *libraryWatch) dirOf(path util.Path) util.Path {
+	for dir := range l.dirs {
+		if isInside(dir, path) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Adds dir and its subdirectories to the watcher, which doesn't watch recursively
+func watchTree(dir util.Path, watcher *fsnotify.Watcher) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// Follows changes to the installed libraries. Libraries that were already loaded are read again and re-analyzed,
+// with the files importing them. When libraries are added or removed, imports may now resolve to other files, so
+// the whole workspace is analyzed again. The documentation bundle is regenerated from the libraries too.
+func (w *Workspace) handleLibraryEvents(events []fsnotify.Event, dirs map[util.Path]bool, s *Server, watcher *fsnotify.Watcher) {
+	if len(events) == 0 {
+		return
+	}
+	reanalyze := map[util.Path]bool{}
+	workspace := false
+	for _, event := range events {
+		path := event.Name
+		logging.Logger.Info("Got disk event for library", "path", path, "event", event)
+		fi, err := os.Stat(path)
+		if err != nil {
+			// Removed, or renamed to another path which gets its own event
+			for _, f := range s.Files.list() {
+				if isInside(path, f.Handle.Path) {
+					for _, importer := range w.deleteFile(f.Handle.Path, s) {
+						reanalyze[importer] = true
+					}
+				}
+			}
+			workspace = true
+			continue
+		}
+		if fi.IsDir() {
+			if event.Has(fsnotify.Create) {
+				// A package installed as a directory
+				watchTree(path, watcher)
+				workspace = true
+			}
+			continue
+		}
+		if !IsFaustFile(path) {
+			continue
+		}
+		if event.Has(fsnotify.Create) {
+			workspace = true
+		}
+		// Libraries nothing imported yet are loaded when they are first imported
+		if _, ok := s.Files.GetFromPath(path); !ok {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		s.Files.ModifyFull(path, string(content))
+		reanalyze[path] = true
+		for _, importer := range s.Store.Dependencies.Dependents(path) {
+			reanalyze[importer] = true
+		}
+	}
+
+	if workspace {
+		w.mu.Lock()
+		for _, path := range w.Files {
+			if IsFaustFile(path) {
+				reanalyze[path] = true
+			}
+		}
+		w.mu.Unlock()
+	}
+	for path := range reanalyze {
+		f, ok := s.Files.GetFromPath(path)
+		if !ok {
+			continue
+		}
+		logging.Logger.Info("Re-analyzing after library change", "path", path)
+		s.analyzeInBackground(f)
+		w.diagnoseOn(diagnoseSave, path, s)
+	}
+
+	for dir := range dirs {
+		w.updateInstalledDocs(dir)
+	}
+}
+
+// Regenerates the documentation bundle from the standard libraries installed in dir, so that hover and completion
+// show the documentation of the installed version. It is cached like downloaded bundles, the freshest one being used.
+func (w *Workspace) updateInstalledDocs(dir util.Path) {
+	if !util.IsValidPath(filepath.Join(dir, "stdfaust.lib")) {
+		return
+	}
+	bundle, err := generateDocsBundle(dir, installedDocsVersion)
+	if err != nil {
+		logging.Logger.Warn("Couldn't generate documentation of the installed libraries", "path", dir, "error", err)
+		return
+	}
+	if _, err := saveDocsBundle(bundle); err != nil {
+		logging.Logger.Warn("Couldn't cache documentation of the installed libraries", "path", dir, "error", err)
+		return
+	}
+	loadDocsBundle(w.folderFor(w.Root).Config.DocsVersion)
+}
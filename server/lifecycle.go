@@ -4,13 +4,31 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
 	"github.com/carn181/faustlsp/util"
 )
 
+// Position encodings the server can count characters in
+var positionEncodings = []transport.PositionEncodingKind{transport.UTF8, transport.UTF16, transport.UTF32}
+
+// The first encoding of the client's preferences that the server supports. Clients that don't send position
+// encodings only support UTF-16, which every client supports.
+func negotiatePositionEncoding(general *transport.GeneralClientCapabilities) transport.PositionEncodingKind {
+	if general != nil {
+		for _, encoding := range general.PositionEncodings {
+			if slices.Contains(positionEncodings, encoding) {
+				return encoding
+			}
+		}
+	}
+	return transport.UTF16
+}
+
 // Initialize Handler
 func Initialize(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
 	// TODO: Error Handling
@@ -19,45 +37,73 @@ func Initialize(ctx context.Context, s *Server, par json.RawMessage) (json.RawMe
 	var params transport.InitializeParams
 	json.Unmarshal(par, &params)
 	logging.Logger.Info("Got Initialize Parameters from Client", "params", par)
+	s.ClientCapabilities = params.Capabilities
+	if params.Trace != nil {
+		s.setTrace(*params.Trace)
+	}
 
 	// TODO: Choose ServerCapabilities based on ClientCapabilities
 	// Server Capabilities
 
-	// Don't select UTF-8, select UTF-32 and UTF-16 only
-	var positionEncoding transport.PositionEncodingKind
-	if params.Capabilities.General.PositionEncodings[0] == "utf-16" {
-		positionEncoding = transport.UTF16
-	} else if params.Capabilities.General.PositionEncodings[0] == "utf-32" {
-		positionEncoding = transport.UTF32
-	} else {
-		positionEncoding = transport.UTF16
-	}
+	positionEncoding := negotiatePositionEncoding(params.Capabilities.General)
 	var result transport.InitializeResult = transport.InitializeResult{
 		Capabilities: transport.ServerCapabilities{
 			// TODO: Implement Incremental Changes for better synchronization
 			DocumentSymbolProvider: &transport.Or_ServerCapabilities_documentSymbolProvider{Value: true},
 			PositionEncoding:       &positionEncoding,
-			TextDocumentSync:       transport.Incremental,
+			TextDocumentSync: transport.TextDocumentSyncOptions{
+				OpenClose: true,
+				Change:    transport.Incremental,
+				// Needed for on-save diagnostics of files open in the editor. The text resyncs documents that missed a change.
+				Save: &transport.SaveOptions{IncludeText: true},
+			},
 			Workspace: &transport.WorkspaceOptions{
 				WorkspaceFolders: &transport.WorkspaceFolders5Gn{
 					Supported:           true,
 					ChangeNotifications: "ws",
 				},
+				FileOperations: &transport.FileOperationOptions{
+					DidDelete: &transport.FileOperationRegistrationOptions{
+						Filters: deleteFileFilters,
+					},
+				},
 			},
-			DocumentFormattingProvider: &transport.Or_ServerCapabilities_documentFormattingProvider{Value: true},
-			DefinitionProvider:         &transport.Or_ServerCapabilities_definitionProvider{Value: true},
-			HoverProvider:              &transport.Or_ServerCapabilities_hoverProvider{Value: true},
-			CompletionProvider: &transport.CompletionOptions{
-				TriggerCharacters: []string{"."},
+			DefinitionProvider:        &transport.Or_ServerCapabilities_definitionProvider{Value: true},
+			ReferencesProvider:        &transport.Or_ServerCapabilities_referencesProvider{Value: true},
+			DocumentHighlightProvider: &transport.Or_ServerCapabilities_documentHighlightProvider{Value: true},
+			SemanticTokensProvider: transport.SemanticTokensOptions{
+				Legend: semanticTokensLegend,
+				Range:  &transport.Or_SemanticTokensOptions_range{Value: true},
+				Full:   &transport.Or_SemanticTokensOptions_full{Value: transport.SemanticTokensFullDelta{Delta: true}},
 			},
+			CodeActionProvider: &transport.CodeActionOptions{
+				CodeActionKinds: []transport.CodeActionKind{transport.QuickFix, transport.RefactorExtract, transport.RefactorMove, transport.Source},
+			},
+			SignatureHelpProvider: &transport.SignatureHelpOptions{
+				TriggerCharacters: []string{"(", ","},
+			},
+			ExecuteCommandProvider: &transport.ExecuteCommandOptions{
+				Commands: executeCommandNames(),
+			},
+			// Completion, formatting and hover are advertised depending on the config
 		},
 		ServerInfo: &transport.ServerInfo{Name: "faust-lsp", Version: "0.0.1"},
 	}
-	s.Capabilities = result.Capabilities
 
 	rootPath, _ := util.URI2path(string(params.RootURI))
 	logging.Logger.Info("Got workspace", "workspace", rootPath)
 	s.Workspace.Root = rootPath
+	s.Workspace.setFolders(params.WorkspaceFolders)
+	s.Workspace.client.initOptions = clientSection(params.InitializationOptions)
+
+	// Expansions are shown in virtual documents if the client can ask for their content
+	if params.Capabilities.Workspace.TextDocumentContent != nil {
+		result.Capabilities.Workspace.TextDocumentContent = &transport.Or_WorkspaceOptions_textDocumentContent{
+			Value: transport.TextDocumentContentOptions{Scheme: expandScheme},
+		}
+	}
+	advertiseFeatures(&result.Capabilities, params.Capabilities, s.Workspace.initialConfig(rootPath))
+	s.Capabilities = result.Capabilities
 
 	resultBytes, err := json.Marshal(result)
 	if err != nil {
@@ -70,12 +116,19 @@ func Initialize(ctx context.Context, s *Server, par json.RawMessage) (json.RawMe
 func Initialized(ctx context.Context, s *Server, par json.RawMessage) error {
 
 	s.Status = Running
-	go s.GenerateDiagnostics()
+	if s.grammarErr != nil {
+		s.showMessage(transport.Error, fmt.Sprintf("Faust files can't be parsed, symbols, navigation and syntax diagnostics are unavailable: %s", s.grammarErr))
+	}
+	// Created before anything can send diagnostics
+	s.diagChan = make(chan diagnosticsUpdate)
+	s.background.Go(s.GenerateDiagnostics)
 	s.Files.Init(ctx, *s.Capabilities.PositionEncoding)
 	s.Store.Files = &s.Files
 	s.Store.Dependencies = NewDependencyGraph()
 	s.Store.Cache = make(map[[sha256.Size]byte]*Scope)
-	s.Workspace.Init(ctx, s)
+	s.Store.loadWorkspaceIndex(s.Workspace.Root)
+	s.Store.indexing.notify = s.sendIndexingStatus
+	s.Workspace.Init(s)
 	logging.Logger.Info("Handling Initialized with diagnostics")
 	logging.Logger.Info("Started Diagnostic Handler")
 	// Send WorkspaceFolders Request
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Metadata every library should declare, as faustlibraries does
+var requiredLibraryMetadata = []string{"name", "author", "license"}
+
+// Checks the conventions of faustlibraries on the content of a library: declaring its name, author and license,
+// documenting every top-level function with a Usage section, and binding environments to two-letter prefixes like os.
+// Diagnostics have the source lint so that they can be hidden at once with the severity mapping.
+func libraryLint(content []byte, encoding string) []transport.Diagnostic {
+	diagnostics := []transport.Diagnostic{}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return diagnostics
+	}
+	defer tree.Close()
+
+	root := tree.RootNode()
+	declared := map[string]bool{}
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		var name *tree_sitter.Node
+		switch node.GrammarName() {
+		case "global_metadata":
+			if key := node.ChildByFieldName("key"); key != nil {
+				declared[key.Utf8Text(content)] = true
+			}
+			continue
+		case "definition":
+			name = node.ChildByFieldName("variable")
+			if value := node.ChildByFieldName("value"); value != nil && isEnvironment(value) {
+				if name != nil && !isLibraryPrefix(name.Utf8Text(content)) {
+					diagnostics = append(diagnostics, lintDiagnostic(name, content, encoding, "environment-prefix",
+						fmt.Sprintf("%s should be bound to a two-letter lowercase prefix like os", name.Utf8Text(content))))
+				}
+				continue
+			}
+		case "function_definition":
+			name = node.ChildByFieldName("name")
+		}
+		if name == nil {
+			continue
+		}
+
+		docs := ParseDocumentation(node, content)
+		if docs.Full == "" {
+			diagnostics = append(diagnostics, lintDiagnostic(name, content, encoding, "missing-doc",
+				fmt.Sprintf("%s has no doc comment", name.Utf8Text(content))))
+		} else if !hasUsageSection(docs.Full) {
+			diagnostics = append(diagnostics, lintDiagnostic(name, content, encoding, "missing-usage",
+				fmt.Sprintf("The doc comment of %s has no Usage section", name.Utf8Text(content))))
+		}
+	}
+
+	for _, key := range requiredLibraryMetadata {
+		if !declared[key] {
+			diagnostics = append(diagnostics, transport.Diagnostic{
+				Range:    transport.Range{},
+				Message:  fmt.Sprintf("The library doesn't declare its %s, e.g. declare %s \"...\";", key, key),
+				Severity: transport.SeverityInformation,
+				Source:   "lint",
+				Code:     "missing-declare",
+			})
+		}
+	}
+	return diagnostics
+}
+
+func lintDiagnostic(node *tree_sitter.Node, content []byte, encoding string, code string, message string) transport.Diagnostic {
+	return transport.Diagnostic{
+		Range:    replaceRange(node.StartByte(), node.EndByte(), string(content), encoding),
+		Message:  message,
+		Severity: transport.SeverityInformation,
+		Source:   "lint",
+		Code:     code,
+	}
+}
+
+func isEnvironment(node *tree_sitter.Node) bool {
+	switch node.GrammarName() {
+	case "library", "environment":
+		return true
+	}
+	return false
+}
+
+func isLibraryPrefix(name string) bool {
+	return len(name) == 2 && 'a' <= name[0] && name[0] <= 'z' && 'a' <= name[1] && name[1] <= 'z'
+}
+
+// Whether a doc comment has a Usage heading, written #### Usage in faustlibraries
+func hasUsageSection(doc string) bool {
+	for _, line := range strings.Split(doc, "\n") {
+		heading := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if strings.EqualFold(heading, "Usage") {
+			return true
+		}
+	}
+	return false
+}
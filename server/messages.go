@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+)
+
+// Shows a message to the user with window/showMessage
+func (s *Server) showMessage(messageType transport.MessageType, message string) {
+	content, err := json.Marshal(transport.ShowMessageParams{Type: messageType, Message: message})
+	if err != nil {
+		return
+	}
+	if err := s.Transport.WriteNotif("window/showMessage", content); err != nil {
+		logging.Logger.Error("Couldn't show message", "error", err)
+	}
+}
+
+// Shows a message only the first time it is sent with key, so that users aren't flooded with the same warning
+func (s *Server) showMessageOnce(key string, messageType transport.MessageType, message string) {
+	s.shownMessagesMu.Lock()
+	if s.shownMessages == nil {
+		s.shownMessages = make(map[string]bool)
+	}
+	shown := s.shownMessages[key]
+	s.shownMessages[key] = true
+	s.shownMessagesMu.Unlock()
+
+	if !shown {
+		s.showMessage(messageType, message)
+	}
+}
+
+// Allows the message sent with key to be shown again. Returns whether it had been shown.
+func (s *Server) forgetMessage(key string) bool {
+	s.shownMessagesMu.Lock()
+	defer s.shownMessagesMu.Unlock()
+	shown := s.shownMessages[key]
+	delete(s.shownMessages, key)
+	return shown
+}
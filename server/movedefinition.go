@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Offers to move the top-level definition named at rng, along with its doc comment, into a library of the folder.
+// The origin file gets a library binding for it, e.g. fx = library("effects.lib"), and its references are rewritten
+// to go through that binding. Only libraries in which everything the definition refers to resolves the same way are
+// offered, so that the moved definition keeps its meaning.
+func moveDefinitionActions(s *Server, f *File, rng transport.Range) []transport.CodeAction {
+	f.mu.RLock()
+	path, uri := f.Handle.Path, f.Handle.URI
+	f.mu.RUnlock()
+	if util.IsMemoryPath(path) {
+		return nil
+	}
+	snap := s.Workspace.snapshot(f, &s.Store)
+	if snap.Scope == nil {
+		return nil
+	}
+	encoding := string(s.Files.encoding)
+	offset, err := PositionToOffset(rng.Start, string(snap.Content), encoding)
+	if err != nil {
+		return nil
+	}
+
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return nil
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+
+	node, name := topLevelDefinitionAt(root, snap.Content, offset)
+	if node == nil {
+		return nil
+	}
+	folder := s.Workspace.folderFor(path)
+	// Moving the process would leave nothing to compile, and rules of a pattern matching function can't be split
+	if name == folder.processName(path) || len(topLevelDefinitions(root, snap.Content, name)) > 1 {
+		return nil
+	}
+	definition, err := FindSymbolDefinition(name, snap.Scope, &s.Store)
+	if err != nil {
+		return nil
+	}
+
+	start, end := definitionBounds(node, snap.Content)
+	moved := strings.TrimRight(string(snap.Content[start:end]), "\n") + "\n"
+	end = withBlankLine(snap.Content, start, end)
+	// Symbols defined outside of the definition, which the target library must resolve the same way
+	external := map[string]Location{}
+	for _, ident := range referencedIdentifiers(node, snap.Content) {
+		sym, err := FindSymbolDefinition(ident.Utf8Text(snap.Content), FindLowestScopeContainingRange(snap.Scope, ToRange(ident)), &s.Store)
+		if err != nil || sym.Loc.File == path && RangeContains(ToRange(node), sym.Loc.Range) {
+			continue
+		}
+		external[ident.Utf8Text(snap.Content)] = sym.Loc
+	}
+
+	actions := []transport.CodeAction{}
+	for _, target := range s.Workspace.folderLibraries(path, &s.Store) {
+		targetFile, ok := s.Files.GetFromPath(target)
+		if !ok {
+			continue
+		}
+		targetSnap := s.Workspace.snapshot(targetFile, &s.Store)
+		if targetSnap.Scope == nil {
+			continue
+		}
+		if sym, err := FindSymbolDefinition(name, targetSnap.Scope, &s.Store); err == nil && sym.Loc.File == target {
+			continue
+		}
+		resolves := true
+		for ident, loc := range external {
+			sym, err := FindSymbolDefinition(ident, targetSnap.Scope, &s.Store)
+			if err != nil || sym.Loc != loc {
+				resolves = false
+				break
+			}
+		}
+		if !resolves {
+			continue
+		}
+
+		rel, err := filepath.Rel(filepath.Dir(path), target)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		alias, bound := libraryBinding(root, snap.Content, rel)
+		if !bound {
+			alias = libraryAlias(target, name, snap.Scope, &s.Store)
+		}
+
+		binding := ""
+		if !bound {
+			binding = fmt.Sprintf("%s = library(%s);\n", alias, strconv.Quote(rel))
+		}
+		edits := removeAndInsert(snap.Content, start, end, bindingOffset(root, snap.Content, start), binding, encoding)
+		for _, ident := range identifierNodes(root, snap.Content, name) {
+			if ident.StartByte() >= start && ident.EndByte() <= end {
+				continue
+			}
+			sym, err := FindSymbolDefinition(name, FindLowestScopeContainingRange(snap.Scope, ToRange(ident)), &s.Store)
+			if err != nil || sym.Loc != definition.Loc {
+				continue
+			}
+			edits = append(edits, transport.TextEdit{
+				Range:   replaceRange(ident.StartByte(), ident.EndByte(), string(snap.Content), encoding),
+				NewText: alias + "." + name,
+			})
+		}
+
+		targetContent := string(targetSnap.Content)
+		appended := moved
+		if strings.HasSuffix(targetContent, "\n") && !strings.HasSuffix(targetContent, "\n\n") {
+			appended = "\n" + moved
+		} else if targetContent != "" && !strings.HasSuffix(targetContent, "\n") {
+			appended = "\n\n" + moved
+		}
+		targetEnd := replaceRange(uint(len(targetContent)), uint(len(targetContent)), targetContent, encoding)
+
+		actions = append(actions, transport.CodeAction{
+			Title: fmt.Sprintf("Move %s to %s", name, rel),
+			Kind:  transport.RefactorMove,
+			Edit: &transport.WorkspaceEdit{
+				Changes: map[transport.DocumentURI][]transport.TextEdit{
+					transport.DocumentURI(uri):                   edits,
+					transport.DocumentURI(util.Path2URI(target)): {{Range: targetEnd, NewText: appended}},
+				},
+			},
+		})
+	}
+	return actions
+}
+
+// Libraries of the folder of path other than path, sorted by path
+func (w *Workspace) folderLibraries(path util.Path, store *Store) []util.Path {
+	root := w.folderFor(path).Root
+	targets := []util.Path{}
+	for _, f := range store.Files.list() {
+		f.mu.RLock()
+		target := f.Handle.Path
+		f.mu.RUnlock()
+		if target != path && IsLibFile(target) && isInside(root, target) && !w.isExcluded(target) {
+			targets = append(targets, target)
+		}
+	}
+	slices.Sort(targets)
+	return targets
+}
+
+// Returns the top-level definition whose name contains offset, and its name
+func topLevelDefinitionAt(root *tree_sitter.Node, content []byte, offset uint) (*tree_sitter.Node, string) {
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		name := definitionName(node)
+		if name != nil && name.StartByte() <= offset && offset <= name.EndByte() {
+			return node, name.Utf8Text(content)
+		}
+	}
+	return nil, ""
+}
+
+// Top-level definitions and rules named name
+func topLevelDefinitions(root *tree_sitter.Node, content []byte, name string) []*tree_sitter.Node {
+	nodes := []*tree_sitter.Node{}
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if ident := definitionName(node); ident != nil && ident.Utf8Text(content) == name {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func definitionName(node *tree_sitter.Node) *tree_sitter.Node {
+	switch node.GrammarName() {
+	case "definition":
+		return node.ChildByFieldName("variable")
+	case "function_definition":
+		return node.ChildByFieldName("name")
+	}
+	return nil
+}
+
+// Bounds of the lines of a definition and its doc comment
+func definitionBounds(node *tree_sitter.Node, content []byte) (uint, uint) {
+	first := node
+	for prev := node.PrevSibling(); prev != nil && prev.GrammarName() == "comment"; prev = prev.PrevSibling() {
+		first = prev
+	}
+	start := uint(bytes.LastIndexByte(content[:first.StartByte()], '\n') + 1)
+	end := uint(len(content))
+	if newline := bytes.IndexByte(content[node.EndByte():], '\n'); newline != -1 {
+		end = node.EndByte() + uint(newline) + 1
+	}
+	return start, end
+}
+
+// Extends the end of the lines content[start:end] that are removed to one of the blank lines around them, so that
+// removing them doesn't leave two blank lines
+func withBlankLine(content []byte, start uint, end uint) uint {
+	blankBefore := start == 0 || start >= 2 && content[start-2] == '\n'
+	if blankBefore && end < uint(len(content)) && content[end] == '\n' {
+		return end + 1
+	}
+	return end
+}
+
+// Identifiers and accesses like os.osc that node refers to
+func referencedIdentifiers(node *tree_sitter.Node, content []byte) []*tree_sitter.Node {
+	switch node.GrammarName() {
+	case "identifier", "access":
+		return []*tree_sitter.Node{node}
+	}
+	nodes := []*tree_sitter.Node{}
+	for i := range node.NamedChildCount() {
+		nodes = append(nodes, referencedIdentifiers(node.NamedChild(i), content)...)
+	}
+	return nodes
+}
+
+// Name of the top-level binding of the library at rel, e.g. fx for fx = library("effects.lib")
+func libraryBinding(root *tree_sitter.Node, content []byte, rel string) (string, bool) {
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() != "definition" {
+			continue
+		}
+		variable, value := node.ChildByFieldName("variable"), node.ChildByFieldName("value")
+		if variable == nil || value == nil || value.GrammarName() != "library" {
+			continue
+		}
+		if filename := value.ChildByFieldName("filename"); filename != nil && filepath.Clean(stripQuotes(filename.Utf8Text(content))) == filepath.Clean(rel) {
+			return variable.Utf8Text(content), true
+		}
+	}
+	return "", false
+}
+
+// A name for the binding of the library at path that isn't taken in scope: a two-letter prefix like the standard
+// libraries' when possible, the library's file name otherwise
+func libraryAlias(path util.Path, moved string, scope *Scope, store *Store) string {
+	stem := []rune{}
+	for _, r := range strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) {
+		if isIdentRune(r) {
+			stem = append(stem, r)
+		}
+	}
+	base := strings.ToLower(string(stem))
+	if base == "" || !('a' <= base[0] && base[0] <= 'z') {
+		base = "lib" + base
+	}
+	candidates := []string{base}
+	if prefix := []rune(base); len(prefix) > 2 {
+		candidates = slices.Insert(candidates, 0, string(prefix[:2]))
+	}
+	for i := 2; ; i++ {
+		for _, candidate := range candidates {
+			if _, err := FindSymbolDefinition(candidate, scope, store); err != nil && candidate != moved {
+				return candidate
+			}
+		}
+		candidates = []string{base + strconv.Itoa(i)}
+	}
+}
+
+// Offset at which a library binding is inserted: after the imports, metadata and library bindings before the
+// definition at definitionStart, or at the top of the file
+func bindingOffset(root *tree_sitter.Node, content []byte, definitionStart uint) uint {
+	offset := uint(0)
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.EndByte() > definitionStart {
+			break
+		}
+		header := false
+		switch node.GrammarName() {
+		case "file_import", "global_metadata":
+			header = true
+		case "definition":
+			value := node.ChildByFieldName("value")
+			header = value != nil && value.GrammarName() == "library"
+		}
+		if !header {
+			continue
+		}
+		offset = uint(len(content))
+		if newline := bytes.IndexByte(content[node.EndByte():], '\n'); newline != -1 {
+			offset = node.EndByte() + uint(newline) + 1
+		}
+	}
+	return offset
+}
+
+// Edits removing content[start:end] and inserting text at offset at. Edits can't overlap, so text takes the place of
+// the removed content when at is within it.
+func removeAndInsert(content []byte, start uint, end uint, at uint, text string, encoding string) []transport.TextEdit {
+	removal := transport.TextEdit{Range: replaceRange(start, end, string(content), encoding)}
+	if text == "" {
+		return []transport.TextEdit{removal}
+	}
+	if at >= start && at <= end {
+		removal.NewText = text
+		return []transport.TextEdit{removal}
+	}
+	insertion := transport.TextEdit{Range: replaceRange(at, at, string(content), encoding), NewText: text}
+	return []transport.TextEdit{insertion, removal}
+}
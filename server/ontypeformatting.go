@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Re-indents the definition completed by typing ; or the block completed by typing }, like the with { … } of a
+// definition. Lines are indented by their nesting in brackets, lines continuing an expression of the previous line by
+// one more level. Unlike faustfmt, which formats whole documents, this works while the rest of the document is being
+// written, and only changes indentation.
+func OnTypeFormatting(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.DocumentOnTypeFormattingParams
+	json.Unmarshal(par, &params)
+
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		return []byte("null"), nil
+	}
+	f.mu.RLock()
+	content := f.Content
+	f.mu.RUnlock()
+
+	offset, err := PositionToOffset(params.Position, string(content), string(s.Files.encoding))
+	if err != nil || offset == 0 || string(content[offset-1]) != params.Ch {
+		return []byte("null"), nil
+	}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return []byte("null"), nil
+	}
+	defer tree.Close()
+
+	statement, first, last, ok := completedRows(tree.RootNode(), offset)
+	if !ok {
+		return []byte("null"), nil
+	}
+	indent := GetIndent(transport.DocumentFormattingParams{Options: params.Options})
+	return json.Marshal(reindentEdits(content, statement, first, last, indent))
+}
+
+// Rows of the outermost node ending with the character before offset, and the top-level statement containing it.
+// Definitions end before their semicolon, which belongs to the block around them, so the definition before a semicolon
+// is the one it completes. Nothing is completed when the character is in a string or a comment, or when the code
+// around it doesn't parse.
+func completedRows(root *tree_sitter.Node, offset uint) (*tree_sitter.Node, uint, uint, bool) {
+	node := root.DescendantForByteRange(offset-1, offset)
+	if node == nil || node.EndByte() != offset {
+		return nil, 0, 0, false
+	}
+	last := node.EndPosition().Row
+	if node.GrammarName() == ";" {
+		node = node.PrevNamedSibling()
+		if node == nil {
+			return nil, 0, 0, false
+		}
+	}
+	for parent := node.Parent(); parent != nil && parent.Parent() != nil && parent.EndByte() == offset; parent = parent.Parent() {
+		node = parent
+	}
+	if node.HasError() || node.GrammarName() == "comment" || node.GrammarName() == "string" {
+		return nil, 0, 0, false
+	}
+	statement := node
+	for statement.Parent() != nil && statement.Parent().Parent() != nil {
+		statement = statement.Parent()
+	}
+	return statement, node.StartPosition().Row, last, true
+}
+
+// Edits changing the indentation of the rows from first to last that aren't indented at their level. Levels are
+// counted from the row statement starts on, which is at the top level.
+func reindentEdits(content []byte, statement *tree_sitter.Node, first uint, last uint, indent string) []transport.TextEdit {
+	lines := strings.Split(string(content), "\n")
+	top := int(statement.StartPosition().Row)
+	end := min(int(last), len(lines)-1)
+	levels, verbatim := indentLevels(lines[top : end+1])
+
+	edits := []transport.TextEdit{}
+	for row := int(first); row <= end; row++ {
+		line := lines[row]
+		code := strings.TrimLeft(line, " \t")
+		if code == "" || verbatim[row-top] {
+			continue
+		}
+		current := line[:len(line)-len(code)]
+		if wanted := strings.Repeat(indent, levels[row-top]); current != wanted {
+			edits = append(edits, transport.TextEdit{
+				Range: transport.Range{
+					Start: transport.Position{Line: uint32(row)},
+					// Indentation is made of ASCII characters, which take one unit in every encoding
+					End: transport.Position{Line: uint32(row), Character: uint32(len(current))},
+				},
+				NewText: wanted,
+			})
+		}
+	}
+	return edits
+}
+
+// A bracket that isn't closed yet, with the level of the line it was opened on
+type openBracket struct {
+	char  byte
+	level int
+}
+
+// Indentation level of each line, and whether it starts in a string or a block comment, whose content must be kept
+// as it is. The content of brackets is one level deeper than the line opening them, their closing bracket at the
+// same level. The first line is at the top level.
+func indentLevels(lines []string) ([]int, []bool) {
+	levels, verbatim := []int{}, []bool{}
+	brackets := []openBracket{}
+	inString, inComment := false, false
+	// Whether the code so far stops in the middle of a statement
+	continuation := false
+	for _, line := range lines {
+		code := strings.TrimLeft(line, " \t")
+		verbatim = append(verbatim, inString || inComment)
+		level := 0
+		if len(brackets) > 0 {
+			level = brackets[len(brackets)-1].level + 1
+		}
+		if code != "" && strings.ContainsRune("})]", rune(code[0])) {
+			level = max(level-1, 0)
+		} else if continuation && !strings.HasPrefix(code, "//") && (len(brackets) == 0 || brackets[len(brackets)-1].char == '{') {
+			// Arguments within parentheses are already indented by them
+			level++
+		}
+		levels = append(levels, level)
+
+		var lastCode byte
+	scan:
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case inComment:
+				if c == '*' && i+1 < len(line) && line[i+1] == '/' {
+					inComment = false
+					i++
+				}
+				continue
+			case inString:
+				if c == '"' {
+					inString = false
+					lastCode = c
+				}
+				continue
+			}
+			switch c {
+			case '"':
+				inString = true
+			case '/':
+				if i+1 < len(line) && line[i+1] == '/' {
+					break scan
+				}
+				if i+1 < len(line) && line[i+1] == '*' {
+					inComment = true
+					i++
+					continue
+				}
+			case '{', '(', '[':
+				brackets = append(brackets, openBracket{c, level})
+			case '}', ')', ']':
+				if len(brackets) > 0 {
+					brackets = brackets[:len(brackets)-1]
+				}
+			}
+			if c != ' ' && c != '\t' && c != '\r' {
+				lastCode = c
+			}
+		}
+		if lastCode != 0 {
+			continuation = lastCode != ';' && lastCode != '{' && lastCode != '}'
+		}
+	}
+	return levels, verbatim
+}
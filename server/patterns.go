@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// A rule of a pattern matching function: a rule of case{}, or a definition of a function defined several times
+type patternRule struct {
+	node      *tree_sitter.Node
+	arguments []*tree_sitter.Node
+	// Offset after the parenthesis closing the arguments
+	headEnd uint
+}
+
+// Warns about pattern matching rules that can't match, because an earlier rule of the same pattern matching function
+// matches every argument they do, e.g. (0) => … after (x) => …. Rules are tried in order, so the later rule is never used.
+func unreachableRules(uri transport.DocumentURI, content []byte, encoding string) []transport.Diagnostic {
+	diagnostics := []transport.Diagnostic{}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return diagnostics
+	}
+	defer tree.Close()
+
+	for _, rules := range patternFunctions(tree.RootNode(), content) {
+		for i, rule := range rules {
+			for _, earlier := range rules[:i] {
+				if !matchesAll(earlier, rule, content) {
+					continue
+				}
+				line := earlier.node.StartPosition().Row + 1
+				diagnostics = append(diagnostics, transport.Diagnostic{
+					Range:    replaceRange(rule.node.StartByte(), rule.headEnd, string(content), encoding),
+					Message:  fmt.Sprintf("This rule is unreachable, the rule on line %d matches everything it does", line),
+					Severity: transport.SeverityWarning,
+					Source:   "faustlsp",
+					Code:     "unreachable-rule",
+					RelatedInformation: []transport.DiagnosticRelatedInformation{{
+						Location: transport.Location{URI: uri, Range: replaceRange(earlier.node.StartByte(), earlier.headEnd, string(content), encoding)},
+						Message:  "More general rule",
+					}},
+				})
+				break
+			}
+		}
+	}
+	return diagnostics
+}
+
+// Rules of the pattern matching functions under node, in the order they are tried
+func patternFunctions(node *tree_sitter.Node, content []byte) [][]patternRule {
+	functions := [][]patternRule{}
+	if node.GrammarName() == "rules" {
+		rules := []patternRule{}
+		for i := range node.NamedChildCount() {
+			if rule := node.NamedChild(i); rule.GrammarName() == "rule" {
+				rules = append(rules, newPatternRule(rule))
+			}
+		}
+		functions = append(functions, rules)
+	}
+
+	// Definitions of the same function among the definitions of a file or an environment
+	names := []string{}
+	definitions := map[string][]patternRule{}
+	for i := range node.NamedChildCount() {
+		child := node.NamedChild(i)
+		if child.GrammarName() == "function_definition" {
+			if name := child.ChildByFieldName("name"); name != nil {
+				ident := name.Utf8Text(content)
+				if _, ok := definitions[ident]; !ok {
+					names = append(names, ident)
+				}
+				definitions[ident] = append(definitions[ident], newPatternRule(child))
+			}
+		}
+		functions = append(functions, patternFunctions(child, content)...)
+	}
+	for _, name := range names {
+		if len(definitions[name]) > 1 {
+			functions = append(functions, definitions[name])
+		}
+	}
+	return functions
+}
+
+// Finds the argument patterns of a rule or a function definition
+func newPatternRule(node *tree_sitter.Node) patternRule {
+	rule := patternRule{node: node, headEnd: node.EndByte()}
+	for i := range node.ChildCount() {
+		child := node.Child(i)
+		if child.GrammarName() == "arguments" {
+			for j := range child.NamedChildCount() {
+				if argument := child.NamedChild(j); argument.GrammarName() != "comment" {
+					rule.arguments = append(rule.arguments, argument)
+				}
+			}
+		} else if child.GrammarName() == ")" && rule.arguments != nil {
+			rule.headEnd = child.EndByte()
+			break
+		}
+	}
+	return rule
+}
+
+// Whether general matches every list of arguments specific does
+func matchesAll(general patternRule, specific patternRule, content []byte) bool {
+	if len(general.arguments) == 0 || len(general.arguments) != len(specific.arguments) {
+		return false
+	}
+	// A variable used several times only matches equal arguments
+	uses := map[string]int{}
+	for _, argument := range general.arguments {
+		countVariables(argument, content, uses)
+	}
+	for i, argument := range general.arguments {
+		if !subsumes(argument, specific.arguments[i], content, uses) {
+			return false
+		}
+	}
+	return true
+}
+
+func countVariables(node *tree_sitter.Node, content []byte, uses map[string]int) {
+	if node.GrammarName() == "identifier" {
+		uses[node.Utf8Text(content)]++
+		return
+	}
+	for i := range node.NamedChildCount() {
+		countVariables(node.NamedChild(i), content, uses)
+	}
+}
+
+// Whether the pattern general matches everything the pattern specific does: variables used once match anything,
+// other patterns only match patterns of the same shape
+func subsumes(general *tree_sitter.Node, specific *tree_sitter.Node, content []byte, uses map[string]int) bool {
+	if general.GrammarName() == "identifier" && uses[general.Utf8Text(content)] == 1 {
+		return true
+	}
+	if general.GrammarName() != specific.GrammarName() || general.ChildCount() != specific.ChildCount() {
+		return false
+	}
+	if general.ChildCount() == 0 {
+		return general.Utf8Text(content) == specific.Utf8Text(content)
+	}
+	for i := range general.ChildCount() {
+		if !subsumes(general.Child(i), specific.Child(i), content, uses) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/carn181/faustlsp/transport"
+)
+
+// ErrPositionOutOfRange is returned for positions on a line past the end of the document
+var ErrPositionOutOfRange = errors.New("position out of range")
+
+const utf8BOM = "\uFEFF"
+
+// Offsets are byte offsets into the document content. Positions count
+// characters in the code units of the encoding negotiated with the client:
+// UTF-8, UTF-16 (the default) or UTF-32.
+// Lines end with \n or \r\n, the same as for tree-sitter and the compiler.
+// A byte order mark at the start of the document isn't shown by editors, so it
+// isn't part of the first line's characters.
+// Anything past the end of a line or the document is clamped to that end and
+// offsets never fall inside a multi-byte character or a \r\n line break.
+
+// PositionToOffset converts pos to a byte offset in s.
+// A character past the end of its line is clamped to the end of the line, and
+// the line just after the last one maps to the end of the document. Lines
+// further than that return ErrPositionOutOfRange along with the end of the
+// document, so callers that only need a clamped offset can ignore the error.
+func PositionToOffset(pos transport.Position, s string, encoding string) (uint, error) {
+	indices := GetLineIndices(s)
+	line := uint(pos.Line)
+	if line > uint(len(indices)) {
+		return uint(len(s)), fmt.Errorf("%w: line %d, document has %d lines", ErrPositionOutOfRange, pos.Line, len(indices))
+	} else if line == uint(len(indices)) {
+		return uint(len(s)), nil
+	}
+
+	offset := max(indices[line], bomLength(s))
+	end := lineEnd(s, indices, line)
+	for units := uint32(0); units < pos.Character && offset < end; {
+		r, w := utf8.DecodeRuneInString(s[offset:end])
+		units += codeUnits(r, w, encoding)
+		offset += uint(w)
+	}
+	return offset, nil
+}
+
+// OffsetToPosition converts a byte offset in s to a position.
+// Offsets past the end of the document are clamped to it and an offset inside
+// a multi-byte character maps to the start of that character.
+func OffsetToPosition(offset uint, s string, encoding string) (transport.Position, error) {
+	if offset > uint(len(s)) {
+		offset = uint(len(s))
+	}
+	offset = max(offset, bomLength(s))
+	if offset > 0 && offset < uint(len(s)) && s[offset-1] == '\r' && s[offset] == '\n' {
+		offset--
+	}
+	prefix := s[:offset]
+	line := strings.Count(prefix, "\n")
+	char := uint32(0)
+	for i := max(uint(strings.LastIndexByte(prefix, '\n')+1), bomLength(s)); i < offset; {
+		r, w := utf8.DecodeRuneInString(s[i:])
+		if i+uint(w) > offset {
+			break
+		}
+		char += codeUnits(r, w, encoding)
+		i += uint(w)
+	}
+	return transport.Position{Line: uint32(line), Character: char}, nil
+}
+
+// GetLineIndices returns the byte offset of the start of every line in s.
+// A line starts after \n, so \r\n line breaks are covered as well.
+func GetLineIndices(s string) []uint {
+	lines := []uint{0}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			lines = append(lines, uint(i)+1)
+		}
+	}
+	return lines
+}
+
+// bomLength returns the length of the byte order mark s starts with, 0 if there is none
+func bomLength(s string) uint {
+	if strings.HasPrefix(s, utf8BOM) {
+		return uint(len(utf8BOM))
+	}
+	return 0
+}
+
+// lineEnd returns the offset of the end of line, excluding its line break
+func lineEnd(s string, indices []uint, line uint) uint {
+	if line+1 >= uint(len(indices)) {
+		return uint(len(s))
+	}
+	end := indices[line+1] - 1
+	if end > indices[line] && s[end-1] == '\r' {
+		end--
+	}
+	return end
+}
+
+// codeUnits returns how many code units of encoding r takes up, w being its width in bytes
+func codeUnits(r rune, w int, encoding string) uint32 {
+	switch encoding {
+	case "utf-8":
+		return uint32(w)
+	case "utf-32":
+		return 1
+	default:
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	}
+}
+
+func getDocumentEndPosition(s string, encoding string) (transport.Position, error) {
+	return OffsetToPosition(uint(len(s)), s, encoding)
+}
+
+// runeBoundary clamps offset to s and moves it back to the start of the character it falls in
+func runeBoundary(s string, offset uint) uint {
+	if offset > uint(len(s)) {
+		return uint(len(s))
+	}
+	for offset > 0 && offset < uint(len(s)) && !utf8.RuneStart(s[offset]) {
+		offset--
+	}
+	return offset
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isDottedIdentRune(r rune) bool {
+	return r == '.' || isIdentRune(r)
+}
+
+// identifierStart returns the offset where the run of characters accepted by
+// valid ending at offset starts
+func identifierStart(s string, offset uint, valid func(rune) bool) uint {
+	start := runeBoundary(s, offset)
+	for start > 0 {
+		r, w := utf8.DecodeLastRuneInString(s[:start])
+		if !valid(r) {
+			break
+		}
+		start -= uint(w)
+	}
+	return start
+}
+
+// identifierEnd returns the offset where the run of characters accepted by
+// valid starting at offset ends
+func identifierEnd(s string, offset uint, valid func(rune) bool) uint {
+	end := runeBoundary(s, offset)
+	for end < uint(len(s)) {
+		r, w := utf8.DecodeRuneInString(s[end:])
+		if !valid(r) {
+			break
+		}
+		end += uint(w)
+	}
+	return end
+}
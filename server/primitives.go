@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// A primitive of the language, documented for hover and completion as no library defines it
+type primitive struct {
+	name string
+	// Grammar name of the node of the primitive, or of the node around it for operators, like add for +
+	node string
+	// Number of inputs and outputs, -1 for compositions and primitives whose arity depends on their arguments
+	inputs, outputs int
+	usage           string
+	doc             string
+}
+
+// Catalog of the primitives, in the order they are completed in
+var primitives = []primitive{
+	{"_", "wire", 1, 1, "_", "Identity: lets its input through unchanged."},
+	{"!", "cut", 1, 0, "_ : !", "Cut: terminates its input."},
+	{"mem", "mem", 1, 1, "_ : mem", "Delays its input by one sample, like `_'`."},
+	{"'", "one_sample_delay", 1, 1, "x'", "Delays `x` by one sample, like `x : mem`."},
+	{"@", "delay", 2, 1, "_ : @(n)", "Delays its first input by the number of samples given by its second input, which must be bounded."},
+	{"prefix", "prefix", 2, 1, "prefix(init, x)", "Outputs `init` on the first sample, then `x` delayed by one sample."},
+	{"rdtable", "rdtable", 3, 1, "rdtable(size, init, ridx)", "Read-only table of `size` samples, filled with the first `size` samples of `init`, outputting the sample at index `ridx`."},
+	{"rwtable", "rwtable", 5, 1, "rwtable(size, init, widx, wsig, ridx)", "Read-write table of `size` samples, filled with the first `size` samples of `init`. Writes `wsig` at index `widx` and outputs the sample at index `ridx`."},
+	{"select2", "select2", 3, 1, "select2(s, x0, x1)", "Outputs `x0` when `s` is 0 and `x1` when `s` is 1. Both inputs are computed."},
+	{"select3", "select3", 4, 1, "select3(s, x0, x1, x2)", "Outputs `x0`, `x1` or `x2` when `s` is 0, 1 or 2. All inputs are computed."},
+	{"attach", "attach", 2, 1, "attach(x, y)", "Outputs `x`, and keeps `y` computed although its value isn't used, e.g. to display it in a bargraph."},
+	{"enable", "enable", 2, 1, "enable(x, e)", "Outputs `x` when `e` isn't 0 and 0 otherwise, skipping the computation of `x` when it isn't needed."},
+	{"control", "control", 2, 1, "control(x, c)", "Outputs `x`, computed only when `c` isn't 0, holding its last value otherwise."},
+	{"int", "int", 1, 1, "int(x)", "Converts `x` to an integer, truncating it towards 0."},
+	{"float", "float", 1, 1, "float(x)", "Converts `x` to a floating point number."},
+	{"lowest", "lowest", 1, 1, "lowest(x)", "Lowest value `x` can take, as found by the compiler."},
+	{"highest", "highest", 1, 1, "highest(x)", "Highest value `x` can take, as found by the compiler."},
+	{"assertbounds", "assertbounds", 3, 1, "assertbounds(lo, hi, x)", "Outputs `x`, telling the compiler its values are between `lo` and `hi`."},
+	{"route", "route", -1, -1, "route(ins, outs, (from, to), …)", "Routes inputs to outputs: each pair connects input `from` to output `to`, counted from 1."},
+	{"waveform", "waveform", 0, 2, "waveform{v0, v1, …}", "Outputs the number of values, and the values themselves, repeated."},
+	{"abs", "abs", 1, 1, "abs(x)", "Absolute value of `x`."},
+	{"acos", "acos", 1, 1, "acos(x)", "Arc cosine of `x`, in radians."},
+	{"asin", "asin", 1, 1, "asin(x)", "Arc sine of `x`, in radians."},
+	{"atan", "atan", 1, 1, "atan(x)", "Arc tangent of `x`, in radians."},
+	{"atan2", "atan2", 2, 1, "atan2(y, x)", "Arc tangent of `y/x`, in radians, using the signs of both to find the quadrant."},
+	{"ceil", "ceil", 1, 1, "ceil(x)", "Smallest integer not less than `x`."},
+	{"cos", "cos", 1, 1, "cos(x)", "Cosine of `x`, in radians."},
+	{"exp", "exp", 1, 1, "exp(x)", "Base-e exponential of `x`."},
+	{"floor", "floor", 1, 1, "floor(x)", "Largest integer not greater than `x`."},
+	{"fmod", "fmod", 2, 1, "fmod(x, y)", "Floating point remainder of `x/y`, with the sign of `x`."},
+	{"log", "log", 1, 1, "log(x)", "Natural logarithm of `x`."},
+	{"log10", "log10", 1, 1, "log10(x)", "Base-10 logarithm of `x`."},
+	{"max", "max", 2, 1, "max(x, y)", "Largest of `x` and `y`."},
+	{"min", "min", 2, 1, "min(x, y)", "Smallest of `x` and `y`."},
+	{"pow", "pow", 2, 1, "pow(x, y)", "`x` raised to the power `y`, like `x ^ y`."},
+	{"remainder", "remainder", 2, 1, "remainder(x, y)", "Remainder of `x/y`, rounded to the nearest integer quotient."},
+	{"rint", "rint", 1, 1, "rint(x)", "`x` rounded to the nearest integer, halfway cases to even."},
+	{"round", "round", 1, 1, "round(x)", "`x` rounded to the nearest integer, halfway cases away from 0."},
+	{"sin", "sin", 1, 1, "sin(x)", "Sine of `x`, in radians."},
+	{"sqrt", "sqrt", 1, 1, "sqrt(x)", "Square root of `x`."},
+	{"tan", "tan", 1, 1, "tan(x)", "Tangent of `x`, in radians."},
+	{"+", "add", 2, 1, "_ , _ : +", "Sum of its inputs."},
+	{"-", "sub", 2, 1, "_ , _ : -", "First input minus the second."},
+	{"*", "mult", 2, 1, "_ , _ : *", "Product of its inputs."},
+	{"/", "div", 2, 1, "_ , _ : /", "First input divided by the second."},
+	{"%", "mod", 2, 1, "_ , _ : %", "Remainder of the division of the first input by the second."},
+	{"^", "pow", 2, 1, "_ , _ : ^", "First input raised to the power of the second, like `pow`."},
+	{"&", "and", 2, 1, "_ , _ : &", "Bitwise and of its inputs, as integers."},
+	{"|", "or", 2, 1, "_ , _ : |", "Bitwise or of its inputs, as integers."},
+	{"xor", "xor", 2, 1, "_ , _ : xor", "Bitwise exclusive or of its inputs, as integers."},
+	{"<<", "lshift", 2, 1, "_ , _ : <<", "First input shifted left by the number of bits given by the second."},
+	{">>", "rshift", 2, 1, "_ , _ : >>", "First input shifted right by the number of bits given by the second."},
+	{"<", "lt", 2, 1, "_ , _ : <", "1 when the first input is less than the second, 0 otherwise."},
+	{"<=", "le", 2, 1, "_ , _ : <=", "1 when the first input is less than or equal to the second, 0 otherwise."},
+	{">", "gt", 2, 1, "_ , _ : >", "1 when the first input is greater than the second, 0 otherwise."},
+	{">=", "ge", 2, 1, "_ , _ : >=", "1 when the first input is greater than or equal to the second, 0 otherwise."},
+	{"==", "eq", 2, 1, "_ , _ : ==", "1 when its inputs are equal, 0 otherwise."},
+	{"!=", "neq", 2, 1, "_ , _ : !=", "1 when its inputs are different, 0 otherwise."},
+	{":", "sequential", -1, -1, "A : B", "Sequential composition: the outputs of `A` are connected to the inputs of `B`."},
+	{",", "parallel", -1, -1, "A , B", "Parallel composition: `A` and `B` side by side, their inputs and outputs put together."},
+	{"<:", "split", -1, -1, "A <: B", "Split composition: the outputs of `A` are distributed to the inputs of `B`, which has a multiple of their number."},
+	{":>", "merge", -1, -1, "A :> B", "Merge composition: the outputs of `A` are summed into the inputs of `B`, whose number they are a multiple of."},
+	{"~", "recursive", -1, -1, "A ~ B", "Recursive composition: the outputs of `A` are fed back through `B`, with a one sample delay, to the first inputs of `A`."},
+}
+
+// Documentation of the primitive, with its usage and its number of inputs and outputs
+func (p primitive) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "```faust\n%s\n```\n%s", p.usage, p.doc)
+	if p.inputs >= 0 {
+		fmt.Fprintf(&b, "\n\n%s, %s", plural(p.inputs, "input"), plural(p.outputs, "output"))
+	}
+	return b.String()
+}
+
+// Finds the primitive written at offset. Primitives aren't identifiers, so they are found by the node the grammar gives
+// them, and operators like + and ~ by the node around them, which e.g. tells the , of a parallel composition from the
+// one separating arguments.
+func primitiveAt(content []byte, offset uint) (primitive, bool) {
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return primitive{}, false
+	}
+	defer tree.Close()
+	node := tree.RootNode().DescendantForByteRange(offset, offset)
+	if node == nil || node.ChildCount() > 0 {
+		return primitive{}, false
+	}
+	return lookupPrimitive(node, content)
+}
+
+func lookupPrimitive(node *tree_sitter.Node, content []byte) (primitive, bool) {
+	parent := ""
+	if node.Parent() != nil {
+		parent = node.Parent().GrammarName()
+	}
+	// Number literals share the grammar name of int, so the text is compared as well
+	text := node.Utf8Text(content)
+	for _, p := range primitives {
+		if p.name == text && (p.node == node.GrammarName() || p.node == parent) {
+			return p, true
+		}
+	}
+	return primitive{}, false
+}
+
+// Completions of the primitives named like identifiers, with their documentation
+func primitiveCompletions(replaceRange transport.Range) []transport.CompletionItem {
+	plainText := transport.PlainTextTextFormat
+	items := []transport.CompletionItem{}
+	for _, p := range primitives {
+		// Operators and _ are typed rather than completed
+		if !unicode.IsLetter(rune(p.name[0])) {
+			continue
+		}
+		items = append(items, transport.CompletionItem{
+			Label:            p.name,
+			Kind:             transport.FunctionCompletion,
+			LabelDetails:     &transport.CompletionItemLabelDetails{Description: "primitive"},
+			Detail:           p.usage,
+			InsertTextFormat: &plainText,
+			Documentation: &transport.Or_CompletionItem_documentation{
+				Value: transport.MarkupContent{Kind: transport.Markdown, Value: p.markdown()},
+			},
+			TextEdit: transport.TextEdit{
+				NewText: p.name,
+				Range:   replaceRange,
+			},
+		})
+	}
+	return items
+}
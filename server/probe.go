@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+)
+
+// How long the result of looking for a compiler in PATH is reused. Looking again after that brings
+// compiler features back when faust is installed while the server is running.
+const compilerProbeInterval = 30 * time.Second
+
+// How long `faust -dspdir` may take, so that a compiler that hangs doesn't hold up the lookups waiting for it
+const compilerProbeTimeout = 2 * time.Second
+
+// Result of looking for a compiler command in PATH
+type compilerProbe struct {
+	// Path of the executable, empty if it wasn't found
+	path string
+	// Output of `faust -dspdir`
+	dspDir  string
+	checked time.Time
+}
+
+type compilerProbes struct {
+	mu     sync.Mutex
+	probes map[string]*commandProbe
+}
+
+// Latest probe of a command. Its lock is held while the command is probed, so that lookups of the command wait for
+// that probe instead of starting their own, while other commands are looked up meanwhile.
+type commandProbe struct {
+	mu     sync.Mutex
+	result compilerProbe
+	done   bool
+}
+
+var compilers compilerProbes
+
+// Looks for command in PATH and asks it for its library directory, reusing recent results
+func (c *compilerProbes) probe(command string) compilerProbe {
+	c.mu.Lock()
+	if c.probes == nil {
+		c.probes = make(map[string]*commandProbe)
+	}
+	p, ok := c.probes[command]
+	if !ok {
+		p = &commandProbe{}
+		c.probes[command] = p
+	}
+	c.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous := p.result
+	if p.done && time.Since(previous.checked) < compilerProbeInterval {
+		return previous
+	}
+
+	probe := compilerProbe{checked: time.Now()}
+	if path, err := exec.LookPath(command); err == nil {
+		probe.path = path
+		ctx, cancel := context.WithTimeout(context.Background(), compilerProbeTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, path, "-dspdir")
+		cmd.WaitDelay = time.Second
+		if output, err := cmd.Output(); err == nil {
+			probe.dspDir = strings.TrimSpace(string(output))
+		} else {
+			logging.Logger.Error("Couldn't get the library directory of the compiler", "cmd", command, "error", err)
+		}
+	}
+	if !p.done || (previous.path == "") != (probe.path == "") {
+		logging.Logger.Info("Probed compiler", "cmd", command, "path", probe.path, "dspdir", probe.dspDir)
+	}
+	p.result = probe
+	p.done = true
+	return probe
+}
+
+// Forgets previous results, e.g. when the config changes
+func (c *compilerProbes) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.probes)
+}
+
+// Whether the compiler command can be run. The user is told once when it's missing, and again when it's found,
+// as compiler diagnostics and library lookups are disabled in the meantime.
+func (s *Server) compilerAvailable(command string) bool {
+	available := compilers.probe(command).path != ""
+	// No client to notify when running from the command line
+	if s.diagChan == nil {
+		return available
+	}
+	key := "compiler-missing:" + command
+	if !available {
+		s.showMessageOnce(key, transport.Warning, fmt.Sprintf("%s was not found in PATH. Compiler diagnostics and Faust library lookups are disabled until it is installed.", command))
+	} else if s.forgetMessage(key) {
+		s.showMessage(transport.Info, fmt.Sprintf("Found %s, compiler diagnostics and Faust library lookups are enabled again.", command))
+	}
+	return available
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// A top-level process definition, i.e. a DSP that can be compiled and run
+type ProcessEntry struct {
+	URI   transport.DocumentURI `json:"uri"`
+	Range transport.Range       `json:"range"`
+	// Process name of the file, process unless configured otherwise
+	Name string `json:"name"`
+}
+
+type ProcessesResult struct {
+	Processes []ProcessEntry `json:"processes"`
+}
+
+// Returns the process definitions of the workspace's analyzed Faust files, sorted by URI
+func (w *Workspace) processes(store *Store) []ProcessEntry {
+	processes := []ProcessEntry{}
+	for _, f := range store.Files.list() {
+		f.mu.RLock()
+		path, scope := f.Handle.Path, f.Scope
+		f.mu.RUnlock()
+		// Libraries outside the workspace define processes too, e.g. as demos
+		if scope == nil || !IsFaustFile(path) || util.IsMemoryPath(path) || !w.insideWorkspace(path) || w.isExcluded(path) {
+			continue
+		}
+
+		name := w.folderFor(path).processName(path)
+		for _, sym := range scope.Symbols {
+			if sym.Ident == name && (sym.Kind == Definition || sym.Kind == Function) {
+				processes = append(processes, ProcessEntry{
+					URI:   transport.DocumentURI(util.Path2URI(path)),
+					Range: sym.Loc.Range,
+					Name:  name,
+				})
+				break
+			}
+		}
+	}
+	slices.SortFunc(processes, func(a, b ProcessEntry) int {
+		return strings.Compare(string(a.URI), string(b.URI))
+	})
+	return processes
+}
+
+// Handler for the custom faustlsp/processes request, listing the DSPs of the workspace so that clients can offer
+// to pick one to run
+func Processes(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(ProcessesResult{Processes: s.Workspace.processes(&s.Store)})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+)
+
+// Progress reports the state of a long running operation to the client with window/workDoneProgress.
+// If the client doesn't support work done progress, the operation runs the same way without reports.
+type Progress struct {
+	s     *Server
+	token string
+	// Cancelled when the client cancels the operation
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// StartProgress creates a progress token and sends the begin notification
+func (s *Server) StartProgress(ctx context.Context, title string, message string, cancellable bool) *Progress {
+	progressCtx, cancel := context.WithCancel(ctx)
+	p := &Progress{s: s, ctx: progressCtx, cancel: cancel}
+	if !s.ClientCapabilities.Window.WorkDoneProgress {
+		return p
+	}
+
+	s.progressMu.Lock()
+	if s.progress == nil {
+		s.progress = make(map[string]context.CancelFunc)
+	}
+	s.progressCtr++
+	token := fmt.Sprintf("faustlsp-%d", s.progressCtr)
+	s.progress[token] = cancel
+	s.progressMu.Unlock()
+
+	// Not waiting for the response, as this can be called while the main loop is busy handling a message.
+	// The client handles messages in order, so the token exists before the begin notification arrives.
+	_, err := s.SendRequest("window/workDoneProgress/create", transport.WorkDoneProgressCreateParams{Token: token})
+	if err != nil {
+		logging.Logger.Error("Couldn't create work done progress", "error", err)
+		s.removeProgress(token)
+		return p
+	}
+	p.token = token
+	p.notify(transport.WorkDoneProgressBegin{
+		Kind:        "begin",
+		Title:       title,
+		Message:     message,
+		Cancellable: cancellable,
+	})
+	return p
+}
+
+// Context is cancelled when the client cancels the operation or when the progress ends
+func (p *Progress) Context() context.Context {
+	return p.ctx
+}
+
+func (p *Progress) Report(message string, percentage uint32) {
+	if p.token == "" {
+		return
+	}
+	if percentage > 100 {
+		percentage = 100
+	}
+	p.notify(transport.WorkDoneProgressReport{
+		Kind:       "report",
+		Message:    message,
+		Percentage: &percentage,
+	})
+}
+
+func (p *Progress) End(message string) {
+	p.cancel()
+	if p.token == "" {
+		return
+	}
+	p.notify(transport.WorkDoneProgressEnd{
+		Kind:    "end",
+		Message: message,
+	})
+	p.s.removeProgress(p.token)
+	p.token = ""
+}
+
+func (p *Progress) notify(value any) {
+	content, err := json.Marshal(transport.ProgressParams{Token: p.token, Value: value})
+	if err != nil {
+		return
+	}
+	err = p.s.Transport.WriteNotif("$/progress", content)
+	if err != nil {
+		logging.Logger.Error("Couldn't send progress", "error", err)
+	}
+}
+
+func (s *Server) removeProgress(token string) {
+	s.progressMu.Lock()
+	delete(s.progress, token)
+	s.progressMu.Unlock()
+}
+
+// Handler for window/workDoneProgress/cancel
+func ProgressCancel(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.WorkDoneProgressCancelParams
+	json.Unmarshal(par, &params)
+
+	token := fmt.Sprint(params.Token)
+	s.progressMu.Lock()
+	cancel, ok := s.progress[token]
+	s.progressMu.Unlock()
+	if !ok {
+		return fmt.Errorf("cancel for unknown progress token: %s", token)
+	}
+	logging.Logger.Info("Client cancelled progress", "token", token)
+	cancel()
+	return nil
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Edit distance up to which a visible name is suggested for a name that doesn't resolve
+const maxTypoDistance = 2
+
+// A name at the range of a quick fix request that doesn't resolve, like os.osc without stdfaust.lib or a typo
+type unresolvedName struct {
+	snap  FileSnapshot
+	ident string
+	// Range of the whole name, e.g. of os.osc
+	rng   transport.Range
+	scope *Scope
+}
+
+// The name at the start of the range of req, false if there is none or if it resolves
+func (s *Server) unresolvedNameAt(req codeActionRequest) (unresolvedName, bool) {
+	snap := s.Workspace.snapshot(req.file, &s.Store)
+	if snap.Scope == nil {
+		return unresolvedName{}, false
+	}
+	offset, err := PositionToOffset(req.params.Range.Start, string(snap.Content), string(s.Files.encoding))
+	if err != nil {
+		return unresolvedName{}, false
+	}
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return unresolvedName{}, false
+	}
+	defer tree.Close()
+
+	node := tree.RootNode().DescendantForByteRange(offset, offset)
+	if node == nil || node.GrammarName() != "identifier" {
+		return unresolvedName{}, false
+	}
+	// The whole access the identifier is part of, like lib.env.f
+	for parent := node.Parent(); parent != nil && parent.GrammarName() == "access"; parent = parent.Parent() {
+		node = parent
+	}
+	names, ok := accessNames(node)
+	if !ok {
+		return unresolvedName{}, false
+	}
+	qualified := []string{}
+	for _, name := range names {
+		qualified = append(qualified, name.Utf8Text(snap.Content))
+	}
+	name := unresolvedName{snap: snap, ident: strings.Join(qualified, "."), rng: ToRange(node)}
+	name.scope = FindLowestScopeContainingRange(snap.Scope, name.rng)
+	if _, err := FindSymbolDefinition(name.ident, name.scope, &s.Store); err == nil {
+		return unresolvedName{}, false
+	}
+	return name, true
+}
+
+// Offers to import what defines a name that doesn't resolve: stdfaust.lib for the environments of the standard
+// libraries like os, or the library of the environment alone, like os = library("oscillators.lib"), or a library of
+// the folder defining it. Names of libraries the document already binds are accessed through their binding instead.
+// Libraries are only offered when they resolve like the compiler resolves imports, so that the fix doesn't leave
+// another error behind.
+func missingImportFixes(s *Server, req codeActionRequest) []transport.CodeAction {
+	name, ok := s.unresolvedNameAt(req)
+	if !ok {
+		return nil
+	}
+	tree := parser.ParseTree(name.snap.Content)
+	if tree == nil {
+		return nil
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+	encoding := string(s.Files.encoding)
+	at := bindingOffset(root, name.snap.Content, uint(len(name.snap.Content)))
+	diagnostics := diagnosticsAt(req.params.Context.Diagnostics, name.rng)
+
+	if env, _, qualified := strings.Cut(name.ident, "."); qualified {
+		// Members of environments that resolve are typos rather than missing imports
+		if _, err := FindSymbolDefinition(env, name.scope, &s.Store); err == nil {
+			return nil
+		}
+		library := stdlib.Current().Library(env)
+		if library == "" || importsFile(root, name.snap.Content, stdfaustLibrary) {
+			return nil
+		}
+		folderRoot := s.Workspace.folderFor(req.path).Root
+		actions := []transport.CodeAction{}
+		if resolved, _ := s.Workspace.ResolveFilePath(stdfaustLibrary, folderRoot); resolved != "" {
+			edit := importEdit(name.snap.Content, at, fmt.Sprintf("import(%s);\n", strconv.Quote(stdfaustLibrary)), encoding)
+			actions = append(actions, quickFix("Import "+stdfaustLibrary, req.params.TextDocument.URI, []transport.TextEdit{edit}, diagnostics))
+		}
+		if resolved, _ := s.Workspace.ResolveFilePath(library, folderRoot); resolved != "" {
+			edit := importEdit(name.snap.Content, at, fmt.Sprintf("%s = library(%s);\n", env, strconv.Quote(library)), encoding)
+			actions = append(actions, quickFix(fmt.Sprintf("Bind %s to %s", env, library), req.params.TextDocument.URI, []transport.TextEdit{edit}, diagnostics))
+		}
+		// Importing stdfaust.lib is the usual way of using the standard libraries
+		if len(actions) > 0 {
+			actions[0].IsPreferred = true
+		}
+		return actions
+	}
+
+	if util.IsMemoryPath(req.path) {
+		return nil
+	}
+	actions := []transport.CodeAction{}
+	for _, target := range s.Workspace.folderLibraries(req.path, &s.Store) {
+		targetSnap, ok := analyzedSnapshot(target, &s.Store)
+		if !ok || !slices.ContainsFunc(topLevelDefinitionSymbols(targetSnap.Scope), func(sym *Symbol) bool { return sym.Ident == name.ident }) {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Dir(req.path), target)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if alias, bound := libraryBinding(root, name.snap.Content, rel); bound {
+			edit := transport.TextEdit{Range: name.rng, NewText: alias + "." + name.ident}
+			actions = append(actions, quickFix(fmt.Sprintf("Change to %s.%s", alias, name.ident), req.params.TextDocument.URI, []transport.TextEdit{edit}, diagnostics))
+			continue
+		}
+		edit := importEdit(name.snap.Content, at, fmt.Sprintf("import(%s);\n", strconv.Quote(rel)), encoding)
+		actions = append(actions, quickFix("Import "+rel, req.params.TextDocument.URI, []transport.TextEdit{edit}, diagnostics))
+	}
+	return actions
+}
+
+// Offers to replace a name that doesn't resolve with the visible names closest to it, e.g. gian with gain, or
+// os.oscs with os.osc
+func typoFixes(s *Server, req codeActionRequest) []transport.CodeAction {
+	name, ok := s.unresolvedNameAt(req)
+	if !ok {
+		return nil
+	}
+	prefix, last := "", name.ident
+	if i := strings.LastIndex(name.ident, "."); i != -1 {
+		prefix, last = name.ident[:i+1], name.ident[i+1:]
+	}
+
+	candidates := []string{}
+	if prefix == "" {
+		for scope := name.scope; scope != nil; scope = scope.Parent {
+			for _, sym := range FindSymbolsNew(scope, "", &s.Store, make(map[util.Path]struct{})) {
+				candidates = append(candidates, sym.name)
+			}
+		}
+	} else {
+		env := strings.TrimSuffix(prefix, ".")
+		if sym, err := FindSymbolDefinition(env, name.scope, &s.Store); err == nil {
+			members, err := memberScope(sym, &s.Store, 0)
+			if err != nil {
+				return nil
+			}
+			for _, member := range FindSymbolsNew(members, "", &s.Store, make(map[util.Path]struct{})) {
+				candidates = append(candidates, member.name)
+			}
+		} else {
+			// Standard library environments are known without faustlibraries
+			candidates = stdlib.Current().Members(env)
+		}
+	}
+
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	suggestions := []suggestion{}
+	for _, candidate := range candidates {
+		if candidate == last || strings.Contains(candidate, ".") || slices.ContainsFunc(suggestions, func(s suggestion) bool { return s.name == candidate }) {
+			continue
+		}
+		if distance := editDistance(last, candidate); distance <= maxTypoDistance && distance < len(last) {
+			suggestions = append(suggestions, suggestion{candidate, distance})
+		}
+	}
+	slices.SortFunc(suggestions, func(a, b suggestion) int {
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	diagnostics := diagnosticsAt(req.params.Context.Diagnostics, name.rng)
+	actions := []transport.CodeAction{}
+	for i, suggestion := range suggestions[:min(len(suggestions), 3)] {
+		edit := transport.TextEdit{Range: name.rng, NewText: prefix + suggestion.name}
+		action := quickFix(fmt.Sprintf("Change to %s%s", prefix, suggestion.name), req.params.TextDocument.URI, []transport.TextEdit{edit}, diagnostics)
+		// The closest name, when no other one is as close
+		action.IsPreferred = i == 0 && (len(suggestions) == 1 || suggestions[1].distance > suggestion.distance)
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// Offers to remove the top-level definition named at the range, with its doc comment, when nothing refers to it in
+// the workspace. Definitions of libraries aren't offered, as they're meant to be used by other projects.
+func unusedDefinitionFixes(s *Server, req codeActionRequest) []transport.CodeAction {
+	if !IsDSPFile(req.path) {
+		return nil
+	}
+	snap := s.Workspace.snapshot(req.file, &s.Store)
+	if snap.Scope == nil {
+		return nil
+	}
+	encoding := string(s.Files.encoding)
+	offset, err := PositionToOffset(req.params.Range.Start, string(snap.Content), encoding)
+	if err != nil {
+		return nil
+	}
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return nil
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+
+	node, name := topLevelDefinitionAt(root, snap.Content, offset)
+	if node == nil || name == s.Workspace.folderFor(req.path).processName(req.path) || len(topLevelDefinitions(root, snap.Content, name)) > 1 {
+		return nil
+	}
+	definition, err := FindSymbolDefinition(name, snap.Scope, &s.Store)
+	if err != nil || definition.Loc.File != req.path {
+		return nil
+	}
+	for _, file := range referenceFiles(req.path, definition, &s.Store) {
+		fileSnap := snap
+		if file != req.path {
+			var ok bool
+			if fileSnap, ok = analyzedSnapshot(file, &s.Store); !ok {
+				continue
+			}
+		}
+		for _, occurrence := range symbolOccurrences(fileSnap, definition, &s.Store) {
+			if !occurrence.declaration {
+				return nil
+			}
+		}
+	}
+
+	start, end := definitionBounds(node, snap.Content)
+	end = withBlankLine(snap.Content, start, end)
+	edit := transport.TextEdit{Range: replaceRange(start, end, string(snap.Content), encoding)}
+	return []transport.CodeAction{quickFix("Remove unused definition "+name, req.params.TextDocument.URI, []transport.TextEdit{edit}, nil)}
+}
+
+func quickFix(title string, uri transport.DocumentURI, edits []transport.TextEdit, diagnostics []transport.Diagnostic) transport.CodeAction {
+	return transport.CodeAction{
+		Title:       title,
+		Kind:        transport.QuickFix,
+		Diagnostics: diagnostics,
+		Edit: &transport.WorkspaceEdit{
+			Changes: map[transport.DocumentURI][]transport.TextEdit{uri: edits},
+		},
+	}
+}
+
+// Diagnostics of the client overlapping rng, which a quick fix for rng resolves
+func diagnosticsAt(diagnostics []transport.Diagnostic, rng transport.Range) []transport.Diagnostic {
+	overlapping := []transport.Diagnostic{}
+	for _, diagnostic := range diagnostics {
+		if !positionBefore(diagnostic.Range.End, rng.Start) && !positionBefore(rng.End, diagnostic.Range.Start) {
+			overlapping = append(overlapping, diagnostic)
+		}
+	}
+	return overlapping
+}
+
+// Levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current := make([]int, len(rb)+1)
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(rb)]
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Moves everything known about a renamed file, or about the files in a renamed directory, to the new path
+func (workspace *Workspace) renamePath(oldPath util.Path, newPath util.Path, s *Server) {
+	renamed := map[util.Path]util.Path{}
+	workspace.mu.Lock()
+	for _, file := range workspace.Files {
+		if isInside(oldPath, file) {
+			rel, _ := filepath.Rel(oldPath, file)
+			renamed[file] = filepath.Join(newPath, rel)
+		}
+	}
+	workspace.mu.Unlock()
+
+	// Files moved in from outside of the workspace are new
+	if len(renamed) == 0 {
+		workspace.walk(newPath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				s.Files.OpenFromPath(path)
+				workspace.addFile(path)
+				renamed[path] = path
+			}
+			return nil
+		})
+	}
+
+	importers := map[util.Path]struct{}{}
+	for oldFile, newFile := range renamed {
+		if oldFile == newFile {
+			continue
+		}
+		for _, importer := range workspace.renameFile(oldFile, newFile, s) {
+			importers[importer] = struct{}{}
+		}
+	}
+	for oldFile := range renamed {
+		delete(importers, oldFile)
+	}
+
+	// Renamed files are analyzed under their new path, and their importers can't resolve the old path anymore
+	toAnalyze := []util.Path{}
+	for _, newFile := range renamed {
+		toAnalyze = append(toAnalyze, newFile)
+	}
+	for importer := range importers {
+		toAnalyze = append(toAnalyze, importer)
+	}
+	for _, path := range toAnalyze {
+		f, ok := s.Files.GetFromPath(path)
+		if !ok || !IsFaustFile(path) {
+			continue
+		}
+		s.analyzeInBackground(f)
+		workspace.diagnoseOn(diagnoseSave, path, s)
+	}
+}
+
+// Moves a renamed file in the File Store and the workspace, drops its cached scope which has locations in
+// the old file, removes it from the dependency graph and clears the diagnostics of the old URI.
+// Returns the files that imported the old path.
+func (workspace *Workspace) renameFile(oldPath util.Path, newPath util.Path, s *Server) []util.Path {
+	s.Files.Rename(oldPath, newPath)
+	workspace.removeFile(oldPath)
+	workspace.addFile(newPath)
+
+	if f, ok := s.Files.GetFromPath(newPath); ok {
+		f.mu.RLock()
+		hash := f.Hash
+		f.mu.RUnlock()
+		s.Store.forgetScopeOf(newPath, hash)
+	}
+
+	importers := s.Store.Dependencies.GetImporters(oldPath)
+	s.Store.Dependencies.RemoveFile(oldPath)
+
+	if IsFaustFile(oldPath) {
+		s.clearDiagnostics(oldPath)
+	}
+	logging.Logger.Info("Renamed file", "from", oldPath, "to", newPath, "importers", importers)
+	return importers
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"os"
+
+	"github.com/carn181/faustlsp/logging"
+)
+
+// Chooses where the workspace is replicated according to the config of the root folder.
+// Changing these settings takes effect when the server is restarted.
+func (w *Workspace) setupReplica(s *Server) {
+	cfg := w.rootConfig()
+	if !cfg.Replicate {
+		// Files are compiled from disk, so unsaved changes aren't seen by the compiler
+		logging.Logger.Info("Workspace replication disabled")
+		os.RemoveAll(s.tempDir)
+		s.tempDir = ""
+		w.tempDir = ""
+		return
+	}
+	w.tempDir = s.tempDir
+	if cfg.ReplicaDir == "" {
+		return
+	}
+
+	dir := w.folderFor(w.Root).Rel2Abs(cfg.ReplicaDir)
+	// The replica must not replicate itself when it is inside the workspace
+	w.replicaDir = dir
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		logging.Logger.Error("Couldn't create replica directory, using the default", "path", dir, "error", err)
+		return
+	}
+	tempDir, err := os.MkdirTemp(dir, "faustlsp-")
+	if err != nil {
+		logging.Logger.Error("Couldn't create replica directory, using the default", "path", dir, "error", err)
+		return
+	}
+	os.RemoveAll(s.tempDir)
+	s.tempDir = tempDir
+	w.tempDir = tempDir
+	logging.Logger.Info("Replicating workspace in configured directory", "path", tempDir)
+}
+
+// Whether the workspace is replicated in a temporary directory
+func (w *Workspace) replicating() bool {
+	return w.tempDir != ""
+}
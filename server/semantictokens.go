@@ -0,0 +1,370 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Token types and modifiers of semantic tokens, indexed like in the legend
+const (
+	tokenNamespace uint32 = iota
+	tokenFunction
+	tokenVariable
+	tokenParameter
+)
+
+const (
+	modifierDeclaration uint32 = 1 << iota
+	modifierReadonly
+	modifierDefaultLibrary
+)
+
+var semanticTokensLegend = transport.SemanticTokensLegend{
+	TokenTypes: []string{
+		string(transport.NamespaceType),
+		string(transport.FunctionType),
+		string(transport.VariableType),
+		string(transport.ParameterType),
+	},
+	TokenModifiers: []string{
+		string(transport.ModDeclaration),
+		string(transport.ModReadonly),
+		string(transport.ModDefaultLibrary),
+	},
+}
+
+type semanticToken struct {
+	node      *tree_sitter.Node
+	tokenType uint32
+	modifiers uint32
+}
+
+// Handler for textDocument/semanticTokens/full. Identifiers are classified by the symbol they resolve to: libraries
+// and environments, functions, definitions and parameters. Modifiers mark where symbols are declared, definitions of
+// numeric constants, and symbols of the Faust libraries, so that themes can tell them apart from project code.
+func SemanticTokens(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.SemanticTokensParams
+	json.Unmarshal(par, &params)
+
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+	tokens, ok := s.documentTokens(path)
+	if !ok {
+		return []byte("null"), nil
+	}
+	return json.Marshal(transport.SemanticTokens{ResultID: tokens.resultID, Data: tokens.data})
+}
+
+// Handler for textDocument/semanticTokens/range, the tokens of the lines the editor shows
+func SemanticTokensRange(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.SemanticTokensRangeParams
+	json.Unmarshal(par, &params)
+
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+	tokens, ok := s.documentTokens(path)
+	if !ok {
+		return []byte("null"), nil
+	}
+	inRange := []positionedToken{}
+	for _, token := range tokens.tokens {
+		start := transport.Position{Line: token.line, Character: token.character}
+		end := transport.Position{Line: token.line, Character: token.character + token.length}
+		if !positionBefore(end, params.Range.Start) && positionBefore(start, params.Range.End) {
+			inRange = append(inRange, token)
+		}
+	}
+	return json.Marshal(transport.SemanticTokens{Data: encodeSemanticTokens(inRange)})
+}
+
+// Handler for textDocument/semanticTokens/full/delta. Only the part of the tokens that changed since the result the
+// client has is sent, which is typically a few tokens around an edit. The whole tokens are sent when the client's
+// result isn't the latest one of the document anymore.
+func SemanticTokensDelta(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.SemanticTokensDeltaParams
+	json.Unmarshal(par, &params)
+
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+	previous, hadPrevious := s.semanticTokens.get(path)
+	tokens, ok := s.documentTokens(path)
+	if !ok {
+		return []byte("null"), nil
+	}
+	if !hadPrevious || previous.resultID != params.PreviousResultID {
+		return json.Marshal(transport.SemanticTokens{ResultID: tokens.resultID, Data: tokens.data})
+	}
+	return json.Marshal(transport.SemanticTokensDelta{ResultID: tokens.resultID, Edits: semanticTokensEdits(previous.data, tokens.data)})
+}
+
+func positionBefore(a transport.Position, b transport.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Character < b.Character
+}
+
+// A single edit replacing the part of previous that differs from current, none if they are equal
+func semanticTokensEdits(previous []uint32, current []uint32) []transport.SemanticTokensEdit {
+	prefix := 0
+	for prefix < len(previous) && prefix < len(current) && previous[prefix] == current[prefix] {
+		prefix++
+	}
+	if prefix == len(previous) && prefix == len(current) {
+		return []transport.SemanticTokensEdit{}
+	}
+	suffix := 0
+	for suffix < len(previous)-prefix && suffix < len(current)-prefix && previous[len(previous)-1-suffix] == current[len(current)-1-suffix] {
+		suffix++
+	}
+	return []transport.SemanticTokensEdit{{
+		Start:       uint32(prefix),
+		DeleteCount: uint32(len(previous) - prefix - suffix),
+		Data:        current[prefix : len(current)-suffix],
+	}}
+}
+
+// Semantic tokens of the documents, reused while their content and scope don't change, e.g. when the client asks for
+// the visible range after the whole document. The latest result of a document is the base of the next delta.
+type semanticTokensCache struct {
+	mu      sync.Mutex
+	entries map[util.Path]documentTokens
+	// Counter of result ids
+	results int
+}
+
+type documentTokens struct {
+	// Content and scope the tokens were classified from
+	hash     [sha256.Size]byte
+	scope    *Scope
+	resultID string
+	tokens   []positionedToken
+	data     []uint32
+}
+
+func (c *semanticTokensCache) get(path util.Path) (documentTokens, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tokens, ok := c.entries[path]
+	return tokens, ok
+}
+
+// Stores the tokens of path as its latest result, with a new result id
+func (c *semanticTokensCache) set(path util.Path, tokens documentTokens) documentTokens {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[util.Path]documentTokens)
+	}
+	c.results++
+	tokens.resultID = strconv.Itoa(c.results)
+	c.entries[path] = tokens
+	return tokens
+}
+
+// Semantic tokens of the document at path, classified again only when its content or scope changed since they were
+// last requested. False if the document isn't known.
+func (s *Server) documentTokens(path util.Path) (documentTokens, bool) {
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		logging.Logger.Error("File should've been in server file store", "path", path)
+		return documentTokens{}, false
+	}
+	snap := s.Workspace.snapshot(f, &s.Store)
+	if cached, ok := s.semanticTokens.get(path); ok && cached.hash == snap.Hash && cached.scope == snap.Scope {
+		return cached, true
+	}
+
+	tokens := documentTokens{hash: snap.Hash, scope: snap.Scope, tokens: []positionedToken{}}
+	if snap.Scope != nil {
+		if tree := parser.ParseTree(snap.Content); tree != nil {
+			c := tokenClassifier{
+				snap:       snap,
+				store:      &s.Store,
+				libraryDir: s.Workspace.folderFor(path).libraryDir(),
+				constants:  newConstantEvaluator(path, snap, &s.Store),
+				readonly:   map[Location]bool{},
+			}
+			tokens.tokens = positionTokens(c.tokens(tree.RootNode()), snap.Content, string(s.Files.encoding))
+			tree.Close()
+		}
+	}
+	tokens.data = encodeSemanticTokens(tokens.tokens)
+	return s.semanticTokens.set(path, tokens), true
+}
+
+type tokenClassifier struct {
+	snap  FileSnapshot
+	store *Store
+	// Directory of the Faust libraries, whose symbols are marked as default library
+	libraryDir util.Path
+	constants  constantEvaluator
+	// Whether definitions are numeric constants, by location
+	readonly map[Location]bool
+}
+
+// Tokens of the identifiers under node, in the order they appear
+func (c *tokenClassifier) tokens(node *tree_sitter.Node) []semanticToken {
+	switch node.GrammarName() {
+	case "identifier":
+		if token, ok := c.classify(node, node.Utf8Text(c.snap.Content), node); ok {
+			return []semanticToken{token}
+		}
+		return nil
+	case "access":
+		// Every name of a chain like lib.env.f is classified by what the chain up to it resolves to
+		if names, ok := accessNames(node); ok {
+			tokens := []semanticToken{}
+			qualified := []string{}
+			for _, name := range names {
+				qualified = append(qualified, name.Utf8Text(c.snap.Content))
+				if token, ok := c.classify(name, strings.Join(qualified, "."), node); ok {
+					tokens = append(tokens, token)
+				}
+			}
+			return tokens
+		}
+	}
+	tokens := []semanticToken{}
+	for i := range node.NamedChildCount() {
+		tokens = append(tokens, c.tokens(node.NamedChild(i))...)
+	}
+	return tokens
+}
+
+// Identifiers of an access made of names only, like lib.env.f, false if it accesses another expression
+func accessNames(node *tree_sitter.Node) ([]*tree_sitter.Node, bool) {
+	switch node.GrammarName() {
+	case "identifier":
+		return []*tree_sitter.Node{node}, true
+	case "access":
+		environment, definition := node.ChildByFieldName("environment"), node.ChildByFieldName("definition")
+		if environment == nil || definition == nil {
+			return nil, false
+		}
+		names, ok := accessNames(environment)
+		if !ok || definition.GrammarName() != "identifier" {
+			return nil, false
+		}
+		return append(names, definition), true
+	}
+	return nil, false
+}
+
+// Classifies the name node, which refers to ident as seen from the scope of the expression at
+func (c *tokenClassifier) classify(node *tree_sitter.Node, ident string, at *tree_sitter.Node) (semanticToken, bool) {
+	scope := FindLowestScopeContainingRange(c.snap.Scope, ToRange(at))
+	sym, err := FindSymbolDefinition(ident, scope, c.store)
+	if err != nil {
+		// Standard library names are still known when faustlibraries isn't installed
+		bundle := stdlib.Current()
+		if _, ok := bundle.Lookup(ident); ok {
+			return semanticToken{node: node, tokenType: tokenFunction, modifiers: modifierDefaultLibrary}, true
+		}
+		if len(bundle.Members(ident)) > 0 {
+			return semanticToken{node: node, tokenType: tokenNamespace, modifiers: modifierDefaultLibrary}, true
+		}
+		return semanticToken{}, false
+	}
+
+	token := semanticToken{node: node}
+	switch sym.Kind {
+	case Library, Environment:
+		token.tokenType = tokenNamespace
+	case Function, Case:
+		token.tokenType = tokenFunction
+	case Definition:
+		token.tokenType = tokenVariable
+		if _, err := memberScope(sym, c.store, 0); err == nil {
+			token.tokenType = tokenNamespace
+		} else if c.isConstant(sym) {
+			token.modifiers |= modifierReadonly
+		}
+	case Identifier:
+		token.tokenType = tokenParameter
+	default:
+		return semanticToken{}, false
+	}
+	if node == at && declares(node, sym) {
+		token.modifiers |= modifierDeclaration
+	}
+	// Bindings like ma = library("maths.lib") refer to a library of Faust too
+	file := sym.Loc.File
+	if sym.Kind == Library {
+		file = sym.File
+	}
+	if c.libraryDir != "" && isInside(c.libraryDir, file) {
+		token.modifiers |= modifierDefaultLibrary
+	}
+	return token, true
+}
+
+func (c *tokenClassifier) isConstant(sym Symbol) bool {
+	if readonly, ok := c.readonly[sym.Loc]; ok {
+		return readonly
+	}
+	value, ok := c.constants.definition(sym, 0)
+	c.readonly[sym.Loc] = ok && value.numeric
+	return c.readonly[sym.Loc]
+}
+
+// A token at its position in the document, which is on a single line
+type positionedToken struct {
+	line, character, length uint32
+	tokenType, modifiers    uint32
+}
+
+func positionTokens(tokens []semanticToken, content []byte, encoding string) []positionedToken {
+	positioned := []positionedToken{}
+	text := string(content)
+	for _, token := range tokens {
+		start, err := OffsetToPosition(token.node.StartByte(), text, encoding)
+		if err != nil {
+			continue
+		}
+		end, err := OffsetToPosition(token.node.EndByte(), text, encoding)
+		if err != nil || end.Line != start.Line {
+			continue
+		}
+		positioned = append(positioned, positionedToken{
+			line:      start.Line,
+			character: start.Character,
+			length:    end.Character - start.Character,
+			tokenType: token.tokenType,
+			modifiers: token.modifiers,
+		})
+	}
+	return positioned
+}
+
+// Encodes tokens relatively to the previous one, as the protocol expects
+func encodeSemanticTokens(tokens []positionedToken) []uint32 {
+	data := []uint32{}
+	var line, character uint32
+	for _, token := range tokens {
+		deltaStart := token.character
+		if token.line == line {
+			deltaStart -= character
+		}
+		data = append(data, token.line-line, deltaStart, token.length, token.tokenType, token.modifiers)
+		line, character = token.line, token.character
+	}
+	return data
+}
@@ -8,7 +8,10 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/parser"
@@ -18,6 +21,17 @@ import (
 
 // TODO: Have a type for request ID
 
+var (
+	// The client sent exit without sending shutdown first
+	ErrUngracefulExit = errors.New("exiting ungracefully")
+	// The input stream was closed without an exit notification
+	ErrStreamClosed = errors.New("stream closed: got EOF")
+	// The connection to the client couldn't be set up
+	ErrTransport = errors.New("couldn't set up transport")
+	// The temporary directory for the workspace replica couldn't be created
+	ErrTempDir = errors.New("couldn't create temporary directory")
+)
+
 type ServerState int
 
 const (
@@ -50,30 +64,80 @@ type Server struct {
 
 	// Request Id Counter for new requ ests
 	reqIdCtr int
+	// Requests sent to the client that are waiting for a response, keyed by request ID
+	pendingRequests map[string]chan transport.ResponseMessage
+	// Cancel functions of the requests from the client being handled, keyed by request ID
+	ongoingRequests map[string]context.CancelCauseFunc
+	requestsMu      sync.Mutex
+
+	// Capabilities the client sent in initialize
+	ClientCapabilities transport.ClientCapabilities
+
+	// What is traced with $/logTrace, set by initialize and $/setTrace
+	trace   transport.TraceValue
+	traceMu sync.Mutex
+
+	// Cancel functions of ongoing work done progress operations, keyed by progress token
+	progress    map[string]context.CancelFunc
+	progressCtr int
+	progressMu  sync.Mutex
+
+	// Features registered dynamically with the client
+	registrations registrations
+
+	// Code expanded by faust.expand, shown in virtual documents
+	expansions expansions
+
+	// Semantic tokens of the documents, for range and delta requests
+	semanticTokens semanticTokensCache
+
+	// Keys of the messages already shown to the user with showMessageOnce
+	shownMessages   map[string]bool
+	shownMessagesMu sync.Mutex
 
 	// Temporary Directory where we replicate workspace for diagnostics
 	tempDir util.Path
+	// Why the Faust grammar couldn't be loaded, nil if it was. Features relying on parsing don't find anything without it.
+	grammarErr error
 
 	// Diagnostic Channel
-	diagChan chan transport.PublishDiagnosticsParams
+	diagChan chan diagnosticsUpdate
+
+	// Goroutines that run in the background, stopped and waited for when the server stops
+	background backgroundTasks
 }
 
 // Initialize Server
-func (s *Server) Init(transp transport.TransportMethod) {
+// Errors wrap ErrTransport or ErrTempDir depending on what failed
+func (s *Server) Init(transp transport.TransportMethod) error {
 	s.Status = Created
-	s.Transport.Init(transport.Server, transp)
-	parser.Init()
+	err := s.Transport.Init(transport.Server, transp)
+	if err != nil {
+		logging.Logger.Error("Couldn't set up transport", "error", err)
+		return fmt.Errorf("%w: %w", ErrTransport, err)
+	}
+	// The server still runs without a grammar, the user is told once initialized
+	if err := parser.Init(); err != nil {
+		logging.Logger.Error("Couldn't load the Faust grammar", "error", err)
+		s.grammarErr = err
+	}
 
 	// Create Temporary Directory
-	faustTemp := filepath.Join(os.TempDir(), "faustlsp") // No need to create $TEMPDIR/faustlsp as logging should create it
+	faustTemp := filepath.Join(os.TempDir(), "faustlsp")
+	err = os.MkdirAll(faustTemp, 0750)
+	if err != nil {
+		logging.Logger.Error("Couldn't create temp dir", "error", err)
+		return fmt.Errorf("%w: %w", ErrTempDir, err)
+	}
 	temp_dir, err := os.MkdirTemp(faustTemp, "faustlsp-")
 	if err != nil {
 		logging.Logger.Error("Couldn't create temp dir", "error", err)
-		return
+		return fmt.Errorf("%w: %w", ErrTempDir, err)
 	} else {
 		logging.Logger.Info("Created Temp Directory", "path", temp_dir)
 	}
 	s.tempDir = temp_dir
+	return nil
 }
 
 // Might be pointless ?
@@ -81,14 +145,14 @@ func (s *Server) Init(transp transport.TransportMethod) {
 func (s *Server) Run(ctx context.Context) error {
 	var returnError error
 	end := make(chan error, 1)
-	go s.Loop(ctx, end)
+	loopCtx, cancel := context.WithCancel(ctx)
+	go s.Loop(loopCtx, end)
 	select {
 	case err := <-end:
 		if err != nil {
 			errormsg := "Ending because of error (" + err.Error() + ")"
 			logging.Logger.Info(errormsg)
-			fmt.Println(errormsg)
-			returnError = errors.New(err.Error())
+			returnError = err
 		} else {
 			logging.Logger.Info("LSP Successfully Exited")
 		}
@@ -96,6 +160,11 @@ func (s *Server) Run(ctx context.Context) error {
 		logging.Logger.Info("Canceling Main Loop")
 	}
 
+	// Stop the workspace watcher, the diagnostics publisher and pending analyses and diagnostics before cleaning up
+	cancel()
+	s.Workspace.diagTimers.stop()
+	s.background.stop()
+
 	// TODO: Have a proper cleanup function here
 	parser.Close()
 	os.RemoveAll(s.tempDir)
@@ -107,30 +176,47 @@ func (s *Server) Loop(ctx context.Context, end chan<- error) {
 	var err error
 	var msg []byte
 	var method string
+	// Closed once the last document synchronization notification read is handled
+	var synchronized chan struct{}
 
 	// LSP Server Main Loop
 	for s.Status != Exit && s.Status != ExitError && !s.Transport.Closed && err == nil {
-		// If parent cancels, make sure to stop
-		select {
-		case <-ctx.Done():
-			break
-		default:
-		}
-
 		// Read one JSON RPC Message
+		// If parent cancels, the read is interrupted so that the server stops promptly
 		logging.Logger.Debug("Reading")
-		msg, err = s.Transport.Read()
+		msg, err = s.Transport.ReadContext(ctx)
+		if ctx.Err() != nil {
+			end <- ctx.Err()
+			return
+		}
+		if errors.Is(err, transport.ErrInvalidMessage) {
+			// Only the offending message is skipped, the session goes on
+			logging.Logger.Warn("Skipping message", "error", err)
+			s.rejectUnparsed(err)
+			err = nil
+			continue
+		}
 		if err != nil {
 			logging.Logger.Error("Scanning error", "error", err)
+			break
+		}
+		if s.Transport.Closed {
+			break
 		}
 
 		// Parse JSON RPC Message here and get method
 		method, err = transport.GetMethod(msg)
-		if len(method) == 0 {
-			break
-		}
 		if err != nil {
-			logging.Logger.Error("Parsing error", "error", err)
+			logging.Logger.Warn("Parsing error", "error", err)
+			s.rejectUnparsed(err)
+			err = nil
+			continue
+		}
+		if len(method) == 0 {
+			// Responses to requests sent by the server don't have a method
+			if s.handleResponse(msg) {
+				continue
+			}
 			break
 		}
 
@@ -139,7 +225,15 @@ func (s *Server) Loop(ctx context.Context, end chan<- error) {
 		// Validate Message (error if the client shouldn't be sending that method)
 		err = s.ValidateMethod(method)
 		if err != nil {
-			break
+			// The server keeps running, requests are answered with an error and notifications are dropped
+			logging.Logger.Warn("Rejecting message", "method", method, "error", err)
+			code := transport.InvalidRequest
+			if s.Status == Created {
+				code = transport.ServerNotInitialized
+			}
+			s.rejectRequest(msg, code, err)
+			err = nil
+			continue
 		}
 
 		// Dispatch to Method Handler
@@ -148,19 +242,36 @@ func (s *Server) Loop(ctx context.Context, end chan<- error) {
 		switch method {
 		case "exit", "shutdown", "initialize", "initialized":
 			s.HandleMethod(ctx, method, msg)
+		case "textDocument/didOpen", "textDocument/didChange", "textDocument/didSave", "textDocument/didClose":
+			// Each of these builds on the previous ones, so they are handled in the order they were sent. They wait
+			// for each other rather than for the loop, so that the messages read meanwhile aren't held up.
+			previous, handled := synchronized, make(chan struct{})
+			synchronized = handled
+			go func(method string, msg []byte) {
+				defer close(handled)
+				if previous != nil {
+					<-previous
+				}
+				s.HandleMethod(ctx, method, msg)
+			}(method, msg)
 		default:
-			go s.HandleMethod(ctx, method, msg)
+			requestCtx, done := s.startRequest(ctx, msg)
+			// The message is passed on, as the next read replaces msg and method
+			go func(method string, msg []byte) {
+				defer done()
+				s.HandleMethod(requestCtx, method, msg)
+			}(method, msg)
 		}
 	}
 	if s.Status == ExitError {
-		err = errors.New("exiting ungracefully")
-		end <- err
+		end <- ErrUngracefulExit
+		return
 	} else if s.Status == Exit {
 		end <- nil
 		return
 	}
 	if err == nil && s.Transport.Closed {
-		err = errors.New("stream closed: got EOF")
+		err = ErrStreamClosed
 	} else {
 		s.Transport.Close()
 	}
@@ -172,7 +283,7 @@ func (s *Server) Loop(ctx context.Context, end chan<- error) {
 func (s *Server) ValidateMethod(method string) error {
 	switch s.Status {
 	case Created:
-		if method != "initialize" {
+		if method != "initialize" && method != "exit" {
 			return errors.New("Server not started, but received " + method)
 		}
 	case Shutdown:
@@ -184,6 +295,7 @@ func (s *Server) ValidateMethod(method string) error {
 }
 
 // Main Handle Method
+// Every request gets a response: a result, the error of its handler, or an error if no handler exists for it
 func (s *Server) HandleMethod(ctx context.Context, method string, content []byte) {
 	// TODO: Receive only content, no Header
 	handler, ok := requestHandlers[method]
@@ -191,19 +303,32 @@ func (s *Server) HandleMethod(ctx context.Context, method string, content []byte
 		var m transport.RequestMessage
 		json.Unmarshal(content, &m)
 		logging.Logger.Debug("Request ID", "type", reflect.TypeOf(m.ID), "value", m.ID)
-		if reflect.TypeOf(m.ID).String() == "float64" {
-			s.reqIdCtr = int(m.ID.(float64) + 1)
-		}
 
 		// Main handle method for request and get response
-		resp, err := handler(ctx, s, m.Params)
+		start := time.Now()
+		resp, err := callRequestHandler(ctx, s, handler, m.Params)
+		s.logTraceSince(start, fmt.Sprintf("Handled request '%s - (%v)'", method, m.ID), func() string { return string(m.Params) })
 
 		var responseError *transport.ResponseError
-		if err != nil {
+		if requestCancelled(ctx) {
+			// Whatever the handler got done is of no use to the client anymore
+			resp = nil
+			responseError = &transport.ResponseError{
+				Code:    int(transport.RequestCancelled),
+				Message: errRequestCancelled.Error(),
+			}
+		} else if err != nil {
+			resp = nil
 			responseError = &transport.ResponseError{
 				Code:    int(transport.InternalError),
 				Message: err.Error(),
 			}
+		} else if !json.Valid(resp) {
+			// Handlers that have nothing to return may return no content at all
+			if len(resp) > 0 {
+				logging.Logger.Error("Handler returned invalid JSON", "method", method, "result", string(resp))
+			}
+			resp = json.RawMessage("null")
 		}
 		err = s.Transport.WriteResponse(m.ID, resp, responseError)
 		if err != nil {
@@ -219,34 +344,153 @@ func (s *Server) HandleMethod(ctx context.Context, method string, content []byte
 		json.Unmarshal(content, &m)
 
 		// Send Request Message to appropriate Handler
+		start := time.Now()
 		err := handler2(ctx, s, m.Params)
+		s.logTraceSince(start, fmt.Sprintf("Handled notification '%s'", method), func() string { return string(m.Params) })
 		if err != nil {
 			logging.Logger.Warn(err.Error())
 			return
 		}
+		return
+	}
+	s.rejectRequest(content, transport.MethodNotFound, fmt.Errorf("method not found: %s", method))
+}
+
+// Runs a request handler, turning panics into errors so that the request still gets a response
+func callRequestHandler(ctx context.Context, s *Server, handler func(context.Context, *Server, json.RawMessage) (json.RawMessage, error), params json.RawMessage) (resp json.RawMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Logger.Error("Request handler panicked", "panic", r, "stack", string(debug.Stack()))
+			resp, err = nil, fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	return handler(ctx, s, params)
+}
+
+// Responds to msg with an error if it is a request. Notifications can't be answered and are only logged.
+func (s *Server) rejectRequest(msg []byte, code transport.ErrorCodes, err error) {
+	var m transport.RequestMessage
+	if json.Unmarshal(msg, &m) != nil || m.ID == nil {
+		// Notifications starting with $/ are optional and can be ignored silently
+		if !strings.HasPrefix(m.Method, "$/") {
+			logging.Logger.Info("Ignoring notification", "method", m.Method, "reason", err)
+		}
+		return
+	}
+	responseError := &transport.ResponseError{Code: int(code), Message: err.Error()}
+	if err := s.Transport.WriteResponse(m.ID, nil, responseError); err != nil {
+		logging.Logger.Warn(err.Error())
+	}
+}
+
+// Answers a message that couldn't be read or parsed. Its ID is unknown, so the response has a null ID.
+func (s *Server) rejectUnparsed(err error) {
+	responseError := &transport.ResponseError{Code: int(transport.ParseError), Message: err.Error()}
+	if err := s.Transport.WriteResponse(nil, nil, responseError); err != nil {
+		logging.Logger.Warn(err.Error())
+	}
+}
+
+// Sends a request to the client. The response can be received from the returned channel, and can be ignored if not needed.
+func (s *Server) SendRequest(method string, params any) (<-chan transport.ResponseMessage, error) {
+	content, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make(chan transport.ResponseMessage, 1)
+	s.requestsMu.Lock()
+	if s.pendingRequests == nil {
+		s.pendingRequests = make(map[string]chan transport.ResponseMessage)
+	}
+	s.reqIdCtr++
+	id := s.reqIdCtr
+	s.pendingRequests[fmt.Sprint(id)] = response
+	s.requestsMu.Unlock()
+
+	err = s.Transport.WriteRequest(id, method, content)
+	if err != nil {
+		s.requestsMu.Lock()
+		delete(s.pendingRequests, fmt.Sprint(id))
+		s.requestsMu.Unlock()
+		return nil, err
+	}
+	return response, nil
+}
+
+// Passes a response from the client to the request waiting for it. Returns false if msg isn't a response.
+func (s *Server) handleResponse(msg []byte) bool {
+	var m transport.ResponseMessage
+	err := json.Unmarshal(msg, &m)
+	if err != nil || m.ID == nil {
+		return false
+	}
+
+	s.requestsMu.Lock()
+	response, ok := s.pendingRequests[fmt.Sprint(m.ID)]
+	delete(s.pendingRequests, fmt.Sprint(m.ID))
+	s.requestsMu.Unlock()
+
+	if !ok {
+		logging.Logger.Warn("Got response for unknown request", "id", m.ID)
+		return true
+	}
+	if m.Error != nil {
+		logging.Logger.Warn("Client responded with error", "id", m.ID, "error", m.Error.Message)
 	}
-	return
+	response <- m
+	return true
 }
 
 // Map from method to method handler for request methods
 var requestHandlers = map[string]func(context.Context, *Server, json.RawMessage) (json.RawMessage, error){
-	"initialize":                  Initialize,
-	"textDocument/documentSymbol": TextDocumentSymbol,
-	"textDocument/formatting":     Formatting,
-	"textDocument/definition":     GetDefinition,
-	"textDocument/hover":          Hover,
-	"textDocument/completion":     Completion,
-	"shutdown":                    ShutdownEnd,
+	"initialize":                             Initialize,
+	"textDocument/documentSymbol":            TextDocumentSymbol,
+	"textDocument/formatting":                withFeature(func(f FeaturesConfig) bool { return f.Formatting }, Formatting),
+	"textDocument/onTypeFormatting":          withFeature(func(f FeaturesConfig) bool { return f.Formatting }, OnTypeFormatting),
+	"textDocument/definition":                GetDefinition,
+	"textDocument/references":                GetReferences,
+	"textDocument/documentHighlight":         DocumentHighlights,
+	"textDocument/semanticTokens/full":       SemanticTokens,
+	"textDocument/semanticTokens/full/delta": SemanticTokensDelta,
+	"textDocument/semanticTokens/range":      SemanticTokensRange,
+	"textDocument/codeAction":                CodeActions,
+	"textDocument/signatureHelp":             SignatureHelp,
+	"textDocument/hover":                     withFeature(func(f FeaturesConfig) bool { return f.Hover }, Hover),
+	"textDocument/completion":                withFeature(func(f FeaturesConfig) bool { return f.Completion }, Completion),
+	"textDocument/inlayHint":                 withFeature(func(f FeaturesConfig) bool { return f.InlayHints }, InlayHints),
+	"textDocument/codeLens":                  withFeature(func(f FeaturesConfig) bool { return f.CodeLens }, CodeLens),
+	"codeLens/resolve":                       withFeature(func(f FeaturesConfig) bool { return f.CodeLens }, CodeLensResolve),
+	"shutdown":                               ShutdownEnd,
+	"workspace/executeCommand":               ExecuteCommand,
+	"workspace/textDocumentContent":          TextDocumentContent,
+
+	// Custom requests
+	"faustlsp/dependencyGraph": DependencyGraphExport,
+	"faustlsp/diagnose":        Diagnose,
+	"faustlsp/effectiveConfig": EffectiveConfig,
+	"faustlsp/processes":       Processes,
+	"faustlsp/stats":           Stats,
+	// Name the request was first published under
+	"faust/processes": Processes,
 }
 
 // Map from method to method handler for request methods
 var notificationHandlers = map[string]func(context.Context, *Server, json.RawMessage) error{
-	"initialized":            Initialized,
-	"textDocument/didOpen":   TextDocumentOpen,
-	"textDocument/didChange": TextDocumentChangeIncremental,
-	"textDocument/didClose":  TextDocumentClose,
-	// The save action of textDocument/didSave should be handled by our watcher to our store, so no need to handle
-	"exit": ExitEnd,
+	"initialized":                    Initialized,
+	"textDocument/didOpen":           TextDocumentOpen,
+	"textDocument/didChange":         TextDocumentChangeIncremental,
+	"textDocument/didClose":          TextDocumentClose,
+	"window/workDoneProgress/cancel": ProgressCancel,
+	"$/cancelRequest":                CancelRequest,
+	"$/setTrace":                     SetTrace,
+	// The save action of textDocument/didSave should be handled by our watcher to our store, only on-save diagnostics are triggered here
+	"textDocument/didSave":                TextDocumentSave,
+	"workspace/didChangeWorkspaceFolders": WorkspaceFoldersChange,
+	"workspace/didChangeConfiguration":    DidChangeConfiguration,
+	"workspace/didDeleteFiles":            DidDeleteFiles,
+	"workspace/didChangeWatchedFiles":     DidChangeWatchedFiles,
+	"exit":                                ExitEnd,
 }
 
 func TextDocumentSymbol(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Shows the parameters of the function called around the position, with the one the argument at the position is
+// passed to highlighted. Parameters come from the arguments of the function's definition, or from the usage of its
+// documentation for functions of the standard libraries that couldn't be resolved.
+func SignatureHelp(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	var params transport.SignatureHelpParams
+	json.Unmarshal(par, &params)
+
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		logging.Logger.Error("Uri2path error", "error", err)
+		return []byte{}, err
+	}
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		logging.Logger.Error("File should've been in server file store", "path", path)
+		return []byte("null"), nil
+	}
+	snap := s.Workspace.snapshot(f, &s.Store)
+	encoding := string(s.Files.encoding)
+	offset, err := PositionToOffset(params.Position, string(snap.Content), encoding)
+	if err != nil {
+		return []byte("null"), nil
+	}
+
+	// The call is usually being typed, so it is found in the text rather than in the syntax tree
+	calleeEnd, argument, ok := enclosingCall(snap.Content, offset)
+	if !ok {
+		return []byte("null"), nil
+	}
+	callee, scope := FindSymbolScopeAtOffset(snap.Content, snap.Scope, calleeEnd, encoding)
+	if callee == "" || strings.HasPrefix(callee, ".") || strings.HasSuffix(callee, ".") {
+		return []byte("null"), nil
+	}
+
+	parameters := []string{}
+	sym, err := FindSymbolDefinition(callee, scope, &s.Store)
+	docs := sym.Docs
+	if libraryDoc, ok := libraryDocs(callee, sym, err); ok {
+		docs = libraryDoc
+	}
+	if err == nil && sym.Kind == Function && sym.Scope != nil {
+		for _, parameter := range sym.Scope.Symbols {
+			parameters = append(parameters, parameter.Ident)
+		}
+	}
+	name := callee[strings.LastIndex(callee, ".")+1:]
+	fromUsage, usageCall := usageParameters(docs.Usage, name)
+	if len(parameters) == 0 {
+		parameters = fromUsage
+	}
+	if len(parameters) == 0 {
+		return []byte("null"), nil
+	}
+
+	// Past the last parameter, the result of the function is called and no parameter is active
+	active := uint32(min(argument, len(parameters)))
+	signature := signatureInformation{SignatureInformation: transport.SignatureInformation{
+		Label:           callee + "(" + strings.Join(parameters, ", ") + ")",
+		ActiveParameter: active,
+	}}
+	for _, parameter := range parameters {
+		signature.Parameters = append(signature.Parameters, transport.ParameterInformation{Label: parameter})
+	}
+	if docs.Usage != "" {
+		usage := docs.Usage
+		if usageCall {
+			usage = "```faust\n" + usage + "\n```"
+		}
+		signature.Documentation = &transport.MarkupContent{Kind: transport.Markdown, Value: usage}
+	}
+	return json.Marshal(signatureHelp{
+		SignatureHelp: transport.SignatureHelp{ActiveParameter: &active},
+		Signatures:    []signatureInformation{signature},
+	})
+}
+
+// Signature help whose documentation is markdown. The documentation of transport.SignatureInformation is a union
+// that would be marshaled as an object wrapping the markdown.
+type signatureHelp struct {
+	transport.SignatureHelp
+	Signatures []signatureInformation `json:"signatures"`
+}
+
+type signatureInformation struct {
+	transport.SignatureInformation
+	Documentation *transport.MarkupContent `json:"documentation,omitempty"`
+}
+
+// Finds the call whose parentheses are open at offset, returning where its callee ends and the index of the argument
+// at offset. Parentheses and commas in strings, like the labels of sliders, are skipped. Calls don't span statements.
+func enclosingCall(content []byte, offset uint) (uint, int, bool) {
+	depth, argument := 0, 0
+	inString := false
+	for i := int(min(offset, uint(len(content)))) - 1; i >= 0; i-- {
+		c := content[i]
+		if c == '"' {
+			inString = !inString
+		}
+		if inString {
+			continue
+		}
+		switch c {
+		case ')':
+			depth++
+		case '(':
+			if depth == 0 {
+				end := uint(i)
+				for end > 0 && (content[end-1] == ' ' || content[end-1] == '\t') {
+					end--
+				}
+				return end, argument, true
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				argument++
+			}
+		case ';', '{', '}':
+			if depth == 0 {
+				return 0, 0, false
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Parameters of the call of name in the usage of its documentation, like N and fc in _ : fi.lowpass(N,fc) : _, and
+// whether the usage shows a call of it at all
+func usageParameters(usage string, name string) ([]string, bool) {
+	start := -1
+	for from := 0; start == -1; {
+		i := strings.Index(usage[from:], name+"(")
+		if i == -1 {
+			return nil, false
+		}
+		i += from
+		// A whole name, possibly qualified like fi.lowpass, not the end of another one like in highpass
+		if i == 0 || !isIdentRune(rune(usage[i-1])) {
+			start = i + len(name) + 1
+		}
+		from = i + 1
+	}
+	end := strings.Index(usage[start:], ")")
+	if end == -1 {
+		return nil, true
+	}
+	parameters := []string{}
+	for _, parameter := range strings.Split(usage[start:start+end], ",") {
+		if parameter = strings.TrimSpace(parameter); parameter != "" {
+			parameters = append(parameters, parameter)
+		}
+	}
+	return parameters, true
+}
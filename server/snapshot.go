@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/sha256"
+
+	"github.com/carn181/faustlsp/util"
+)
+
+// A consistent view of a document for feature requests, Scope being the scope
+// analyzed from exactly Content. Changes replace Content instead of modifying
+// it in place, so a snapshot stays valid while the document keeps changing.
+type FileSnapshot struct {
+	Content []byte
+	Scope   *Scope
+	Version int32
+	Hash    [sha256.Size]byte
+}
+
+// Times a document is analyzed for a snapshot before settling for a snapshot without scope
+const snapshotAttempts = 3
+
+// Returns the content of f along with its scope, analyzing f first if it
+// changed since it was last analyzed, e.g. while an edit is still being analyzed.
+// When the document keeps changing faster than it is analyzed, the snapshot has
+// no scope rather than a scope of other content.
+func (w *Workspace) snapshot(f *File, store *Store) FileSnapshot {
+	for attempt := 1; ; attempt++ {
+		f.mu.RLock()
+		snap := FileSnapshot{Content: f.Content, Scope: f.Scope, Version: f.Version, Hash: f.Hash}
+		current := f.Scope != nil && f.scopeHash == f.Hash
+		path := f.Handle.Path
+		f.mu.RUnlock()
+		if current || !IsFaustFile(path) {
+			return snap
+		}
+		if attempt == snapshotAttempts {
+			if analyzed, ok := analyzedSnapshot(path, store); ok {
+				return analyzed
+			}
+			snap.Scope = nil
+			return snap
+		}
+		w.AnalyzeFileSync(f, store)
+	}
+}
+
+// Returns the content of the file at path along with its scope, if its scope was
+// analyzed from its current content. Unlike snapshot, the file isn't analyzed again.
+func analyzedSnapshot(path util.Path, store *Store) (FileSnapshot, bool) {
+	f, ok := store.Files.GetFromPath(path)
+	if !ok {
+		return FileSnapshot{}, false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.Scope == nil || f.scopeHash != f.Hash {
+		return FileSnapshot{}, false
+	}
+	return FileSnapshot{Content: f.Content, Scope: f.Scope, Version: f.Version, Hash: f.Hash}, true
+}
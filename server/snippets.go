@@ -0,0 +1,87 @@
+package server
+
+import (
+	"github.com/carn181/faustlsp/transport"
+)
+
+// A keyword or primitive of the language, completed with placeholders for its arguments
+type construct struct {
+	name string
+	// Arguments after the name, shown next to it in the completion list
+	signature string
+	// What the name is followed by as a snippet, with a tab stop for each argument
+	snippet string
+}
+
+// Keywords and constructs, which aren't defined by any library. Without snippets, only their name is inserted.
+var keywords = []construct{
+	{"process", " = …;", " = $0;"},
+	{"import", `("file.lib");`, `("${1:stdfaust.lib}");`},
+	{"declare", ` name "value";`, ` ${1:name} "${2:value}";`},
+	{"with", " { … }", " {\n\t$0\n}"},
+	{"letrec", " { … }", " {\n\t$0\n}"},
+	{"environment", " { … }", " {\n\t$0\n}"},
+	{"library", `("file.lib")`, `("${1:file.lib}")`},
+	{"component", `("file.dsp")`, `("${1:file.dsp}")`},
+	{"case", " { (x) => …; }", " {\n\t(${1:x}) => ${2:x};\n}"},
+	{"par", "(i, N, expr)", "(${1:i}, ${2:N}, ${3:_})"},
+	{"seq", "(i, N, expr)", "(${1:i}, ${2:N}, ${3:_})"},
+	{"sum", "(i, N, expr)", "(${1:i}, ${2:N}, ${3:_})"},
+	{"prod", "(i, N, expr)", "(${1:i}, ${2:N}, ${3:_})"},
+	{"ffunction", "(prototype, include, library)", `(${1:float f(float)}, ${2:<math.h>}, "${3}")`},
+}
+
+// Primitives of the user interface, only offered as snippets as their arguments are the point of completing them
+var uiSnippets = []construct{
+	{"button", `("label")`, `("${1:label}")`},
+	{"checkbox", `("label")`, `("${1:label}")`},
+	{"hslider", `("label", init, min, max, step)`, `("${1:label}", ${2:0}, ${3:0}, ${4:1}, ${5:0.01})`},
+	{"vslider", `("label", init, min, max, step)`, `("${1:label}", ${2:0}, ${3:0}, ${4:1}, ${5:0.01})`},
+	{"nentry", `("label", init, min, max, step)`, `("${1:label}", ${2:0}, ${3:0}, ${4:1}, ${5:1})`},
+	{"hbargraph", `("label", min, max)`, `("${1:label}", ${2:0}, ${3:1})`},
+	{"vbargraph", `("label", min, max)`, `("${1:label}", ${2:0}, ${3:1})`},
+	{"hgroup", `("label", x)`, `("${1:label}", ${2:_})`},
+	{"vgroup", `("label", x)`, `("${1:label}", ${2:_})`},
+	{"tgroup", `("label", x)`, `("${1:label}", ${2:_})`},
+}
+
+// Completions of the keywords and primitives, and of the user interface primitives for clients supporting snippets,
+// which insert the arguments as placeholders to fill in. Only offered for names that aren't accessed in an environment,
+// as these aren't members of one.
+func constructCompletions(content string, replaceRange transport.Range, encoding string, snippets bool) []transport.CompletionItem {
+	start, err := PositionToOffset(replaceRange.Start, content, encoding)
+	if err != nil || (start > 0 && content[start-1] == '.') {
+		return nil
+	}
+	items := []transport.CompletionItem{}
+	for _, keyword := range keywords {
+		items = append(items, constructItem(keyword, transport.KeywordCompletion, "Keyword", replaceRange, snippets))
+	}
+	if snippets {
+		for _, ui := range uiSnippets {
+			items = append(items, constructItem(ui, transport.SnippetCompletion, "User interface primitive", replaceRange, true))
+		}
+	}
+	items = append(items, primitiveCompletions(replaceRange)...)
+	return items
+}
+
+func constructItem(c construct, kind transport.CompletionItemKind, detail string, replaceRange transport.Range, snippet bool) transport.CompletionItem {
+	format := transport.PlainTextTextFormat
+	text := c.name
+	if snippet {
+		format = transport.SnippetTextFormat
+		text += c.snippet
+	}
+	return transport.CompletionItem{
+		Label:            c.name,
+		Kind:             kind,
+		LabelDetails:     &transport.CompletionItemLabelDetails{Detail: c.signature},
+		Detail:           detail,
+		InsertTextFormat: &format,
+		TextEdit: transport.TextEdit{
+			NewText: text,
+			Range:   replaceRange,
+		},
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Source actions reordering the top-level statements of a file
+const (
+	sortDefinitionsAlphabetically transport.CodeActionKind = "source.sortDefinitions.alphabetical"
+	sortDefinitionsByDependencies transport.CodeActionKind = "source.sortDefinitions.dependencies"
+)
+
+// Groups of top-level statements, in the order they are sorted into
+const (
+	importStatements = iota
+	declareStatements
+	definitionStatements
+)
+
+// A top-level statement along with its doc comment
+type statementChunk struct {
+	node  *tree_sitter.Node
+	text  string
+	group int
+	// Name of definitions, rules of a pattern matching function sharing theirs
+	name string
+}
+
+// Statements between comments that stand on their own, like the section headings of libraries. Statements are
+// only reordered within their section so that headings keep introducing the same definitions.
+type statementSection struct {
+	// Comments before the statements, separated from them by a blank line
+	heading string
+	chunks  []statementChunk
+}
+
+// Offers to sort the top-level statements of f: imports first, then declare statements, then definitions sorted
+// alphabetically or so that definitions come after the ones they use. Not offered when f is already sorted.
+func sortDefinitionsActions(s *Server, f *File) []transport.CodeAction {
+	f.mu.RLock()
+	uri := f.Handle.URI
+	f.mu.RUnlock()
+	snap := s.Workspace.snapshot(f, &s.Store)
+	if snap.Scope == nil {
+		return nil
+	}
+	tree := parser.ParseTree(snap.Content)
+	if tree == nil {
+		return nil
+	}
+	defer tree.Close()
+	root := tree.RootNode()
+	// Statements of broken content can't be told apart
+	if root.HasError() {
+		return nil
+	}
+
+	sections, ok := statementSections(root, snap.Content)
+	if !ok {
+		return nil
+	}
+	encoding := string(s.Files.encoding)
+	whole := replaceRange(0, uint(len(snap.Content)), string(snap.Content), encoding)
+	actions := []transport.CodeAction{}
+	for _, sort := range []struct {
+		title string
+		kind  transport.CodeActionKind
+		order func([]statementChunk) []statementChunk
+	}{
+		{"Sort definitions alphabetically", sortDefinitionsAlphabetically, alphabeticalOrder},
+		{"Sort definitions by dependencies", sortDefinitionsByDependencies, func(chunks []statementChunk) []statementChunk {
+			return dependencyOrder(chunks, snap, &s.Store)
+		}},
+	} {
+		sorted := sortedContent(sections, sort.order)
+		if sorted == string(snap.Content) {
+			continue
+		}
+		actions = append(actions, transport.CodeAction{
+			Title: sort.title,
+			Kind:  sort.kind,
+			Edit: &transport.WorkspaceEdit{
+				Changes: map[transport.DocumentURI][]transport.TextEdit{
+					transport.DocumentURI(uri): {{Range: whole, NewText: sorted}},
+				},
+			},
+		})
+	}
+	return actions
+}
+
+// Splits the top-level statements of root into sections. Doc comments, i.e. comments right above a statement,
+// belong to it, and comments after a statement on its line too. Returns false if there are statements
+// that can't be reordered.
+func statementSections(root *tree_sitter.Node, content []byte) ([]statementSection, bool) {
+	sections := []statementSection{{}}
+	pending := []*tree_sitter.Node{}
+	var previousEnd uint
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() == "comment" {
+			// Comments after a statement on its line are part of it
+			if node.StartByte() < previousEnd {
+				continue
+			}
+			pending = append(pending, node)
+			continue
+		}
+
+		chunk := statementChunk{node: node}
+		switch node.GrammarName() {
+		case "file_import":
+			chunk.group = importStatements
+		case "global_metadata", "function_metadata":
+			chunk.group = declareStatements
+		case "definition", "function_definition":
+			chunk.group = definitionStatements
+			chunk.name = definitionName(node).Utf8Text(content)
+		default:
+			return nil, false
+		}
+
+		// The comments right above the statement are its doc comment, earlier ones stand on their own
+		attached := len(pending)
+		next := node.StartByte()
+		for attached > 0 && !hasBlankLine(content[pending[attached-1].EndByte():next]) {
+			attached--
+			next = pending[attached].StartByte()
+		}
+		if attached > 0 {
+			start := lineStart(content, pending[0].StartByte())
+			sections = append(sections, statementSection{heading: strings.TrimRight(string(content[start:pending[attached-1].EndByte()]), "\r\n")})
+		}
+		start := lineStart(content, node.StartByte())
+		if attached < len(pending) {
+			start = lineStart(content, pending[attached].StartByte())
+		}
+		end := lineEndOffset(content, node.EndByte())
+		chunk.text = strings.TrimRight(string(content[start:end]), "\r\n")
+		sections[len(sections)-1].chunks = append(sections[len(sections)-1].chunks, chunk)
+		pending = pending[:0]
+		previousEnd = end
+	}
+	if len(pending) > 0 {
+		start := lineStart(content, pending[0].StartByte())
+		sections = append(sections, statementSection{heading: strings.TrimRight(string(content[start:]), "\r\n")})
+	}
+	return sections, true
+}
+
+// Content of the file with the statements of each section grouped and their definitions ordered by order.
+// Imports and declare statements of every section are moved to the first one with statements.
+func sortedContent(sections []statementSection, order func([]statementChunk) []statementChunk) string {
+	var header [definitionStatements][]statementChunk
+	for _, section := range sections {
+		for _, chunk := range section.chunks {
+			if chunk.group != definitionStatements {
+				header[chunk.group] = append(header[chunk.group], chunk)
+			}
+		}
+	}
+
+	// The first section with statements, as sections before it only have comments, e.g. a license header
+	first := slices.IndexFunc(sections, func(section statementSection) bool { return len(section.chunks) > 0 })
+	parts := []string{}
+	for i, section := range sections {
+		if section.heading != "" {
+			parts = append(parts, section.heading)
+		}
+		groups := [][]statementChunk{}
+		if i == first {
+			groups = append(groups, header[importStatements], header[declareStatements])
+		}
+		definitions := []statementChunk{}
+		for _, chunk := range section.chunks {
+			if chunk.group == definitionStatements {
+				definitions = append(definitions, chunk)
+			}
+		}
+		groups = append(groups, order(definitions))
+		for _, group := range groups {
+			if len(group) > 0 {
+				parts = append(parts, joinChunks(group))
+			}
+		}
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// Joins statements that fit on a line each without blank lines, others with blank lines to keep them apart
+func joinChunks(chunks []statementChunk) string {
+	separator := "\n"
+	for _, chunk := range chunks {
+		if strings.Contains(chunk.text, "\n") {
+			separator = "\n\n"
+		}
+	}
+	texts := []string{}
+	for _, chunk := range chunks {
+		texts = append(texts, chunk.text)
+	}
+	return strings.Join(texts, separator)
+}
+
+// Sorts definitions by name. Rules of a function keep their order.
+func alphabeticalOrder(chunks []statementChunk) []statementChunk {
+	sorted := slices.Clone(chunks)
+	slices.SortStableFunc(sorted, func(a, b statementChunk) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return sorted
+}
+
+// Sorts definitions so that they come after the definitions of chunks they use, keeping the original order
+// otherwise. Definitions using each other, which is only possible through environments, stay in their order.
+func dependencyOrder(chunks []statementChunk, snap FileSnapshot, store *Store) []statementChunk {
+	// Names in order of first appearance, with their rules and the names they depend on
+	names := []string{}
+	rules := map[string][]statementChunk{}
+	for _, chunk := range chunks {
+		if _, ok := rules[chunk.name]; !ok {
+			names = append(names, chunk.name)
+		}
+		rules[chunk.name] = append(rules[chunk.name], chunk)
+	}
+	dependencies := map[string]map[string]bool{}
+	for _, chunk := range chunks {
+		if dependencies[chunk.name] == nil {
+			dependencies[chunk.name] = map[string]bool{}
+		}
+		for _, ident := range referencedIdentifiers(chunk.node, snap.Content) {
+			name := ident.Utf8Text(snap.Content)
+			if _, ok := rules[name]; !ok || name == chunk.name {
+				continue
+			}
+			sym, err := FindSymbolDefinition(name, FindLowestScopeContainingRange(snap.Scope, ToRange(ident)), store)
+			if err != nil || !slices.ContainsFunc(rules[name], func(c statementChunk) bool {
+				return RangeContains(ToRange(c.node), sym.Loc.Range)
+			}) {
+				continue
+			}
+			dependencies[chunk.name][name] = true
+		}
+	}
+
+	sorted := []statementChunk{}
+	placed := map[string]bool{}
+	for len(placed) < len(names) {
+		next := ""
+		for _, name := range names {
+			if placed[name] {
+				continue
+			}
+			ready := true
+			for dependency := range dependencies[name] {
+				if !placed[dependency] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = name
+				break
+			}
+		}
+		// Cycles are left in their order
+		if next == "" {
+			for _, name := range names {
+				if !placed[name] {
+					next = name
+					break
+				}
+			}
+		}
+		placed[next] = true
+		sorted = append(sorted, rules[next]...)
+	}
+	return sorted
+}
+
+func hasBlankLine(between []byte) bool {
+	return bytes.Count(between, []byte("\n")) > 1
+}
+
+// Offset of the start of the line containing offset
+func lineStart(content []byte, offset uint) uint {
+	return uint(bytes.LastIndexByte(content[:offset], '\n') + 1)
+}
+
+// Offset after the end of the line containing offset, including its line break
+func lineEndOffset(content []byte, offset uint) uint {
+	if newline := bytes.IndexByte(content[offset:], '\n'); newline != -1 {
+		return offset + uint(newline) + 1
+	}
+	return uint(len(content))
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// IndexWorkspace analyzes every Faust file in the workspace at root along with the files they import, without a client connection.
+// Used by command line subcommands that need the symbol store or the dependency graph.
+func IndexWorkspace(ctx context.Context, root util.Path) (*Server, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("workspace root is not a directory: %s", root)
+	}
+
+	if err := parser.Init(); err != nil {
+		return nil, err
+	}
+	s := &Server{}
+	s.Files.Init(ctx, transport.UTF16)
+	s.Store.Files = &s.Files
+	s.Store.Dependencies = NewDependencyGraph()
+	s.Store.Cache = make(map[[sha256.Size]byte]*Scope)
+	s.Workspace.Root = root
+
+	// Config is loaded before walking for the exclude patterns
+	s.Workspace.loadConfigFiles(s)
+
+	err = s.Workspace.walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (IsFaustFile(path) || filepath.Base(path) == faustConfigFile) {
+			s.Files.OpenFromPath(path)
+			s.Workspace.addFile(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// and again after walking so that default process files are known
+	s.Workspace.loadConfigFiles(s)
+
+	for _, path := range s.Workspace.Files {
+		select {
+		case <-ctx.Done():
+			return s, ctx.Err()
+		default:
+		}
+		f, ok := s.Files.GetFromPath(path)
+		if ok && IsFaustFile(path) {
+			s.Workspace.AnalyzeFileSync(f, &s.Store)
+		}
+	}
+	return s, nil
+}
+
+// AnalyzeFileSync is like AnalyzeFile, but returns only after the file and everything it imports has been parsed
+func (workspace *Workspace) AnalyzeFileSync(f *File, store *Store) {
+	visited := newVisitedSet()
+
+	store.beginAnalysis()
+	defer store.endAnalysis()
+
+	queue := []*File{f}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		// Collect the imports found while parsing the current file
+		fileChan := make(chan string)
+		imports := make(chan []util.Path)
+		go func() {
+			paths := []util.Path{}
+			for path := range fileChan {
+				// The imports are analyzed as part of this call
+				store.endAnalysis()
+				visited.pending.Done()
+				paths = append(paths, path)
+			}
+			imports <- paths
+		}()
+
+		workspace.ParseFile(current, store, visited, fileChan)
+		close(fileChan)
+
+		for _, path := range <-imports {
+			if path == "" {
+				continue
+			}
+			if _, ok := visited.state(path); ok {
+				continue
+			}
+			importedFile, ok := store.Files.GetFromPath(path)
+			if !ok {
+				store.Files.OpenFromPath(path)
+				importedFile, ok = store.Files.GetFromPath(path)
+			}
+			if ok {
+				queue = append(queue, importedFile)
+			}
+		}
+	}
+	logging.Logger.Info("Analyzed file and its imports", "path", f.Handle.Path, "files", visited.len())
+}
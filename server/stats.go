@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+	tree_sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+type StatsResult struct {
+	// Files in the file store, including imported libraries outside of the workspace
+	Files int `json:"files"`
+	// Files of the store that have been analyzed
+	AnalyzedFiles int `json:"analyzedFiles"`
+	// Faust files of the workspace folders
+	WorkspaceFiles int `json:"workspaceFiles"`
+	// Definitions, functions and pattern matching functions of analyzed files, at any depth
+	Definitions int `json:"definitions"`
+	// Uses of identifiers and accesses like os.osc in analyzed files
+	References  int        `json:"references"`
+	ImportEdges int        `json:"importEdges"`
+	Cache       CacheStats `json:"cache"`
+	// Analyzed files, slowest first
+	Analysis []FileAnalysisStats `json:"analysis"`
+}
+
+type CacheStats struct {
+	// Scopes cached by content hash
+	Scopes int `json:"scopes"`
+	// Size of the content of the files in the store, in bytes
+	ContentBytes int `json:"contentBytes"`
+	// Compiler commands whose lookup in PATH is cached
+	CompilerProbes int `json:"compilerProbes"`
+}
+
+type FileAnalysisStats struct {
+	URI transport.DocumentURI `json:"uri"`
+	// Time the last parse and analysis of the file took in milliseconds, without its imports
+	DurationMs float64 `json:"durationMs"`
+}
+
+// Gathers counts about the workspace and the analysis of its files, to find out what makes a project slow
+func (s *Server) stats() StatsResult {
+	result := StatsResult{Analysis: []FileAnalysisStats{}}
+	for _, f := range s.Store.Files.list() {
+		f.mu.RLock()
+		path, scope, content, duration := f.Handle.Path, f.Scope, f.Content, f.analysisDuration
+		f.mu.RUnlock()
+		result.Files++
+		result.Cache.ContentBytes += len(content)
+		if scope == nil {
+			continue
+		}
+		result.AnalyzedFiles++
+		result.Definitions += countDefinitions(scope)
+		result.References += countReferences(content)
+		result.Analysis = append(result.Analysis, FileAnalysisStats{
+			URI:        transport.DocumentURI(util.Path2URI(path)),
+			DurationMs: float64(duration) / float64(time.Millisecond),
+		})
+	}
+	slices.SortFunc(result.Analysis, func(a, b FileAnalysisStats) int {
+		if a.DurationMs != b.DurationMs {
+			if a.DurationMs > b.DurationMs {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(string(a.URI), string(b.URI))
+	})
+
+	s.Workspace.mu.Lock()
+	for _, path := range s.Workspace.Files {
+		if IsFaustFile(path) {
+			result.WorkspaceFiles++
+		}
+	}
+	s.Workspace.mu.Unlock()
+	result.ImportEdges = len(s.Store.Dependencies.Edges())
+
+	s.Store.mu.Lock()
+	result.Cache.Scopes = len(s.Store.Cache)
+	s.Store.mu.Unlock()
+	compilers.mu.Lock()
+	result.Cache.CompilerProbes = len(compilers.probes)
+	compilers.mu.Unlock()
+	return result
+}
+
+func countDefinitions(scope *Scope) int {
+	count := 0
+	for _, sym := range scope.Symbols {
+		switch sym.Kind {
+		case Definition, Function, Case:
+			count++
+		}
+	}
+	for _, child := range scope.Children {
+		count += countDefinitions(child)
+	}
+	return count
+}
+
+// Counts the identifiers and accesses of content that refer to a symbol, leaving out the names and arguments
+// that definitions declare
+func countReferences(content []byte) int {
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return 0
+	}
+	defer tree.Close()
+	return countNodeReferences(tree.RootNode())
+}
+
+func countNodeReferences(node *tree_sitter.Node) int {
+	switch node.GrammarName() {
+	case "identifier", "access":
+		return 1
+	}
+	count := 0
+	for i := range node.NamedChildCount() {
+		child := node.NamedChild(i)
+		if declaresNames(node, child) {
+			continue
+		}
+		count += countNodeReferences(child)
+	}
+	return count
+}
+
+// Whether child is the name or the arguments a definition or a rule of parent declares
+func declaresNames(parent *tree_sitter.Node, child *tree_sitter.Node) bool {
+	switch parent.GrammarName() {
+	case "definition":
+		variable := parent.ChildByFieldName("variable")
+		return variable != nil && variable.Id() == child.Id()
+	case "function_definition":
+		name := parent.ChildByFieldName("name")
+		return name != nil && name.Id() == child.Id() || child.GrammarName() == "arguments"
+	case "rule":
+		return child.GrammarName() == "arguments"
+	}
+	return false
+}
+
+// Handler for the custom faustlsp/stats request, returning counts and analysis durations to diagnose slow projects
+func Stats(ctx context.Context, s *Server, par json.RawMessage) (json.RawMessage, error) {
+	return json.Marshal(s.stats())
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/carn181/faustlsp/parser"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Generates the documentation bundle of the faustlibraries checkout at dir from the doc comments of the libraries
+// stdfaust.lib binds, naming functions by their environment there, e.g. os.osc
+func GenerateDocsBundle(dir util.Path, version string) (*stdlib.Bundle, error) {
+	if err := parser.Init(); err != nil {
+		return nil, err
+	}
+	return generateDocsBundle(dir, version)
+}
+
+// Like GenerateDocsBundle, for when the parser is already initialized
+func generateDocsBundle(dir util.Path, version string) (*stdlib.Bundle, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "stdfaust.lib"))
+	if err != nil {
+		return nil, err
+	}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return nil, parser.ErrIncompatibleGrammar
+	}
+	defer tree.Close()
+
+	bundle := &stdlib.Bundle{Version: version, Generated: time.Now().UTC(), Docs: map[string]stdlib.Doc{}}
+	root := tree.RootNode()
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		if node.GrammarName() != "definition" {
+			continue
+		}
+		prefix, value := node.ChildByFieldName("variable"), node.ChildByFieldName("value")
+		if prefix == nil || value == nil || value.GrammarName() != "library" {
+			continue
+		}
+		filename := value.ChildByFieldName("filename")
+		if filename == nil {
+			continue
+		}
+		library := stripQuotes(filename.Utf8Text(content))
+		if err := addLibraryDocs(bundle, prefix.Utf8Text(content), filepath.Join(dir, library)); err != nil {
+			return nil, fmt.Errorf("%s: %w", library, err)
+		}
+	}
+	return bundle, nil
+}
+
+// Adds the documented top-level definitions of the library at path to bundle
+func addLibraryDocs(bundle *stdlib.Bundle, prefix string, path util.Path) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tree := parser.ParseTree(content)
+	if tree == nil {
+		return parser.ErrIncompatibleGrammar
+	}
+	defer tree.Close()
+
+	root := tree.RootNode()
+	for i := range root.NamedChildCount() {
+		node := root.NamedChild(i)
+		var name string
+		switch node.GrammarName() {
+		case "definition":
+			if ident := node.ChildByFieldName("variable"); ident != nil {
+				name = ident.Utf8Text(content)
+			}
+		case "function_definition":
+			if ident := node.ChildByFieldName("name"); ident != nil {
+				name = ident.Utf8Text(content)
+			}
+		}
+		if name == "" {
+			continue
+		}
+		docs := ParseDocumentation(node, content)
+		if docs.Full == "" {
+			continue
+		}
+		bundle.Docs[prefix+"."+name] = stdlib.Doc{Library: filepath.Base(path), Full: docs.Full, Usage: docs.Usage}
+	}
+	return nil
+}
+
+// Documentation of a qualified name like os.osc from the standard library bundle. It is used when the symbol
+// couldn't be resolved, e.g. because faustlibraries isn't installed, or when its library has no doc comment for it.
+func libraryDocs(qualified string, sym Symbol, err error) (Documentation, bool) {
+	doc, ok := stdlib.Current().Lookup(qualified)
+	if !ok {
+		return Documentation{}, false
+	}
+	// Symbols of the user's own code that happen to have the same name keep their documentation
+	if err == nil && (sym.Docs.Full != "" || filepath.Base(sym.Loc.File) != doc.Library) {
+		return Documentation{}, false
+	}
+	return Documentation{Full: doc.Full, Usage: doc.Usage}, true
+}
+
+// Completions for the members of a standard library environment like os, for when its library couldn't be resolved
+func libraryCompletions(prefix string) []CompletionSym {
+	bundle := stdlib.Current()
+	symbols := []CompletionSym{}
+	for _, member := range bundle.Members(prefix) {
+		doc, _ := bundle.Lookup(prefix + "." + member)
+		// Functions are told from constants by the call of their usage
+		kind := transport.VariableCompletion
+		if _, call := usageParameters(doc.Usage, member); call {
+			kind = transport.FunctionCompletion
+		}
+		symbols = append(symbols, CompletionSym{
+			name: member,
+			docs: Documentation{Full: doc.Full, Usage: doc.Usage},
+			kind: kind,
+			file: util.Path(doc.Library),
+		})
+	}
+	return symbols
+}
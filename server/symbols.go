@@ -4,13 +4,11 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"log/slog"
-	"os/exec"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
 	"time"
-	"unicode"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/parser"
@@ -120,22 +118,11 @@ func ParseDocumentation(node *tree_sitter.Node, content []byte) Documentation {
 		}
 
 		lineContent := curr.Utf8Text(content)
-		lineContent = lineContent[len("//"):]
-		// Double spaces for markdown
-		docContent = slices.Insert(docContent, 0, lineContent)
+		lineContent = strings.TrimSuffix(lineContent[len("//"):], "\r")
+		docContent = slices.Insert(docContent, 0, strings.TrimPrefix(lineContent, " "))
 	}
 
-	usage := ""
-	if len(docContent) > 1 {
-		usage = docContent[1]
-	} else if len(docContent) == 1 {
-		usage = docContent[0]
-	}
-
-	doc := Documentation{
-		Full:  strings.Join(docContent, "  \n"),
-		Usage: usage,
-	}
+	doc := renderDocumentation(docContent)
 	logging.Logger.Info("Parsed docs", "documentation", doc)
 	return doc
 }
@@ -353,10 +340,24 @@ func (dg *DependencyGraph) RemoveDependenciesForFile(path util.Path) {
 		delete(dg.imports, path) // Remove its own entry
 	}
 
-	// Remove any incoming dependencies (if another file was importing it)
-	// This is effectively handled by the other file being re-analyzed or removed.
-	// But good to clean up if the file itself is deleted.
-	delete(dg.importedBy, path) // If this file was being imported
+	// Incoming dependencies are kept, as the files importing this one haven't changed.
+	// They are handled by the other file being re-analyzed or removed.
+}
+
+// Removes a deleted file from the graph, along with the edges from the files importing it.
+// The importers get their edges back when they are re-analyzed.
+func (dg *DependencyGraph) RemoveFile(path util.Path) {
+	dg.RemoveDependenciesForFile(path)
+
+	dg.mu.Lock()
+	defer dg.mu.Unlock()
+	for importerPath := range dg.importedBy[path] {
+		delete(dg.imports[importerPath], path)
+		if len(dg.imports[importerPath]) == 0 {
+			delete(dg.imports, importerPath)
+		}
+	}
+	delete(dg.importedBy, path)
 }
 
 // GetImporters returns a list of URIs that import the given file.
@@ -373,6 +374,25 @@ func (dg *DependencyGraph) GetImporters(path string) []string {
 	return importers
 }
 
+// Returns the files that import path, directly or through other imported files
+func (dg *DependencyGraph) Dependents(path util.Path) []util.Path {
+	dependents := []util.Path{}
+	visited := map[util.Path]bool{path: true}
+	queue := []util.Path{path}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, importer := range dg.GetImporters(current) {
+			if !visited[importer] {
+				visited[importer] = true
+				dependents = append(dependents, importer)
+				queue = append(queue, importer)
+			}
+		}
+	}
+	return dependents
+}
+
 type SymbolKey struct {
 	File util.Path
 	Name string
@@ -390,6 +410,57 @@ type Store struct {
 	References   ReferenceMap
 	Dependencies DependencyGraph
 	Cache        map[[sha256.Size]byte]*Scope
+
+	indexing indexingTracker
+}
+
+type visitState int
+
+const (
+	visitInProgress visitState = iota
+	visitDone
+)
+
+// Files reached by one analysis. Shared by the goroutines that parse the imported files.
+type visitedSet struct {
+	mu    sync.Mutex
+	files map[util.Path]visitState
+	// Imported files queued for parsing that haven't been parsed yet
+	pending sync.WaitGroup
+}
+
+func newVisitedSet() *visitedSet {
+	return &visitedSet{files: make(map[util.Path]visitState)}
+}
+
+// Marks path as being parsed. Returns false if it was already reached, so that every file is parsed once per analysis.
+func (v *visitedSet) visit(path util.Path) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.files[path]; ok {
+		return false
+	}
+	v.files[path] = visitInProgress
+	return true
+}
+
+func (v *visitedSet) done(path util.Path) {
+	v.mu.Lock()
+	v.files[path] = visitDone
+	v.mu.Unlock()
+}
+
+func (v *visitedSet) state(path util.Path) (visitState, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	state, ok := v.files[path]
+	return state, ok
+}
+
+func (v *visitedSet) len() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.files)
 }
 
 // This needs workspace to be able to resolve the file path
@@ -397,78 +468,125 @@ type Store struct {
 func (workspace *Workspace) AnalyzeFile(f *File, store *Store) {
 	// 3) After 1) and 2) are done, resolve all symbols as references
 
-	var visited = make(map[util.Path]struct{})
+	visited := newVisitedSet()
 
 	// Stack for files to parse after current file
 	var fileChan = make(chan string)
 
 	// Parse through file import tree asynchronously to speed up parsing times using a pipeline
 	go func() {
-		for {
-			select {
-			case currentFile := <-fileChan:
-				logging.Logger.Info("Parsing file", "file", currentFile)
+		for currentFile := range fileChan {
+			logging.Logger.Info("Parsing file", "file", currentFile)
+			go func() {
+				defer visited.pending.Done()
+				defer store.endAnalysis()
 				f, ok := store.Files.GetFromPath(currentFile)
 				//logging.Logger.Info("AST Traversal: Got library definition", "file", current, "ident", identName)
-				if ok {
-					go workspace.ParseFile(f, store, visited, fileChan)
-
-				} else {
+				if !ok {
 					store.Files.OpenFromPath(currentFile)
-					f, ok := store.Files.GetFromPath(currentFile)
-					if ok {
-						go workspace.ParseFile(f, store, visited, fileChan)
-					}
-
+					f, ok = store.Files.GetFromPath(currentFile)
 				}
-			// Close file channel after 30 seconds
-			// TODO: Find way to close channel when all files are done parsing
-			case <-time.After(5 * time.Second):
-				logging.Logger.Info("Closing file channel as nothing received for 5 seconds")
-				close(fileChan)
-				return
-			}
+				if ok {
+					workspace.ParseFile(f, store, visited, fileChan)
+				}
+			}()
 		}
 	}()
 
 	logging.Logger.Info("Starting to analyze file", "path", f.Handle.Path)
+	store.beginAnalysis()
 	workspace.ParseFile(f, store, visited, fileChan)
+	store.endAnalysis()
+
+	// Imports are queued before the file importing them is done, so once nothing is pending no more imports can be queued
+	visited.pending.Wait()
+	close(fileChan)
 
 	logging.Logger.Info("AST Parsing completed for file", "file", f.Handle.Path)
 	//	logging.Logger.Info("Dependency Graph", "graph", store.Dependencies.imports)
 }
 
-func (workspace *Workspace) ParseFile(f *File, store *Store, visited map[util.Path]struct{}, fileChan chan string) {
+func (workspace *Workspace) ParseFile(f *File, store *Store, visited *visitedSet, fileChan chan string) {
+	path := f.Handle.Path
 	// If file is already visited, skip it
-	if _, ok := visited[f.Handle.Path]; !ok {
-		f.mu.Lock()
-		// Check if file content of this type is already parsed
-		scope, ok := store.Cache[f.Hash]
-		if ok {
-			logging.Logger.Info("File already parsed, using cached scope", "file", f.Handle.Path)
-			f.Scope = scope
-			f.mu.Unlock()
+	if !visited.visit(path) {
+		if state, _ := visited.state(path); state == visitInProgress {
+			logging.Logger.Info("Skipping file as it is already being parsed", "file", path)
 		} else {
-
-			tree := parser.ParseTree(f.Content)
+			logging.Logger.Info("Skipping file as it is already visited", "file", path)
+		}
+		return
+	}
+	defer visited.done(path)
+
+	f.mu.Lock()
+	// The scope of the previous content is stale once the file has changed
+	previous := f.scopeHash
+	f.scopeHash = f.Hash
+	if previous != f.Hash && previous != ([sha256.Size]byte{}) {
+		defer store.forgetScope(previous)
+	}
+	// Check if file content of this type is already parsed
+	store.mu.Lock()
+	scope, ok := store.Cache[f.Hash]
+	store.mu.Unlock()
+	if ok {
+		logging.Logger.Info("File already parsed, using cached scope", "file", path)
+		f.Scope = scope
+		// Imported files still have to be loaded and registered as dependencies
+		store.Dependencies.RemoveDependenciesForFile(path)
+		followScopeImports(path, scope, store, visited, fileChan)
+		f.mu.Unlock()
+	} else {
+		started := time.Now()
+		tree := parser.ParseTree(f.Content)
+		// Imports are collected again while traversing the tree
+		store.Dependencies.RemoveDependenciesForFile(path)
+		scope := NewScope(nil, transport.Range{})
+		// Without a grammar the file is known but has no symbols
+		if tree != nil {
 			root := tree.RootNode()
-			scope := NewScope(nil, ToRange(root))
-			visited[f.Handle.Path] = struct{}{}
+			scope.Range = ToRange(root)
 			workspace.ParseASTNode(root, f, scope, store, visited, fileChan)
-			f.Scope = scope
-			store.Cache[f.Hash] = scope
-			f.mu.Unlock()
-
-			//			tree.Close()
-			logging.Logger.Info("Parsed file", "path", f.Handle.Path)
 		}
-	} else {
-		logging.Logger.Info("Skipping file as it is already visited", "file", f.Handle.Path)
+		f.Scope = scope
+		f.analysisDuration = time.Since(started)
+		store.mu.Lock()
+		store.Cache[f.Hash] = scope
+		store.mu.Unlock()
+		f.mu.Unlock()
+
+		//			tree.Close()
+		logging.Logger.Info("Parsed file", "path", path)
 	}
+}
 
+// Sends an imported file to be analyzed. The receiver ends the analysis and marks the import as no longer
+// pending once it is done with it.
+func queueImport(path util.Path, store *Store, visited *visitedSet, fileChan chan string) {
+	store.beginAnalysis()
+	visited.pending.Add(1)
+	fileChan <- path
 }
 
-func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *File, scope *Scope, store *Store, visited map[util.Path]struct{}, fileChan chan string) {
+// Registers dependencies and queues imported files of a scope that didn't have to be parsed (e.g. from the cache)
+func followScopeImports(path util.Path, scope *Scope, store *Store, visited *visitedSet, fileChan chan string) {
+	for _, sym := range scope.Symbols {
+		switch sym.Kind {
+		case Import:
+			queueImport(sym.File, store, visited, fileChan)
+			store.Dependencies.AddDependency(path, sym.File)
+		case Library:
+			queueImport(sym.File, store, visited, fileChan)
+			store.Dependencies.AddLibraryDependency(path, sym.File, sym.Ident)
+		}
+	}
+	for _, child := range scope.Children {
+		followScopeImports(path, child, store, visited, fileChan)
+	}
+}
+
+func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *File, scope *Scope, store *Store, visited *visitedSet, fileChan chan string) {
 	// Parse Symbols recursively. Map from tree_sitter.Node -> a Symbol type
 	if node == nil {
 		logging.Logger.Error("AST Parsing Traversal Error: Node is nil", "node", node)
@@ -501,13 +619,12 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 			}
 
 			libraryFilePath := stripQuotes(fileName.Utf8Text(currentFile.Content))
-			resolvedPath, _ := workspace.ResolveFilePath(libraryFilePath, workspace.Root)
+			resolvedPath, _ := workspace.ResolveFilePath(libraryFilePath, workspace.folderFor(currentFile.Handle.Path).Root)
 
 			logging.Logger.Info("AST Traversal: Got library definition", "file", resolvedPath, "ident", identName)
-			fileChan <- resolvedPath
+			queueImport(resolvedPath, store, visited, fileChan)
 
 			logging.Logger.Info("AST Traversal: Got library definition", "file", resolvedPath, "ident", identName)
-			store.Dependencies.RemoveDependenciesForFile(currentFile.Handle.Path)
 			store.Dependencies.AddLibraryDependency(currentFile.Handle.Path, resolvedPath, identName)
 
 			sym := NewLibrary(Location{
@@ -623,8 +740,9 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 			return
 		}
 
-		// Treat it as a part of a pattern scope because arguments defined are only in function scope
-		exprScope := NewScope(scope, ToRange(node))
+		// Treat it as a part of a pattern scope because arguments defined are only in function scope. Nested in the
+		// arguments scope, so that the local environments and iterations of the value see the arguments.
+		exprScope := NewScope(argumentsScope, ToRange(node))
 		logging.Logger.Info("Parsing function value using separate scope")
 		for i := uint(0); i < node.ChildCount(); i++ {
 			workspace.ParseASTNode(node.Child(i), currentFile, exprScope, store, visited, fileChan)
@@ -684,7 +802,8 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 			workspace.ParseASTNode(environment.NamedChild(i), currentFile, withScope, store, visited, fileChan)
 		}
 
-		exprScope := NewScope(scope, ToRange(node))
+		// The expression sees the local definitions, and the iterations and patterns it contains are found inside it
+		exprScope := NewScope(withScope, ToRange(expr))
 		logging.Logger.Info("AST Traversal: Parsing expr definition", "child", expr.GrammarName())
 		workspace.ParseASTNode(expr, currentFile, exprScope, store, visited, fileChan)
 
@@ -714,7 +833,7 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 			workspace.ParseASTNode(environment.Child(i), currentFile, letRecScope, store, visited, fileChan)
 		}
 
-		exprScope := NewScope(scope, ToRange(node))
+		exprScope := NewScope(letRecScope, ToRange(expr))
 		workspace.ParseASTNode(expr, currentFile, exprScope, store, visited, fileChan)
 
 		sym := NewLetRecEnvironment(Location{
@@ -734,12 +853,11 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 
 		// Strip quotes as file name comes as "file_name" not just file_name in tree_sitter grammar
 		file := stripQuotes(fileNode.Utf8Text(currentFile.Content))
-		resolvedPath, _ := workspace.ResolveFilePath(file, workspace.Root)
+		resolvedPath, _ := workspace.ResolveFilePath(file, workspace.folderFor(currentFile.Handle.Path).Root)
 		logging.Logger.Info("AST Traversal: Got import statement. Going through tree", "file", resolvedPath)
 
-		fileChan <- resolvedPath
+		queueImport(resolvedPath, store, visited, fileChan)
 
-		store.Dependencies.RemoveDependenciesForFile(currentFile.Handle.Path)
 		store.Dependencies.AddDependency(currentFile.Handle.Path, resolvedPath)
 
 		sym := NewImport(
@@ -828,8 +946,8 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 			}
 
 			ruleScope := NewScope(scope, ToRange(ruleNode))
-			for j := uint(0); j < arguments.ChildCount(); j++ {
-				argument := arguments.Child(j)
+			// Every identifier in a rule's arguments is bound by it, also in patterns like (x:y)
+			for _, argument := range patternIdentifiers(arguments) {
 				argumentSym := NewIdentifier(
 					Location{
 						File:  currentFile.Handle.Path,
@@ -838,6 +956,8 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 					argument.Utf8Text(currentFile.Content))
 				ruleScope.addSymbol(&argumentSym)
 			}
+			// Nested patterns and environments of the rule only see its own arguments
+			workspace.ParseASTNode(expression, currentFile, ruleScope, store, visited, fileChan)
 
 			ruleSym := NewRule(Location{
 				File:  currentFile.Handle.Path,
@@ -865,6 +985,18 @@ func (workspace *Workspace) ParseASTNode(node *tree_sitter.Node, currentFile *Fi
 	}
 }
 
+// Identifiers bound by the arguments of a case rule
+func patternIdentifiers(arguments *tree_sitter.Node) []*tree_sitter.Node {
+	if arguments.GrammarName() == "identifier" {
+		return []*tree_sitter.Node{arguments}
+	}
+	identifiers := []*tree_sitter.Node{}
+	for i := uint(0); i < arguments.NamedChildCount(); i++ {
+		identifiers = append(identifiers, patternIdentifiers(arguments.NamedChild(i))...)
+	}
+	return identifiers
+}
+
 func ToRange(node *tree_sitter.Node) transport.Range {
 	start := node.StartPosition()
 	end := node.EndPosition()
@@ -875,26 +1007,17 @@ func ToRange(node *tree_sitter.Node) transport.Range {
 	}
 }
 
+// stripQuotes removes the quotes around a string literal like "stdfaust.lib"
 func stripQuotes(s string) string {
-	stripped := s[1 : len(s)-1]
-	return stripped
-}
-
-func (w *Workspace) GetFaustDSPDir() string {
-	faustCommand := w.Config.Command
-	_, err := exec.LookPath(faustCommand)
-	if err != nil {
-		logging.Logger.Error("Couldn't find faust command in PATH", "cmd", faustCommand)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
 	}
-	var output strings.Builder
-	cmd := exec.Command(faustCommand, "-dspdir")
-	cmd.Stdout = &output
+	return strings.Trim(s, `"`)
+}
 
-	_ = cmd.Run()
-	faustDSPDirPath := output.String()
-	// Remove \n at the end
-	faustDSPDirPath = faustDSPDirPath[:len(faustDSPDirPath)-1]
-	return faustDSPDirPath
+// Library directory of the compiler, empty if the compiler isn't in PATH
+func GetFaustDSPDir(faustCommand string) string {
+	return compilers.probe(faustCommand).dspDir
 }
 
 // Resolves a given file path like the Faust compiler does when it has to import a file
@@ -907,12 +1030,24 @@ func (w *Workspace) ResolveFilePath(relPath util.Path, rootDir util.Path) (path
 		return path1, rootDir
 	}
 
-	// File in Faust System Library DSP directory
-	faustDSPDir := w.GetFaustDSPDir()
-	path2 := filepath.Join(faustDSPDir, relPath)
-	//	logging.Logger.Info("Trying path", "path", path2)
-	if util.IsValidPath(path2) {
-		return path2, faustDSPDir
+	// File in one of the config's include directories
+	folder := w.folderFor(rootDir)
+	for _, dir := range folder.includeDirs() {
+		path := filepath.Join(dir, relPath)
+		if util.IsValidPath(path) {
+			return path, dir
+		}
+	}
+
+	// File in Faust System Library DSP directory, or the library directory set in the config
+	// It's empty when the compiler isn't installed, and relative paths must not resolve against the working directory
+	faustDSPDir := folder.libraryDir()
+	if faustDSPDir != "" {
+		path2 := filepath.Join(faustDSPDir, relPath)
+		//	logging.Logger.Info("Trying path", "path", path2)
+		if util.IsValidPath(path2) {
+			return path2, faustDSPDir
+		}
 	}
 
 	logging.Logger.Info("Couldn't resolve file path")
@@ -930,6 +1065,32 @@ func FindSymbolHelper(ident string, scope *Scope, store *Store, visited *map[uti
 		return Symbol{}, fmt.Errorf("Invalid scope")
 	}
 
+	if found, err := findMemberHelper(ident, scope, store, visited); err == nil {
+		return found, nil
+	}
+
+	if scope.Parent != nil {
+		logging.Logger.Info("Going to parent to find", "ident", ident)
+		return FindSymbolHelper(ident, scope.Parent, store, visited)
+	} else {
+		return Symbol{}, fmt.Errorf("Couldn't find symbol")
+	}
+
+}
+
+// Finds a member of an environment or a library: a symbol of its scope or of the files it imports. Unlike FindSymbol,
+// enclosing scopes aren't searched, as env.f only refers to the f of env.
+func FindMember(ident string, scope *Scope, store *Store) (Symbol, error) {
+	var visited = make(map[util.Path]struct{})
+
+	return findMemberHelper(ident, scope, store, &visited)
+}
+
+func findMemberHelper(ident string, scope *Scope, store *Store, visited *map[util.Path]struct{}) (Symbol, error) {
+	if scope == nil {
+		return Symbol{}, fmt.Errorf("Invalid scope")
+	}
+
 	// 1) Check current scope's definitions for this symbol
 	for _, symbol := range scope.Symbols {
 
@@ -945,63 +1106,114 @@ func FindSymbolHelper(ident string, scope *Scope, store *Store, visited *map[uti
 
 		if symbol.Kind == Import {
 			logging.Logger.Info("Symbol type", "type", symbol.Kind.String(), "index", i)
+			// Files importing each other would otherwise be searched forever
+			if !visitImport(symbol.File, visited) {
+				continue
+			}
 			f, ok := store.Files.GetFromPath(symbol.File)
 			if ok {
 				logging.Logger.Info("Found import statement, checking in file", "path", f.Handle.Path)
-				found, err := FindSymbolHelper(ident, f.Scope, store, visited)
+				f.mu.RLock()
+				importScope := f.Scope
+				f.mu.RUnlock()
+				found, err := findMemberHelper(ident, importScope, store, visited)
 				if err == nil {
 					return found, nil
 				}
 			}
 		}
 	}
+	return Symbol{}, fmt.Errorf("Couldn't find symbol")
+}
 
-	if scope.Parent != nil {
-		logging.Logger.Info("Going to parent to find", "ident", ident)
-		return FindSymbolHelper(ident, scope.Parent, store, visited)
-	} else {
-		return Symbol{}, fmt.Errorf("Couldn't find symbol")
+// Marks an imported file as searched by a lookup. Returns false if it already was.
+func visitImport(path util.Path, visited *map[util.Path]struct{}) bool {
+	if _, ok := (*visited)[path]; ok {
+		return false
 	}
-
+	(*visited)[path] = struct{}{}
+	return true
 }
 
+// Finds the symbol ident refers to from scope, following accesses like lib.env.sub.f: the first name is looked up
+// from scope, and every following name among the members of the previous one, be it a library, an environment or a
+// definition evaluating to one of them
 func FindSymbolDefinition(ident string, scope *Scope, store *Store) (Symbol, error) {
-	identSplit := strings.Split(ident, ".")
-
-	if len(identSplit) > 1 {
-		logging.Logger.Info("Resolving library symbol", "symbol", identSplit)
-		for i := range len(identSplit) - 1 {
-			libIdent := identSplit[i]
-
-			// Resolve as Environment
-			sym, err := FindEnvironmentIdent(libIdent, scope, store)
-			logging.Logger.Info("Resolved environment", "env", libIdent, "sym", sym.Ident, "loc", sym.Loc)
-			if err == nil {
-				scope = sym.Scope
-				continue
-			}
+	return findAccess(strings.Split(ident, "."), scope, store, 0)
+}
+
+// Definitions followed at most to resolve an access, e.g. through aliases like fx = lib.env;
+const maxAccessDepth = 32
 
-			// Resolve as Library if not resolved as environment
-			file, err := FindLibraryIdent(libIdent, scope, store)
+func findAccess(names []string, scope *Scope, store *Store, depth int) (Symbol, error) {
+	logging.Logger.Info("Resolving access", "names", names)
+	sym, err := FindSymbol(names[0], scope, store)
+	if err != nil {
+		return Symbol{}, err
+	}
+	for _, name := range names[1:] {
+		members, err := memberScope(sym, store, depth)
+		if err != nil {
+			return Symbol{}, err
+		}
+		sym, err = FindMember(name, members, store)
+		if err != nil {
+			return Symbol{}, err
+		}
+	}
+	return sym, nil
+}
+
+// Scope of the members reachable from sym through an access: the definitions of an environment or of a library
+// file. Definitions and with/letrec expressions are followed to the environment they evaluate to, e.g. for
+// fx = lib.env; or sub = s with { s = environment { … }; };
+func memberScope(sym Symbol, store *Store, depth int) (*Scope, error) {
+	if depth > maxAccessDepth {
+		return nil, fmt.Errorf("Access of %s nested too deeply", sym.Ident)
+	}
+	switch sym.Kind {
+	case Environment:
+		return sym.Scope, nil
+	case Library:
+		f, ok := store.Files.GetFromPath(sym.File)
+		if !ok {
+			return nil, fmt.Errorf("Library %s isn't analyzed", sym.File)
+		}
+		f.mu.RLock()
+		scope := f.Scope
+		f.mu.RUnlock()
+		if scope == nil {
+			return nil, fmt.Errorf("Library %s isn't analyzed", sym.File)
+		}
+		return scope, nil
+	case Definition, Function, WithEnvironment, LetRecEnvironment:
+		if sym.Expr != nil && (sym.Expr.GrammarName() == "identifier" || sym.Expr.GrammarName() == "access") {
+			source, ok := analyzedSnapshot(sym.Loc.File, store)
+			if !ok || uint(len(source.Content)) < sym.Expr.EndByte() {
+				return nil, fmt.Errorf("Couldn't read the value of %s", sym.Ident)
+			}
+			// Names of a with or letrec expression are looked up in its local environment first
+			lookup := sym.Expression
+			if sym.Kind == WithEnvironment || sym.Kind == LetRecEnvironment {
+				lookup = sym.Scope
+			}
+			target, err := findAccess(strings.Split(sym.Expr.Utf8Text(source.Content), "."), lookup, store, depth+1)
 			if err != nil {
-				break
+				return nil, err
 			}
-			logging.Logger.Info("Resolved library environment", "env", libIdent, "location", file)
-			f, ok := store.Files.GetFromPath(file)
-			if ok {
-				f.mu.RLock()
-				logging.Logger.Info("Setting New Scope to", "path", file)
-				scope = f.Scope
-				f.mu.RUnlock()
-				if scope == nil {
-					break
-				}
+			return memberScope(target, store, depth+1)
+		}
+		if sym.Expression == nil {
+			break
+		}
+		for _, child := range sym.Expression.Symbols {
+			switch child.Kind {
+			case Environment, Library, WithEnvironment, LetRecEnvironment:
+				return memberScope(*child, store, depth+1)
 			}
 		}
 	}
-	ident = identSplit[len(identSplit)-1]
-
-	return FindSymbol(ident, scope, store)
+	return nil, fmt.Errorf("%s isn't an environment", sym.Ident)
 }
 
 func FindDefinition(ident string, scope *Scope, store *Store) (Location, error) {
@@ -1041,10 +1253,17 @@ func FindEnvironmentHelper(ident string, scope *Scope, store *Store, visited *ma
 
 		if symbol.Kind == Import {
 			logging.Logger.Info("Symbol type", "type", symbol.Kind.String(), "index", i)
+			// Files importing each other would otherwise be searched forever
+			if !visitImport(symbol.File, visited) {
+				continue
+			}
 			f, ok := store.Files.GetFromPath(symbol.File)
 			if ok {
 				logging.Logger.Info("Found import statement, checking in file", "path", f.Handle.Path)
-				found, err := FindEnvironmentHelper(ident, f.Scope, store, visited)
+				f.mu.RLock()
+				importScope := f.Scope
+				f.mu.RUnlock()
+				found, err := FindEnvironmentHelper(ident, importScope, store, visited)
 				if err == nil {
 					return found, nil
 				}
@@ -1073,6 +1292,10 @@ func FindFirstEnvironment(sym *Symbol) (Symbol, error) {
 		}
 	case Function, Definition:
 		//		logging.Logger.Info("Definition, looking in it's children")
+		// Definitions of letrec environments don't have an expression scope
+		if sym.Expression == nil {
+			break
+		}
 		for _, sym := range sym.Expression.Symbols {
 			return FindFirstEnvironment(sym)
 		}
@@ -1108,10 +1331,17 @@ func FindLibraryHelper(ident string, scope *Scope, store *Store, visited *map[ut
 	for i, symbol := range scope.Symbols {
 		if symbol.Kind == Import {
 			logging.Logger.Info("Symbol type", "type", symbol.Kind.String(), "index", i)
+			// Files importing each other would otherwise be searched forever
+			if !visitImport(symbol.File, visited) {
+				continue
+			}
 			f, ok := store.Files.GetFromPath(symbol.File)
 			if ok {
 				logging.Logger.Info("Found import statement, checking in file", "path", f.Handle.Path)
-				found, err := FindLibraryHelper(ident, f.Scope, store, visited)
+				f.mu.RLock()
+				importScope := f.Scope
+				f.mu.RUnlock()
+				found, err := FindLibraryHelper(ident, importScope, store, visited)
 				if err == nil {
 					return found, nil
 				}
@@ -1131,23 +1361,24 @@ func FindLibraryHelper(ident string, scope *Scope, store *Store, visited *map[ut
 type CompletionSym struct {
 	name string
 	docs Documentation
+	// Edits making the symbol reachable from the file it is completed in, e.g. importing its library
+	edits []transport.TextEdit
+	// Library the symbol is imported from by edits
+	library string
+	kind    transport.CompletionItemKind
+	// File defining the symbol, shown next to it when it isn't the completed file
+	file util.Path
 }
 
-func GetPossibleSymbols(pos transport.Position, filePath util.Path, store *Store, encoding string) []CompletionSym {
-	f, ok := store.Files.GetFromPath(filePath)
-	if !ok {
-		logging.Logger.Info("Couldn't find file", "path", filePath)
-		return []CompletionSym{}
-	}
-
+func GetPossibleSymbols(pos transport.Position, snap FileSnapshot, store *Store, encoding string) []CompletionSym {
 	// 1) Get scope at position
-	offset, err := PositionToOffset(pos, string(f.Content), encoding)
+	offset, err := PositionToOffset(pos, string(snap.Content), encoding)
 	if err != nil {
 		logging.Logger.Info("Couldn't convert position to offset", "pos", pos, "err", err)
 		return []CompletionSym{}
 	}
 
-	identifier, scope := FindSymbolScopeAtOffset(f.Content, f.Scope, offset, string(store.Files.encoding))
+	identifier, scope := FindSymbolScopeAtOffset(snap.Content, snap.Scope, offset, encoding)
 	if scope == nil {
 		logging.Logger.Info("Couldn't find scope at position", "pos", pos, "offset", offset)
 		return []CompletionSym{}
@@ -1186,30 +1417,34 @@ func GetPossibleSymbols(pos transport.Position, filePath util.Path, store *Store
 					return []CompletionSym{}
 				}
 			} else {
-				return []CompletionSym{}
+				// Standard libraries are still documented when faustlibraries isn't installed, and imported when
+				// the file doesn't import them yet
+				return withStdlibImport(libraryCompletions(identifier), snap.Content, encoding)
 			}
 		}
 		logging.Logger.Info("Found symbol definition for identifier", "ident", identifier, "loc", sym.Loc)
 
-		if sym.Kind == Library {
-			logging.Logger.Info("Identifier is a library, getting symbols from file", "file", sym.File)
-			f, ok := store.Files.GetFromPath(sym.File)
-			if ok {
-				f.mu.RLock()
-				syms := FindSymbolsNew(f.Scope, "", store, make(map[util.Path]struct{}))
-				f.mu.RUnlock()
-				return syms
-			} else {
-				logging.Logger.Info("Couldn't find file for library", "file", sym.File)
-				return []CompletionSym{}
-			}
-		} else {
-			env, err := FindEnvironmentIdent(identifier, scope, store)
-			if err == nil {
-				return FindSymbolsNew(env.Scope, "", store, make(map[util.Path]struct{}))
+		// Members of a library, of an environment, or of what a definition like fx = lib.env evaluates to
+		members, err := memberScope(sym, store, 0)
+		if err != nil {
+			logging.Logger.Info("Couldn't find members of identifier", "ident", identifier, "err", err)
+			if sym.Kind == Library {
+				return libraryCompletions(identifier)
 			}
 			return []CompletionSym{}
 		}
+		syms := FindSymbolsNew(members, "", store, make(map[util.Path]struct{}))
+		if sym.Kind == Library {
+			for i, completion := range syms {
+				if completion.docs.Full != "" {
+					continue
+				}
+				if doc, ok := libraryDocs(identifier+"."+completion.name, Symbol{Loc: Location{File: sym.File}}, nil); ok {
+					syms[i].docs = doc
+				}
+			}
+		}
+		return syms
 	} else {
 		//		logging.Logger.Info("Identifier doesn't end with '.', returning all symbols in current scope", "ident", identifier)
 		availableSymbols := []CompletionSym{}
@@ -1241,8 +1476,24 @@ func AddEnvIdents(symbols []CompletionSym, parentSymbol string) []CompletionSym
 	return symbols
 }
 
-func NewCompletionSym(sym *Symbol) CompletionSym {
-	return CompletionSym{name: sym.Ident, docs: sym.Docs}
+func NewCompletionSym(sym *Symbol, store *Store) CompletionSym {
+	return CompletionSym{name: sym.Ident, docs: sym.Docs, kind: completionKind(sym, store), file: sym.Loc.File}
+}
+
+// Kind of the completion of sym: libraries, environments and definitions evaluating to one are modules, like in
+// semantic tokens
+func completionKind(sym *Symbol, store *Store) transport.CompletionItemKind {
+	switch sym.Kind {
+	case Library, Environment:
+		return transport.ModuleCompletion
+	case Function, Case:
+		return transport.FunctionCompletion
+	case Definition:
+		if _, err := memberScope(*sym, store, 0); err == nil {
+			return transport.ModuleCompletion
+		}
+	}
+	return transport.VariableCompletion
 }
 
 func FindSymbolsNew(scope *Scope, parentSymbol string, store *Store, visited map[util.Path]struct{}) []CompletionSym {
@@ -1251,7 +1502,7 @@ func FindSymbolsNew(scope *Scope, parentSymbol string, store *Store, visited map
 	for _, sym := range scope.Symbols {
 		//		logging.Logger.Info("Found symbol in scope", "symbol", sym.Ident, "kind", sym.Kind.String(), "loc", sym.Loc)
 		if sym.Ident != "" {
-			symbols = append(symbols, NewCompletionSym(sym))
+			symbols = append(symbols, NewCompletionSym(sym, store))
 		}
 		if sym.Kind == Definition || sym.Kind == Function {
 			env, err := FindFirstEnvironment(sym)
@@ -1309,6 +1560,9 @@ func FindSymbolsInFile(sym *Symbol, parentSymbol string, store *Store, visited m
 
 func FindSymbolScope(content []byte, scope *Scope, offset uint) (string, *Scope) {
 	tree := parser.ParseTree(content)
+	if tree == nil {
+		return "", nil
+	}
 	fileAST := tree.RootNode()
 	defer tree.Close()
 	node := fileAST.DescendantForByteRange(offset, offset)
@@ -1354,60 +1608,20 @@ func FindSymbolScope(content []byte, scope *Scope, offset uint) (string, *Scope)
 
 func FindSymbolScopeAtOffset(content []byte, scope *Scope, offset uint, encoding string) (string, *Scope) {
 	// Manual version of FindSymbolScope that doesn't use tree-sitter to find the identifier at the given offset
-	i, j := offset, offset
-
-	// Move start till reaches non valid character
-	for {
-		if j == uint(len(content)-1) {
-			break
-		}
-		if unicode.IsLetter(rune(content[j])) || unicode.IsDigit(rune(content[j])) || content[j] == '.' {
-			j++
-		} else {
-			break
-		}
-	}
-
-	// Move end till reaches non valid character
-	for {
-		if i == 0 {
-			break
-		}
-		if unicode.IsLetter(rune(content[i])) || unicode.IsDigit(rune(content[i])) || content[i] == '.' {
-			i--
-		} else {
-			break
-		}
-	}
-	ident := content[i:j]
-	if string(ident) == "" {
-		// Trying to go back from offset to find identifier
-		i--
-		for {
-			if i <= 0 {
-				break
-			}
-			if unicode.IsLetter(rune(content[i])) || unicode.IsDigit(rune(content[i])) || content[i] == '.' {
-				i--
-			} else {
-				break
-			}
-		}
-		ident = content[i+1 : j]
-	}
-
-	//logging.Logger.Info("Found identifier at offset", "ident", string(ident), "start", i+1, "end", j, "offset", offset)
-	start, err := OffsetToPosition(i, string(content), encoding)
-	end, err := OffsetToPosition(j, string(content), encoding)
-	if err != nil {
-		return "", nil
-	}
+	// The identifier may be qualified like a.b. while it is being typed, so '.' is part of it
+	text := string(content)
+	start := identifierStart(text, offset, isDottedIdentRune)
+	end := identifierEnd(text, offset, isDottedIdentRune)
+	ident := text[start:end]
+
+	startPos, _ := OffsetToPosition(start, text, encoding)
+	endPos, _ := OffsetToPosition(end, text, encoding)
 	identRange := transport.Range{
-		Start: start,
-		End:   end,
+		Start: startPos,
+		End:   endPos,
 	}
 	lowestScope := FindLowestScopeContainingRange(scope, identRange)
-	return string(ident), lowestScope
+	return ident, lowestScope
 }
 
 func FindLowestScopeContainingRange(scope *Scope, identRange transport.Range) *Scope {
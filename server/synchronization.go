@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/transport"
@@ -15,6 +16,9 @@ const (
 	TDOpen = iota
 	TDChange
 	TDClose
+	// Deleted through the editor with workspace/didDeleteFiles
+	TDDelete
+	TDSave
 )
 
 type TDEvent struct {
@@ -28,25 +32,45 @@ func TextDocumentOpen(ctx context.Context, s *Server, par json.RawMessage) error
 
 	fileURI := params.TextDocument.URI
 
+	// Documents that can't be read from disk are kept in memory, without compiler diagnostics
+	if scheme := util.URIScheme(string(fileURI)); !util.SupportedScheme(scheme) {
+		logging.Logger.Warn("Unsupported URI scheme, only in-memory features are available", "uri", fileURI, "scheme", scheme)
+		s.showMessageOnce("scheme:"+scheme, transport.Warning, fmt.Sprintf("faustlsp: documents with the %q URI scheme aren't supported on disk, only syntax diagnostics, completion and symbols are available for them", scheme))
+	}
+
 	// Open File
 	s.Workspace.EditorOpenFile(util.URI(fileURI), &s.Files)
 
 	logging.Logger.Info("Opening File", "uri", string(fileURI))
 	f, ok := s.Files.GetFromURI(util.URI(fileURI))
 
+	// Not on disk, e.g. untitled documents, so the editor's content is all there is
 	if !ok {
-		s.Files.AddFromURI(util.URI(fileURI), []byte{})
+		s.Files.AddFromURI(util.URI(fileURI), []byte(params.TextDocument.Text))
 		f, _ = s.Files.GetFromURI(util.URI(fileURI))
 	}
 
+	f.mu.Lock()
+	f.Version = params.TextDocument.Version
+	f.mu.Unlock()
+
+	// Documents outside of the workspace get a folder of their own, before anything looks up their config
+	s.Workspace.openExternal(f.Handle.Path)
+
 	f.mu.RLock()
 	logging.Logger.Info("Current File", "content", f.Content)
+	// Workspace files are analyzed when the workspace is loaded, other documents when they are opened
+	analyzed := f.Scope != nil
 
-	s.Workspace.TDEvents <- TDEvent{Type: TDOpen, Path: f.Handle.Path}
+	s.queueEditorEvent(TDEvent{Type: TDOpen, Path: f.Handle.Path})
 	f.mu.RUnlock()
 
-	//	go s.Workspace.AnalyzeFile(f, &s.Store)
-	go s.Workspace.DiagnoseFile(f.Handle.Path, s)
+	if !analyzed && IsFaustFile(f.Handle.Path) {
+		s.analyzeInBackground(f)
+	}
+	s.background.Go(func(context.Context) {
+		s.Workspace.diagnoseOn(diagnoseOpen, f.Handle.Path, s)
+	})
 
 	return nil
 }
@@ -61,10 +85,11 @@ func TextDocumentChangeFull(ctx context.Context, s *Server, par json.RawMessage)
 	if err != nil {
 		return err
 	}
-	for _, change := range params.ContentChanges {
-		s.Files.ModifyFull(path, change.Text)
+	if !s.Files.ApplyChanges(path, params.TextDocument.Version, params.ContentChanges) {
+		logging.Logger.Warn("Ignoring stale change", "path", path, "version", params.TextDocument.Version)
+		return nil
 	}
-	s.Workspace.TDEvents <- TDEvent{Type: TDChange, Path: path}
+	s.queueEditorEvent(TDEvent{Type: TDChange, Path: path})
 
 	logging.Logger.Info("Modified File", "fileURI", string(fileURI))
 	return nil
@@ -80,12 +105,34 @@ func TextDocumentChangeIncremental(ctx context.Context, s *Server, par json.RawM
 	if err != nil {
 		return err
 	}
-	for _, change := range params.ContentChanges {
-		s.Files.ModifyIncremental(path, *change.Range, change.Text)
+	if !s.Files.ApplyChanges(path, params.TextDocument.Version, params.ContentChanges) {
+		logging.Logger.Warn("Ignoring stale change", "path", path, "version", params.TextDocument.Version)
+		return nil
 	}
 
-	s.Workspace.TDEvents <- TDEvent{Type: TDChange, Path: path}
+	s.queueEditorEvent(TDEvent{Type: TDChange, Path: path})
+
+	return nil
+}
+
+// Triggers on-save diagnostics. The saved text brings the document back in sync in case a change was missed, the
+// watcher keeps the rest of the store in sync with the disk. Changes sent before the save are applied by then, as
+// document synchronization is handled in order, so the saved text is never older than the document.
+func TextDocumentSave(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.DidSaveTextDocumentParams
+	json.Unmarshal(par, &params)
 
+	path, err := util.URI2path(string(params.TextDocument.URI))
+	if err != nil {
+		return err
+	}
+	logging.Logger.Info("Saved File", "path", path)
+	if params.Text != nil && s.Files.resync(path, *params.Text) {
+		logging.Logger.Warn("Document out of sync with its saved text", "path", path)
+		s.queueEditorEvent(TDEvent{Type: TDChange, Path: path})
+	}
+	// Diagnosed once the watcher replicated the saved text
+	s.queueEditorEvent(TDEvent{Type: TDSave, Path: path})
 	return nil
 }
 
@@ -95,13 +142,30 @@ func TextDocumentClose(ctx context.Context, s *Server, par json.RawMessage) erro
 
 	fileURI := params.TextDocument.URI
 
-	s.Files.CloseFromURI(util.Path(params.TextDocument.URI))
+	s.Files.CloseFromURI(util.URI(fileURI))
 
 	path, err := util.URI2path(string(fileURI))
 	logging.Logger.Error("Got error when getting path from URI", "error", err)
-	s.Workspace.TDEvents <- TDEvent{Type: TDClose, Path: path}
+	s.queueEditorEvent(TDEvent{Type: TDClose, Path: path})
 
 	logging.Logger.Info("Closed File", "uri", string(fileURI))
 	//	logging.Logger.Printf("Current Files: %s\n", s.Files)
 	return nil
 }
+
+// Handler for workspace/didDeleteFiles. Deletions are also seen by the watcher, but only for files inside the workspace.
+func DidDeleteFiles(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.DeleteFilesParams
+	json.Unmarshal(par, &params)
+
+	for _, file := range params.Files {
+		path, err := util.URI2path(file.URI)
+		if err != nil {
+			logging.Logger.Error("Invalid URI of deleted file", "uri", file.URI, "error", err)
+			continue
+		}
+		logging.Logger.Info("Deleted File", "path", path)
+		s.queueEditorEvent(TDEvent{Type: TDDelete, Path: path})
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+)
+
+// Sets how much the server traces with $/logTrace: nothing, messages, or messages with their details
+func (s *Server) setTrace(value transport.TraceValue) {
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	s.trace = value
+}
+
+func (s *Server) tracing() transport.TraceValue {
+	s.traceMu.Lock()
+	defer s.traceMu.Unlock()
+	if s.trace == "" {
+		return transport.Off
+	}
+	return s.trace
+}
+
+// Sends message to the client with $/logTrace when tracing is on. The details given by verbose, which are only
+// computed when tracing is verbose, are sent along with it.
+func (s *Server) logTrace(message string, verbose func() string) {
+	trace := s.tracing()
+	if trace == transport.Off {
+		return
+	}
+	params := transport.LogTraceParams{Message: message}
+	if trace == transport.Verbose && verbose != nil {
+		params.Verbose = verbose()
+	}
+	content, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	if err := s.Transport.WriteNotif("$/logTrace", content); err != nil {
+		logging.Logger.Error("Couldn't send trace", "error", err)
+	}
+}
+
+// Traces how long something took, e.g. "Analyzed main.dsp in 3ms"
+func (s *Server) logTraceSince(start time.Time, message string, verbose func() string) {
+	s.logTrace(fmt.Sprintf("%s in %dms", message, time.Since(start).Milliseconds()), verbose)
+}
+
+// Handler for $/setTrace
+func SetTrace(ctx context.Context, s *Server, par json.RawMessage) error {
+	var params transport.SetTraceParams
+	json.Unmarshal(par, &params)
+
+	switch params.Value {
+	case transport.Off, transport.Messages, transport.Verbose:
+		s.setTrace(params.Value)
+		return nil
+	}
+	return fmt.Errorf("invalid trace value %q", params.Value)
+}
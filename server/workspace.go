@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/fs"
 	"log/slog"
 	"os"
@@ -9,6 +11,7 @@ import (
 	"runtime"
 	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/util"
@@ -39,15 +42,39 @@ type Workspace struct {
 	mu       sync.Mutex
 	TDEvents chan TDEvent
 	Config   FaustProjectConfig
-
-	// Temporary directory where this workspace is replicated
-	tempDir     util.Path
+	// Changes reported by the client's file watcher, merged with the ones of the workspace watcher
+	watchedFileEvents chan fsnotify.Event
+	// Watcher of the directories of the workspace folders
+	watcher *fsnotify.Watcher
+
+	// Temporary directory where this workspace is replicated, empty if replication is disabled
+	tempDir util.Path
+	// Directory configured with replica_dir, excluded from the workspace
+	replicaDir  util.Path
 	openedFiles map[util.Handle]struct{}
+
+	// Pending debounced diagnostics
+	diagTimers diagnosticsTimers
+	// Diagnostics stages passed by each file
+	diagStates diagnosticsStates
+	// Files that got compiler diagnostics in the last compiler run of each folder, keyed by the folder's root
+	compiledFiles   map[util.Path]map[util.Path]bool
+	compiledFilesMu sync.Mutex
+
+	// Settings sent by the client
+	client clientConfig
+
+	// Workspace folders of a multi-root setup, each with its own config. Contains at least Root.
+	Folders   []*Folder
+	foldersMu sync.RWMutex
+	// Folders of the documents opened outside of every workspace folder, keyed by the documents' directory
+	external map[util.Path]*externalFolder
 }
 
+// Documents that only exist in memory count as Faust files, as clients only send documents in the Faust language
 func IsFaustFile(path util.Path) bool {
 	ext := filepath.Ext(path)
-	return ext == ".dsp" || ext == ".lib"
+	return ext == ".dsp" || ext == ".lib" || util.IsMemoryPath(path)
 }
 
 func IsDSPFile(path util.Path) bool {
@@ -65,99 +92,258 @@ func (workspace *Workspace) TempDirPath(filePath util.Path) util.Path {
 	return result
 }
 
-func (workspace *Workspace) Init(ctx context.Context, s *Server) {
+// Loads the configs of the workspace, then indexes it in the background, so that the client isn't kept waiting
+// while large workspaces are replicated and analyzed. Files the client opens in the meantime are analyzed when opened.
+func (workspace *Workspace) Init(s *Server) {
 	// Open all files in workspace and add to File Store
 	workspace.Files = []util.Path{}
 	workspace.TDEvents = make(chan TDEvent)
+	workspace.watchedFileEvents = make(chan fsnotify.Event)
 	workspace.openedFiles = make(map[util.Handle]struct{})
-	workspace.tempDir = s.tempDir
 
-	// Replicate Workspace in our Temp Dir by copying
-	logging.Logger.Info("Current workspace root", "path", workspace.Root)
+	// Parse Config File, which has the patterns of files to exclude
+	workspace.loadConfigFiles(s)
+	workspace.setupReplica(s)
 
-	tempWorkspacePath := filepath.Join(s.tempDir, workspace.Root)
-	err := cp.Copy(workspace.Root, tempWorkspacePath)
+	// Folders added later are watched by the same watcher. Without one, e.g. when inotify instances run out, only
+	// the changes reported by the client's watcher are seen.
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		logging.Logger.Error("Copying file error", "error", err)
+		logging.Logger.Error("Error in starting watcher, only changes reported by the client are seen", "error", err)
+		watcher = nil
 	}
-	logging.Logger.Info("Replicating Workspace in ", "path", tempWorkspacePath)
+	workspace.mu.Lock()
+	workspace.watcher = watcher
+	workspace.mu.Unlock()
 
-	// Parse Config File
-	workspace.loadConfigFiles(s)
+	s.background.Go(func(ctx context.Context) {
+		workspace.index(ctx, s, watcher)
+	})
+	logging.Logger.Info("Started workspace indexing\n")
+}
+
+// Replicates the workspace and analyzes the files of every folder, reporting the files analyzed so far with work done
+// progress. The watcher starts once the replica exists, so that documents opened while the files are analyzed aren't
+// held up. Returns once every file is queued for analysis, the progress ends when they are all analyzed.
+func (workspace *Workspace) index(ctx context.Context, s *Server, watcher *fsnotify.Watcher) {
+	folders := workspace.folders()
+	progress := s.StartProgress(ctx, "Indexing", filepath.Base(workspace.Root), false)
+	workspace.replicateFolders(progress, folders)
 
+	tracking := s.background.Go(func(ctx context.Context) {
+		workspace.StartTrackingChanges(ctx, s, watcher)
+	})
+	if !tracking && watcher != nil {
+		watcher.Close()
+	}
+	logging.Logger.Info("Started workspace watcher\n")
+
+	workspace.analyzeFolders(s, progress, folders)
+}
+
+// Indexes folders added to the workspace
+func (workspace *Workspace) indexFolders(ctx context.Context, s *Server, folders []*Folder) {
+	progress := s.StartProgress(ctx, "Indexing", filepath.Base(folders[0].Root), false)
+	workspace.replicateFolders(progress, folders)
+	workspace.analyzeFolders(s, progress, folders)
+}
+
+// Replicates folders and watches their directories
+func (workspace *Workspace) replicateFolders(progress *Progress, folders []*Folder) {
+	for _, folder := range folders {
+		// Replicate Workspace in our Temp Dir by copying
+		logging.Logger.Info("Current workspace folder", "path", folder.Root)
+		if workspace.replicating() {
+			progress.Report("Replicating workspace…", 0)
+			workspace.replicate(folder.Root)
+		}
+		// Directories are watched before files are opened, so that changes made once a file is diagnosed aren't missed
+		if err := workspace.watch(folder.Root); err != nil {
+			logging.Logger.Warn("Couldn't watch folder, only changes reported by the client are seen", "path", folder.Root, "error", err)
+		}
+	}
+}
+
+// Opens and analyzes the files of folders, then ends progress once they are all analyzed
+func (workspace *Workspace) analyzeFolders(s *Server, progress *Progress, folders []*Folder) {
 	// Open the files in file store
-	err = filepath.Walk(workspace.Root, func(path string, info os.FileInfo, err error) error {
+	s.Store.startIndexing()
+	paths := []util.Path{}
+	walked := map[util.Path]bool{}
+	for _, folder := range folders {
+		err := workspace.walk(folder.Root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Nested folders are walked with their parent
+			if !info.IsDir() && !walked[path] {
+				walked[path] = true
+				paths = append(paths, path)
+			}
+			return nil
+		})
 		if err != nil {
-			return err
+			logging.Logger.Error("Walking workspace error", "error", err)
 		}
-		if !info.IsDir() {
-			f, ok := s.Files.GetFromPath(path)
+	}
 
-			if !ok {
-				// Path relative to workspace
-				logging.Logger.Info("Opening file from workspace\n", "path", path)
+	// The default process files of a folder are its .dsp files, which are only known once it is walked
+	for _, path := range paths {
+		workspace.addFile(path)
+	}
+	for _, folder := range folders {
+		workspace.loadFolder(s, folder)
+	}
+
+	faustFiles := 0
+	for _, path := range paths {
+		if IsFaustFile(path) {
+			faustFiles++
+		}
+	}
+	var analyzed sync.WaitGroup
+	var done atomic.Int32
+	for _, path := range paths {
+		f, ok := s.Files.GetFromPath(path)
 
-				s.Files.OpenFromPath(path)
+		if !ok {
+			// Path relative to workspace
+			logging.Logger.Info("Opening file from workspace\n", "path", path)
 
-				workspace.addFile(path)
+			s.Files.OpenFromPath(path)
 
-				f, ok = s.Files.GetFromPath(path)
-				if ok {
-					workspace.DiagnoseFile(path, s)
-				}
-			}
-			// Test if goroutine speeds this up
+			f, ok = s.Files.GetFromPath(path)
 			if ok {
-				if IsFaustFile(f.Handle.Path) {
-					go workspace.AnalyzeFile(f, &s.Store)
-				}
+				workspace.diagnoseOn(diagnoseOpen, path, s)
 			}
 		}
-		return nil
-	})
+		if !ok || !IsFaustFile(f.Handle.Path) {
+			continue
+		}
+		analyzed.Add(1)
+		// Counted before the goroutine starts, so that indexing can't be seen as finished while files are still queued
+		s.Store.beginAnalysis()
+		started := s.background.Go(func(context.Context) {
+			defer analyzed.Done()
+			defer s.Store.endAnalysis()
+			s.analyzeFile(f)
+			n := int(done.Add(1))
+			rel, _ := filepath.Rel(workspace.folderFor(path).Root, path)
+			progress.Report(fmt.Sprintf("%d/%d files: %s", n, faustFiles, rel), uint32(n*100/faustFiles))
+		})
+		if !started {
+			analyzed.Done()
+			s.Store.endAnalysis()
+		}
+	}
+
+	s.Store.endAnalysis()
 
 	logging.Logger.Info("Workspace Files", "files", workspace.Files)
 	logging.Logger.Info("File Store", "files", &s.Files)
 
-	go func() { workspace.StartTrackingChanges(ctx, s) }()
-	logging.Logger.Info("Started workspace watcher\n")
+	ended := s.background.Go(func(context.Context) {
+		analyzed.Wait()
+		progress.End(fmt.Sprintf("Indexed %d files", done.Load()))
+	})
+	if !ended {
+		progress.End("")
+	}
 }
 
+// Copies the folder at root to the replica
+func (workspace *Workspace) replicate(root util.Path) {
+	tempPath := workspace.TempDirPath(root)
+	err := cp.Copy(root, tempPath, cp.Options{
+		Skip: func(info os.FileInfo, src, dest string) (bool, error) {
+			return src != root && workspace.isExcluded(src), nil
+		},
+		OnSymlink: workspace.replicaLinkAction,
+	})
+	if err != nil {
+		logging.Logger.Error("Copying file error", "error", err)
+	}
+	logging.Logger.Info("Replicating Workspace in ", "path", tempPath)
+}
+
+// Loads the config file of every workspace folder
 func (workspace *Workspace) loadConfigFiles(s *Server) {
-	configFilePath := filepath.Join(workspace.Root, faustConfigFile)
+	workspace.addRootFolder()
+	// The compiler command may have changed, or faust may have been installed since
+	compilers.reset()
+	for _, folder := range workspace.folders() {
+		folder = workspace.loadFolder(s, folder)
+		if folder.Config.CompilerDiagnostics || folder.Config.LibraryDir == "" {
+			s.compilerAvailable(folder.compilerCommand())
+		}
+	}
+	// The documentation version may be pinned in the config
+	loadDocsBundle(workspace.rootConfig().DocsVersion)
+	s.updateRegistrations()
+}
+
+// Loads the config file of folder and returns the folder with its config
+func (workspace *Workspace) loadFolder(s *Server, folder *Folder) *Folder {
+	cfg := workspace.loadFolderConfig(s, folder.Root)
+	logging.Logger.Info("Workspace Config", "folder", folder.Root, "config", cfg)
+	return workspace.setFolderConfig(folder, cfg)
+}
+
+func (workspace *Workspace) loadFolderConfig(s *Server, root util.Path) FaustProjectConfig {
+	configFilePath := filepath.Join(root, faustConfigFile)
 	f, ok := s.Files.GetFromPath(configFilePath)
-	var cfg FaustProjectConfig
-	var err error
+	if !ok {
+		// Try opening file if not opened but it exists
+		s.Files.OpenFromPath(configFilePath)
+		f, ok = s.Files.GetFromPath(configFilePath)
+	}
+	var content []byte
 	if ok {
 		f.mu.RLock()
-		cfg, err = workspace.parseConfig(f.Content)
+		content = f.Content
+		version := f.Version
 		f.mu.RUnlock()
+
+		// Show what's wrong in the config file itself instead of silently using defaults
+		problems := validateConfig(root, content)
+		publishConfigDiagnostics(s, configFilePath, version, problems, content)
+	}
+
+	// An invalid config file is skipped, the other layers still apply
+	cfg, _ := workspace.mergeConfig(root, append([]json.RawMessage{content}, workspace.client.layers()...)...)
+	return cfg
+}
+
+// Adds the directories of the folder at root to the watcher of the workspace. Returns an error if the workspace has
+// no watcher or root can't be watched.
+func (workspace *Workspace) watch(root util.Path) error {
+	workspace.mu.Lock()
+	watcher := workspace.watcher
+	workspace.mu.Unlock()
+	if watcher == nil {
+		return fmt.Errorf("no workspace watcher")
+	}
+
+	// Recursively add directories to watchlist
+	if err := watcher.Add(root); err != nil {
+		return err
+	}
+	return workspace.walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			cfg = workspace.defaultConfig()
+			return err
 		}
-	} else {
-		// Try opening file if not opened but it exists
-		s.Files.OpenFromPath(configFilePath)
-		f, ok := s.Files.GetFromPath(configFilePath)
-		if ok {
-			f.mu.RLock()
-			cfg, err = workspace.parseConfig(f.Content)
-			f.mu.RUnlock()
-			if err != nil {
-				cfg = workspace.defaultConfig()
-			}
-		} else {
-			cfg = workspace.defaultConfig()
+		if info.IsDir() {
+			watcher.Add(path)
+			logging.Logger.Info("Adding directory to watcher\n", path, root)
 		}
-	}
-	workspace.Config = cfg
-	logging.Logger.Info("Workspace Config", "config", cfg)
+		return nil
+	})
 }
 
 // Track and Replicate Changes to workspace
 // TODO: Refactor and simplify
 // TODO: Avoid repetition of getting relative paths
-func (workspace *Workspace) StartTrackingChanges(ctx context.Context, s *Server) {
+func (workspace *Workspace) StartTrackingChanges(ctx context.Context, s *Server, watcher *fsnotify.Watcher) {
 	// 1) Open All Files in Path with absolute Path recursively, store in s.Files, give pointers to Workspace.Files
 	// 2) Copy Directory to TempDir Workspace
 	// 3) Start Watching Changes like util
@@ -166,24 +352,19 @@ func (workspace *Workspace) StartTrackingChanges(ctx context.Context, s *Server)
 
 	// Ideal Pipeline
 	// File Paths -> Content{Get from disk, Get from text document changes} -> Replicate in Disk TempDir -> ParseSymbols/Get Diagnostics from TempDir and Memory
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		logging.Logger.Error("Error in starting watcher", "error", err)
-	}
 
-	// Recursively add directories to watchlist
-	watcher.Add(workspace.Root)
-	err = filepath.Walk(workspace.Root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			watcher.Add(path)
-			logging.Logger.Info("Adding directory to watcher\n", path, workspace.Root)
-		}
-		return nil
-	})
+	// The installed libraries are watched too
+	var libraries libraryWatch
+	libraries.update(workspace, watcher)
+
+	// Without a watcher, nothing is received from these and only the changes reported by the client are handled
+	var watcherEvents <-chan fsnotify.Event
+	var watcherErrors <-chan error
+	if watcher != nil {
+		watcherEvents, watcherErrors = watcher.Events, watcher.Errors
+	}
 
+	var events diskEvents
 	for {
 		select {
 		// Editor TextDocument Events
@@ -191,21 +372,42 @@ func (workspace *Workspace) StartTrackingChanges(ctx context.Context, s *Server)
 		case change := <-workspace.TDEvents:
 			logging.Logger.Info("Handling TD Event", "event", change)
 			workspace.HandleEditorEvent(change, s)
-		// Disk Events
-		case event, ok := <-watcher.Events:
-			logging.Logger.Info("Handling Workspace Disk Event", "event", event)
+			libraries.update(workspace, watcher)
+		// Disk Events, merged with the rest of their burst before being handled
+		case event, ok := <-watcherEvents:
 			if !ok {
 				return
 			}
-			workspace.HandleDiskEvent(event, s, watcher)
+			events.add(event)
+		// The same changes seen by the client's watcher, which also sees them when inotify doesn't, e.g. in containers.
+		// Changes seen by both are merged into one.
+		case event := <-workspace.watchedFileEvents:
+			events.add(event)
+		case <-events.ready():
+			libraryEvents := []fsnotify.Event{}
+			changedDirs := map[util.Path]bool{}
+			for _, event := range events.flush() {
+				if dir := libraries.dirOf(event.Name); dir != "" && !workspace.inFolders(event.Name) {
+					libraryEvents = append(libraryEvents, event)
+					changedDirs[dir] = true
+					continue
+				}
+				logging.Logger.Info("Handling Workspace Disk Event", "event", event)
+				workspace.HandleDiskEvent(event, s, watcher)
+			}
+			workspace.handleLibraryEvents(libraryEvents, changedDirs, s, watcher)
+			// The config may have changed the library directory
+			libraries.update(workspace, watcher)
 		// Watcher Errors
-		case _, ok := <-watcher.Errors:
+		case _, ok := <-watcherErrors:
 			if !ok {
 				return
 			}
-		// Cancel from parent
+		// Cancel from parent. Coalesced events that aren't handled yet are dropped, as the server is stopping.
 		case <-ctx.Done():
-			watcher.Close()
+			if watcher != nil {
+				watcher.Close()
+			}
 			return
 		}
 	}
@@ -228,13 +430,25 @@ func (workspace *Workspace) HandleDiskEvent(event fsnotify.Event, s *Server, wat
 		return
 	}
 
-	// Path relative to workspace
-	relPath := origPath[len(workspace.Root)+1:]
+	// Reload ignore rules if the .gitignore changed
+	if filepath.Base(origPath) == ".gitignore" {
+		workspace.loadConfigFiles(s)
+	}
+
+	// Changes to excluded files, e.g. build artifacts, are neither replicated nor analyzed
+	if workspace.isExcluded(origPath) {
+		return
+	}
+
+	// Nothing to replicate when a folder itself changes, e.g. when it is deleted
+	if workspace.isFolderRoot(origPath) || !workspace.inFolders(origPath) {
+		return
+	}
 
 	// Reload config file if changed
-	if filepath.Base(relPath) == faustConfigFile {
+	if filepath.Base(origPath) == faustConfigFile {
 		workspace.loadConfigFiles(s)
-		workspace.cleanDiagnostics(s)
+		workspace.cleanDiagnostics(s.background.context(), s)
 	}
 
 	// The equivalent of the workspace file path for the temporary directory
@@ -253,74 +467,91 @@ func (workspace *Workspace) HandleDiskEvent(event fsnotify.Event, s *Server, wat
 			if err != nil {
 				return
 			}
+			if workspace.skippedLink(origPath) {
+				return
+			}
 
 			if fi.IsDir() {
 				// If a directory is being created, mkdir instead of create
-				os.MkdirAll(tempDirFilePath, fi.Mode().Perm())
+				if workspace.replicating() {
+					os.MkdirAll(tempDirFilePath, fi.Mode().Perm())
+				}
 				// Add this new directory to watch as watcher does not recursively watch subdirectories
-				watcher.Add(origPath)
+				if watcher != nil {
+					watcher.Add(origPath)
+				}
 			} else {
 				// Add it our server tracking and workspace
 				s.Files.OpenFromPath(origPath)
 
 				// Create File
-				f, err := os.Create(tempDirFilePath)
-				if err != nil {
-					logging.Logger.Error("Create File error", "error", err)
+				if workspace.replicating() {
+					f, err := os.Create(tempDirFilePath)
+					if err != nil {
+						logging.Logger.Error("Create File error", "error", err)
+					}
+					f.Chmod(fi.Mode())
+					f.Close()
 				}
-				f.Chmod(fi.Mode())
-				f.Close()
 
 				workspace.addFile(origPath)
 			}
 		} else {
 			// Rename Create
-			oldFileRelPath := event.RenamedFrom[len(workspace.Root)+1:]
-			oldTempPath := filepath.Join(workspace.tempDir, workspace.Root, oldFileRelPath)
+			oldTempPath := workspace.TempDirPath(event.RenamedFrom)
 
-			if util.IsValidPath(tempDirFilePath) && util.IsValidPath(oldTempPath) {
+			if workspace.replicating() && util.IsValidPath(oldTempPath) {
+				os.MkdirAll(filepath.Dir(tempDirFilePath), 0755)
 				err := os.Rename(oldTempPath, tempDirFilePath)
 				if err != nil {
-					return
+					logging.Logger.Error("Renaming replica error", "error", err)
 				}
 			}
 
-			fi, _ := os.Stat(origPath)
-			if fi.IsDir() {
+			fi, err := os.Stat(origPath)
+			if err == nil && fi.IsDir() {
 				// Add this new directory to watch as watcher does not recursively watch subdirectories
-				watcher.Add(origPath)
+				if watcher != nil {
+					watcher.Add(origPath)
+				}
 			}
+			workspace.renamePath(event.RenamedFrom, origPath, s)
 		}
 	}
 
 	// OS REMOVE Event
 	if event.Has(fsnotify.Remove) {
-		// Remove from File Store, Workspace and Temp Directory
-		s.Files.RemoveFromPath(origPath)
-		workspace.removeFile(origPath)
-		os.Remove(tempDirFilePath)
+		workspace.deletePath(origPath, s)
 	}
 
 	// OS WRITE Event
 	if event.Has(fsnotify.Write) {
 		contents, _ := os.ReadFile(origPath)
-		os.WriteFile(tempDirFilePath, contents, fs.FileMode(os.O_TRUNC))
+		if workspace.replicating() {
+			os.WriteFile(tempDirFilePath, contents, fs.FileMode(os.O_TRUNC))
+		}
 		s.Files.ModifyFull(origPath, string(contents))
-		workspace.DiagnoseFile(origPath, s)
+		if f, ok := s.Files.GetFromPath(origPath); ok && IsFaustFile(origPath) {
+			s.analyzeInBackground(f)
+		}
+		workspace.diagnoseOn(diagnoseSave, origPath, s)
 	}
 }
 
 func (workspace *Workspace) HandleEditorEvent(change TDEvent, s *Server) {
-	// Temporary Directory
-	tempDir := s.tempDir
-
 	// Path of File that this Event affected
 	origFilePath := change.Path
 
+	// Deleted files aren't in the File Store anymore once handled
+	if change.Type == TDDelete {
+		workspace.deletePath(origFilePath, s)
+		return
+	}
+
 	// Reload config file if changed
 	if filepath.Base(origFilePath) == faustConfigFile {
 		workspace.loadConfigFiles(s)
-		workspace.cleanDiagnostics(s)
+		workspace.cleanDiagnostics(s.background.context(), s)
 	}
 
 	file, ok := s.Files.GetFromPath(origFilePath)
@@ -328,9 +559,15 @@ func (workspace *Workspace) HandleEditorEvent(change TDEvent, s *Server) {
 		logging.Logger.Error("File should've been in File Store.", "path", origFilePath)
 	}
 
-	tempDirFilePath := filepath.Join(tempDir, origFilePath) // Construct the temporary file path
+	tempDirFilePath := workspace.TempDirPath(origFilePath) // Construct the temporary file path
+	// Documents that only exist in memory are never written to disk
+	replicate := workspace.replicating() && !util.IsMemoryPath(origFilePath)
 	switch change.Type {
 	case TDOpen:
+		// Without a replica there's nothing to create, and the path is the original file
+		if !replicate {
+			break
+		}
 		// Ensure directory exists before creating file. This mirrors the workspace's directory structure in the temp directory.
 		// TODO: Add this and sub-directories to watcher
 		dirPath := filepath.Dir(tempDirFilePath)
@@ -357,26 +594,54 @@ func (workspace *Workspace) HandleEditorEvent(change TDEvent, s *Server) {
 		f.Close()
 	case TDChange:
 		// Write File to Temporary Directory. Updates the temporary file with the latest content from the editor.
-		logging.Logger.Info("Writing recent change to", "path", tempDirFilePath)
-		os.WriteFile(tempDirFilePath, file.Content, fs.FileMode(os.O_TRUNC)) // Write the file content to the temp file, overwriting existing content
-		content, _ := os.ReadFile(tempDirFilePath)
-		logging.Logger.Info("Current state of file", "path", tempDirFilePath, "content", string(content))
-		go s.Workspace.AnalyzeFile(file, &s.Store)
-		workspace.DiagnoseFile(origFilePath, s)
+		if replicate && ok {
+			logging.Logger.Info("Writing recent change to", "path", tempDirFilePath)
+			file.mu.RLock()
+			os.WriteFile(tempDirFilePath, file.Content, fs.FileMode(os.O_TRUNC)) // Write the file content to the temp file, overwriting existing content
+			file.mu.RUnlock()
+			content, _ := os.ReadFile(tempDirFilePath)
+			logging.Logger.Info("Current state of file", "path", tempDirFilePath, "content", string(content))
+		}
+		// Symbols of the file follow the editor's content
+		if ok && IsFaustFile(origFilePath) {
+			s.analyzeInBackground(file)
+		}
+		workspace.diagnoseOn(diagnoseChange, origFilePath, s)
+
+	case TDSave:
+		// Compiling takes a while, the watcher goes on meanwhile
+		s.background.Go(func(context.Context) {
+			workspace.diagnoseOn(diagnoseSave, origFilePath, s)
+		})
 
 	case TDClose:
 		// Sync file from disk on close if it exists and replicate it to temporary directory, else remove from Files Store
-		if util.IsValidPath(origFilePath) { // Check if the file path is valid
+		if workspace.closeExternal(origFilePath) {
+			// Documents outside of the workspace aren't tracked once closed
+			s.Files.RemoveFromPath(origFilePath)
+			s.Store.Dependencies.RemoveFile(origFilePath)
+			if ok {
+				file.mu.RLock()
+				hash := file.Hash
+				file.mu.RUnlock()
+				s.Store.forgetScope(hash)
+			}
+			if replicate {
+				os.Remove(tempDirFilePath)
+			}
+		} else if util.IsValidPath(origFilePath) { // Check if the file path is valid
 			s.Files.OpenFromPath(origFilePath) // Reload the file from the specified path.
 
 			file, ok := s.Files.GetFromPath(origFilePath) // Retrieve the file again (unnecessary, can use the previous `file`)
-			if ok {
+			if ok && replicate {
 				os.WriteFile(tempDirFilePath, file.Content, os.FileMode(os.O_TRUNC)) // Write content to temporary file, replicating it from disk.
 			}
 			workspace.addFile(origFilePath)
 		} else {
 			s.Files.RemoveFromPath(origFilePath) // Remove the file from the file store if the path isn't valid
 		}
+		// Diagnostics of closed files aren't kept up to date, so don't leave them behind in the editor
+		s.clearDiagnostics(origFilePath)
 
 	}
 }
@@ -389,24 +654,26 @@ func (workspace *Workspace) EditorOpenFile(uri util.URI, files *Files) {
 
 func (workspace *Workspace) addFile(path util.Path) {
 	workspace.mu.Lock()
-	workspace.Files = append(workspace.Files, path)
+	// A file replaced by an atomic save is created again without being removed
+	if !slices.Contains(workspace.Files, path) {
+		workspace.Files = append(workspace.Files, path)
+	}
 	workspace.mu.Unlock()
 }
 
-func (w *Workspace) DiagnoseFile(path util.Path, s *Server) {
+func (w *Workspace) DiagnoseFile(ctx context.Context, path util.Path, s *Server) {
 	if IsFaustFile(path) {
 		logging.Logger.Info("Diagnosing File", "path", path)
 
-		params := s.Files.TSDiagnostics(path)
-		logging.Logger.Info("Got Diagnose File", "params", params)
-		if params.URI != "" {
-			s.diagChan <- params
-		}
-		if len(params.Diagnostics) == 0 {
-			// Compiler Diagnostics if exists
-			if w.Config.CompilerDiagnostics {
+		if w.checkSyntax(s, path) {
+			// Compiler Diagnostics if exists. Unsaved documents can't be compiled.
+			folder := w.folderFor(path)
+			if folder.Config.CompilerDiagnostics && !util.IsMemoryPath(path) {
 				logging.Logger.Info("Generating Compiler errors as no syntax errors")
-				w.sendCompilerDiagnostics(s)
+				w.sendCompilerDiagnostics(ctx, s, folder)
+			} else if !folder.Config.CompilerDiagnostics {
+				// Compiler diagnostics may have been disabled since the last run
+				w.finishCompilerRun(s, folder, nil)
 			}
 		}
 	}
@@ -416,7 +683,8 @@ func (workspace *Workspace) removeFile(path util.Path) {
 	workspace.mu.Lock()
 	for i, filePath := range workspace.Files {
 		if filePath == path {
-			workspace.Files = slices.Delete(workspace.Files, i, i)
+			workspace.Files = slices.Delete(workspace.Files, i, i+1)
+			break
 		}
 	}
 	workspace.mu.Unlock()
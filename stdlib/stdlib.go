@@ -0,0 +1,104 @@
+// Package stdlib embeds documentation of the standard Faust libraries, so that hover and completion can
+// document functions like os.osc even when faustlibraries isn't installed or lacks doc comments.
+package stdlib
+
+import (
+	_ "embed"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Regenerate the bundle from a faustlibraries checkout with FAUSTLIBRARIES set to its path
+//go:generate go run .. docs -o docs.json $FAUSTLIBRARIES
+
+//go:embed docs.json
+var embedded []byte
+
+// Documentation of a library function
+type Doc struct {
+	// Library file defining the function, e.g. oscillators.lib
+	Library string `json:"library"`
+	Full    string `json:"full"`
+	Usage   string `json:"usage,omitempty"`
+}
+
+// Documentation of the standard libraries, keyed by the names they have through stdfaust.lib, e.g. os.osc
+type Bundle struct {
+	// faustlibraries version the bundle was generated from
+	Version string `json:"version"`
+	// When the bundle was generated, the freshest bundle is preferred
+	Generated time.Time      `json:"generated,omitzero"`
+	Docs      map[string]Doc `json:"docs"`
+}
+
+func Parse(data []byte) (*Bundle, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if b.Docs == nil {
+		b.Docs = map[string]Doc{}
+	}
+	return &b, nil
+}
+
+// Returns the documentation of a qualified name like fi.lowpass
+func (b *Bundle) Lookup(name string) (Doc, bool) {
+	doc, ok := b.Docs[name]
+	return doc, ok
+}
+
+// Names of the functions documented under prefix, without it, e.g. osc for os, sorted
+func (b *Bundle) Members(prefix string) []string {
+	members := []string{}
+	for name := range b.Docs {
+		if member, ok := strings.CutPrefix(name, prefix+"."); ok {
+			members = append(members, member)
+		}
+	}
+	slices.Sort(members)
+	return members
+}
+
+// Returns the library file the functions documented under prefix are defined in, e.g. oscillators.lib for os, empty
+// if none is documented
+func (b *Bundle) Library(prefix string) string {
+	for _, member := range b.Members(prefix) {
+		if doc := b.Docs[prefix+"."+member]; doc.Library != "" {
+			return doc.Library
+		}
+	}
+	return ""
+}
+
+var (
+	embeddedBundle *Bundle
+	current        atomic.Pointer[Bundle]
+)
+
+func init() {
+	b, err := Parse(embedded)
+	if err != nil {
+		panic("stdlib: invalid embedded documentation bundle: " + err.Error())
+	}
+	embeddedBundle = b
+	current.Store(b)
+}
+
+// Returns the bundle built into faustlsp
+func Embedded() *Bundle {
+	return embeddedBundle
+}
+
+// Returns the bundle used for documentation, the embedded one unless another was set
+func Current() *Bundle {
+	return current.Load()
+}
+
+// Replaces the bundle used for documentation, e.g. with a fresher one
+func Set(b *Bundle) {
+	current.Store(b)
+}
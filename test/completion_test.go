@@ -1,11 +1,20 @@
 package tests
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/stdlib"
 	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
 )
 
 func TestFindCompletionReplaceRange(t *testing.T) {
@@ -29,6 +38,40 @@ foo = 1;`,
 				End:   transport.Position{Line: 1, Character: 2},
 			},
 		},
+		{
+			name:     "Empty file",
+			text:     "",
+			position: transport.Position{Line: 0, Character: 0},
+			encoding: "utf-16",
+			want:     transport.Range{},
+		},
+		{
+			name:     "Position past the end of the file",
+			text:     "foo",
+			position: transport.Position{Line: 5, Character: 2},
+			encoding: "utf-16",
+			want:     transport.Range{},
+		},
+		{
+			name:     "Character past the end of the line",
+			text:     "process = os.osc\nbar",
+			position: transport.Position{Line: 0, Character: 40},
+			encoding: "utf-16",
+			want: transport.Range{
+				Start: transport.Position{Line: 0, Character: 13},
+				End:   transport.Position{Line: 0, Character: 16},
+			},
+		},
+		{
+			name:     "Multi-byte characters",
+			text:     "gain = 1; // 😆\nvolume_é",
+			position: transport.Position{Line: 1, Character: 8},
+			encoding: "utf-16",
+			want: transport.Range{
+				Start: transport.Position{Line: 1, Character: 0},
+				End:   transport.Position{Line: 1, Character: 8},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -39,3 +82,510 @@ foo = 1;`,
 		})
 	}
 }
+
+func TestDeclareCompletion(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	content := `declare name "x";
+declare options "[midi:on][n";
+declare foo au;
+declare name "";
+gain = 1; process = ga;
+`
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+
+	tests := []struct {
+		name     string
+		position transport.Position
+		// Label that should be completed, none when empty
+		label string
+		want  transport.Range
+	}{
+		{"Metadata key", transport.Position{Line: 0, Character: 10}, "name", transport.Range{Start: transport.Position{Line: 0, Character: 8}, End: transport.Position{Line: 0, Character: 10}}},
+		{"Option flag", transport.Position{Line: 1, Character: 28}, "[nvoices:8]", transport.Range{Start: transport.Position{Line: 1, Character: 26}, End: transport.Position{Line: 1, Character: 28}}},
+		{"Function metadata key", transport.Position{Line: 2, Character: 14}, "author", transport.Range{Start: transport.Position{Line: 2, Character: 12}, End: transport.Position{Line: 2, Character: 14}}},
+		{"Metadata value", transport.Position{Line: 3, Character: 14}, "", transport.Range{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+				TextDocument: transport.TextDocumentIdentifier{URI: uri},
+				Position:     tt.position,
+			}})
+			result, err := server.Completion(context.Background(), s, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var items []transport.CompletionItem
+			json.Unmarshal(result, &items)
+			if tt.label == "" {
+				if len(items) != 0 {
+					t.Errorf("got %d completions, want none", len(items))
+				}
+				return
+			}
+			for _, item := range items {
+				if item.Label == tt.label {
+					if item.TextEdit.Range != tt.want {
+						t.Errorf("%s replaces %v, want %v", tt.label, item.TextEdit.Range, tt.want)
+					}
+					return
+				}
+			}
+			t.Errorf("%s not completed in %v", tt.label, items)
+		})
+	}
+
+	// Outside of declare statements, symbols are completed
+	params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 4, Character: 22},
+	}})
+	result, _ := server.Completion(context.Background(), s, params)
+	var items []transport.CompletionItem
+	json.Unmarshal(result, &items)
+	for _, item := range items {
+		if item.Label == "author" {
+			t.Errorf("metadata key completed outside of a declare statement")
+		}
+	}
+}
+
+func TestAutoImportCompletion(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "utils.lib"), []byte("// Doubles its input.\ndouble = *(2);\n"), 0644)
+	// Defines gain like main.dsp, so importing it would redefine gain
+	os.WriteFile(filepath.Join(root, "fx.lib"), []byte("gain = 0.5;\necho = @(100) : *(gain);\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("gain = 1;\nprocess = dou;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "osc.dsp"), []byte("declare name \"osc\";\nprocess = os.\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := func(file string, pos transport.Position) map[string]transport.CompletionItem {
+		params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, file)))},
+			Position:     pos,
+		}})
+		result, err := server.Completion(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []transport.CompletionItem
+		json.Unmarshal(result, &items)
+		labels := map[string]transport.CompletionItem{}
+		for _, item := range items {
+			labels[item.Label] = item
+		}
+		return labels
+	}
+	start := transport.Range{}
+
+	// Before dou, where every name can be completed
+	items := complete("main.dsp", transport.Position{Line: 1, Character: 10})
+	double, ok := items["double"]
+	if !ok {
+		t.Fatalf("double not completed in %v", items)
+	}
+	if want := []transport.TextEdit{{Range: start, NewText: "import(\"utils.lib\");\n"}}; !reflect.DeepEqual(double.AdditionalTextEdits, want) {
+		t.Errorf("double edits = %+v, want %+v", double.AdditionalTextEdits, want)
+	}
+	if double.Documentation == nil || double.LabelDetails == nil || double.LabelDetails.Description != "utils.lib" {
+		t.Errorf("double = %+v, want documented from utils.lib", double)
+	}
+	echo, ok := items["fx.echo"]
+	if !ok {
+		t.Fatalf("fx.echo not completed in %v", items)
+	}
+	if want := []transport.TextEdit{{Range: start, NewText: "fx = library(\"fx.lib\");\n"}}; !reflect.DeepEqual(echo.AdditionalTextEdits, want) {
+		t.Errorf("fx.echo edits = %+v, want %+v", echo.AdditionalTextEdits, want)
+	}
+	if _, ok := items["echo"]; ok {
+		t.Errorf("echo completed without its library binding")
+	}
+	// Definitions of the file don't need importing
+	if item, ok := items["gain"]; !ok || len(item.AdditionalTextEdits) != 0 {
+		t.Errorf("gain = %+v, want it completed without edits", item)
+	}
+
+	// Standard library environments are imported through stdfaust.lib, after the declare statements
+	previous := stdlib.Current()
+	stdlib.Set(&stdlib.Bundle{Docs: map[string]stdlib.Doc{"os.osc": {Library: "oscillators.lib", Full: "Sine oscillator."}}})
+	t.Cleanup(func() { stdlib.Set(previous) })
+	items = complete("osc.dsp", transport.Position{Line: 1, Character: 13})
+	osc, ok := items["osc"]
+	if !ok {
+		t.Fatalf("osc not completed in %v", items)
+	}
+	after := transport.Range{Start: transport.Position{Line: 1}, End: transport.Position{Line: 1}}
+	if want := []transport.TextEdit{{Range: after, NewText: "import(\"stdfaust.lib\");\n"}}; !reflect.DeepEqual(osc.AdditionalTextEdits, want) {
+		t.Errorf("osc edits = %+v, want %+v", osc.AdditionalTextEdits, want)
+	}
+}
+
+func TestLocalEnvironmentCompletion(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		"gain = 1;",
+		"f(freq, q) = lp with {",
+		"  lp = fi + q;",
+		"  fi = par(i, 2, freq * i);",
+		"};",
+		"g(x) = y letrec { 'y = y + x; };",
+		"process = f(1, 2) + g(gain);",
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	complete := func(line int, after string) map[string]bool {
+		params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(strings.Index(lines[line], after) + len(after))},
+		}})
+		result, err := server.Completion(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []transport.CompletionItem
+		json.Unmarshal(result, &items)
+		labels := map[string]bool{}
+		for _, item := range items {
+			labels[item.Label] = true
+		}
+		return labels
+	}
+
+	tests := []struct {
+		name  string
+		line  int
+		after string
+		want  []string
+	}{
+		{"Expression of a with", 1, "= ", []string{"freq", "q", "lp", "fi", "gain"}},
+		{"Definition of a with", 2, "+ ", []string{"freq", "q", "lp", "fi", "gain"}},
+		{"Iteration in a definition of a with", 3, "freq * ", []string{"i", "freq", "q", "lp", "fi"}},
+		{"Definition of a letrec", 5, "+ ", []string{"x", "y", "gain"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := complete(tt.line, tt.after)
+			for _, want := range tt.want {
+				if !got[want] {
+					t.Errorf("%s not completed in %v", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUISnippetCompletion(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		"gain = hsl",
+		"process = os.hsl",
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	// The hslider item completing the end of line
+	hslider := func(line int) (transport.CompletionItem, bool) {
+		params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(len(lines[line]))},
+		}})
+		result, err := server.Completion(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []transport.CompletionItem
+		json.Unmarshal(result, &items)
+		for _, item := range items {
+			if item.Label == "hslider" {
+				return item, true
+			}
+		}
+		return transport.CompletionItem{}, false
+	}
+
+	if _, ok := hslider(0); ok {
+		t.Errorf("snippet offered to a client without snippet support")
+	}
+	s.ClientCapabilities.TextDocument.Completion.CompletionItem.SnippetSupport = true
+	item, ok := hslider(0)
+	if !ok {
+		t.Fatal("hslider not completed")
+	}
+	want := transport.TextEdit{
+		Range:   transport.Range{Start: transport.Position{Line: 0, Character: 7}, End: transport.Position{Line: 0, Character: 10}},
+		NewText: `hslider("${1:label}", ${2:0}, ${3:0}, ${4:1}, ${5:0.01})`,
+	}
+	if item.TextEdit != want || item.InsertTextFormat == nil || *item.InsertTextFormat != transport.SnippetTextFormat {
+		t.Errorf("hslider completed with %v (format %v), want snippet %v", item.TextEdit, item.InsertTextFormat, want)
+	}
+	if _, ok := hslider(1); ok {
+		t.Errorf("primitive offered as a member of an environment")
+	}
+}
+
+func TestKeywordCompletion(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		"process = pa",
+		"gain = os.pa",
+		"delay = rd",
+		"mix = pro",
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	// Completions labeled label at the end of line
+	complete := func(line int, label string) []transport.CompletionItem {
+		params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(len(lines[line]))},
+		}})
+		result, err := server.Completion(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []transport.CompletionItem
+		json.Unmarshal(result, &items)
+		labeled := []transport.CompletionItem{}
+		for _, item := range items {
+			if item.Label == label {
+				labeled = append(labeled, item)
+			}
+		}
+		return labeled
+	}
+
+	if par := complete(0, "par"); len(par) != 1 || par[0].Kind != transport.KeywordCompletion || par[0].TextEdit.NewText != "par" {
+		t.Errorf("par completed with %v, want the keyword alone", par)
+	}
+	if process := complete(3, "process"); len(process) != 1 {
+		t.Errorf("process completed %d times, want once", len(process))
+	}
+	if par := complete(1, "par"); len(par) != 0 {
+		t.Errorf("keyword offered as a member of an environment")
+	}
+	rdtable := complete(2, "rdtable")
+	if len(rdtable) != 1 || rdtable[0].Kind != transport.FunctionCompletion || rdtable[0].Detail != "rdtable(size, init, ridx)" {
+		t.Fatalf("rdtable completed with %v, want the primitive with its usage", rdtable)
+	}
+	if docs, _ := json.Marshal(rdtable[0].Documentation); !strings.Contains(string(docs), "3 inputs, 1 output") {
+		t.Errorf("rdtable documented with %s, want its arity", docs)
+	}
+	s.ClientCapabilities.TextDocument.Completion.CompletionItem.SnippetSupport = true
+	if par := complete(0, "par"); len(par) != 1 || par[0].TextEdit.NewText != "par(${1:i}, ${2:N}, ${3:_})" {
+		t.Errorf("par completed with %v, want a snippet", par)
+	}
+}
+
+func TestCompletionKinds(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		`import("defs.lib");`,
+		`ut = library("defs.lib");`,
+		`local = 1;`,
+		`process = `,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	os.WriteFile(filepath.Join(root, "defs.lib"), []byte("f(x) = x;\ngain = 0.5;\nenv = environment { a = 1; };\nalias = env;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))},
+		Position:     transport.Position{Line: 3, Character: uint32(len(lines[3]))},
+	}})
+	result, err := server.Completion(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []transport.CompletionItem
+	json.Unmarshal(result, &items)
+	labels := map[string]transport.CompletionItem{}
+	for _, item := range items {
+		labels[item.Label] = item
+	}
+
+	tests := []struct {
+		label string
+		kind  transport.CompletionItemKind
+		// Description of the label details, the defining file unless it is the completed one
+		file string
+	}{
+		{"f", transport.FunctionCompletion, "defs.lib"},
+		{"gain", transport.VariableCompletion, "defs.lib"},
+		{"env", transport.ModuleCompletion, "defs.lib"},
+		{"alias", transport.ModuleCompletion, "defs.lib"},
+		{"ut", transport.ModuleCompletion, ""},
+		{"local", transport.VariableCompletion, ""},
+		{"with", transport.KeywordCompletion, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			item, ok := labels[tt.label]
+			if !ok {
+				t.Fatalf("%s not completed", tt.label)
+			}
+			if item.Kind != tt.kind {
+				t.Errorf("kind = %v, want %v", item.Kind, tt.kind)
+			}
+			file := ""
+			if item.LabelDetails != nil {
+				file = item.LabelDetails.Description
+			}
+			if file != tt.file {
+				t.Errorf("label details = %q, want %q", file, tt.file)
+			}
+		})
+	}
+}
+
+func TestCompletionLimit(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false, "max_completions": 10}`), 0644)
+	definitions := []string{"other = 1;"}
+	for i := range 30 {
+		definitions = append(definitions, fmt.Sprintf("osc%d = %d;", i, i))
+	}
+	os.WriteFile(filepath.Join(root, "defs.lib"), []byte(strings.Join(definitions, "\n")+"\n"), 0644)
+	lines := []string{
+		`import("defs.lib");`,
+		`process = os`,
+		`gain = OTH`,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := func(line int) json.RawMessage {
+		params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(len(lines[line]))},
+		}})
+		result, err := server.Completion(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// More items match than fit, the client asks again as the name is typed
+	var list transport.CompletionList
+	if err := json.Unmarshal(complete(1), &list); err != nil {
+		t.Fatalf("completion of os isn't a list: %v", err)
+	}
+	if !list.IsIncomplete || len(list.Items) != 10 {
+		t.Errorf("completion of os = %d items, incomplete %v, want 10 items of an incomplete list", len(list.Items), list.IsIncomplete)
+	}
+	for _, item := range list.Items {
+		if !strings.HasPrefix(item.Label, "os") {
+			t.Errorf("%s completed for os", item.Label)
+		}
+	}
+
+	// Everything matching fits, regardless of case
+	var items []transport.CompletionItem
+	if err := json.Unmarshal(complete(2), &items); err != nil {
+		t.Fatalf("completion of OTH isn't a list of items: %v", err)
+	}
+	if len(items) != 1 || items[0].Label != "other" {
+		t.Errorf("completion of OTH = %v, want other alone", items)
+	}
+}
+
+func TestCompletionRanking(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.lib"), []byte("import(\"b.lib\");\ngain = 2;\namp = 1;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.lib"), []byte("amp = 3;\nbias = 0;\n"), 0644)
+	lines := []string{
+		`import("a.lib");`,
+		`gain = 1;`,
+		`process = `,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))},
+		Position:     transport.Position{Line: 2, Character: uint32(len(lines[2]))},
+	}})
+	result, err := server.Completion(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []transport.CompletionItem
+	json.Unmarshal(result, &items)
+
+	// Index of the only item labeled label, and the file it is described with
+	find := func(label string) (int, string) {
+		index, file := -1, ""
+		for i, item := range items {
+			if item.Label != label {
+				continue
+			}
+			if index != -1 {
+				t.Errorf("%s completed several times", label)
+			}
+			index = i
+			if item.LabelDetails != nil {
+				file = item.LabelDetails.Description
+			}
+		}
+		if index == -1 {
+			t.Fatalf("%s not completed", label)
+		}
+		return index, file
+	}
+	gain, gainFile := find("gain")
+	amp, ampFile := find("amp")
+	with, _ := find("with")
+	bias, biasFile := find("bias")
+	if gainFile != "" || ampFile != "a.lib" || biasFile != "b.lib" {
+		t.Errorf("gain, amp and bias from %q, %q and %q, want the document, a.lib and b.lib", gainFile, ampFile, biasFile)
+	}
+	// The document, its imports, keywords, then what its imports import
+	if !(gain < amp && amp < with && with < bias) {
+		t.Errorf("gain, amp, with and bias at %d, %d, %d and %d, want them in this order", gain, amp, with, bias)
+	}
+	for i := 1; i < len(items); i++ {
+		if items[i-1].SortText > items[i].SortText {
+			t.Errorf("%s sorted before %s", items[i-1].SortText, items[i].SortText)
+		}
+	}
+}
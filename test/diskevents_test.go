@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestAtomicSave(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	path := filepath.Join(root, "main.dsp")
+	os.WriteFile(path, []byte("process = ;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(path)
+	diagnostics := func(empty bool) {
+		readUntil(t, tr, fmt.Sprintf("diagnostics with empty = %v", empty), func(msg []byte) bool {
+			var m transport.NotificationMessage
+			json.Unmarshal(msg, &m)
+			var params transport.PublishDiagnosticsParams
+			json.Unmarshal(m.Params, &params)
+			return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && (len(params.Diagnostics) == 0) == empty
+		})
+	}
+	diagnostics(false)
+
+	// Written to a temporary file which then replaces the original
+	temp := filepath.Join(root, ".main.dsp.swp")
+	os.WriteFile(temp, []byte("process = _;\n"), 0644)
+	if err := os.Rename(temp, path); err != nil {
+		t.Fatal(err)
+	}
+	diagnostics(true)
+
+	// Removed and written again
+	os.Remove(path)
+	os.WriteFile(path, []byte("process = ;\n"), 0644)
+	diagnostics(false)
+}
+
+func TestLibraryDirectoryWatched(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	libraries := t.TempDir()
+	main := "import(\"ext.lib\");\nprocess = gain;\n"
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(main), 0644)
+	config, _ := json.Marshal(map[string]any{"compiler_diagnostics": false, "library_path": libraries})
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), config, 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	libURI := util.Path2URI(filepath.Join(libraries, "ext.lib"))
+	definition, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(uri)},
+		Position:     transport.Position{Line: 1, Character: 11},
+	}})
+	id := 10
+	waitForDefinition := func(line uint32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for ; ; id++ {
+			tr.WriteRequest(id, "textDocument/definition", definition)
+			var location transport.Location
+			readUntil(t, tr, "definition response", func(msg []byte) bool {
+				var r transport.ResponseMessage
+				json.Unmarshal(msg, &r)
+				if n, ok := r.ID.(float64); ok && int(n) == id {
+					json.Unmarshal(r.Result, &location)
+					return true
+				}
+				return false
+			})
+			if string(location.URI) == libURI && location.Range.Start.Line == line {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("definition of gain = %v, want line %d of %s", location, line, libURI)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// Installed while the server is running
+	os.WriteFile(filepath.Join(libraries, "ext.lib"), []byte("gain = 0.5;\n"), 0644)
+	waitForDefinition(0)
+
+	// Updated
+	os.WriteFile(filepath.Join(libraries, "ext.lib"), []byte("// Gain\n\ngain = 0.5;\n"), 0644)
+	waitForDefinition(2)
+}
+
+func TestWatchedFiles(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	capabilities := transport.ClientCapabilities{Workspace: transport.WorkspaceClientCapabilities{
+		DidChangeWatchedFiles: transport.DidChangeWatchedFilesClientCapabilities{DynamicRegistration: true},
+	}}
+	tr, stop := startTestServerWithCapabilities(t, root, capabilities)
+	defer stop()
+	readUntil(t, tr, "registration of watched files", func(msg []byte) bool {
+		return strings.Contains(string(msg), `"client/registerCapability"`) && strings.Contains(string(msg), `"workspace/didChangeWatchedFiles"`) && strings.Contains(string(msg), `"**/*.dsp"`)
+	})
+
+	// Reported by the client as well as seen by the workspace watcher, which handles it once
+	path := filepath.Join(root, "new.dsp")
+	os.WriteFile(path, []byte("process = ;\n"), 0644)
+	uri := util.Path2URI(path)
+	changes, _ := json.Marshal(transport.DidChangeWatchedFilesParams{Changes: []transport.FileEvent{{URI: transport.DocumentURI(uri), Type: transport.Created}}})
+	tr.WriteNotif("workspace/didChangeWatchedFiles", changes)
+	readUntil(t, tr, "diagnostics of the new file", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && len(params.Diagnostics) > 0
+	})
+}
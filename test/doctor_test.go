@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestDoctorConfig(t *testing.T) {
+	logging.Init()
+	tests := []struct {
+		name   string
+		config string
+		wantOK bool
+		detail string
+	}{
+		{name: "No config", config: "", wantOK: true, detail: "not found"},
+		{name: "Valid config", config: `{"process_files": ["main.dsp"]}`, wantOK: true},
+		{name: "Invalid JSON", config: `{"process_files": [`, wantOK: false, detail: "invalid config"},
+		{name: "Missing process file", config: `{"process_files": ["missing.dsp"]}`, wantOK: false, detail: "missing.dsp"},
+		{name: "Unknown key", config: `{"proces_files": ["main.dsp"]}`, wantOK: false, detail: `Unknown key "proces_files"`},
+		{name: "Wrong type", config: `{"compiler_diagnostics": "yes"}`, wantOK: false, detail: `"compiler_diagnostics" should be a boolean`},
+		{name: "Invalid diagnostics mode", config: `{"diagnostics": {"compiler": {"mode": "sometimes"}}}`, wantOK: false, detail: `invalid diagnostics mode "sometimes"`},
+		{name: "Diagnostics policy", config: `{"diagnostics": {"syntax": {"mode": "on-type", "delay": 200}, "compiler": {"mode": "on-save"}}}`, wantOK: true},
+		{name: "Include directory from environment", config: `{"include": ["${FAUSTLSP_TEST_ROOT}"]}`, wantOK: true},
+		{name: "Missing include directory", config: `{"include": ["libs"]}`, wantOK: false, detail: `Include directory "libs" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			t.Setenv("FAUSTLSP_TEST_ROOT", root)
+			os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;"), 0644)
+			if tt.config != "" {
+				os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(tt.config), 0644)
+			}
+			check := server.Doctor(root)[0]
+			if check.OK != tt.wantOK {
+				t.Errorf("config check OK = %v, want %v (%s)", check.OK, tt.wantOK, check.Detail)
+			}
+			if !strings.Contains(check.Detail, tt.detail) {
+				t.Errorf("config check detail = %q, want it to contain %q", check.Detail, tt.detail)
+			}
+		})
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+	t.Setenv("FAUST_LIB_PATH", "/opt/faust/lib")
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"~/libs", "/home/user/libs"},
+		{"~", "/home/user"},
+		{"$HOME/libs", "/home/user/libs"},
+		{"${FAUST_LIB_PATH}/extra", "/opt/faust/lib/extra"},
+		{"libs/~notexpanded", "libs/~notexpanded"},
+		{"faust", "faust"},
+	}
+	for _, tt := range tests {
+		if got := util.ExpandPath(tt.path); got != tt.want {
+			t.Errorf("ExpandPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
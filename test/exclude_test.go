@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+)
+
+func TestExcludePatterns(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	files := []string{"main.dsp", "build/main.dsp", "node_modules/pkg/lib.dsp", "gen/out.dsp", "src/gen/fx.dsp"}
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("process = _;\n"), 0644)
+	}
+	config := `{"exclude": ["build", "node_modules", "src/gen"]}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"main.dsp", true},
+		{"build/main.dsp", false},
+		{"node_modules/pkg/lib.dsp", false},
+		// Patterns with a slash are relative to the root
+		{"gen/out.dsp", true},
+		{"src/gen/fx.dsp", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(s.Workspace.Root, tt.file)
+		if got := slices.Contains(s.Workspace.Files, path); got != tt.want {
+			t.Errorf("%s indexed = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	files := []string{"main.dsp", "out/main.dsp", "gen/a.dsp", "gen/keep.dsp", "src/fx.dsp", "src/fx-gen.dsp", "docs/deep/b.dsp"}
+	for _, file := range files {
+		path := filepath.Join(root, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("process = _;\n"), 0644)
+	}
+	gitignore := "# artifacts\nout/\ngen/*\n!gen/keep.dsp\n*-gen.dsp\n/docs/**/b.dsp\n"
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte(gitignore), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"gitignore": true}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"main.dsp", true},
+		{"out/main.dsp", false},
+		{"gen/a.dsp", false},
+		{"gen/keep.dsp", true},
+		{"src/fx.dsp", true},
+		{"src/fx-gen.dsp", false},
+		{"docs/deep/b.dsp", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(s.Workspace.Root, tt.file)
+		if got := slices.Contains(s.Workspace.Files, path); got != tt.want {
+			t.Errorf("%s indexed = %v, want %v", tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, file := range []string{filepath.Join(root, "src/fx.dsp"), filepath.Join(outside, "ext.dsp")} {
+		os.MkdirAll(filepath.Dir(file), 0755)
+		os.WriteFile(file, []byte("process = _;\n"), 0644)
+	}
+	links := map[string]string{
+		// Cycle back to the root
+		"src/loop": "..",
+		// Visited a second time under another path
+		"alias":      "src",
+		"a-fx.dsp":   "src/fx.dsp",
+		"external":   outside,
+		"broken.dsp": "missing.dsp",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skip("symbolic links not supported:", err)
+		}
+	}
+
+	done := make(chan *server.Server)
+	go func() {
+		s, err := server.IndexWorkspace(context.Background(), root)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- s
+	}()
+	var s *server.Server
+	select {
+	case s = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("walking the workspace doesn't terminate")
+	}
+	if s == nil {
+		return
+	}
+	want := []string{filepath.Join(s.Workspace.Root, "src/fx.dsp")}
+	if !slices.Equal(s.Workspace.Files, want) {
+		t.Errorf("indexed %v, want %v", s.Workspace.Files, want)
+	}
+}
@@ -0,0 +1,371 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestCompileCommand(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Stands in for the compiler and writes its arguments to the output file
+	fakeFaust := "#!/bin/sh\nwhile [ $# -gt 0 ]; do\n  if [ \"$1\" = \"-o\" ]; then out=\"$2\"; fi\n  args=\"$args $1\"; shift\ndone\necho \"$args\" > \"$out\"\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	config := `{"command": "./fakefaust", "target": "wasm", "output_dir": "build/web", "extra_flags": ["-ftz", "2"], "precision": "double", "process_names": {"*.dsp": "process_dsp", "main.dsp": "process_main"}}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := json.Marshal(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	result, err := server.CompileCommand(context.Background(), s, []json.RawMessage{uri})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join(s.Workspace.Root, "build", "web", "main.wasm")
+	if output := result.(server.CompileResult).Output; output != want {
+		t.Fatalf("output = %s, want %s", output, want)
+	}
+	args, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"-lang wasm", "-pn process_main", "-double", "-ftz 2"} {
+		if !strings.Contains(string(args), arg) {
+			t.Errorf("compiler arguments %q don't contain %q", strings.TrimSpace(string(args)), arg)
+		}
+	}
+}
+
+func TestMissingCompiler(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"stdfaust.lib\");\nprocess = _;\n"), 0644)
+	config := `{"command": "faustlsp-missing-compiler"}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := server.GetFaustDSPDir("faustlsp-missing-compiler"); dir != "" {
+		t.Errorf("library directory = %q, want none", dir)
+	}
+	if path, _ := s.Workspace.ResolveFilePath("stdfaust.lib", s.Workspace.Root); path != "" {
+		t.Errorf("stdfaust.lib resolved to %s without a compiler", path)
+	}
+
+	uri, _ := json.Marshal(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	_, err = server.CompileCommand(context.Background(), s, []json.RawMessage{uri})
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("compiling without a compiler: error = %v, want not found", err)
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Stands in for the compiler and prints its arguments and the file it expands
+	fakeFaust := "#!/bin/sh\necho \"$@\"\ncat \"$1\"\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("gain = 0.5;\nprocess = *(gain);\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust", "precision": "double", "extra_flags": ["-vec"]}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := json.Marshal(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	if result, err := server.ExpandCommand(context.Background(), s, nil); err == nil {
+		t.Fatalf("expanding without a document = %v, want an error", result)
+	}
+
+	tests := []struct {
+		name string
+		args []json.RawMessage
+		want []string
+	}{
+		{name: "Whole file", args: []json.RawMessage{uri}, want: []string{"-e -pn process -double", "-vec", "process = *(gain);"}},
+		{name: "Selection", args: []json.RawMessage{uri, json.RawMessage(`{"start": {"line": 1, "character": 10}, "end": {"line": 1, "character": 17}}`)}, want: []string{"-e -pn faust_expand -double", "-vec", "faust_expand = *(gain);"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := server.ExpandCommand(context.Background(), s, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expansion := result.(server.ExpandResult)
+			for _, want := range tt.want {
+				if !strings.Contains(expansion.Content, want) {
+					t.Errorf("expansion %q doesn't contain %q", expansion.Content, want)
+				}
+			}
+
+			// The virtual document shows the latest expansion
+			params, _ := json.Marshal(map[string]any{"uri": expansion.URI})
+			content, err := server.TextDocumentContent(context.Background(), s, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var doc server.TextDocumentContentResult
+			json.Unmarshal(content, &doc)
+			if doc.Text != expansion.Content {
+				t.Errorf("virtual document = %q, want %q", doc.Text, expansion.Content)
+			}
+		})
+	}
+}
+
+func TestExpandTimeout(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Stands in for a compiler that never finishes expanding
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\nsleep 5\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust", "compiler_diagnostics": false, "compiler_timeout": 100}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := json.Marshal(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	start := time.Now()
+	_, err = server.ExpandCommand(context.Background(), s, []json.RawMessage{uri})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expanding with a slow compiler = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expansion was stopped after %v, want compiler_timeout", elapsed)
+	}
+}
+
+func TestCheckSelectionCommand(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Stands in for the compiler: rejects undefined symbols, and describes other processes with 1 input and 2 outputs
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit\nif grep -q undefined \"$1\"; then echo 'ERROR : undefined symbol : undefined' >&2; exit 1; fi\necho '{\"inputs\": 1, \"outputs\": 2}' > \"$1.json\"\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"stdfaust.lib\");\nprocess = _ <: _, _;\nbroken = undefined;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust"}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := json.Marshal(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	if result, err := server.CheckSelectionCommand(context.Background(), s, []json.RawMessage{uri}); err == nil {
+		t.Fatalf("checking without a selection = %v, want an error", result)
+	}
+
+	tests := []struct {
+		name      string
+		selection string
+		want      server.CheckSelectionResult
+	}{
+		{name: "Valid", selection: `{"start": {"line": 1, "character": 10}, "end": {"line": 1, "character": 20}}`, want: server.CheckSelectionResult{OK: true, Inputs: 1, Outputs: 2}},
+		{name: "Invalid", selection: `{"start": {"line": 2, "character": 9}, "end": {"line": 2, "character": 19}}`, want: server.CheckSelectionResult{Error: "ERROR : undefined symbol : undefined"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := server.CheckSelectionCommand(context.Background(), s, []json.RawMessage{uri, json.RawMessage(tt.selection)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := result.(server.CheckSelectionResult)
+			if !strings.HasPrefix(check.Source, "import(\"stdfaust.lib\");\nprocess = ") {
+				t.Errorf("source = %q, want the imports of the document and a process", check.Source)
+			}
+			check.Source = ""
+			if check != tt.want {
+				t.Errorf("result = %+v, want %+v", check, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitConfigCommand(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.MkdirAll(filepath.Join(root, "effects"), 0755)
+	os.WriteFile(filepath.Join(root, "effects", "echo.dsp"), []byte("process = _;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	initConfigAction := func() (transport.CodeAction, bool) {
+		for _, action := range codeActionsAt(t, s, uri, transport.Position{}) {
+			if action.Command != nil && action.Command.Command == "faust.initConfig" {
+				return action, true
+			}
+		}
+		return transport.CodeAction{}, false
+	}
+
+	// Offered while there is no config
+	action, ok := initConfigAction()
+	if !ok {
+		t.Fatalf("no code action running faust.initConfig")
+	}
+	result, err := server.InitConfigCommand(context.Background(), s, action.Command.Arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, ".faustcfg.json")
+	if created := result.(server.InitConfigResult).URI; string(created) != util.Path2URI(path) {
+		t.Errorf("created %s, want %s", created, path)
+	}
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), "// ") {
+		t.Errorf("config isn't commented:\n%s", content)
+	}
+
+	// The commented config is valid and lists the .dsp files explicitly
+	edited := strings.Replace(string(content), `"process_name": "process"`, `"process_name": "dsp"`, 1)
+	os.WriteFile(path, []byte(edited), 0644)
+	s, err = server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := s.Workspace.Config.ProcessName; name != "dsp" {
+		t.Errorf("process name = %s, want dsp from the edited config:\n%s", name, edited)
+	}
+	processFiles := slices.Sorted(slices.Values(s.Workspace.Config.ProcessFiles))
+	if want := []string{filepath.Join("effects", "echo.dsp"), "main.dsp"}; !slices.Equal(processFiles, want) {
+		t.Errorf("process files = %v, want %v", processFiles, want)
+	}
+	if action, ok := initConfigAction(); ok {
+		t.Errorf("code action %+v offered once the config exists", action)
+	}
+	if _, err := server.InitConfigCommand(context.Background(), s, nil); err == nil {
+		t.Errorf("existing config was overwritten")
+	}
+}
+
+func TestMetadataTemplateAction(t *testing.T) {
+	logging.Init()
+	gitConfig := filepath.Join(t.TempDir(), "gitconfig")
+	t.Setenv("GIT_CONFIG_GLOBAL", gitConfig)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "reverb.dsp"), []byte("declare author \"Someone Else\";\ndeclare copyright \"(c) Someone Else\";\ndeclare license \"GPL\";\nprocess = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "synth.dsp"), []byte("declare version \"2.0\";\nprocess = _;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "synth.dsp")))
+	template := func() string {
+		for _, action := range codeActionsAt(t, s, uri, transport.Position{}) {
+			if action.Edit != nil {
+				edits := action.Edit.Changes[uri]
+				if len(edits) != 1 || edits[0].Range != (transport.Range{}) {
+					t.Fatalf("edits = %+v, want one insertion at the top", edits)
+				}
+				return edits[0].NewText
+			}
+		}
+		t.Fatal("no metadata template action")
+		return ""
+	}
+
+	// Missing metadata is filled from the other files of the folder
+	want := "declare name \"synth\";\ndeclare author \"Someone Else\";\ndeclare copyright \"(c) Someone Else\";\ndeclare license \"GPL\";\n\n"
+	if got := template(); got != want {
+		t.Errorf("template = %q, want %q", got, want)
+	}
+
+	// The author configured in git takes precedence, along with a copyright of their own
+	os.WriteFile(gitConfig, []byte("[user]\n\tname = Test Author\n"), 0644)
+	want = fmt.Sprintf("declare name \"synth\";\ndeclare author \"Test Author\";\ndeclare copyright \"(c) %d Test Author\";\ndeclare license \"GPL\";\n\n", time.Now().Year())
+	if got := template(); got != want {
+		t.Errorf("template = %q, want %q", got, want)
+	}
+}
+
+func TestDocgenCommand(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	library := "declare name \"Demo\";\ndeclare author \"Someone\";\n\n" +
+		"// Sine wave.\n//\n// #### Usage\n//\n// ```\n// wave(freq) : _\n// ```\nwave(freq) = freq : sin;\n\n" +
+		"gain(g, x) = x * g;\n"
+	os.MkdirAll(filepath.Join(root, "libs"), 0755)
+	os.WriteFile(filepath.Join(root, "libs", "demo.lib"), []byte(library), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"libs/demo.lib\");\nprocess = wave(440);\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arguments := func(args ...any) []json.RawMessage {
+		raw := []json.RawMessage{}
+		for _, arg := range args {
+			content, _ := json.Marshal(arg)
+			raw = append(raw, content)
+		}
+		return raw
+	}
+
+	result, err := server.DocgenCommand(context.Background(), s, arguments("docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(s.Workspace.Root, "docs")
+	page := filepath.Join(dir, "libs", "demo.md")
+	want := []transport.DocumentURI{
+		transport.DocumentURI(util.Path2URI(filepath.Join(dir, "index.md"))),
+		transport.DocumentURI(util.Path2URI(page)),
+	}
+	if files := result.(server.DocgenResult).Files; !slices.Equal(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+	index, _ := os.ReadFile(filepath.Join(dir, "index.md"))
+	if !strings.Contains(string(index), "* [Demo](libs/demo.md) (`demo.lib`): 2 definitions") {
+		t.Errorf("index doesn't link to demo.md:\n%s", index)
+	}
+	content, _ := os.ReadFile(page)
+	for _, expected := range []string{
+		"# Demo\n",
+		"* **author**: Someone",
+		"## wave\n\nSine wave.\n\n#### Usage\n\n```faust\nwave(freq) : _\n```",
+		"[demo.lib:11](../../libs/demo.lib#L11)",
+		// Undocumented functions get their signature
+		"## gain\n\n```faust\ngain(g, x)\n```\n\n[demo.lib:13](../../libs/demo.lib#L13)",
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("demo.md doesn't contain %q:\n%s", expected, content)
+		}
+	}
+
+	if _, err := server.DocgenCommand(context.Background(), s, arguments(util.Path2URI(filepath.Join(root, "site")), "html")); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = os.ReadFile(filepath.Join(root, "site", "libs", "demo.html"))
+	for _, expected := range []string{"<title>Demo</title>", "<h2>wave</h2>", "<pre><code class=\"language-faust\">wave(freq) : _\n</code></pre>", "<li><strong>author</strong>: Someone</li>"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("demo.html doesn't contain %q:\n%s", expected, content)
+		}
+	}
+	if _, err := server.DocgenCommand(context.Background(), s, arguments("docs", "pdf")); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
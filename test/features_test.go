@@ -0,0 +1,278 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestFeatureToggles(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"features": {"completion": false}}`), 0644)
+
+	// Returns which of completion, hover and formatting are advertised
+	initialize := func(capabilities transport.ClientCapabilities) map[string]bool {
+		var s server.Server
+		params, _ := json.Marshal(transport.InitializeParams{
+			XInitializeParams: transport.XInitializeParams{
+				RootURI:      transport.DocumentURI(util.Path2URI(root)),
+				Capabilities: capabilities,
+			},
+		})
+		content, err := server.Initialize(context.Background(), &s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Capabilities map[string]any `json:"capabilities"`
+		}
+		json.Unmarshal(content, &result)
+		advertised := map[string]bool{}
+		for _, provider := range []string{"completionProvider", "hoverProvider", "documentFormattingProvider"} {
+			_, advertised[provider] = result.Capabilities[provider]
+		}
+		return advertised
+	}
+
+	static := initialize(transport.ClientCapabilities{})
+	if static["completionProvider"] {
+		t.Errorf("completion advertised although disabled in the config")
+	}
+	if !static["hoverProvider"] || !static["documentFormattingProvider"] {
+		t.Errorf("enabled features not advertised: %v", static)
+	}
+
+	// Features the client can register dynamically are registered after initialization instead
+	dynamic := initialize(transport.ClientCapabilities{
+		TextDocument: transport.TextDocumentClientCapabilities{
+			Hover: &transport.HoverClientCapabilities{DynamicRegistration: true},
+		},
+	})
+	if dynamic["hoverProvider"] {
+		t.Errorf("hover advertised statically although the client registers it dynamically")
+	}
+}
+
+func TestInlayHints(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	content := `fi = environment { resonlp(fc, Q, gain) = _; };
+f(a, b) = a + b;
+x = 1;
+process = fi.resonlp(2000, 5, 0.9), f(1, x), f(1, -2), f(1, 2, 3);
+`
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := json.Marshal(transport.InlayHintParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))},
+		Range:        transport.Range{End: transport.Position{Line: 4}},
+	})
+	result, err := server.InlayHints(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hints []transport.InlayHint
+	json.Unmarshal(result, &hints)
+
+	// f(1, x) has a single numeric argument and f(1, 2, 3) more arguments than f has parameters
+	want := map[transport.Position]string{
+		{Line: 3, Character: 21}: "fc:",
+		{Line: 3, Character: 27}: "Q:",
+		{Line: 3, Character: 30}: "gain:",
+		{Line: 3, Character: 47}: "a:",
+		{Line: 3, Character: 50}: "b:",
+	}
+	if len(hints) != len(want) {
+		t.Fatalf("got %d hints, want %d: %v", len(hints), len(want), hints)
+	}
+	for _, hint := range hints {
+		if label := want[hint.Position]; len(hint.Label) != 1 || hint.Label[0].Value != label {
+			t.Errorf("hint at %v = %v, want %q", hint.Position, hint.Label, label)
+		}
+	}
+}
+
+func TestIterationInlayHints(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	content := `n = 2*2;
+process = par(i, 4, _), seq(j, n, _), sum(k, N, _), prod(l, 1+m, _);
+`
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ := json.Marshal(transport.InlayHintParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))},
+		Range:        transport.Range{End: transport.Position{Line: 2}},
+	})
+	result, err := server.InlayHints(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hints []transport.InlayHint
+	json.Unmarshal(result, &hints)
+
+	// Constant counts are evaluated, names that aren't constants are shown, and other expressions aren't
+	want := map[transport.Position]string{
+		{Line: 1, Character: 15}: ": 0..3",
+		{Line: 1, Character: 29}: ": 0..3",
+		{Line: 1, Character: 43}: ": 0..N-1",
+	}
+	if len(hints) != len(want) {
+		t.Fatalf("got %d hints, want %d: %v", len(hints), len(want), hints)
+	}
+	for _, hint := range hints {
+		if label := want[hint.Position]; len(hint.Label) != 1 || hint.Label[0].Value != label {
+			t.Errorf("hint at %v = %v, want %q", hint.Position, hint.Label, label)
+		}
+	}
+}
+
+func TestCodeLens(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Stands in for the compiler: rejects undefined symbols, and describes other processes with 1 input and 2 outputs
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit\nif grep -q undefined \"$1\"; then echo 'ERROR : undefined symbol : undefined' >&2; exit 1; fi\necho '{\"inputs\": 1, \"outputs\": 2}' > \"$1.json\"\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("gain = 0.5;\nprocess = _ <: _, _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "utils.lib"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust"}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeLenses := func(file string) []transport.CodeLens {
+		t.Helper()
+		params, _ := json.Marshal(transport.CodeLensParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, file)))},
+		})
+		result, err := server.CodeLens(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lenses []transport.CodeLens
+		json.Unmarshal(result, &lenses)
+		return lenses
+	}
+	resolve := func(lens transport.CodeLens) string {
+		t.Helper()
+		params, _ := json.Marshal(lens)
+		result, err := server.CodeLensResolve(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resolved transport.CodeLens
+		json.Unmarshal(result, &resolved)
+		if resolved.Command == nil {
+			t.Fatalf("resolved lens has no command")
+		}
+		return resolved.Command.Title
+	}
+
+	if lenses := codeLenses("utils.lib"); len(lenses) != 0 {
+		t.Errorf("lenses of a library = %v, want none", lenses)
+	}
+
+	// Unresolved until the client shows it
+	lenses := codeLenses("main.dsp")
+	if len(lenses) != 1 || lenses[0].Range.Start.Line != 1 || lenses[0].Command != nil {
+		t.Fatalf("lenses = %+v, want an unresolved lens over the process", lenses)
+	}
+	if title := resolve(lenses[0]); title != "1 input, 2 outputs" {
+		t.Errorf("title = %q, want %q", title, "1 input, 2 outputs")
+	}
+
+	// Unsaved content is compiled
+	s.Files.ModifyFull(filepath.Join(s.Workspace.Root, "main.dsp"), "gain = undefined;\nprocess = _ <: _, _;\n")
+	if title := resolve(lenses[0]); title != "Doesn't compile" {
+		t.Errorf("title of a process that doesn't compile = %q, want %q", title, "Doesn't compile")
+	}
+}
+
+func TestSignatureHelp(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	content := "// Biquad filter\n// #### Usage\n// ```\n// _ : filter(fc, q) : _\n// ```\nfilter(fc, q) = _;\n" +
+		"process = filter(hslider(\"q, (x)\", 1, 0, 10, 0.1), 2) + fi.lowpass(2, 500);\n"
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Functions of the standard libraries are known from the documentation bundle without faustlibraries
+	previous := stdlib.Current()
+	stdlib.Set(&stdlib.Bundle{Docs: map[string]stdlib.Doc{"fi.lowpass": {Library: "filters.lib", Full: "Lowpass filter.", Usage: "_ : fi.lowpass(N,fc) : _"}}})
+	t.Cleanup(func() { stdlib.Set(previous) })
+
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	type signatureHelp struct {
+		Signatures []struct {
+			Label           string                  `json:"label"`
+			ActiveParameter uint32                  `json:"activeParameter"`
+			Documentation   transport.MarkupContent `json:"documentation"`
+		} `json:"signatures"`
+	}
+	signatureHelpAt := func(pos transport.Position) *signatureHelp {
+		t.Helper()
+		params, _ := json.Marshal(transport.SignatureHelpParams{
+			TextDocumentPositionParams: transport.TextDocumentPositionParams{TextDocument: transport.TextDocumentIdentifier{URI: uri}, Position: pos},
+		})
+		result, err := server.SignatureHelp(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var help *signatureHelp
+		json.Unmarshal(result, &help)
+		return help
+	}
+
+	tests := []struct {
+		name          string
+		position      transport.Position
+		label         string
+		active        uint32
+		documentation string
+	}{
+		{"First argument", transport.Position{Line: 6, Character: 17}, "filter(fc, q)", 0, "```faust\n_ : filter(fc, q) : _\n```"},
+		// The parentheses and commas of the nested call and its label don't count
+		{"After a nested call", transport.Position{Line: 6, Character: 51}, "filter(fc, q)", 1, "```faust\n_ : filter(fc, q) : _\n```"},
+		{"Standard library", transport.Position{Line: 6, Character: 70}, "fi.lowpass(N, fc)", 1, "```faust\n_ : fi.lowpass(N,fc) : _\n```"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			help := signatureHelpAt(tt.position)
+			if help == nil || len(help.Signatures) != 1 {
+				t.Fatalf("signature help = %+v, want one signature", help)
+			}
+			signature := help.Signatures[0]
+			if signature.Label != tt.label || signature.ActiveParameter != tt.active {
+				t.Errorf("signature = %q with parameter %d active, want %q with parameter %d", signature.Label, signature.ActiveParameter, tt.label, tt.active)
+			}
+			if signature.Documentation.Value != tt.documentation {
+				t.Errorf("documentation = %q, want %q", signature.Documentation.Value, tt.documentation)
+			}
+		})
+	}
+
+	if help := signatureHelpAt(transport.Position{Line: 6, Character: 5}); help != nil {
+		t.Errorf("signature help outside of calls = %+v, want none", help)
+	}
+}
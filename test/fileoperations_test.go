@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Starts a server on a workspace where main.dsp imports common.lib, which has a syntax error. The compiler rejects
+// main.dsp when common.lib is missing next to it. Returns once both files are indexed and diagnosed.
+func startImportingWorkspace(t *testing.T) (string, *transport.Transport, func()) {
+	root := t.TempDir()
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\n[ -e \"$(dirname \"$1\")/common.lib\" ] && exit 0\necho \"$1 : 1 : ERROR : common.lib not found\" >&2\nexit 1\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"common.lib\");\nprocess = double(1);\n"), 0644)
+	os.WriteFile(filepath.Join(root, "common.lib"), []byte("double(x) = x*2;\nquad = double(double(1));\nbroken = ;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust", "process_files": ["main.dsp"]}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	published := diagnosticsPublished(map[string]string{
+		util.Path2URI(filepath.Join(root, "main.dsp")):   "",
+		util.Path2URI(filepath.Join(root, "common.lib")): "tree-sitter",
+	})
+	indexed, diagnosed := false, false
+	readUntil(t, tr, "indexing and diagnostics", func(msg []byte) bool {
+		indexed = indexed || strings.Contains(string(msg), `"state":"finished"`)
+		diagnosed = diagnosed || published(msg)
+		return indexed && diagnosed
+	})
+	return root, tr, stop
+}
+
+// Reads messages until the diagnostics of every URI of want were published, from the sources listed, comma separated
+func readDiagnostics(t *testing.T, tr *transport.Transport, want map[string]string) {
+	readUntil(t, tr, "diagnostics of "+strings.Join(mapKeys(want), ", "), diagnosticsPublished(want))
+}
+
+// Returns whether the diagnostics of every URI of want were published in the messages passed so far
+func diagnosticsPublished(want map[string]string) func(msg []byte) bool {
+	pending := map[string]string{}
+	for uri, sources := range want {
+		pending[uri] = sources
+	}
+	return func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		if m.Method == "textDocument/publishDiagnostics" {
+			got := []string{}
+			for _, d := range params.Diagnostics {
+				got = append(got, d.Source)
+			}
+			if sources, ok := pending[string(params.URI)]; ok && strings.Join(got, ",") == sources {
+				delete(pending, string(params.URI))
+			}
+		}
+		return len(pending) == 0
+	}
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Number of scopes in the symbol cache of the server
+func cachedScopes(t *testing.T, tr *transport.Transport, id int) int {
+	tr.WriteRequest(id, "faustlsp/stats", nil)
+	var stats server.StatsResult
+	readUntil(t, tr, "stats", func(msg []byte) bool {
+		var m struct {
+			ID     any                `json:"id"`
+			Result server.StatsResult `json:"result"`
+		}
+		json.Unmarshal(msg, &m)
+		if n, ok := m.ID.(float64); !ok || int(n) != id {
+			return false
+		}
+		stats = m.Result
+		return true
+	})
+	return stats.Cache.Scopes
+}
+
+func TestDeletedFile(t *testing.T) {
+	logging.Init()
+	root, tr, stop := startImportingWorkspace(t)
+	defer stop()
+	if n := cachedScopes(t, tr, 3); n != 2 {
+		t.Fatalf("%d scopes cached, want the ones of main.dsp and common.lib", n)
+	}
+
+	path := filepath.Join(root, "common.lib")
+	os.Remove(path)
+	params, _ := json.Marshal(transport.DeleteFilesParams{Files: []transport.FileDelete{{URI: util.Path2URI(path)}}})
+	tr.WriteNotif("workspace/didDeleteFiles", params)
+	// The deleted file loses its diagnostics and its importer is diagnosed again
+	readDiagnostics(t, tr, map[string]string{
+		util.Path2URI(path):                            "",
+		util.Path2URI(filepath.Join(root, "main.dsp")): "faust",
+	})
+	if n := cachedScopes(t, tr, 4); n != 1 {
+		t.Errorf("%d scopes cached after deletion, want the one of main.dsp", n)
+	}
+}
+
+func TestRenamedFile(t *testing.T) {
+	logging.Init()
+	root, tr, stop := startImportingWorkspace(t)
+	defer stop()
+
+	oldPath, newPath := filepath.Join(root, "common.lib"), filepath.Join(root, "tools.lib")
+	if err := os.Rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	// The diagnostics move to the new URI, and the importer, which can't find the old path anymore, is diagnosed again
+	readDiagnostics(t, tr, map[string]string{
+		util.Path2URI(oldPath):                         "",
+		util.Path2URI(newPath):                         "tree-sitter",
+		util.Path2URI(filepath.Join(root, "main.dsp")): "faust",
+	})
+	if n := cachedScopes(t, tr, 3); n != 2 {
+		t.Errorf("%d scopes cached after renaming, want the ones of main.dsp and tools.lib", n)
+	}
+
+	// The renamed file is parsed again, so its definitions are in the new file
+	uri := transport.DocumentURI(util.Path2URI(newPath))
+	params, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 1, Character: 8},
+	}})
+	tr.WriteRequest(4, "textDocument/definition", params)
+	readUntil(t, tr, "definition", func(msg []byte) bool {
+		var m struct {
+			ID     any                 `json:"id"`
+			Result *transport.Location `json:"result"`
+		}
+		json.Unmarshal(msg, &m)
+		if n, ok := m.ID.(float64); !ok || n != 4 {
+			return false
+		}
+		if m.Result == nil || m.Result.URI != uri {
+			t.Errorf("definition of double at %+v, want in %s", m.Result, uri)
+		}
+		return true
+	})
+}
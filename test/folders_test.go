@@ -0,0 +1,225 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestConfigForFolder(t *testing.T) {
+	w := server.Workspace{
+		Root: "/ws/a",
+		Folders: []*server.Folder{
+			{Root: "/ws/a", Config: server.FaustProjectConfig{ProcessName: "a"}},
+			{Root: "/ws/b", Config: server.FaustProjectConfig{ProcessName: "b"}},
+			{Root: "/ws/b/nested", Config: server.FaustProjectConfig{ProcessName: "nested"}},
+		},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/ws/a/main.dsp", "a"},
+		{"/ws/b/main.dsp", "b"},
+		{"/ws/b/nested/fx.dsp", "nested"},
+		{"/ws/bb/main.dsp", "a"},
+		{"/usr/share/faust/stdfaust.lib", "a"},
+	}
+	for _, tt := range tests {
+		if got := w.ConfigFor(tt.path).ProcessName; got != tt.want {
+			t.Errorf("ConfigFor(%q) is the config of folder %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// Writes a folder compiled by a fake compiler that rejects every file, with its own config
+func writeRejectingFolder(t *testing.T, root string) {
+	os.MkdirAll(root, 0755)
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\necho \"$1 : 1 : ERROR : rejected\" >&2\nexit 1\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust", "process_name": "folder"}`), 0644)
+}
+
+// Waits for the compiler diagnostics of the main.dsp of the folder at root, then checks its effective config
+func checkFolderIndexed(t *testing.T, tr *transport.Transport, root string) {
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	readUntil(t, tr, "compiler diagnostics of "+uri, func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri &&
+			len(params.Diagnostics) == 1 && params.Diagnostics[0].Source == "faust"
+	})
+
+	params, _ := json.Marshal(server.EffectiveConfigParams{URI: transport.DocumentURI(uri)})
+	tr.WriteRequest(10, "faustlsp/effectiveConfig", params)
+	readUntil(t, tr, "effective config", func(msg []byte) bool {
+		var m struct {
+			ID     any                          `json:"id"`
+			Result server.EffectiveConfigResult `json:"result"`
+		}
+		json.Unmarshal(msg, &m)
+		if n, ok := m.ID.(float64); !ok || n != 10 {
+			return false
+		}
+		if m.Result.Folder != root || m.Result.Config.ProcessName != "folder" {
+			t.Errorf("config of folder %q with process name %q, want the one of %q", m.Result.Folder, m.Result.Config.ProcessName, root)
+		}
+		// The default process files are the .dsp files of the folder
+		if !slices.Equal(m.Result.Config.ProcessFiles, []string{"main.dsp"}) {
+			t.Errorf("process files %q, want the .dsp files of the folder", m.Result.Config.ProcessFiles)
+		}
+		return true
+	})
+}
+
+func TestSecondFolder(t *testing.T) {
+	logging.Init()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.MkdirAll(a, 0755)
+	os.WriteFile(filepath.Join(a, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+	writeRejectingFolder(t, b)
+
+	tr, stop := startTestServerWithParams(t, transport.ParamInitialize{
+		XInitializeParams: transport.XInitializeParams{RootURI: transport.DocumentURI(util.Path2URI(a))},
+		WorkspaceFoldersInitializeParams: transport.WorkspaceFoldersInitializeParams{WorkspaceFolders: []transport.WorkspaceFolder{
+			{URI: transport.URI(util.Path2URI(a)), Name: "a"},
+			{URI: transport.URI(util.Path2URI(b)), Name: "b"},
+		}},
+	})
+	defer stop()
+	checkFolderIndexed(t, tr, b)
+}
+
+func TestAddedFolder(t *testing.T) {
+	logging.Init()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.MkdirAll(a, 0755)
+	os.WriteFile(filepath.Join(a, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+	writeRejectingFolder(t, b)
+
+	tr, stop := startTestServer(t, a)
+	defer stop()
+	params, _ := json.Marshal(transport.DidChangeWorkspaceFoldersParams{Event: transport.WorkspaceFoldersChangeEvent{
+		Added: []transport.WorkspaceFolder{{URI: transport.URI(util.Path2URI(b)), Name: "b"}},
+	}})
+	tr.WriteNotif("workspace/didChangeWorkspaceFolders", params)
+	checkFolderIndexed(t, tr, b)
+}
+
+func TestRemovedFolder(t *testing.T) {
+	logging.Init()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	os.MkdirAll(a, 0755)
+	os.WriteFile(filepath.Join(a, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+	writeRejectingFolder(t, b)
+
+	tr, stop := startTestServerWithParams(t, transport.ParamInitialize{
+		XInitializeParams: transport.XInitializeParams{RootURI: transport.DocumentURI(util.Path2URI(a))},
+		WorkspaceFoldersInitializeParams: transport.WorkspaceFoldersInitializeParams{WorkspaceFolders: []transport.WorkspaceFolder{
+			{URI: transport.URI(util.Path2URI(a)), Name: "a"},
+			{URI: transport.URI(util.Path2URI(b)), Name: "b"},
+		}},
+	})
+	defer stop()
+	checkFolderIndexed(t, tr, b)
+
+	params, _ := json.Marshal(transport.DidChangeWorkspaceFoldersParams{Event: transport.WorkspaceFoldersChangeEvent{
+		Removed: []transport.WorkspaceFolder{{URI: transport.URI(util.Path2URI(b)), Name: "b"}},
+	}})
+	tr.WriteNotif("workspace/didChangeWorkspaceFolders", params)
+	// The diagnostics of the folder's files are removed from the client
+	uri := util.Path2URI(filepath.Join(b, "main.dsp"))
+	readUntil(t, tr, "cleared diagnostics of "+uri, func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && len(params.Diagnostics) == 0
+	})
+
+	// The folder isn't part of the workspace anymore
+	config, _ := json.Marshal(server.EffectiveConfigParams{URI: transport.DocumentURI(uri)})
+	tr.WriteRequest(11, "faustlsp/effectiveConfig", config)
+	readUntil(t, tr, "effective config", func(msg []byte) bool {
+		var m struct {
+			ID     any                          `json:"id"`
+			Result server.EffectiveConfigResult `json:"result"`
+		}
+		json.Unmarshal(msg, &m)
+		if n, ok := m.ID.(float64); !ok || n != 11 {
+			return false
+		}
+		if m.Result.Folder == b {
+			t.Errorf("file of removed folder %q still belongs to it", b)
+		}
+		return true
+	})
+}
+
+func TestHoverInSecondFolder(t *testing.T) {
+	logging.Init()
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, root := range []string{a, b} {
+		os.MkdirAll(root, 0755)
+		os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+	}
+	os.MkdirAll(filepath.Join(b, "lib"), 0755)
+	os.WriteFile(filepath.Join(b, "lib", "gains.lib"), []byte("half = *(0.5);\n"), 0644)
+	main := "import(\"lib/gains.lib\");\nprocess = half;\n"
+	os.WriteFile(filepath.Join(b, "main.dsp"), []byte(main), 0644)
+
+	tr, stop := startTestServerWithParams(t, transport.ParamInitialize{
+		XInitializeParams: transport.XInitializeParams{RootURI: transport.DocumentURI(util.Path2URI(a))},
+		WorkspaceFoldersInitializeParams: transport.WorkspaceFoldersInitializeParams{WorkspaceFolders: []transport.WorkspaceFolder{
+			{URI: transport.URI(util.Path2URI(a)), Name: "a"},
+			{URI: transport.URI(util.Path2URI(b)), Name: "b"},
+		}},
+	})
+	defer stop()
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(b, "main.dsp")))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: uri, LanguageID: "faust", Version: 1, Text: main}})
+	tr.WriteNotif("textDocument/didOpen", open)
+
+	// Files of the folder are named relative to the folder rather than to the workspace root
+	params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 1, Character: 11},
+	}})
+	want := "`half` is defined on line 1 of lib/gains.lib"
+	var hover string
+	for id, start := 10, time.Now(); !strings.HasSuffix(hover, want); id++ {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("hover = %q, want it to end with %q", hover, want)
+		}
+		tr.WriteRequest(id, "textDocument/hover", params)
+		readUntil(t, tr, "hover", func(msg []byte) bool {
+			var m struct {
+				ID     any             `json:"id"`
+				Result transport.Hover `json:"result"`
+			}
+			json.Unmarshal(msg, &m)
+			if n, ok := m.ID.(float64); !ok || int(n) != id {
+				return false
+			}
+			hover = m.Result.Contents.Value
+			return true
+		})
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -1,12 +1,133 @@
 package tests
 
 import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
 )
 
 func TestFormat(t *testing.T) {
-	out, err := server.Format([]byte("process=a with {f=2;};"), "    ")
+	out, err := server.Format(context.Background(), []byte("process=a with {f=2;};"), "    ", 0)
 	t.Log(string(out), err)
 }
+
+func TestFormatterFailure(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process=_;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false, "formatter_timeout": 200}`), 0644)
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))
+	params, _ := json.Marshal(transport.DocumentFormattingParams{TextDocument: transport.TextDocumentIdentifier{URI: uri}, Options: transport.FormattingOptions{TabSize: 4, InsertSpaces: true}})
+
+	for id, fakeFormatter := range map[int]string{
+		10: "#!/bin/sh\nsleep 10\n",
+		11: "#!/bin/sh\necho crashed >&2\nexit 1\n",
+	} {
+		os.WriteFile(filepath.Join(bin, "faustfmt"), []byte(fakeFormatter), 0755)
+		start := time.Now()
+		tr.WriteRequest(id, "textDocument/formatting", params)
+		var result json.RawMessage
+		var message string
+		readUntil(t, tr, "formatting response", func(msg []byte) bool {
+			var m transport.NotificationMessage
+			json.Unmarshal(msg, &m)
+			if m.Method == "window/showMessage" {
+				var show transport.ShowMessageParams
+				json.Unmarshal(m.Params, &show)
+				message = show.Message
+			}
+			var r transport.ResponseMessage
+			json.Unmarshal(msg, &r)
+			if n, ok := r.ID.(float64); ok && int(n) == id {
+				result = r.Result
+				return true
+			}
+			return false
+		})
+		if string(result) != "null" {
+			t.Errorf("%q: formatting result = %s, want null", fakeFormatter, result)
+		}
+		if message == "" {
+			t.Errorf("%q: no message shown", fakeFormatter)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%q: formatting took %v", fakeFormatter, elapsed)
+		}
+	}
+}
+
+func TestOnTypeFormatting(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	uri := transport.DocumentURI(util.Path2URI(path))
+
+	tests := []struct {
+		name     string
+		content  string
+		position transport.Position
+		ch       string
+		want     string
+	}{
+		{
+			name:     "Closing brace",
+			content:  "process = x with {\ny = 1;\n      z = y\n+ 1;\n};\n",
+			position: transport.Position{Line: 4, Character: 1},
+			ch:       "}",
+			want:     "process = x with {\n    y = 1;\n    z = y\n        + 1;\n};\n",
+		},
+		{
+			name:     "Semicolon",
+			content:  "  gain = 0.5;\nf(x) =\nhgroup(\"f\",\nx + gain\n);\n",
+			position: transport.Position{Line: 4, Character: 2},
+			ch:       ";",
+			want:     "  gain = 0.5;\nf(x) =\n    hgroup(\"f\",\n        x + gain\n    );\n",
+		},
+		{
+			name:     "Semicolon in a string",
+			content:  "process = hslider(\"a;\n  b\", 0, 0, 1, 0.1);\n",
+			position: transport.Position{Line: 0, Character: 21},
+			ch:       ";",
+			want:     "process = hslider(\"a;\n  b\", 0, 0, 1, 0.1);\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Files.ModifyFull(path, tt.content)
+			params, _ := json.Marshal(transport.DocumentOnTypeFormattingParams{
+				TextDocument: transport.TextDocumentIdentifier{URI: uri},
+				Position:     tt.position,
+				Ch:           tt.ch,
+				Options:      transport.FormattingOptions{TabSize: 4, InsertSpaces: true},
+			})
+			result, err := server.OnTypeFormatting(context.Background(), s, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var edits []transport.TextEdit
+			json.Unmarshal(result, &edits)
+			if got := applyEdits(t, tt.content, edits); got != tt.want {
+				t.Errorf("formatted = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/server"
+)
+
+func TestDependencyGraphDOT(t *testing.T) {
+	dg := server.NewDependencyGraph()
+	dg.AddDependency("/ws/main.dsp", "/ws/lib/a.lib")
+	dg.AddLibraryDependency("/ws/main.dsp", "/usr/share/faust/stdfaust.lib", "sf")
+	dg.AddDependency("/ws/main.dsp", "")
+
+	got := dg.DOT("/ws")
+	want := []string{
+		`"main.dsp" -> "lib/a.lib";`,
+		`"main.dsp" -> "/usr/share/faust/stdfaust.lib" [label="sf"];`,
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line) {
+			t.Errorf("DOT() missing %s, got:\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, `""`) {
+		t.Errorf("DOT() contains unresolved import, got:\n%s", got)
+	}
+}
+
+func TestDependencyGraphJSON(t *testing.T) {
+	dg := server.NewDependencyGraph()
+	dg.AddDependency("/ws/main.dsp", "/ws/a.lib")
+	dg.AddDependency("/ws/a.lib", "/ws/b.lib")
+
+	content, err := dg.JSON("/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graph server.DependencyGraphJSON
+	if err := json.Unmarshal(content, &graph); err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Nodes) != 3 {
+		t.Errorf("JSON() nodes = %v, want 3 nodes", graph.Nodes)
+	}
+	if len(graph.Edges) != 2 || graph.Edges[0].From != "a.lib" || graph.Edges[0].To != "b.lib" {
+		t.Errorf("JSON() edges = %v", graph.Edges)
+	}
+}
+
+func TestDependencyGraphRemoveFile(t *testing.T) {
+	dg := server.NewDependencyGraph()
+	dg.AddDependency("/ws/main.dsp", "/ws/a.lib")
+	dg.AddDependency("/ws/a.lib", "/ws/b.lib")
+	dg.AddDependency("/ws/other.dsp", "/ws/b.lib")
+
+	dg.RemoveFile("/ws/a.lib")
+
+	for _, edge := range dg.Edges() {
+		if edge.From == "/ws/a.lib" || edge.To == "/ws/a.lib" {
+			t.Errorf("edge %v of removed file is still in the graph", edge)
+		}
+	}
+	if importers := dg.GetImporters("/ws/b.lib"); len(importers) != 1 || importers[0] != "/ws/other.dsp" {
+		t.Errorf("GetImporters(b.lib) = %v, want [/ws/other.dsp]", importers)
+	}
+}
+
+func TestDependencyGraphDependents(t *testing.T) {
+	dg := server.NewDependencyGraph()
+	dg.AddDependency("/ws/main.dsp", "/ws/a.lib")
+	dg.AddDependency("/ws/other.dsp", "/ws/b.lib")
+	dg.AddDependency("/ws/a.lib", "/ws/b.lib")
+	// Cycle between the libraries
+	dg.AddDependency("/ws/b.lib", "/ws/a.lib")
+
+	got := dg.Dependents("/ws/b.lib")
+	slices.Sort(got)
+	want := []string{"/ws/a.lib", "/ws/main.dsp", "/ws/other.dsp"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Dependents(b.lib) = %v, want %v", got, want)
+	}
+	if got := dg.Dependents("/ws/main.dsp"); len(got) != 0 {
+		t.Errorf("Dependents(main.dsp) = %v, want none", got)
+	}
+}
@@ -175,6 +175,62 @@ func TestPositionToOffset(t *testing.T) {
 			want:     5,
 			wantErr:  false,
 		},
+		{
+			name:     "Character past the end of a line that isn't the last",
+			text:     "abc\ndef",
+			pos:      transport.Position{Line: 0, Character: 10},
+			encoding: "utf-16",
+			want:     3,
+			wantErr:  false,
+		},
+		{
+			name:     "Line past the end of the document",
+			text:     "abc\ndef",
+			pos:      transport.Position{Line: 5, Character: 0},
+			encoding: "utf-16",
+			want:     7,
+			wantErr:  true,
+		},
+		{
+			name:     "CRLF, character past the end of the line",
+			text:     "abc\r\ndef",
+			pos:      transport.Position{Line: 0, Character: 10},
+			encoding: "utf-16",
+			want:     3,
+			wantErr:  false,
+		},
+		{
+			name:     "CRLF, start of second line",
+			text:     "abc\r\ndef",
+			pos:      transport.Position{Line: 1, Character: 0},
+			encoding: "utf-16",
+			want:     5,
+			wantErr:  false,
+		},
+		{
+			name:     "CRLF, end of second line",
+			text:     "abc\r\ndef\r\n",
+			pos:      transport.Position{Line: 1, Character: 3},
+			encoding: "utf-16",
+			want:     8,
+			wantErr:  false,
+		},
+		{
+			name:     "CRLF, empty line",
+			text:     "\r\n\r\n",
+			pos:      transport.Position{Line: 1, Character: 1},
+			encoding: "utf-16",
+			want:     2,
+			wantErr:  false,
+		},
+		{
+			name:     "UTF-8 encoding counts bytes",
+			text:     "é=1",
+			pos:      transport.Position{Line: 0, Character: 2},
+			encoding: "utf-8",
+			want:     2,
+			wantErr:  false,
+		},
 		{
 			name:     "Tabs and spaces",
 			text:     "a\tb c\n d",
@@ -304,6 +360,38 @@ func TestOffsetToPosition(t *testing.T) {
 			want:     transport.Position{Line: 0, Character: 3},
 			wantErr:  false,
 		},
+		{
+			name:     "CRLF, offset at the carriage return",
+			text:     "abc\r\ndef",
+			offset:   3,
+			encoding: "utf-16",
+			want:     transport.Position{Line: 0, Character: 3},
+			wantErr:  false,
+		},
+		{
+			name:     "CRLF, offset inside the line break",
+			text:     "abc\r\ndef",
+			offset:   4,
+			encoding: "utf-16",
+			want:     transport.Position{Line: 0, Character: 3},
+			wantErr:  false,
+		},
+		{
+			name:     "CRLF, start of second line",
+			text:     "abc\r\ndef",
+			offset:   5,
+			encoding: "utf-16",
+			want:     transport.Position{Line: 1, Character: 0},
+			wantErr:  false,
+		},
+		{
+			name:     "Offset inside a multi-byte character",
+			text:     "a😆b",
+			offset:   3,
+			encoding: "utf-16",
+			want:     transport.Position{Line: 0, Character: 1},
+			wantErr:  false,
+		},
 		{
 			name:     "Negative offset (invalid)",
 			text:     "abc\ndef",
@@ -491,6 +579,30 @@ func TestApplyIncrementalChange(t *testing.T) {
 			encoding:    "utf-16",
 			want:        "abcXYZ",
 		},
+		{
+			name:        "CRLF, insert past the end of a line",
+			original:    "abc\r\ndef",
+			changeRange: transport.Range{Start: transport.Position{Line: 0, Character: 100}, End: transport.Position{Line: 0, Character: 100}},
+			newText:     "XYZ",
+			encoding:    "utf-16",
+			want:        "abcXYZ\r\ndef",
+		},
+		{
+			name:        "CRLF, join lines",
+			original:    "abc\r\ndef\r\nghi",
+			changeRange: transport.Range{Start: transport.Position{Line: 0, Character: 3}, End: transport.Position{Line: 1, Character: 0}},
+			newText:     "",
+			encoding:    "utf-16",
+			want:        "abcdef\r\nghi",
+		},
+		{
+			name:        "CRLF, replace across lines",
+			original:    "abc\r\ndef\r\nghi",
+			changeRange: transport.Range{Start: transport.Position{Line: 0, Character: 1}, End: transport.Position{Line: 2, Character: 1}},
+			newText:     "1\r\n2",
+			encoding:    "utf-16",
+			want:        "a1\r\n2hi",
+		},
 		{
 			name:        "Replace with multi-line text",
 			original:    "abc\ndef",
@@ -0,0 +1,888 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestSymbolIndexRoundTrip(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	main := []byte(`import("a.lib");
+// Docs for f
+f(x) = x with { g = 2; };
+process = f(1);
+`)
+	os.WriteFile(filepath.Join(root, "main.dsp"), main, 0644)
+	os.WriteFile(filepath.Join(root, "a.lib"), []byte("y = 3;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexPath := filepath.Join(t.TempDir(), "index.json")
+	if err := s.Store.WriteIndex(s.Workspace.Root, indexPath); err != nil {
+		t.Fatal(err)
+	}
+
+	store := server.Store{Cache: make(map[[sha256.Size]byte]*server.Scope)}
+	loaded, err := store.LoadIndex(s.Workspace.Root, indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 2 {
+		t.Fatalf("LoadIndex() loaded %d scopes, want 2", loaded)
+	}
+
+	scope := store.Cache[sha256.Sum256(main)]
+	if scope == nil {
+		t.Fatal("scope of main.dsp missing from loaded index")
+	}
+	idents := map[string]*server.Symbol{}
+	for _, sym := range scope.Symbols {
+		idents[sym.Ident] = sym
+	}
+	f, ok := idents["f"]
+	if !ok || f.Kind != server.Function {
+		t.Fatalf("function f missing from loaded scope: %v", idents)
+	}
+	if f.Docs.Full != "Docs for f" {
+		t.Errorf("docs of f = %q", f.Docs.Full)
+	}
+	if f.Scope == nil || len(f.Scope.Symbols) != 1 || f.Scope.Symbols[0].Ident != "x" {
+		t.Errorf("arguments scope of f not restored")
+	}
+	if f.Scope.Parent != scope {
+		t.Errorf("parent of arguments scope not restored")
+	}
+	if _, ok := idents[""]; !ok {
+		t.Errorf("import symbol missing from loaded scope")
+	}
+
+	if _, err := store.LoadIndex("/elsewhere", indexPath); err == nil {
+		t.Errorf("LoadIndex() accepted an index built for another workspace")
+	}
+}
+
+func TestIncludeDirResolution(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "libs"), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"my.lib\");\nprocess = f;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "libs", "my.lib"), []byte("f = 1;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"include": ["libs"]}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, edge := range s.Store.Dependencies.Edges() {
+		if edge.From == filepath.Join(s.Workspace.Root, "main.dsp") && edge.To == filepath.Join(s.Workspace.Root, "libs", "my.lib") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("import of my.lib not resolved through the include directory, edges: %v", s.Store.Dependencies.Edges())
+	}
+}
+
+func TestLibraryPathOverride(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "faustlibraries"), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"stdfaust.lib\");\nprocess = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "faustlibraries", "stdfaust.lib"), []byte("x = 1;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"library_path": "faustlibraries"}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(s.Workspace.Root, "faustlibraries", "stdfaust.lib")
+	found := false
+	for _, edge := range s.Store.Dependencies.Edges() {
+		if edge.To == want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("stdfaust.lib not resolved to the configured library path, edges: %v", s.Store.Dependencies.Edges())
+	}
+
+	for _, check := range server.Doctor(s.Workspace.Root) {
+		if check.Name == "library_path" && !check.OK {
+			t.Errorf("library_path check failed: %s", check.Detail)
+		}
+	}
+}
+
+func TestConcurrentAnalysis(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"a.lib\");\nprocess = a;\n"), 0644)
+	// Mutually importing libraries
+	os.WriteFile(filepath.Join(root, "a.lib"), []byte("import(\"b.lib\");\na = b;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.lib"), []byte("import(\"a.lib\");\nb = 1;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"library_path": "."}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Analyses of files importing each other share the imported files
+	var wg sync.WaitGroup
+	for _, name := range []string{"main.dsp", "a.lib", "b.lib", "main.dsp"} {
+		f, ok := s.Files.GetFromPath(filepath.Join(s.Workspace.Root, name))
+		if !ok {
+			t.Fatalf("%s not in file store", name)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Workspace.AnalyzeFile(f, &s.Store)
+		}()
+	}
+	wg.Wait()
+
+	importers := s.Store.Dependencies.GetImporters(filepath.Join(s.Workspace.Root, "b.lib"))
+	if len(importers) != 1 || importers[0] != filepath.Join(s.Workspace.Root, "a.lib") {
+		t.Errorf("importers of b.lib = %v, want [a.lib]", importers)
+	}
+}
+
+func TestCyclicImportLookup(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.lib"), []byte("import(\"b.lib\");\na = 1;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.lib"), []byte("import(\"a.lib\");\nb = 2;\nbenv = environment { c = 3; };\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"library_path": "."}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := s.Files.GetFromPath(filepath.Join(s.Workspace.Root, "a.lib"))
+	if !ok || f.Scope == nil {
+		t.Fatal("a.lib wasn't analyzed")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if sym, err := server.FindSymbol("b", f.Scope, &s.Store); err != nil || sym.Ident != "b" {
+			t.Errorf("FindSymbol(b) = %v, %v", sym.Ident, err)
+		}
+		if _, err := server.FindSymbol("missing", f.Scope, &s.Store); err == nil {
+			t.Errorf("FindSymbol(missing) found a symbol")
+		}
+		if _, err := server.FindEnvironmentIdent("missing", f.Scope, &s.Store); err == nil {
+			t.Errorf("FindEnvironmentIdent(missing) found a symbol")
+		}
+		if _, err := server.FindLibraryIdent("missing", f.Scope, &s.Store); err == nil {
+			t.Errorf("FindLibraryIdent(missing) found a library")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup in mutually importing files didn't terminate")
+	}
+}
+
+func TestAccessChains(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lib := []string{
+		`env = environment {`,
+		`  sub = environment { f = 1; };`,
+		`  alias = sub;`,
+		`};`,
+		`wenv = s with { s = environment { g = 2; }; };`,
+	}
+	os.WriteFile(filepath.Join(root, "lib.lib"), []byte(strings.Join(lib, "\n")+"\n"), 0644)
+	os.WriteFile(filepath.Join(root, "deep.lib"), []byte("lv = library(\"lib.lib\");\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("dl = library(\"deep.lib\");\nf = 0;\nprocess = dl.lv.env.sub.\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	f, ok := s.Files.GetFromPath(path)
+	if !ok || f.Scope == nil {
+		t.Fatal("main.dsp wasn't analyzed")
+	}
+
+	tests := []struct {
+		ident string
+		// Line of the definition in lib.lib, -1 if it must not resolve
+		line int
+	}{
+		{"dl.lv.env.sub.f", 1},
+		{"dl.lv.env.alias.f", 1},
+		{"dl.lv.wenv.g", 4},
+		{"dl.lv.env.sub", 1},
+		// Members are only looked up in their environment, not around it
+		{"dl.lv.env.f", -1},
+		{"dl.lv.env.sub.missing", -1},
+		{"dl.f", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ident, func(t *testing.T) {
+			sym, err := server.FindSymbolDefinition(tt.ident, f.Scope, &s.Store)
+			if tt.line < 0 {
+				if err == nil {
+					t.Errorf("FindSymbolDefinition(%s) = %s at %v, want no symbol", tt.ident, sym.Ident, sym.Loc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindSymbolDefinition(%s): %v", tt.ident, err)
+			}
+			if filepath.Base(sym.Loc.File) != "lib.lib" || int(sym.Loc.Range.Start.Line) != tt.line {
+				t.Errorf("FindSymbolDefinition(%s) at %v, want line %d of lib.lib", tt.ident, sym.Loc, tt.line)
+			}
+		})
+	}
+
+	params, _ := json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(path))},
+		Position:     transport.Position{Line: 2, Character: 24},
+	}})
+	result, err := server.Completion(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []transport.CompletionItem
+	json.Unmarshal(result, &items)
+	if len(items) != 1 || items[0].Label != "f" {
+		t.Errorf("completions of dl.lv.env.sub. = %+v, want f", items)
+	}
+}
+
+func TestReanalysisAfterChange(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("a = 1;\nprocess = a;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		t.Fatal("main.dsp not in file store")
+	}
+	oldHash := f.Hash
+
+	s.Files.ModifyFull(path, "b = 2;\nprocess = b;\n")
+	s.Workspace.AnalyzeFileSync(f, &s.Store)
+
+	if _, err := server.FindSymbol("b", f.Scope, &s.Store); err != nil {
+		t.Errorf("b not found after the change: %v", err)
+	}
+	if _, err := server.FindSymbol("a", f.Scope, &s.Store); err == nil {
+		t.Errorf("a still found after the change")
+	}
+	if _, ok := s.Store.Cache[oldHash]; ok {
+		t.Errorf("scope of the previous content is still cached")
+	}
+}
+
+func TestDefinitionWhileEditing(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	versions := []string{"a = 1;\nprocess = a;\n", "bb = 2;\nprocess = bb;\n"}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(versions[0]), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	f, ok := s.Files.GetFromPath(path)
+	if !ok {
+		t.Fatal("main.dsp not in file store")
+	}
+
+	// Edits analyzed in the background like the editor's changes, while definitions are requested
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.Files.ModifyFull(path, versions[i%2])
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Workspace.AnalyzeFile(f, &s.Store)
+			}()
+		}
+	}()
+
+	params, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(path))},
+		Position:     transport.Position{Line: 1, Character: 10},
+	}})
+	for range 200 {
+		result, err := server.GetDefinition(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var loc transport.Location
+		if err := json.Unmarshal(result, &loc); err != nil || loc.Range.Start.Line != 0 {
+			t.Fatalf("definition = %s, want the definition on the first line", result)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestByteOrderMark(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("\uFEFFgain = 0.5;\nprocess = gain;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	if d := s.Files.TSDiagnostics(path).Diagnostics; len(d) != 0 {
+		t.Errorf("syntax diagnostics = %v, want none", d)
+	}
+
+	params, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(path))},
+		Position:     transport.Position{Line: 1, Character: 11},
+	}})
+	result, err := server.GetDefinition(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loc transport.Location
+	json.Unmarshal(result, &loc)
+	if want := (transport.Position{Line: 0, Character: 0}); loc.Range.Start != want {
+		t.Errorf("definition starts at %v, want %v", loc.Range.Start, want)
+	}
+
+	// Content that still has a byte order mark maps positions after it
+	if offset, _ := server.PositionToOffset(transport.Position{Line: 0, Character: 1}, "\uFEFFab", "utf-16"); offset != 4 {
+		t.Errorf("PositionToOffset() = %d, want 4", offset)
+	}
+}
+
+func TestProcesses(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("gain = 0.5;\nprocess = *(gain);\n"), 0644)
+	// Defines process, but its configured process name is effect
+	os.WriteFile(filepath.Join(root, "fx.dsp"), []byte("process = _;\neffect(x) = x;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "utils.lib"), []byte("double = *(2);\n"), 0644)
+	os.MkdirAll(filepath.Join(root, "build"), 0755)
+	os.WriteFile(filepath.Join(root, "build", "old.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"process_names": {"fx.dsp": "effect"}, "exclude": ["build"]}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.Processes(context.Background(), s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var processes server.ProcessesResult
+	json.Unmarshal(result, &processes)
+
+	want := []server.ProcessEntry{
+		{
+			URI:   transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "fx.dsp"))),
+			Range: transport.Range{Start: transport.Position{Line: 1}, End: transport.Position{Line: 1, Character: 13}},
+			Name:  "effect",
+		},
+		{
+			URI:   transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp"))),
+			Range: transport.Range{Start: transport.Position{Line: 1}, End: transport.Position{Line: 1, Character: 17}},
+			Name:  "process",
+		},
+	}
+	if !reflect.DeepEqual(processes.Processes, want) {
+		t.Errorf("processes = %+v, want %+v", processes.Processes, want)
+	}
+}
+
+func TestRuleParameters(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	content := "x = 3;\nf = case {\n  (x, 0) => x;\n  (x, y) => x + y;\n  (a:b) => b;\n};\nprocess = f(1, 2) + x;\n"
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	at := func(line, char uint32) transport.Range {
+		return transport.Range{Start: transport.Position{Line: line, Character: char}, End: transport.Position{Line: line, Character: char + 1}}
+	}
+
+	// Uses resolve to the parameter of their own rule, also when it is bound in a pattern
+	for _, tt := range []struct {
+		position transport.Position
+		want     transport.Range
+	}{
+		{transport.Position{Line: 3, Character: 12}, at(3, 3)},
+		{transport.Position{Line: 4, Character: 11}, at(4, 5)},
+	} {
+		params, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     tt.position,
+		}})
+		result, err := server.GetDefinition(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var loc transport.Location
+		json.Unmarshal(result, &loc)
+		if loc.Range != tt.want {
+			t.Errorf("definition at %v = %v, want %v", tt.position, loc.Range, tt.want)
+		}
+	}
+
+	references := func(position transport.Position, includeDeclaration bool) []transport.Range {
+		params, _ := json.Marshal(transport.ReferenceParams{
+			Context: transport.ReferenceContext{IncludeDeclaration: includeDeclaration},
+			TextDocumentPositionParams: transport.TextDocumentPositionParams{
+				TextDocument: transport.TextDocumentIdentifier{URI: uri},
+				Position:     position,
+			},
+		})
+		result, err := server.GetReferences(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var locations []transport.Location
+		json.Unmarshal(result, &locations)
+		ranges := []transport.Range{}
+		for _, loc := range locations {
+			ranges = append(ranges, loc.Range)
+		}
+		return ranges
+	}
+
+	// Only uses within the rule are references of its parameter
+	if got, want := references(transport.Position{Line: 3, Character: 3}, true), []transport.Range{at(3, 3), at(3, 12)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("references of rule parameter = %v, want %v", got, want)
+	}
+	if got, want := references(transport.Position{Line: 3, Character: 12}, false), []transport.Range{at(3, 12)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("references of rule parameter without declaration = %v, want %v", got, want)
+	}
+	// The parameters shadow the definition of x
+	if got, want := references(transport.Position{Line: 0, Character: 0}, true), []transport.Range{at(0, 0), at(6, 20)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("references of definition = %v, want %v", got, want)
+	}
+}
+
+func TestLocalEnvironmentReferences(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		"x = 1;",
+		"a = par(i, 2, i * x) with { x = 3; };",
+		"b = x + (t with { t = x; });",
+		"c = x letrec { 'x = x + 1; };",
+		"process = a + b + c + x;",
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	at := func(line, char uint32) transport.Range {
+		return transport.Range{Start: transport.Position{Line: line, Character: char}, End: transport.Position{Line: line, Character: char + 1}}
+	}
+	position := transport.TextDocumentPositionParams{TextDocument: transport.TextDocumentIdentifier{URI: uri}}
+
+	tests := []struct {
+		name     string
+		position transport.Position
+		want     []transport.Range
+	}{
+		{"Outer definition", transport.Position{Line: 0, Character: 0}, []transport.Range{at(0, 0), at(2, 4), at(2, 22), at(4, 22)}},
+		{"Definition of a with", transport.Position{Line: 1, Character: 28}, []transport.Range{at(1, 18), at(1, 28)}},
+		{"Iteration inside a with", transport.Position{Line: 1, Character: 14}, []transport.Range{at(1, 8), at(1, 14)}},
+		{"Definition of a letrec", transport.Position{Line: 3, Character: 20}, []transport.Range{at(3, 4), at(3, 16), at(3, 20)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			position.Position = tt.position
+			params, _ := json.Marshal(transport.ReferenceParams{Context: transport.ReferenceContext{IncludeDeclaration: true}, TextDocumentPositionParams: position})
+			result, err := server.GetReferences(context.Background(), s, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var locations []transport.Location
+			json.Unmarshal(result, &locations)
+			got := []transport.Range{}
+			for _, loc := range locations {
+				got = append(got, loc.Range)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("references = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	position.Position = transport.Position{Line: 1, Character: 18}
+	params, _ := json.Marshal(transport.DocumentHighlightParams{TextDocumentPositionParams: position})
+	result, err := server.DocumentHighlights(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var highlights []transport.DocumentHighlight
+	json.Unmarshal(result, &highlights)
+	want := []transport.DocumentHighlight{{Range: at(1, 18), Kind: transport.Read}, {Range: at(1, 28), Kind: transport.Write}}
+	if !reflect.DeepEqual(highlights, want) {
+		t.Errorf("highlights = %+v, want %+v", highlights, want)
+	}
+}
+
+func TestCrossFileReferences(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "utils.lib"), []byte("double(x) = x*2;\ngain = 0.5;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"utils.lib\");\nu = library(\"utils.lib\");\nprocess = double(gain) + u.gain;\n"), 0644)
+	// Its own gain shadows the imported one
+	os.WriteFile(filepath.Join(root, "other.dsp"), []byte("import(\"utils.lib\");\ngain = 1;\nprocess = gain;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := func(name string) transport.DocumentURI {
+		return transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, name)))
+	}
+	location := func(name string, line, char uint32) transport.Location {
+		return transport.Location{URI: uri(name), Range: transport.Range{Start: transport.Position{Line: line, Character: char}, End: transport.Position{Line: line, Character: char + 4}}}
+	}
+
+	for _, tt := range []struct {
+		includeDeclaration bool
+		want               []transport.Location
+	}{
+		{true, []transport.Location{location("utils.lib", 1, 0), location("main.dsp", 2, 17), location("main.dsp", 2, 27)}},
+		{false, []transport.Location{location("main.dsp", 2, 17), location("main.dsp", 2, 27)}},
+	} {
+		params, _ := json.Marshal(transport.ReferenceParams{
+			Context: transport.ReferenceContext{IncludeDeclaration: tt.includeDeclaration},
+			TextDocumentPositionParams: transport.TextDocumentPositionParams{
+				TextDocument: transport.TextDocumentIdentifier{URI: uri("main.dsp")},
+				Position:     transport.Position{Line: 2, Character: 17},
+			},
+		})
+		result, err := server.GetReferences(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []transport.Location
+		json.Unmarshal(result, &got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("references with declaration = %v: %v, want %v", tt.includeDeclaration, got, tt.want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"utils.lib\");\ngain = 0.5;\nprocess = double(gain);\n"), 0644)
+	os.WriteFile(filepath.Join(root, "utils.lib"), []byte("double(x) = x*2;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := server.Stats(context.Background(), s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats server.StatsResult
+	json.Unmarshal(result, &stats)
+
+	if stats.Files != 2 || stats.AnalyzedFiles != 2 || stats.WorkspaceFiles != 2 {
+		t.Errorf("files = %d, analyzed = %d, workspace = %d, want 2 each", stats.Files, stats.AnalyzedFiles, stats.WorkspaceFiles)
+	}
+	// gain, process and double
+	if stats.Definitions != 3 {
+		t.Errorf("definitions = %d, want 3", stats.Definitions)
+	}
+	// double and gain in process, x in double
+	if stats.References != 3 {
+		t.Errorf("references = %d, want 3", stats.References)
+	}
+	if stats.ImportEdges != 1 {
+		t.Errorf("import edges = %d, want 1", stats.ImportEdges)
+	}
+	if stats.Cache.Scopes != 2 || stats.Cache.ContentBytes == 0 {
+		t.Errorf("cache = %+v, want 2 scopes and content", stats.Cache)
+	}
+	if len(stats.Analysis) != 2 || stats.Analysis[0].DurationMs < stats.Analysis[1].DurationMs {
+		t.Errorf("analysis = %+v, want both files, slowest first", stats.Analysis)
+	}
+}
+
+func TestIterationHover(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		`import("consts.lib");`,
+		`N = 4;`,
+		`process = par(i, N, i * 2) :> sum(j, 3, _ + j);`,
+		`voices = seq(k, nb, _);`,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	os.WriteFile(filepath.Join(root, "consts.lib"), []byte("nb = 8;\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	hover := func(line int, text string) string {
+		params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(strings.Index(lines[line], text))},
+		}})
+		result, err := server.Hover(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h struct {
+			Contents transport.MarkupContent `json:"contents"`
+		}
+		json.Unmarshal(result, &h)
+		return h.Contents.Value
+	}
+
+	tests := []struct {
+		name string
+		line int
+		text string
+		want []string
+	}{
+		{"Use of the variable", 2, "i * 2", []string{"par(i, N, …)", "par on line 3, from 0 to `N` - 1", "`N` is defined on line 2"}},
+		{"Declaration with a literal count", 2, "j, 3", []string{"sum(j, 3, …)", "from 0 to 2"}},
+		{"Count defined in another file", 3, "k,", []string{"seq(k, nb, …)", "`nb` is defined on line 1 of consts.lib"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hover(tt.line, tt.text)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("hover = %q, want it to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConstantHover(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		`ma = library("consts.lib");`,
+		`ct = 2*ma.PI/ma.SR;`,
+		`period = 1/(2 + 2);`,
+		`gain = 0.5;`,
+		`half = -gain * pow(2, 3) + int(2.7);`,
+		`loop = loop + 1;`,
+		`process = _ * gain;`,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	os.WriteFile(filepath.Join(root, "consts.lib"), []byte("PI = 3.14;\nSR = fconstant(int fSamplingFreq, <math.h>);\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	hover := func(line int, text string) string {
+		params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(strings.Index(lines[line], text))},
+		}})
+		result, err := server.Hover(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h struct {
+			Contents transport.MarkupContent `json:"contents"`
+		}
+		json.Unmarshal(result, &h)
+		return h.Contents.Value
+	}
+
+	tests := []struct {
+		name string
+		line int
+		text string
+		want string
+	}{
+		{"Constant of another library, next to an unknown value", 1, "ct", "ct = 6.28 / ma.SR"},
+		{"Arithmetic", 2, "period", "period = 0.25"},
+		{"Literal", 3, "gain", ""},
+		{"Constants and primitives", 4, "half", "half = -2"},
+		{"Recursive definition", 5, "loop", ""},
+		{"Use of a constant", 6, "gain", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hover(tt.line, tt.text)
+			if tt.want == "" {
+				// The code of the definition is shown, but no value
+				if strings.Count(got, "```faust") != 1 {
+					t.Errorf("hover = %q, want no value", got)
+				}
+			} else if !strings.Contains(got, "```faust\n"+tt.want+"\n```") {
+				t.Errorf("hover = %q, want it to show %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrimitiveHover(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		`f(x, y) = x, y;`,
+		`process = _ <: mem, @(3) : f(1, 2) :> rdtable(4, _, _) ~ _;`,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	hover := func(line int, character int) string {
+		params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(character)},
+		}})
+		result, err := server.Hover(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h struct {
+			Contents transport.MarkupContent `json:"contents"`
+		}
+		json.Unmarshal(result, &h)
+		return h.Contents.Value
+	}
+
+	tests := []struct {
+		name string
+		line int
+		text string
+		want string
+	}{
+		{"Primitive", 1, "mem", "1 input, 1 output"},
+		{"Primitive with arguments", 1, "rdtable", "rdtable(size, init, ridx)"},
+		{"Delay", 1, "@", "2 inputs, 1 output"},
+		{"Composition", 1, "<:", "Split composition"},
+		{"Recursion", 1, "~", "Recursive composition"},
+		{"Parallel composition", 0, ", y;", "Parallel composition"},
+		{"Comma between arguments", 1, ", 2", ""},
+		{"Wire", 1, "_", "Identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hover(tt.line, strings.Index(lines[tt.line], tt.text))
+			if tt.want == "" && got != "" {
+				t.Errorf("hover = %q, want none", got)
+			} else if !strings.Contains(got, tt.want) {
+				t.Errorf("hover = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefinitionHover(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "libs"), 0755)
+	os.WriteFile(filepath.Join(root, "libs", "gains.lib"), []byte("// Halves its input.\nhalf = *(0.5);\n"), 0644)
+	lines := []string{
+		`import("libs/gains.lib");`,
+		`f(x) = y with {`,
+		`  y = x`,
+		`    : half;`,
+		`};`,
+		`process = f(1) : half;`,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	hover := func(line int, text string) string {
+		params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Position:     transport.Position{Line: uint32(line), Character: uint32(strings.LastIndex(lines[line], text))},
+		}})
+		result, err := server.Hover(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h struct {
+			Contents transport.MarkupContent `json:"contents"`
+		}
+		json.Unmarshal(result, &h)
+		return h.Contents.Value
+	}
+
+	tests := []struct {
+		name string
+		line int
+		text string
+		want string
+	}{
+		{"Definition of another file", 5, "half", "Halves its input.\n\n```faust\nhalf = *(0.5);\n```\n\n`half` is defined on line 2 of libs/gains.lib"},
+		{"Function", 5, "f(1)", "```faust\nf(x) = y with {\n  y = x\n    : half;\n};\n```\n\n`f` is defined on line 2 of main.dsp"},
+		{"Local definition, unindented", 1, "y", "```faust\ny = x\n  : half;\n```\n\n`y` is defined on line 3 of main.dsp"},
+		{"Argument", 2, "x", "`x` is defined on line 2 of main.dsp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hover(tt.line, tt.text); got != tt.want {
+				t.Errorf("hover = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
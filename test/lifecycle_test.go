@@ -3,10 +3,17 @@ package tests
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/carn181/faustlsp/logging"
 	"github.com/carn181/faustlsp/server"
 	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
 
 	"testing"
 	"time"
@@ -18,7 +25,9 @@ func TestExitWithoutError(t *testing.T) {
 	var s server.Server
 
 	runserver := func() error {
-		s.Init(transport.Socket)
+		if err := s.Init(transport.Socket); err != nil {
+			return err
+		}
 		err := s.Run(context.Background())
 		s.Transport.Close()
 		return err
@@ -55,8 +64,11 @@ func TestExitWithError(t *testing.T) {
 	var s server.Server
 	ctx, cancel := context.WithCancel(context.Background())
 	runserver := func() error {
-		s.Init(transport.Socket)
+		if err := s.Init(transport.Socket); err != nil {
+			return err
+		}
 		err := s.Run(ctx)
+		s.Transport.Close()
 		return err
 	}
 
@@ -79,7 +91,710 @@ func TestExitWithError(t *testing.T) {
 
 	}()
 	err := runserver()
-	if err.Error() != "Exiting Ungracefully" {
+	if !errors.Is(err, server.ErrUngracefulExit) {
 		t.Errorf("Exit should not have been graceful")
 	}
 }
+
+func TestEveryRequestGetsResponse(t *testing.T) {
+	logging.Init()
+	var s server.Server
+	done := make(chan error, 1)
+	go func() {
+		if err := s.Init(transport.Socket); err != nil {
+			done <- err
+			return
+		}
+		err := s.Run(context.Background())
+		s.Transport.Close()
+		done <- err
+	}()
+
+	var tr transport.Transport
+	tr.Init(transport.Client, transport.Socket)
+	defer tr.Close()
+	// Reads messages until the response to the request with id
+	response := func(id int) transport.ResponseMessage {
+		for {
+			msg, err := tr.Read()
+			if err != nil {
+				t.Fatalf("no response to request %d: %v", id, err)
+			}
+			var m transport.ResponseMessage
+			json.Unmarshal(msg, &m)
+			if n, ok := m.ID.(float64); ok && int(n) == id && m.Message.Jsonrpc != "" {
+				return m
+			}
+			if m.ID == nil && m.Error != nil {
+				t.Errorf("error response without request: %s", m.Error.Message)
+			}
+		}
+	}
+	// Reads messages until the next response, whatever its id
+	nextResponse := func() transport.ResponseMessage {
+		for {
+			msg, err := tr.Read()
+			if err != nil {
+				t.Fatalf("no response: %v", err)
+			}
+			var m struct {
+				transport.ResponseMessage
+				Method string `json:"method"`
+			}
+			json.Unmarshal(msg, &m)
+			if m.Method == "" {
+				return m.ResponseMessage
+			}
+		}
+	}
+	params, _ := json.Marshal(transport.ParamInitialize{})
+
+	tr.WriteRequest(1, "textDocument/hover", json.RawMessage("{}"))
+	if m := response(1); m.Error == nil || m.Error.Code != int(transport.ServerNotInitialized) {
+		t.Errorf("request before initialize: error = %v, want ServerNotInitialized", m.Error)
+	}
+	tr.WriteRequest(2, "initialize", params)
+	if m := response(2); m.Error != nil {
+		t.Fatalf("initialize failed: %s", m.Error.Message)
+	}
+	tr.WriteRequest(3, "faustlsp/unknown", json.RawMessage("{}"))
+	if m := nextResponse(); m.ID != float64(3) || m.Error == nil || m.Error.Code != -32601 {
+		t.Errorf("unknown method: response %v with error %v, want -32601 for request 3", m.ID, m.Error)
+	}
+	// Notifications can't be answered, unknown ones are ignored: the next response is the one of the next request
+	tr.WriteNotif("faustlsp/unknown", json.RawMessage("{}"))
+	tr.WriteRequest(4, "textDocument/documentSymbol", json.RawMessage(`{"textDocument": {"uri": "file:///nonexistent.dsp"}}`))
+	if m := nextResponse(); m.ID != float64(4) {
+		t.Errorf("response %v (error %v) after an unknown notification, want the response to request 4", m.ID, m.Error)
+	} else if m.Error == nil && m.Result == nil {
+		t.Errorf("documentSymbol of a missing file has neither a result nor an error")
+	}
+	tr.WriteRequest(5, "shutdown", nil)
+	response(5)
+	tr.WriteRequest(6, "shutdown", nil)
+	if m := response(6); m.Error == nil || m.Error.Code != int(transport.InvalidRequest) {
+		t.Errorf("request after shutdown: error = %v, want InvalidRequest", m.Error)
+	}
+	tr.WriteNotif("exit", nil)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Exit was not graceful: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't exit")
+	}
+}
+
+// Starts a server on the workspace at root and initializes it. The returned function shuts it down.
+func startTestServer(t *testing.T, root string) (*transport.Transport, func()) {
+	return startTestServerWithCapabilities(t, root, transport.ClientCapabilities{})
+}
+
+func startTestServerWithCapabilities(t *testing.T, root string, capabilities transport.ClientCapabilities) (*transport.Transport, func()) {
+	return startTestServerWithParams(t, transport.ParamInitialize{XInitializeParams: transport.XInitializeParams{RootURI: transport.DocumentURI(util.Path2URI(root)), Capabilities: capabilities}})
+}
+
+func startTestServerWithParams(t *testing.T, initialize transport.ParamInitialize) (*transport.Transport, func()) {
+	var s server.Server
+	done := make(chan error, 1)
+	go func() {
+		if err := s.Init(transport.Socket); err != nil {
+			done <- err
+			return
+		}
+		err := s.Run(context.Background())
+		// Closed before the test goes on, so that the next server can listen on the same port
+		s.Transport.Close()
+		done <- err
+	}()
+
+	tr := &transport.Transport{}
+	tr.Init(transport.Client, transport.Socket)
+	params, _ := json.Marshal(initialize)
+	tr.WriteRequest(1, "initialize", params)
+	tr.Read()
+	tr.WriteNotif("initialized", json.RawMessage("{}"))
+
+	return tr, func() {
+		tr.WriteRequest(2, "shutdown", nil)
+		tr.WriteNotif("exit", nil)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("server didn't exit")
+		}
+		tr.Close()
+	}
+}
+
+// Reads messages until one for which match returns true
+func readUntil(t *testing.T, tr *transport.Transport, what string, match func(msg []byte) bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		msg, err := tr.ReadContext(ctx)
+		if err != nil {
+			t.Fatalf("no %s: %v", what, err)
+		}
+		if match(msg) {
+			return
+		}
+	}
+}
+
+func TestHangingCompilerProbe(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Never answers with its library directory
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte("#!/bin/sh\nsleep 60\n"), 0755)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust"}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	// The compiler is probed while the configs are loaded, and given up on before the request times out
+	tr.WriteRequest(3, "test/method", []byte("{}"))
+	readUntil(t, tr, "response once the probe is given up on", func(msg []byte) bool {
+		var m transport.ResponseMessage
+		json.Unmarshal(msg, &m)
+		n, ok := m.ID.(float64)
+		return ok && n == 3
+	})
+}
+
+func TestRequestCancelled(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	calls := filepath.Join(root, "calls")
+	// Stands in for the compiler. Runs after the first one, which indexing does, are slow.
+	fakeFaust := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\n[ -e %[1]q ] || { echo first > %[1]q; exit 0; }\necho start >> %[1]q\nsleep 3\n", calls)
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust", "process_files": ["main.dsp"]}`), 0644)
+	waitForCall := func(call string) {
+		for start := time.Now(); !t.Failed(); time.Sleep(10 * time.Millisecond) {
+			if content, _ := os.ReadFile(calls); strings.Contains(string(content), call) {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("compiler didn't start")
+			}
+		}
+	}
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	waitForCall("first")
+	params, _ := json.Marshal(server.DiagnoseParams{URI: transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))})
+	tr.WriteRequest(3, "faustlsp/diagnose", params)
+	waitForCall("start")
+	cancelled := time.Now()
+	tr.WriteNotif("$/cancelRequest", json.RawMessage(`{"id": 3}`))
+	readUntil(t, tr, "response to the cancelled request", func(msg []byte) bool {
+		var m transport.ResponseMessage
+		json.Unmarshal(msg, &m)
+		if n, ok := m.ID.(float64); !ok || n != 3 {
+			return false
+		}
+		if m.Error == nil || m.Error.Code != int(transport.RequestCancelled) {
+			t.Errorf("cancelled request: error = %v, want RequestCancelled", m.Error)
+		}
+		return true
+	})
+	// The compiler is stopped rather than waited for
+	if elapsed := time.Since(cancelled); elapsed > 2*time.Second {
+		t.Errorf("cancelled request answered after %v", elapsed)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	trace := func(prefix string, verbose string) {
+		readUntil(t, tr, "trace "+prefix, func(msg []byte) bool {
+			var m transport.NotificationMessage
+			json.Unmarshal(msg, &m)
+			var params transport.LogTraceParams
+			json.Unmarshal(m.Params, &params)
+			return m.Method == "$/logTrace" && strings.HasPrefix(params.Message, prefix) && strings.Contains(params.Verbose, verbose)
+		})
+	}
+	tr.WriteNotif("$/setTrace", json.RawMessage(`{"value": "verbose"}`))
+
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: transport.DocumentURI(uri), LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	trace("Handled notification 'textDocument/didOpen' in ", "process = _;")
+	trace("Analyzed "+filepath.Join(root, "main.dsp")+" in ", "")
+	symbols, _ := json.Marshal(transport.DocumentSymbolParams{TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(uri)}})
+	tr.WriteRequest(3, "textDocument/documentSymbol", symbols)
+	trace("Handled request 'textDocument/documentSymbol - (3)' in ", uri)
+}
+
+func TestIndexingProgress(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.lib"), []byte("f = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	capabilities := transport.ClientCapabilities{Window: transport.WindowClientCapabilities{WorkDoneProgress: true}}
+	tr, stop := startTestServerWithCapabilities(t, root, capabilities)
+	defer stop()
+	readUntil(t, tr, "indexing progress", func(msg []byte) bool {
+		return strings.Contains(string(msg), `"kind":"begin","title":"Indexing"`)
+	})
+	// Every file analyzed is reported before the progress ends
+	files := []string{}
+	readUntil(t, tr, "end of indexing progress", func(msg []byte) bool {
+		var m struct {
+			Params struct {
+				Value struct {
+					Kind    string `json:"kind"`
+					Message string `json:"message"`
+				} `json:"value"`
+			} `json:"params"`
+		}
+		json.Unmarshal(msg, &m)
+		if _, file, ok := strings.Cut(m.Params.Value.Message, "/2 files: "); ok && m.Params.Value.Kind == "report" {
+			files = append(files, file)
+		}
+		if m.Params.Value.Kind == "end" {
+			if m.Params.Value.Message != "Indexed 2 files" {
+				t.Errorf("progress ended with %q", m.Params.Value.Message)
+			}
+			return true
+		}
+		return false
+	})
+	slices.Sort(files)
+	if want := []string{"a.dsp", "b.lib"}; !slices.Equal(files, want) {
+		t.Errorf("reported files %q, want %q", files, want)
+	}
+}
+
+func TestIndexingStatus(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.lib"), []byte("f = _;\ng = f;\n"), 0644)
+	os.WriteFile(filepath.Join(root, "c.lib"), []byte("h = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	// Indexing only finishes once every file is analyzed
+	readUntil(t, tr, "end of indexing", func(msg []byte) bool {
+		var m struct {
+			Method string                      `json:"method"`
+			Params server.IndexingStatusParams `json:"params"`
+		}
+		json.Unmarshal(msg, &m)
+		if m.Method != "faustlsp/indexingStatus" || m.Params.State != server.IndexingFinished {
+			return false
+		}
+		if m.Params.Files != 3 || m.Params.Symbols != 4 {
+			t.Errorf("indexing finished with %d files and %d symbols, want 3 and 4", m.Params.Files, m.Params.Symbols)
+		}
+		return true
+	})
+}
+
+func TestDiagnosticsClearedOnClose(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "broken.dsp"), []byte("process = ;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "broken.dsp"))
+	diagnostics := func(empty bool) {
+		readUntil(t, tr, fmt.Sprintf("diagnostics with empty = %v", empty), func(msg []byte) bool {
+			var m transport.NotificationMessage
+			json.Unmarshal(msg, &m)
+			var params transport.PublishDiagnosticsParams
+			json.Unmarshal(m.Params, &params)
+			return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && (len(params.Diagnostics) == 0) == empty
+		})
+	}
+	diagnostics(false)
+
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: transport.DocumentURI(uri), LanguageID: "faust", Version: 1, Text: "process = ;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	diagnostics(false)
+	closeParams, _ := json.Marshal(transport.DidCloseTextDocumentParams{TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(uri)}})
+	tr.WriteNotif("textDocument/didClose", closeParams)
+	diagnostics(true)
+}
+
+func TestSavedTextResyncsDocument(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false, "diagnostics": {"syntax": {"mode": "on-save"}}}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	diagnostics := func(empty bool) {
+		readUntil(t, tr, fmt.Sprintf("diagnostics with empty = %v", empty), func(msg []byte) bool {
+			var m transport.NotificationMessage
+			json.Unmarshal(msg, &m)
+			var params transport.PublishDiagnosticsParams
+			json.Unmarshal(m.Params, &params)
+			return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && (len(params.Diagnostics) == 0) == empty
+		})
+	}
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: transport.DocumentURI(uri), LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	diagnostics(true)
+
+	// The change that broke the document never arrived, the save brings it
+	text := "process = ;\n"
+	save, _ := json.Marshal(transport.DidSaveTextDocumentParams{TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(uri)}, Text: &text})
+	tr.WriteNotif("textDocument/didSave", save)
+	diagnostics(false)
+}
+
+func TestSaveAfterPendingChange(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: uri, LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	insert := func(version int32, character uint32) {
+		at := transport.Position{Character: character}
+		change, _ := json.Marshal(transport.DidChangeTextDocumentParams{
+			TextDocument:   transport.VersionedTextDocumentIdentifier{TextDocumentIdentifier: transport.TextDocumentIdentifier{URI: uri}, Version: version},
+			ContentChanges: []transport.TextDocumentContentChangeEvent{{Range: &transport.Range{Start: at, End: at}, Text: " : _"}},
+		})
+		tr.WriteNotif("textDocument/didChange", change)
+	}
+
+	// The save is sent right after the changes it includes, before they are handled. Resyncing to the saved text
+	// before they are applied would apply them twice.
+	const changes = 20
+	for version := int32(2); version < 2+changes; version++ {
+		insert(version, 11+4*uint32(version-2))
+	}
+	text := "process = _" + strings.Repeat(" : _", changes) + ";\n"
+	save, _ := json.Marshal(transport.DidSaveTextDocumentParams{TextDocument: transport.TextDocumentIdentifier{URI: uri}, Text: &text})
+	tr.WriteNotif("textDocument/didSave", save)
+	insert(2+changes, 11+4*changes)
+	readUntil(t, tr, "diagnostics of the change after the save", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		if m.Method != "textDocument/publishDiagnostics" || params.URI != uri || params.Version != 2+changes {
+			return false
+		}
+		if len(params.Diagnostics) != 0 {
+			t.Errorf("document corrupted by the save: %s", params.Diagnostics[0].Message)
+		}
+		return true
+	})
+}
+
+func TestDocumentOutsideWorkspace(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+	external := t.TempDir()
+	main := "import(\"ext.lib\");\nprocess = gain;\n"
+	os.WriteFile(filepath.Join(external, "main.dsp"), []byte(main), 0644)
+	os.WriteFile(filepath.Join(external, "ext.lib"), []byte("gain = 0.5;\n"), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(external, "main.dsp"))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: transport.DocumentURI(uri), LanguageID: "faust", Version: 1, Text: main}})
+	tr.WriteNotif("textDocument/didOpen", open)
+
+	// Imports of the document resolve from its own directory
+	libURI := util.Path2URI(filepath.Join(external, "ext.lib"))
+	definition, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(uri)},
+		Position:     transport.Position{Line: 1, Character: 11},
+	}})
+	deadline := time.Now().Add(5 * time.Second)
+	for id := 10; ; id++ {
+		tr.WriteRequest(id, "textDocument/definition", definition)
+		var result json.RawMessage
+		readUntil(t, tr, "definition response", func(msg []byte) bool {
+			var r transport.ResponseMessage
+			json.Unmarshal(msg, &r)
+			if n, ok := r.ID.(float64); ok && int(n) == id {
+				result = r.Result
+				return true
+			}
+			return false
+		})
+		if strings.Contains(string(result), libURI) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("definition of gain = %s, want a location in %s", result, libURI)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCompilerDiagnosticsClearedBySyntaxError(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	// Stands in for the compiler and rejects every file
+	fakeFaust := "#!/bin/sh\necho \"$1 : 1 : ERROR : rejected\" >&2\nexit 1\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	config := `{"command": "./fakefaust", "process_files": ["main.dsp"], "diagnostics": {"compiler": {"mode": "on-save"}}}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	sources := func(want string) {
+		readUntil(t, tr, "diagnostics from "+want, func(msg []byte) bool {
+			var m transport.NotificationMessage
+			json.Unmarshal(msg, &m)
+			var params transport.PublishDiagnosticsParams
+			json.Unmarshal(m.Params, &params)
+			if m.Method != "textDocument/publishDiagnostics" || string(params.URI) != uri {
+				return false
+			}
+			got := []string{}
+			for _, d := range params.Diagnostics {
+				got = append(got, d.Source)
+			}
+			return strings.Join(got, ",") == want
+		})
+	}
+
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: transport.DocumentURI(uri), LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	sources("faust")
+
+	// The compiler only runs on save, but its diagnostics are about content that doesn't exist anymore
+	change, _ := json.Marshal(transport.DidChangeTextDocumentParams{
+		TextDocument: transport.VersionedTextDocumentIdentifier{TextDocumentIdentifier: transport.TextDocumentIdentifier{URI: transport.DocumentURI(uri)}, Version: 2},
+		ContentChanges: []transport.TextDocumentContentChangeEvent{{
+			Range: &transport.Range{Start: transport.Position{Line: 0, Character: 10}, End: transport.Position{Line: 0, Character: 11}},
+			Text:  "",
+		}},
+	})
+	tr.WriteNotif("textDocument/didChange", change)
+	sources("tree-sitter")
+}
+
+func TestInvalidMessagesSkipped(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	invalid := []string{
+		// Bigger than the largest message read
+		"Content-Length: 20000000\r\n\r\n" + strings.Repeat(" ", 20000000),
+		"Content-Lenght: 2\r\n\r\n{}",
+		"Content-Length: two\r\n\r\n{}",
+		"Content-Length: 5\r\n\r\n{oops",
+	}
+	for _, msg := range invalid {
+		tr.Writer.Write([]byte(msg))
+	}
+	// Other header fields don't break a message
+	symbols, _ := json.Marshal(transport.DocumentSymbolParams{TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))}})
+	request, _ := json.Marshal(transport.RequestMessage{Message: transport.Message{Jsonrpc: "2.0"}, ID: 3, Method: "textDocument/documentSymbol", Params: symbols})
+	fmt.Fprintf(tr.Writer, "Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n%s", len(request), request)
+
+	parseErrors := 0
+	readUntil(t, tr, "response after invalid messages", func(msg []byte) bool {
+		var r transport.ResponseMessage
+		json.Unmarshal(msg, &r)
+		if r.Error != nil && r.Error.Code == int(transport.ParseError) && r.ID == nil {
+			parseErrors++
+		}
+		n, ok := r.ID.(float64)
+		return ok && int(n) == 3
+	})
+	if parseErrors != len(invalid) {
+		t.Errorf("got %d parse errors, want %d", parseErrors, len(invalid))
+	}
+}
+
+func TestCompilerStoppedOnExit(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	calls := filepath.Join(root, "calls")
+	// Stands in for the compiler. Runs after the first one are slow and record when they start and finish.
+	fakeFaust := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\n[ -e %[1]q ] || { echo first > %[1]q; exit 0; }\necho start >> %[1]q\nsleep 1\necho done >> %[1]q\n", calls)
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	config := `{"command": "./fakefaust", "process_files": ["main.dsp"], "diagnostics": {"compiler": {"mode": "on-type", "delay": 50}}}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	waitForCall := func(call string) {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			if content, _ := os.ReadFile(calls); strings.Contains(string(content), call) {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("compiler didn't start")
+			}
+		}
+	}
+
+	tr, stop := startTestServer(t, root)
+	// The workspace is indexed in the background, which compiles the process files once
+	waitForCall("first")
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: transport.DocumentURI(uri), LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	waitForCall("start")
+	stop()
+
+	// Nothing the server started keeps running after it exited
+	time.Sleep(1500 * time.Millisecond)
+	if content, _ := os.ReadFile(calls); strings.Contains(string(content), "done") {
+		t.Error("compiler kept running after exit")
+	}
+}
+
+func TestPendingWorkDroppedOnExit(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	calls := filepath.Join(root, "calls")
+	// Stands in for the compiler, recording each run
+	fakeFaust := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\necho run >> %q\n", calls)
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	config := `{"command": "./fakefaust", "process_files": ["main.dsp"], "diagnostics": {"compiler": {"mode": "on-type", "delay": 300}}}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	runs := func() int {
+		content, _ := os.ReadFile(calls)
+		return strings.Count(string(content), "run")
+	}
+	waitForRuns := func(n int) {
+		for start := time.Now(); runs() < n; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("compiler didn't run %d times", n)
+			}
+		}
+	}
+
+	tr, stop := startTestServer(t, root)
+	// Once when the workspace is indexed, once when the document is opened
+	waitForRuns(1)
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: uri, LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	waitForRuns(2)
+
+	// Debounces a compiler run and leaves a disk event to coalesce, then exits before either is handled
+	change, _ := json.Marshal(transport.DidChangeTextDocumentParams{
+		TextDocument: transport.VersionedTextDocumentIdentifier{TextDocumentIdentifier: transport.TextDocumentIdentifier{URI: uri}, Version: 2},
+		ContentChanges: []transport.TextDocumentContentChangeEvent{{
+			Range: &transport.Range{Start: transport.Position{Line: 0, Character: 11}, End: transport.Position{Line: 0, Character: 11}},
+			Text:  ",_",
+		}},
+	})
+	tr.WriteNotif("textDocument/didChange", change)
+	os.WriteFile(filepath.Join(root, "other.dsp"), []byte("process = _;\n"), 0644)
+	stop()
+
+	// The pending run is dropped rather than started after exit
+	time.Sleep(600 * time.Millisecond)
+	if n := runs(); n != 2 {
+		t.Errorf("compiler ran %d times, want 2", n)
+	}
+}
+
+func TestRegisteredMethodNames(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	tr, stop := startTestServer(t, root)
+	defer stop()
+
+	// Sends a request and reads its response
+	request := func(id int, method string, params any) transport.ResponseMessage {
+		raw, _ := json.Marshal(params)
+		tr.WriteRequest(id, method, raw)
+		var response transport.ResponseMessage
+		readUntil(t, tr, "response to "+method, func(msg []byte) bool {
+			json.Unmarshal(msg, &response)
+			n, ok := response.ID.(float64)
+			return ok && int(n) == id && response.Message.Jsonrpc != ""
+		})
+		return response
+	}
+
+	for i, method := range []string{"faustlsp/processes", "faust/processes"} {
+		if m := request(10+i, method, struct{}{}); m.Error != nil {
+			t.Errorf("%s failed: %s", method, m.Error.Message)
+		}
+	}
+	command := func(id int, name string, args ...any) transport.ResponseMessage {
+		arguments := []json.RawMessage{}
+		for _, arg := range args {
+			raw, _ := json.Marshal(arg)
+			arguments = append(arguments, raw)
+		}
+		return request(id, "workspace/executeCommand", transport.ExecuteCommandParams{Command: name, Arguments: arguments})
+	}
+	if m := command(4, "faust.initConfig", util.Path2URI(root)); m.Error != nil {
+		t.Errorf("faust.initConfig failed: %s", m.Error.Message)
+	}
+	if m := command(5, "faust.docgen", "docs"); m.Error != nil {
+		t.Errorf("faust.docgen failed: %s", m.Error.Message)
+	}
+	// Fails without a compiler, but not as an unknown command
+	selection := transport.Range{End: transport.Position{Character: 11}}
+	if m := command(6, "faust.checkSelection", util.Path2URI(filepath.Join(root, "main.dsp")), selection); m.Error != nil && strings.Contains(m.Error.Message, "unknown command") {
+		t.Errorf("faust.checkSelection isn't registered: %s", m.Error.Message)
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	logging.Init()
+	tr, stop := startTestServer(t, t.TempDir())
+	defer stop()
+
+	// Requests are sent without waiting for responses, each to a method of its own
+	const requests = 20
+	for id := 1; id <= requests; id++ {
+		tr.WriteRequest(id, fmt.Sprintf("test/method%d", id), []byte("{}"))
+	}
+	answered := map[int]bool{}
+	readUntil(t, tr, "responses to every request", func(msg []byte) bool {
+		var m transport.ResponseMessage
+		json.Unmarshal(msg, &m)
+		n, ok := m.ID.(float64)
+		if !ok || m.Message.Jsonrpc == "" {
+			return false
+		}
+		id := int(n)
+		want := fmt.Sprintf("method not found: test/method%d", id)
+		if m.Error == nil || m.Error.Message != want {
+			t.Errorf("response to request %d is %+v, want the error %q", id, m.Error, want)
+		}
+		if answered[id] {
+			t.Errorf("request %d got more than one response", id)
+		}
+		answered[id] = true
+		return len(answered) == requests
+	})
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestLibraryLint(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	library := `declare name "Demo Library";
+declare author "Someone";
+
+// Not bound to a two-letter prefix
+maths = library("maths.lib");
+os = library("oscillators.lib");
+
+//--------------------` + "`(dm.)documented`" + `--------------------
+// Sine wave.
+//
+// #### Usage
+//
+// ` + "```" + `
+// documented(freq) : _
+// ` + "```" + `
+//---------------------------------------------------------
+documented(freq) = freq : sin;
+
+// Cosine wave, without usage
+noUsage(freq) = freq : cos;
+
+undocumented = _;
+`
+	os.WriteFile(filepath.Join(root, "demo.lib"), []byte(library), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "demo.lib"))
+	var diagnostics []transport.Diagnostic
+	readUntil(t, tr, "lint diagnostics of demo.lib", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		diagnostics = params.Diagnostics
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && len(params.Diagnostics) > 0
+	})
+
+	found := []string{}
+	for _, d := range diagnostics {
+		if d.Source == "lint" {
+			found = append(found, fmt.Sprintf("%v:%d", d.Code, d.Range.Start.Line))
+		}
+	}
+	slices.Sort(found)
+	expected := []string{"environment-prefix:4", "missing-declare:0", "missing-doc:21", "missing-usage:19"}
+	if !slices.Equal(found, expected) {
+		t.Errorf("lint = %v, want %v", found, expected)
+	}
+}
+
+func TestUnreachableRules(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	content := `f = case {
+  (x) => x;
+  (0) => 1;
+};
+g = case {
+  (0) => 1;
+  (x) => x;
+};
+h = case {
+  (x, x) => 1;
+  (1, 1) => 2;
+  (x, y) => 3;
+  (x:2, 3) => 4;
+};
+k(0) = 1;
+k(n) = n;
+k(1) = 2;
+process = f, g, h, k(2);
+`
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	var diagnostics []transport.Diagnostic
+	readUntil(t, tr, "unreachable rule diagnostics of main.dsp", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		diagnostics = params.Diagnostics
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri && len(params.Diagnostics) > 0
+	})
+
+	found := []string{}
+	for _, d := range diagnostics {
+		if d.Code == "unreachable-rule" && len(d.RelatedInformation) == 1 {
+			found = append(found, fmt.Sprintf("%d:%d-%d after %d", d.Range.Start.Line, d.Range.Start.Character, d.Range.End.Character, d.RelatedInformation[0].Location.Range.Start.Line))
+		}
+	}
+	expected := []string{"2:2-5 after 1", "12:2-10 after 11", "16:0-4 after 15"}
+	if !slices.Equal(found, expected) {
+		t.Errorf("unreachable rules = %v, want %v", found, expected)
+	}
+}
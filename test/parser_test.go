@@ -3,6 +3,7 @@ package tests
 import (
 	"log/slog"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/carn181/faustlsp/logging"
@@ -20,10 +21,30 @@ import("s.dsp");
 import("c.dsp");
 `)
 	tree := parser.ParseTree(code)
-	rslts := parser.GetImports(code, tree)
+	rslts, err := parser.GetImports(code, tree)
 	expected := []string{"a.lib", "s.dsp", "c.dsp"}
-	if !slices.Equal(rslts, expected) {
-		t.Error(parser.GetImports(code, tree))
+	if err != nil || !slices.Equal(rslts, expected) {
+		t.Error(rslts, err)
+	}
+}
+
+func TestGrammar(t *testing.T) {
+	if err := parser.Init(); err != nil {
+		t.Fatalf("bundled grammar: %v", err)
+	}
+	code := []byte("process = _;\n")
+	tree := parser.ParseTree(code)
+	defer tree.Close()
+
+	if _, err := parser.GetQueryMatches("(definition) @def", code, tree); err != nil {
+		t.Errorf("valid query: %v", err)
+	}
+	// A node type the grammar doesn't have, like after a grammar update renamed it
+	if _, err := parser.GetQueryMatches("(no_such_node) @n", code, tree); err == nil || !strings.Contains(err.Error(), "no_such_node") {
+		t.Errorf("invalid query error = %v, want one naming the node", err)
+	}
+	if _, err := parser.GetQueryMatches("(definition", code, tree); err == nil {
+		t.Error("query with a syntax error compiled")
 	}
 }
 
@@ -93,3 +114,81 @@ func TestRangeContains(t *testing.T) {
 		})
 	}
 }
+
+func TestMetadataSymbols(t *testing.T) {
+	if err := parser.Init(); err != nil {
+		t.Fatal(err)
+	}
+	code := []byte("declare name \"Reverb\";\ndeclare author \"Jane\";\nimport(\"stdfaust.lib\");\ndeclare dry license \"MIT\";\nprocess = _;\n")
+	tree := parser.ParseTree(code)
+	defer tree.Close()
+
+	symbols := parser.DocumentSymbols(tree, code)
+	if len(symbols) != 2 || symbols[0].Name != "Metadata" || symbols[1].Name != "process" {
+		t.Fatalf("symbols = %v, want Metadata and process", symbols)
+	}
+	metadata := symbols[0]
+	want := []struct{ name, detail string }{{"name", "Reverb"}, {"author", "Jane"}, {"dry license", "MIT"}}
+	if len(metadata.Children) != len(want) {
+		t.Fatalf("metadata = %v, want %v", metadata.Children, want)
+	}
+	for i, w := range want {
+		if child := metadata.Children[i]; child.Name != w.name || child.Detail != w.detail {
+			t.Errorf("metadata[%d] = %s %q, want %s %q", i, child.Name, child.Detail, w.name, w.detail)
+		}
+	}
+	if metadata.Range.Start.Line != 0 || metadata.Range.End.Line != 3 {
+		t.Errorf("metadata range = %v, want lines 0 to 3", metadata.Range)
+	}
+
+	// Files without declarations have no Metadata group
+	code = []byte("process = _;\n")
+	tree = parser.ParseTree(code)
+	defer tree.Close()
+	if symbols := parser.DocumentSymbols(tree, code); len(symbols) != 1 || symbols[0].Name != "process" {
+		t.Errorf("symbols = %v, want only process", symbols)
+	}
+}
+
+func TestSectionSymbols(t *testing.T) {
+	if err := parser.Init(); err != nil {
+		t.Fatal(err)
+	}
+	code := []byte(`declare name "Filters";
+//=============================Basic Filters=============================
+//=======================================================================
+
+//----------------------------` + "`(fi.)zero`" + `----------------------------
+zero(z) = _ <: _,mem : _,*(z) : -;
+
+//---------------------------Comb Filters---------------------------
+comb = _;
+//=============================Lowpass=============================
+lowpass = _;
+`)
+	tree := parser.ParseTree(code)
+	defer tree.Close()
+
+	// Names of symbols with their children in brackets
+	var outline func(symbols []transport.DocumentSymbol) string
+	outline = func(symbols []transport.DocumentSymbol) string {
+		names := []string{}
+		for _, sym := range symbols {
+			name := sym.Name
+			if sym.Kind == transport.Namespace {
+				name += "[" + outline(sym.Children) + "]"
+			}
+			names = append(names, name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	symbols := parser.SectionSymbols(parser.DocumentSymbols(tree, code), code)
+	want := "Metadata[name] Basic Filters[zero Comb Filters[comb]] Lowpass[lowpass]"
+	if got := outline(symbols); got != want {
+		t.Errorf("outline = %s, want %s", got, want)
+	}
+	if section := symbols[1]; section.Range.Start.Line != 1 || section.Range.End.Line != 8 {
+		t.Errorf("Basic Filters range = %v, want lines 1 to 8", section.Range)
+	}
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+var positionSeeds = []string{
+	"",
+	"\n",
+	"abc\ndef",
+	"a😆b\nc",
+	"process = os.osc(440);\n",
+	"é\n\n💚💚\n",
+	"\xff\xfe\n\x80",
+	"a\r\nb\r\n",
+	"\r\n\r\n😆\r",
+	"\uFEFFprocess = _;\n",
+	"\uFEFF",
+	"\uFEFF\r\n\uFEFF",
+}
+
+var positionEncodings = []string{"utf-8", "utf-16", "utf-32"}
+
+func TestFindSymbolScopeAtOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		offset uint
+		want   string
+	}{
+		{name: "Empty file", text: "", offset: 0, want: ""},
+		{name: "Offset past the end", text: "os.osc", offset: 100, want: "os.osc"},
+		{name: "Identifier at the start of the file", text: "os.", offset: 3, want: "os."},
+		{name: "Identifier at the end of the file", text: "x = os.osc", offset: 8, want: "os.osc"},
+		{name: "Cursor after the dot", text: "process = os.\n", offset: 13, want: "os."},
+		{name: "Multi-byte identifier", text: "gain_é = 1;", offset: 3, want: "gain_é"},
+		{name: "Offset inside a multi-byte character", text: "😆 ab", offset: 2, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := server.FindSymbolScopeAtOffset([]byte(tt.text), nil, tt.offset, "utf-16")
+			if got != tt.want {
+				t.Errorf("FindSymbolScopeAtOffset() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzPositionToOffset(f *testing.F) {
+	for _, s := range positionSeeds {
+		f.Add(s, uint32(0), uint32(0))
+		f.Add(s, uint32(1), uint32(2))
+		f.Add(s, uint32(10), uint32(100))
+	}
+	f.Fuzz(func(t *testing.T, s string, line uint32, char uint32) {
+		pos := transport.Position{Line: line, Character: char}
+		for _, encoding := range positionEncodings {
+			offset, _ := server.PositionToOffset(pos, s, encoding)
+			if offset > uint(len(s)) {
+				t.Fatalf("%s: offset %d past the end of a %d byte document", encoding, offset, len(s))
+			}
+			if offset < uint(len(s)) && !utf8.RuneStart(s[offset]) && utf8.ValidString(s) {
+				t.Fatalf("%s: offset %d inside a character", encoding, offset)
+			}
+			if offset > 0 && offset < uint(len(s)) && s[offset-1] == '\r' && s[offset] == '\n' {
+				t.Fatalf("%s: offset %d inside a \\r\\n line break", encoding, offset)
+			}
+
+			// Offsets produced from positions survive a round trip
+			back, err := server.OffsetToPosition(offset, s, encoding)
+			if err != nil {
+				t.Fatalf("%s: OffsetToPosition(%d) error = %v", encoding, offset, err)
+			}
+			again, err := server.PositionToOffset(back, s, encoding)
+			if err != nil || again != offset {
+				t.Fatalf("%s: round trip of offset %d through %v gave %d, error = %v", encoding, offset, back, again, err)
+			}
+		}
+	})
+}
+
+func FuzzOffsetToPosition(f *testing.F) {
+	for _, s := range positionSeeds {
+		f.Add(s, uint(0))
+		f.Add(s, uint(len(s)))
+		f.Add(s, uint(len(s)+5))
+		f.Add(s, uint(len(s)/2))
+	}
+	f.Fuzz(func(t *testing.T, s string, offset uint) {
+		for _, encoding := range positionEncodings {
+			pos, err := server.OffsetToPosition(offset, s, encoding)
+			if err != nil {
+				t.Fatalf("%s: OffsetToPosition(%d) error = %v", encoding, offset, err)
+			}
+			if lines := uint32(strings.Count(s, "\n")); pos.Line > lines {
+				t.Fatalf("%s: line %d past the last line %d", encoding, pos.Line, lines)
+			}
+			back, err := server.PositionToOffset(pos, s, encoding)
+			if err != nil {
+				t.Fatalf("%s: PositionToOffset(%v) error = %v", encoding, pos, err)
+			}
+			// Offsets inside a byte order mark move to its end, as it has no position of its own
+			if back > offset && offset <= uint(len(s)) && !(strings.HasPrefix(s, "\uFEFF") && back == 3) {
+				t.Fatalf("%s: offset %d moved forward to %d", encoding, offset, back)
+			}
+		}
+	})
+}
+
+func FuzzIdentifierAtPosition(f *testing.F) {
+	for _, s := range positionSeeds {
+		f.Add(s, uint32(0), uint32(3), "x")
+		f.Add(s, uint32(1), uint32(1), "")
+	}
+	f.Fuzz(func(t *testing.T, s string, line uint32, char uint32, text string) {
+		pos := transport.Position{Line: line, Character: char}
+		r := server.FindCompletionReplaceRange(pos, s, "utf-16")
+		if r.End.Line < r.Start.Line || (r.End.Line == r.Start.Line && r.End.Character < r.Start.Character) {
+			t.Fatalf("replace range %v ends before it starts", r)
+		}
+		offset, _ := server.PositionToOffset(pos, s, "utf-16")
+		server.FindSymbolScopeAtOffset([]byte(s), nil, offset, "utf-16")
+		server.FindSymbolScopeAtOffset([]byte(s), nil, uint(len(s))+uint(char), "utf-16")
+
+		changed := server.ApplyIncrementalChange(transport.Range{Start: pos, End: transport.Position{Line: char, Character: line}}, text, s, "utf-16")
+		if !strings.Contains(changed, text) {
+			t.Fatalf("ApplyIncrementalChange() = %q lost the inserted %q", changed, text)
+		}
+	})
+}
+
+func TestPositionEncodingNegotiation(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	tests := []struct {
+		name   string
+		client []transport.PositionEncodingKind
+		want   transport.PositionEncodingKind
+	}{
+		{"None sent", nil, transport.UTF16},
+		{"First preference", []transport.PositionEncodingKind{transport.UTF8, transport.UTF16}, transport.UTF8},
+		{"UTF-32", []transport.PositionEncodingKind{transport.UTF32}, transport.UTF32},
+		{"Unsupported preference skipped", []transport.PositionEncodingKind{"utf-7", transport.UTF32, transport.UTF8}, transport.UTF32},
+		{"Only unsupported", []transport.PositionEncodingKind{"utf-7"}, transport.UTF16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s server.Server
+			params, _ := json.Marshal(transport.InitializeParams{XInitializeParams: transport.XInitializeParams{
+				RootURI:      transport.DocumentURI(util.Path2URI(root)),
+				Capabilities: transport.ClientCapabilities{General: &transport.GeneralClientCapabilities{PositionEncodings: tt.client}},
+			}})
+			content, err := server.Initialize(context.Background(), &s, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result transport.InitializeResult
+			json.Unmarshal(content, &result)
+			if result.Capabilities.PositionEncoding == nil || *result.Capabilities.PositionEncoding != tt.want {
+				t.Errorf("position encoding = %v, want %s", result.Capabilities.PositionEncoding, tt.want)
+			}
+		})
+	}
+}
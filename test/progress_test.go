@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+)
+
+func TestProgress(t *testing.T) {
+	logging.Init()
+	var out bytes.Buffer
+	var s server.Server
+	s.Transport.Writer = &out
+	s.ClientCapabilities.Window.WorkDoneProgress = true
+
+	p := s.StartProgress(context.Background(), "Compiling", "", true)
+	p.Report("Compiling a.dsp…", 50)
+
+	params, _ := json.Marshal(map[string]string{"token": "faustlsp-1"})
+	if err := server.ProgressCancel(context.Background(), &s, params); err != nil {
+		t.Fatal(err)
+	}
+	if p.Context().Err() == nil {
+		t.Errorf("progress context not cancelled by window/workDoneProgress/cancel")
+	}
+	p.End("")
+
+	got := out.String()
+	order := []string{`"window/workDoneProgress/create"`, `"kind":"begin"`, `"kind":"report"`, `"kind":"end"`}
+	// Each message is looked for after the previous one
+	from := 0
+	for _, want := range order {
+		i := strings.Index(got[from:], want)
+		if i == -1 {
+			t.Fatalf("missing or out of order %s in:\n%s", want, got)
+		}
+		from += i + len(want)
+	}
+
+	if err := server.ProgressCancel(context.Background(), &s, params); err == nil {
+		t.Errorf("cancelling an ended progress should fail")
+	}
+}
+
+func TestProgressUnsupported(t *testing.T) {
+	logging.Init()
+	var out bytes.Buffer
+	var s server.Server
+	s.Transport.Writer = &out
+
+	p := s.StartProgress(context.Background(), "Compiling", "", true)
+	p.Report("Compiling a.dsp…", 50)
+	p.End("")
+	if out.Len() != 0 {
+		t.Errorf("progress sent to client without workDoneProgress support: %s", out.String())
+	}
+}
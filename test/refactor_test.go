@@ -0,0 +1,398 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestMoveDefinition(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	main := `declare name "Main";
+
+// Doubles the signal.
+gain2 = *(2);
+
+scaled = *(factor);
+factor = 3;
+
+process = gain2 : scaled : gain2;
+`
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(main), 0644)
+	os.MkdirAll(filepath.Join(root, "lib"), 0755)
+	os.WriteFile(filepath.Join(root, "lib", "effects.lib"), []byte("declare name \"Effects\";\n"), 0644)
+	// Already defines gain2
+	os.WriteFile(filepath.Join(root, "gains.lib"), []byte("gain2 = *(2);\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	target := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "lib", "effects.lib")))
+	moveActions := func(line uint32) []transport.CodeAction {
+		actions := []transport.CodeAction{}
+		for _, action := range codeActionsAt(t, s, uri, transport.Position{Line: line, Character: 1}) {
+			if action.Kind == transport.RefactorMove {
+				actions = append(actions, action)
+			}
+		}
+		return actions
+	}
+
+	actions := moveActions(3)
+	if len(actions) != 1 || actions[0].Title != "Move gain2 to lib/effects.lib" {
+		t.Fatalf("move actions = %+v, want only the one to lib/effects.lib", actions)
+	}
+	changes := actions[0].Edit.Changes
+	want := `declare name "Main";
+ef = library("lib/effects.lib");
+
+scaled = *(factor);
+factor = 3;
+
+process = ef.gain2 : scaled : ef.gain2;
+`
+	if got := applyEdits(t, main, changes[uri]); got != want {
+		t.Errorf("main.dsp after the move:\n%s\nwant:\n%s", got, want)
+	}
+	want = "declare name \"Effects\";\n\n// Doubles the signal.\ngain2 = *(2);\n"
+	if got := applyEdits(t, "declare name \"Effects\";\n", changes[target]); got != want {
+		t.Errorf("effects.lib after the move:\n%s\nwant:\n%s", got, want)
+	}
+
+	// factor wouldn't be defined in the library
+	if actions := moveActions(5); len(actions) != 0 {
+		t.Errorf("move actions = %+v for a definition referring to the file's definitions, want none", actions)
+	}
+	// Nor is moving the process offered
+	if actions := moveActions(8); len(actions) != 0 {
+		t.Errorf("move actions = %+v for the process, want none", actions)
+	}
+}
+
+func codeActionsAt(t *testing.T, s *server.Server, uri transport.DocumentURI, pos transport.Position) []transport.CodeAction {
+	params, _ := json.Marshal(transport.CodeActionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Range:        transport.Range{Start: pos, End: pos},
+	})
+	result, err := server.CodeActions(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []transport.CodeAction
+	json.Unmarshal(result, &actions)
+	return actions
+}
+
+// Applies non-overlapping edits to content
+func applyEdits(t *testing.T, content string, edits []transport.TextEdit) string {
+	edits = slices.Clone(edits)
+	// From the end, so that the offsets of the following edits stay valid
+	slices.SortFunc(edits, func(a, b transport.TextEdit) int {
+		if a.Range.Start.Line != b.Range.Start.Line {
+			return int(b.Range.Start.Line) - int(a.Range.Start.Line)
+		}
+		return int(b.Range.Start.Character) - int(a.Range.Start.Character)
+	})
+	for _, edit := range edits {
+		start, err := server.PositionToOffset(edit.Range.Start, content, "utf-16")
+		if err != nil {
+			t.Fatal(err)
+		}
+		end, err := server.PositionToOffset(edit.Range.End, content, "utf-16")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = content[:start] + edit.NewText + content[end:]
+	}
+	return content
+}
+
+func TestExtractLibrary(t *testing.T) {
+	logging.Init()
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	root := t.TempDir()
+	main := `import("helpers.lib");
+hp = library("helpers.lib");
+
+// Halves the signal.
+half = *(0.5);
+quarter = half : half : hp.twice;
+
+offset = +(1);
+process = quarter : offset;
+`
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(main), 0644)
+	os.WriteFile(filepath.Join(root, "helpers.lib"), []byte("twice = *(2);\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	uri := transport.DocumentURI(util.Path2URI(path))
+	extractAction := func(start uint32, end uint32) (transport.CodeAction, bool) {
+		params, _ := json.Marshal(transport.CodeActionParams{
+			TextDocument: transport.TextDocumentIdentifier{URI: uri},
+			Range:        transport.Range{Start: transport.Position{Line: start}, End: transport.Position{Line: end, Character: 3}},
+		})
+		result, err := server.CodeActions(context.Background(), s, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []transport.CodeAction
+		json.Unmarshal(result, &actions)
+		for _, action := range actions {
+			if action.Kind == transport.RefactorExtract {
+				return action, true
+			}
+		}
+		return transport.CodeAction{}, false
+	}
+
+	// quarter refers to half, which would stay behind
+	if action, ok := extractAction(5, 5); ok {
+		t.Errorf("extraction %+v offered for a definition referring to the file's definitions", action)
+	}
+	if action, ok := extractAction(7, 8); ok {
+		t.Errorf("extraction %+v of the process offered", action)
+	}
+	action, ok := extractAction(3, 5)
+	if !ok || action.Title != "Extract to main.lib" {
+		t.Fatalf("extraction = %+v, want one to main.lib", action)
+	}
+	result, err := server.ExtractLibraryCommand(context.Background(), s, action.Command.Arguments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extraction := result.(server.ExtractLibraryResult)
+
+	library := filepath.Join(s.Workspace.Root, "main.lib")
+	if string(extraction.URI) != util.Path2URI(library) {
+		t.Errorf("library = %s, want %s", extraction.URI, library)
+	}
+	content, _ := os.ReadFile(library)
+	want := `declare name "main";
+declare author "";
+declare copyright "";
+declare license "";
+declare version "1.0";
+
+import("helpers.lib");
+hp = library("helpers.lib");
+
+// Halves the signal.
+half = *(0.5);
+quarter = half : half : hp.twice;
+`
+	if string(content) != want {
+		t.Errorf("main.lib:\n%s\nwant:\n%s", content, want)
+	}
+	edited := applyEdits(t, main, extraction.Edit.Changes[uri])
+	want = `import("helpers.lib");
+hp = library("helpers.lib");
+import("main.lib");
+
+offset = +(1);
+process = quarter : offset;
+`
+	if edited != want {
+		t.Errorf("main.dsp after the extraction:\n%s\nwant:\n%s", edited, want)
+	}
+
+	// The library is known right away, so the extracted definitions resolve once the file is edited
+	s.Files.ModifyFull(path, edited)
+	params, _ := json.Marshal(transport.DefinitionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 5, Character: 11},
+	}})
+	definition, err := server.GetDefinition(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loc transport.Location
+	json.Unmarshal(definition, &loc)
+	if string(loc.URI) != util.Path2URI(library) || loc.Range.Start.Line != 11 {
+		t.Errorf("quarter defined at %+v, want line 11 of main.lib", loc)
+	}
+}
+
+func TestSortDefinitions(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	library := `// Demo library, MIT licensed
+
+declare name "Demo";
+// Doubles the signal.
+double = *(2);
+import("helpers.lib");
+b = a + twice(1); // uses a
+a = 1;
+
+//----- Section two -----
+
+y = z;
+z = 2;
+`
+	os.WriteFile(filepath.Join(root, "demo.lib"), []byte(library), 0644)
+	os.WriteFile(filepath.Join(root, "helpers.lib"), []byte("twice = *(2);\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "demo.lib")))
+	sorted := map[string]string{}
+	for _, action := range codeActionsAt(t, s, uri, transport.Position{}) {
+		if strings.HasPrefix(string(action.Kind), "source.sortDefinitions") {
+			sorted[string(action.Kind)] = applyEdits(t, library, action.Edit.Changes[uri])
+		}
+	}
+
+	// Imports and declare statements first, definitions sorted within the sections headings introduce
+	want := `// Demo library, MIT licensed
+
+import("helpers.lib");
+
+declare name "Demo";
+
+a = 1;
+
+b = a + twice(1); // uses a
+
+// Doubles the signal.
+double = *(2);
+
+//----- Section two -----
+
+y = z;
+z = 2;
+`
+	if got := sorted["source.sortDefinitions.alphabetical"]; got != want {
+		t.Errorf("sorted alphabetically:\n%s\nwant:\n%s", got, want)
+	}
+	want = `// Demo library, MIT licensed
+
+import("helpers.lib");
+
+declare name "Demo";
+
+// Doubles the signal.
+double = *(2);
+
+a = 1;
+
+b = a + twice(1); // uses a
+
+//----- Section two -----
+
+z = 2;
+y = z;
+`
+	if got := sorted["source.sortDefinitions.dependencies"]; got != want {
+		t.Errorf("sorted by dependencies:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Sorted content isn't offered to be sorted again
+	os.WriteFile(filepath.Join(root, "sorted.lib"), []byte(want), 0644)
+	s, err = server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri = transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "sorted.lib")))
+	for _, action := range codeActionsAt(t, s, uri, transport.Position{}) {
+		if action.Kind == "source.sortDefinitions.dependencies" {
+			t.Errorf("sorting offered for sorted content")
+		}
+	}
+}
+
+func TestQuickFixes(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "utils.lib"), []byte("double(x) = x*2;\n"), 0644)
+	content := "gain = 0.5;\nunused = 1;\nprocess = gian + os.osc(440) + double(gain);\n"
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(content), 0644)
+	os.Mkdir(filepath.Join(root, "faustlib"), 0755)
+	os.WriteFile(filepath.Join(root, "faustlib", "stdfaust.lib"), []byte("os = library(\"oscillators.lib\");\n"), 0644)
+	os.WriteFile(filepath.Join(root, "faustlib", "oscillators.lib"), []byte("osc(f) = f;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"library_path": "faustlib"}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := stdlib.Current()
+	stdlib.Set(&stdlib.Bundle{Docs: map[string]stdlib.Doc{"os.osc": {Library: "oscillators.lib", Full: "Sine oscillator."}}})
+	t.Cleanup(func() { stdlib.Set(previous) })
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	fixes := func(pos transport.Position) map[string]string {
+		fixed := map[string]string{}
+		for _, action := range codeActionsAt(t, s, uri, pos) {
+			if action.Kind == transport.QuickFix {
+				fixed[action.Title] = applyEdits(t, content, action.Edit.Changes[uri])
+			}
+		}
+		return fixed
+	}
+
+	tests := []struct {
+		name     string
+		position transport.Position
+		want     map[string]string
+	}{
+		{"Typo", transport.Position{Line: 2, Character: 11}, map[string]string{
+			"Change to gain": "gain = 0.5;\nunused = 1;\nprocess = gain + os.osc(440) + double(gain);\n",
+		}},
+		{"Standard library", transport.Position{Line: 2, Character: 21}, map[string]string{
+			"Import stdfaust.lib":        "import(\"stdfaust.lib\");\ngain = 0.5;\nunused = 1;\nprocess = gian + os.osc(440) + double(gain);\n",
+			"Bind os to oscillators.lib": "os = library(\"oscillators.lib\");\ngain = 0.5;\nunused = 1;\nprocess = gian + os.osc(440) + double(gain);\n",
+		}},
+		{"Library of the folder", transport.Position{Line: 2, Character: 31}, map[string]string{
+			"Import utils.lib": "import(\"utils.lib\");\ngain = 0.5;\nunused = 1;\nprocess = gian + os.osc(440) + double(gain);\n",
+		}},
+		{"Unused definition", transport.Position{Line: 1, Character: 0}, map[string]string{
+			"Remove unused definition unused": "gain = 0.5;\nprocess = gian + os.osc(440) + double(gain);\n",
+		}},
+		{"Used definition", transport.Position{Line: 0, Character: 0}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fixes(tt.position); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("quick fixes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Clients asking for refactorings only don't get quick fixes
+	params, _ := json.Marshal(transport.CodeActionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Range:        transport.Range{Start: transport.Position{Line: 2, Character: 11}, End: transport.Position{Line: 2, Character: 11}},
+		Context:      transport.CodeActionContext{Only: []transport.CodeActionKind{transport.Refactor}},
+	})
+	result, err := server.CodeActions(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []transport.CodeAction
+	json.Unmarshal(result, &actions)
+	for _, action := range actions {
+		if action.Kind == transport.QuickFix {
+			t.Errorf("quick fix %q offered for refactorings only", action.Title)
+		}
+	}
+}
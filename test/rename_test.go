@@ -0,0 +1,31 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestRenameFile(t *testing.T) {
+	logging.Init()
+	var files server.Files
+	files.Init(context.Background(), transport.UTF16)
+	files.AddFromURI(util.Path2URI("/ws/old.dsp"), []byte("process = _;"))
+
+	files.Rename("/ws/old.dsp", "/ws/new.dsp")
+
+	if _, ok := files.GetFromPath("/ws/old.dsp"); ok {
+		t.Errorf("old path is still in the store")
+	}
+	f, ok := files.GetFromPath("/ws/new.dsp")
+	if !ok {
+		t.Fatalf("new path isn't in the store")
+	}
+	if f.Handle.Path != "/ws/new.dsp" || string(f.Content) != "process = _;" {
+		t.Errorf("renamed file = %s with %q", f.Handle.Path, f.Content)
+	}
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+// Starts a server on a workspace with the given config, whose compiler rejects main.dsp. Returns the workspace root
+// and the path main.dsp was compiled from, once the compiler diagnostics are published for main.dsp itself.
+func compiledPath(t *testing.T, config string) (string, string) {
+	root := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\necho \"$1\" >> " + calls + "\n[ -e \"$(dirname \"$1\")/replica\" ] && echo nested >> " + calls + "\necho \"$1 : 1 : ERROR : rejected\" >&2\nexit 1\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	readUntil(t, tr, "compiler diagnostics", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri &&
+			len(params.Diagnostics) == 1 && params.Diagnostics[0].Source == "faust"
+	})
+
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("compiler not called: %v", err)
+	}
+	if strings.Contains(string(content), "nested") {
+		t.Errorf("replica directory replicated in itself")
+	}
+	return root, strings.Fields(string(content))[0]
+}
+
+func TestReplicaDir(t *testing.T) {
+	logging.Init()
+	root, compiled := compiledPath(t, `{"command": "./fakefaust", "process_files": ["main.dsp"], "replica_dir": "replica"}`)
+	replica := filepath.Join(root, "replica")
+	if !strings.HasPrefix(compiled, replica+string(filepath.Separator)) || !strings.HasSuffix(compiled, filepath.Join(root, "main.dsp")) {
+		t.Errorf("compiled %s, want the copy of main.dsp in %s", compiled, replica)
+	}
+	// The replica is removed on exit
+	if entries, _ := os.ReadDir(replica); len(entries) != 0 {
+		t.Errorf("replica left in %s after exit", replica)
+	}
+}
+
+func TestReplicationDisabled(t *testing.T) {
+	logging.Init()
+	root, compiled := compiledPath(t, `{"command": "./fakefaust", "process_files": ["main.dsp"], "replicate": false}`)
+	// Files are compiled from disk, and the diagnostics of the compiler are still resolved to them
+	if want := filepath.Join(root, "main.dsp"); compiled != want {
+		t.Errorf("compiled %s, want %s", compiled, want)
+	}
+}
+
+func TestCompilerWorkingDirectory(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	// Leaves an artifact in its working directory, like the compiler does with some flags
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\npwd >> " + calls + "\ntouch artifact.cpp\necho \"$1 : 1 : ERROR : rejected\" >&2\nexit 1\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"command": "./fakefaust", "process_files": ["main.dsp"]}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := util.Path2URI(filepath.Join(root, "main.dsp"))
+	readUntil(t, tr, "compiler diagnostics", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		return m.Method == "textDocument/publishDiagnostics" && string(params.URI) == uri &&
+			len(params.Diagnostics) == 1 && params.Diagnostics[0].Source == "faust"
+	})
+
+	content, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("compiler not called: %v", err)
+	}
+	workDir := strings.Fields(string(content))[0]
+	if isInsideDir(root, workDir) {
+		t.Errorf("compiler ran in %s, inside the workspace", workDir)
+	}
+	if _, err := os.Stat(filepath.Join(root, "artifact.cpp")); err == nil {
+		t.Errorf("compiler artifact written to the workspace")
+	}
+	// The working directory is removed once the run is over
+	for start := time.Now(); util.IsValidPath(workDir); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("working directory %s left after the run", workDir)
+		}
+	}
+}
+
+func isInsideDir(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
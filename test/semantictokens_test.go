@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestSemanticTokens(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	lines := []string{
+		`ma = library("maths.lib");`,
+		`gain = 0.5;`,
+		`f(x) = x * gain + ma.PI;`,
+		`process = f(1) + os.osc(440);`,
+	}
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	os.Mkdir(filepath.Join(root, "faustlib"), 0755)
+	os.WriteFile(filepath.Join(root, "faustlib", "maths.lib"), []byte("PI = 3.14;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"library_path": "faustlib"}`), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Standard library names are known from the documentation bundle without faustlibraries
+	previous := stdlib.Current()
+	stdlib.Set(&stdlib.Bundle{Docs: map[string]stdlib.Doc{"os.osc": {Library: "oscillators.lib", Full: "Sine oscillator."}}})
+	t.Cleanup(func() { stdlib.Set(previous) })
+
+	params, _ := json.Marshal(transport.SemanticTokensParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))},
+	})
+	result, err := server.SemanticTokens(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens transport.SemanticTokens
+	if err := json.Unmarshal(result, &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoded to absolute positions, with the names of types and modifiers
+	legend := []string{"namespace", "function", "variable", "parameter"}
+	modifiers := []string{"declaration", "readonly", "defaultLibrary"}
+	got := []string{}
+	var line, character uint32
+	for i := 0; i+4 < len(tokens.Data); i += 5 {
+		if tokens.Data[i] > 0 {
+			character = 0
+		}
+		line += tokens.Data[i]
+		character += tokens.Data[i+1]
+		token := lines[line][character:character+tokens.Data[i+2]] + " " + legend[tokens.Data[i+3]]
+		for bit, modifier := range modifiers {
+			if tokens.Data[i+4]&(1<<bit) != 0 {
+				token += " " + modifier
+			}
+		}
+		got = append(got, token)
+	}
+
+	want := []string{
+		"ma namespace declaration defaultLibrary",
+		"gain variable declaration readonly",
+		"f function declaration",
+		"x parameter declaration",
+		"x parameter",
+		"gain variable readonly",
+		"ma namespace defaultLibrary",
+		"PI variable readonly defaultLibrary",
+		"process variable declaration",
+		"f function",
+		"os namespace defaultLibrary",
+		"osc function defaultLibrary",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tokens = %q, want %q", got, want)
+	}
+}
+
+func TestSemanticTokensRangeAndDelta(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("gain = 0.5;\nf(x) = x * gain;\nprocess = f(1);\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.Workspace.Root, "main.dsp")
+	doc := transport.TextDocumentIdentifier{URI: transport.DocumentURI(util.Path2URI(path))}
+	request := func(handler func(context.Context, *server.Server, json.RawMessage) (json.RawMessage, error), params any, result any) {
+		t.Helper()
+		par, _ := json.Marshal(params)
+		raw, err := handler(context.Background(), s, par)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var full transport.SemanticTokens
+	request(server.SemanticTokens, transport.SemanticTokensParams{TextDocument: doc}, &full)
+	if full.ResultID == "" {
+		t.Fatal("full tokens have no result id")
+	}
+
+	// Only the tokens of line 2, relative to the start of the document
+	var inRange transport.SemanticTokens
+	request(server.SemanticTokensRange, transport.SemanticTokensRangeParams{TextDocument: doc, Range: transport.Range{
+		Start: transport.Position{Line: 2, Character: 0},
+		End:   transport.Position{Line: 3, Character: 0},
+	}}, &inRange)
+	if want := []uint32{2, 0, 7, 2, 1, 0, 10, 1, 1, 0}; !reflect.DeepEqual(inRange.Data, want) {
+		t.Errorf("tokens in range = %v, want %v", inRange.Data, want)
+	}
+
+	// Nothing changed
+	var delta transport.SemanticTokensDelta
+	request(server.SemanticTokensDelta, transport.SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: full.ResultID}, &delta)
+	if len(delta.Edits) != 0 || delta.ResultID != full.ResultID {
+		t.Errorf("delta without changes = %+v, want no edits and result %s", delta, full.ResultID)
+	}
+
+	// The edits transform the previous tokens into the tokens of the new content
+	s.Files.ModifyFull(path, "gain = 0.5;\nf(x) = x * gain * gain;\nprocess = f(1);\n")
+	request(server.SemanticTokensDelta, transport.SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: full.ResultID}, &delta)
+	if len(delta.Edits) != 1 || delta.ResultID == full.ResultID {
+		t.Fatalf("delta after an edit = %+v, want one edit and a new result", delta)
+	}
+	edit := delta.Edits[0]
+	patched := append(append(slices.Clone(full.Data[:edit.Start]), edit.Data...), full.Data[edit.Start+edit.DeleteCount:]...)
+	var updated transport.SemanticTokens
+	request(server.SemanticTokens, transport.SemanticTokensParams{TextDocument: doc}, &updated)
+	if !reflect.DeepEqual(patched, updated.Data) {
+		t.Errorf("tokens patched by delta = %v, want %v", patched, updated.Data)
+	}
+
+	// A result the client doesn't have anymore gets the whole tokens
+	var stale transport.SemanticTokens
+	request(server.SemanticTokensDelta, transport.SemanticTokensDeltaParams{TextDocument: doc, PreviousResultID: full.ResultID}, &stale)
+	if !reflect.DeepEqual(stale.Data, updated.Data) {
+		t.Errorf("delta from a stale result = %v, want the whole tokens %v", stale.Data, updated.Data)
+	}
+}
@@ -0,0 +1,46 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestSeverityMapping(t *testing.T) {
+	w := server.Workspace{
+		Root: "/ws",
+		Folders: []*server.Folder{
+			{Root: "/ws", Config: server.FaustProjectConfig{Severity: map[string]server.SeverityLevel{
+				"faust":               "error",
+				"compiler-timeout":    "hint",
+				"tree-sitter":         "warning",
+				"tree-sitter/missing": "off",
+			}}},
+		},
+	}
+	params := transport.PublishDiagnosticsParams{
+		URI: transport.DocumentURI(util.Path2URI("/ws/main.dsp")),
+		Diagnostics: []transport.Diagnostic{
+			{Source: "faust", Code: "compile-error", Severity: transport.SeverityWarning, Message: "compile"},
+			{Source: "faustlsp", Code: "compiler-timeout", Severity: transport.SeverityWarning, Message: "timeout"},
+			{Source: "tree-sitter", Code: "syntax-error", Severity: transport.SeverityError, Message: "syntax"},
+			{Source: "tree-sitter", Code: "missing", Severity: transport.SeverityError, Message: "missing"},
+		},
+	}
+	got := w.RemapSeverities(params).Diagnostics
+	want := map[string]transport.DiagnosticSeverity{
+		"compile": transport.SeverityError,
+		"timeout": transport.SeverityHint,
+		"syntax":  transport.SeverityWarning,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d", len(got), len(want))
+	}
+	for _, d := range got {
+		if d.Severity != want[d.Message] {
+			t.Errorf("severity of %q = %v, want %v", d.Message, d.Severity, want[d.Message])
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/stdlib"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestStdlibDocs(t *testing.T) {
+	logging.Init()
+	libs := t.TempDir()
+	os.WriteFile(filepath.Join(libs, "stdfaust.lib"), []byte("os = library(\"oscillators.lib\");\nfi = library(\"filters.lib\");\n"), 0644)
+	os.WriteFile(filepath.Join(libs, "oscillators.lib"), []byte("//---`(os.)osc`---\n// Sine oscillator.\n//---\nosc(freq) = sin(freq);\nundocumented = 1;\n"), 0644)
+	os.WriteFile(filepath.Join(libs, "filters.lib"), []byte("// Lowpass filter.\nlowpass(N, fc) = _;\n"), 0644)
+
+	bundle, err := server.GenerateDocsBundle(libs, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, ok := bundle.Lookup("os.osc"); !ok || !strings.Contains(doc.Full, "Sine oscillator.") || doc.Library != "oscillators.lib" {
+		t.Errorf("os.osc = %+v, %v", doc, ok)
+	}
+	if _, ok := bundle.Lookup("os.undocumented"); ok {
+		t.Errorf("undocumented definition in the bundle")
+	}
+	if members := bundle.Members("fi"); len(members) != 1 || members[0] != "lowpass" {
+		t.Errorf("members of fi = %v, want [lowpass]", members)
+	}
+
+	// stdfaust.lib can't be found in an empty library path, like when faust isn't installed
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"library_path": "nolibs"}`), 0644)
+	os.MkdirAll(filepath.Join(root, "nolibs"), 0755)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"stdfaust.lib\");\nprocess = os.osc(440);\ng = os.\n"), 0644)
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	// The bundle in use is chosen when the config is loaded
+	previous := stdlib.Current()
+	stdlib.Set(bundle)
+	t.Cleanup(func() { stdlib.Set(previous) })
+
+	params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 1, Character: 14},
+	}})
+	result, err := server.Hover(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hover struct {
+		Contents transport.MarkupContent `json:"contents"`
+	}
+	json.Unmarshal(result, &hover)
+	if !strings.Contains(hover.Contents.Value, "Sine oscillator.") {
+		t.Errorf("hover = %q, want the bundled documentation", hover.Contents.Value)
+	}
+
+	params, _ = json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 2, Character: 7},
+	}})
+	result, err = server.Completion(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []transport.CompletionItem
+	json.Unmarshal(result, &items)
+	if len(items) != 1 || items[0].Label != "osc" || items[0].Documentation == nil {
+		t.Errorf("completions of os. = %+v, want documented osc", items)
+	}
+}
+
+func TestUpdateDocs(t *testing.T) {
+	logging.Init()
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	previous := stdlib.Current()
+	t.Cleanup(func() { stdlib.Set(previous) })
+
+	// Serves faustlibraries archives laid out like GitHub's, recording the versions requested
+	libraries := map[string]string{
+		"stdfaust.lib":    "os = library(\"oscillators.lib\");\n",
+		"oscillators.lib": "// Sine oscillator.\nosc(freq) = sin(freq);\n",
+		"docs/extra.lib":  "// Not a library of stdfaust.lib.\nextra = 1;\n",
+	}
+	requested := []string{}
+	archives := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := strings.TrimPrefix(r.URL.Path, "/")
+		requested = append(requested, version)
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: "faustlibraries-" + version + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		for name, content := range libraries {
+			tw.WriteHeader(&tar.Header{Name: "faustlibraries-" + version + "/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+		gz.Close()
+		w.Write(buf.Bytes())
+	}))
+	defer archives.Close()
+
+	root := t.TempDir()
+	config := `{"docs_version": "2.0", "docs_source": "` + archives.URL + `/{version}"}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := server.UpdateDocsCommand(context.Background(), s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := result.(server.UpdateDocsResult)
+	if update.Version != "2.0" || update.Functions != 1 || len(requested) != 1 || requested[0] != "2.0" {
+		t.Errorf("update = %+v, requested %v, want the pinned version 2.0 with 1 function", update, requested)
+	}
+	if _, err := os.Stat(update.Path); err != nil || !strings.HasPrefix(update.Path, cache) {
+		t.Errorf("bundle not cached in %s: %s, %v", cache, update.Path, err)
+	}
+	if doc, ok := stdlib.Current().Lookup("os.osc"); !ok || !strings.Contains(doc.Full, "Sine oscillator.") {
+		t.Errorf("os.osc not documented by the downloaded bundle")
+	}
+
+	// A newer download of another version isn't used while 2.0 is pinned
+	arg, _ := json.Marshal("master")
+	libraries["oscillators.lib"] = "// Newer sine oscillator.\nosc(freq) = sin(freq);\n"
+	if _, err := server.UpdateDocsCommand(context.Background(), s, []json.RawMessage{arg}); err != nil {
+		t.Fatal(err)
+	}
+	if version := stdlib.Current().Version; version != "2.0" {
+		t.Errorf("bundle version = %s, want the pinned 2.0", version)
+	}
+
+	// Without a pin, the freshest bundle is used
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{}`), 0644)
+	if _, err := server.IndexWorkspace(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	if version := stdlib.Current().Version; version != "master" {
+		t.Errorf("bundle version = %s, want the freshest master", version)
+	}
+
+	// A library decompressing to more than the limit is rejected, whatever the size of the archive
+	arg, _ = json.Marshal("huge")
+	libraries["huge.lib"] = strings.Repeat("/", 16<<20+1)
+	if _, err := server.UpdateDocsCommand(context.Background(), s, []json.RawMessage{arg}); err == nil || !strings.Contains(err.Error(), "huge.lib") {
+		t.Errorf("updating to an archive with a huge library = %v, want an error", err)
+	}
+	if version := stdlib.Current().Version; version != "master" {
+		t.Errorf("bundle version = %s, want master kept", version)
+	}
+}
+
+func TestDocumentationSections(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	library := "//-------------------`(dm.)osc`----------------------\n" +
+		"// Sine oscillator.\n" +
+		"//\n" +
+		"// #### Usage\n" +
+		"//\n" +
+		"// ```\n" +
+		"// osc(freq) : _\n" +
+		"// ```\n" +
+		"//\n" +
+		"// Where:\n" +
+		"//\n" +
+		"// * `freq`: frequency in Hz\n" +
+		"//\n" +
+		"// #### Example test program\n" +
+		"//\n" +
+		"// ```\n" +
+		"// process = osc(440);\n" +
+		"// ```\n" +
+		"//\n" +
+		"// #### Reference\n" +
+		"//\n" +
+		"// * <https://faustlibraries.grame.fr>\n" +
+		"//------------------------------------------------------------\n" +
+		"osc(freq) = freq : sin;\n"
+	os.WriteFile(filepath.Join(root, "demo.lib"), []byte(library), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("import(\"demo.lib\");\nprocess = osc(440);\ng = os\n"), 0644)
+
+	s, err := server.IndexWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(s.Workspace.Root, "main.dsp")))
+	params, _ := json.Marshal(transport.HoverParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 1, Character: 11},
+	}})
+	result, err := server.Hover(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hover struct {
+		Contents transport.MarkupContent `json:"contents"`
+	}
+	json.Unmarshal(result, &hover)
+	want := "Sine oscillator.\n\n" +
+		"#### Usage\n\n```faust\nosc(freq) : _\n```\n\n" +
+		"#### Where\n\n* `freq`: frequency in Hz\n\n" +
+		"#### Example test program\n\n```faust\nprocess = osc(440);\n```\n\n" +
+		"#### Reference\n\n* <https://faustlibraries.grame.fr>\n\n" +
+		"```faust\nosc(freq) = freq : sin;\n```\n\n" +
+		"`osc` is defined on line 24 of demo.lib"
+	if hover.Contents.Value != want {
+		t.Errorf("hover = %q, want %q", hover.Contents.Value, want)
+	}
+
+	params, _ = json.Marshal(transport.CompletionParams{TextDocumentPositionParams: transport.TextDocumentPositionParams{
+		TextDocument: transport.TextDocumentIdentifier{URI: uri},
+		Position:     transport.Position{Line: 2, Character: 6},
+	}})
+	result, err = server.Completion(context.Background(), s, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []transport.CompletionItem
+	json.Unmarshal(result, &items)
+	found := false
+	for _, item := range items {
+		if item.Label == "osc" {
+			found = true
+			if item.Detail != "osc(freq) : _" {
+				t.Errorf("detail of osc = %q, want its usage", item.Detail)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("osc not completed in %+v", items)
+	}
+}
@@ -1,14 +1,20 @@
 package tests
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"github.com/carn181/faustlsp/transport"
 	"fmt"
+	"io"
 	"testing"
+	"time"
 )
 
 func TestSocket(test *testing.T) {
-	expectedMsg := []byte("Content-Length: 4\r\n\r\nHey!")
+	// Read returns the content without the header
+	expectedMsg := []byte("Hey!")
 	client := func() {
 		var t transport.Transport
 		t.Init(transport.Client, transport.Socket)
@@ -41,7 +47,44 @@ func TestSocket(test *testing.T) {
 		t.Close()
 	}
 
-	go func() { server() }()
+	done := make(chan struct{})
+	go func() { defer close(done); server() }()
 	client()
+	<-done
 
 }
+
+func TestReadContextCancel(test *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	scanner := bufio.NewScanner(r)
+	// Messages are delimited by | in this test
+	scanner.Split(func(data []byte, _ bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, '|'); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	})
+	t := transport.Transport{Scanner: scanner}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := t.ReadContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		test.Fatalf("ReadContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > time.Second {
+		test.Fatalf("ReadContext() took %v to return after cancellation", time.Since(start))
+	}
+
+	// Messages arriving after a cancelled read are still delivered
+	go w.Write([]byte("Content-Length: 4\r\n\r\nHey!|"))
+	msg, err := t.Read()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(msg) != "Hey!" {
+		test.Errorf("Read() = %q, want %q", msg, "Hey!")
+	}
+}
@@ -48,3 +48,84 @@ func TestIsWindowsPath(t *testing.T) {
 		fmt.Printf(" Is Windows: %t\n", util.IsWindowsDrivePath(path))
 	}
 }
+
+func TestUntitledURI(t *testing.T) {
+	uri := "untitled:Untitled-1"
+	path, err := util.URI2path(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !util.IsMemoryPath(path) {
+		t.Fatalf("%s is not a memory path", path)
+	}
+	if got := util.Path2URI(path); got != uri {
+		t.Fatalf("Path2URI(%s) = %s, want %s", path, got, uri)
+	}
+	// Lookups by path and by URI must find the same document
+	if util.FromPath(path) != (util.Handle{URI: uri, Path: path}) {
+		t.Fatalf("FromPath(%s) = %v", path, util.FromPath(path))
+	}
+	if util.IsMemoryPath("/home/user/untitled:a.dsp") {
+		t.Fatalf("file path is a memory path")
+	}
+}
+
+func TestUnsupportedSchemes(t *testing.T) {
+	tests := []struct {
+		uri       string
+		memory    bool
+		supported bool
+	}{
+		{"file:///home/user/a.dsp", false, true},
+		{"untitled:Untitled-1", true, true},
+		{"vscode-remote://ssh-remote+host/home/user/a.dsp", true, false},
+		{"jar:file:///libs/faust.jar!/a.lib", true, false},
+	}
+	for _, tt := range tests {
+		path, err := util.URI2path(tt.uri)
+		if err != nil {
+			t.Fatalf("URI2path(%s): %v", tt.uri, err)
+		}
+		if got := util.IsMemoryPath(path); got != tt.memory {
+			t.Errorf("IsMemoryPath(%s) = %v, want %v", path, got, tt.memory)
+		}
+		if got := util.SupportedScheme(util.URIScheme(tt.uri)); got != tt.supported {
+			t.Errorf("SupportedScheme(%s) = %v, want %v", util.URIScheme(tt.uri), got, tt.supported)
+		}
+		if tt.memory && util.Path2URI(path) != tt.uri {
+			t.Errorf("Path2URI(%s) = %s, want %s", path, util.Path2URI(path), tt.uri)
+		}
+	}
+	if util.IsMemoryPath(`C:\Users\a.dsp`) {
+		t.Errorf("Windows path is a memory path")
+	}
+}
+
+func TestNormalizedHandles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix paths")
+	}
+	tests := []struct {
+		uri  string
+		path string
+	}{
+		{"file:///home/user/my%20project/a.dsp", "/home/user/my project/a.dsp"},
+		{"file:///home/user/dir/", "/home/user/dir"},
+		{"file:///home/user/./lib/../a%23b.dsp", "/home/user/a#b.dsp"},
+	}
+	for _, tt := range tests {
+		fromURI, err := util.FromURI(tt.uri)
+		if err != nil {
+			t.Fatalf("FromURI(%s): %v", tt.uri, err)
+		}
+		if fromURI != util.FromPath(tt.path) {
+			t.Errorf("FromURI(%s) = %v, FromPath(%s) = %v", tt.uri, fromURI, tt.path, util.FromPath(tt.path))
+		}
+		if path, _ := util.URI2path(util.Path2URI(tt.path)); path != tt.path {
+			t.Errorf("URI2path(Path2URI(%s)) = %s", tt.path, path)
+		}
+	}
+	if path := util.NormalizePath(`c:\Users\a.dsp`); path[0] != 'C' {
+		t.Errorf("drive letter of %s isn't upper case", path)
+	}
+}
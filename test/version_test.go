@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carn181/faustlsp/logging"
+	"github.com/carn181/faustlsp/server"
+	"github.com/carn181/faustlsp/transport"
+	"github.com/carn181/faustlsp/util"
+)
+
+func TestDocumentVersions(t *testing.T) {
+	logging.Init()
+	var files server.Files
+	files.Init(context.Background(), transport.UTF16)
+	path := "/ws/main.dsp"
+	files.AddFromURI(util.Path2URI(path), []byte("process = _;"))
+
+	tests := []struct {
+		version int32
+		want    bool
+	}{
+		{1, true},
+		{2, true},
+		// Duplicate
+		{2, false},
+		// Out of order
+		{1, false},
+		{5, true},
+	}
+	for _, tt := range tests {
+		if got := files.UpdateVersion(path, tt.version); got != tt.want {
+			t.Errorf("UpdateVersion(%d) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+
+	// Closing the file resets its version, so the next open can start over
+	files.CloseFromPath(path)
+	if !files.UpdateVersion(path, 1) {
+		t.Errorf("UpdateVersion(1) after close = false, want true")
+	}
+}
+
+func TestDiagnosticsVersion(t *testing.T) {
+	logging.Init()
+	var files server.Files
+	files.Init(context.Background(), transport.UTF16)
+	path := "/ws/main.dsp"
+	files.AddFromURI(util.Path2URI(path), []byte("process = ;"))
+	files.UpdateVersion(path, 7)
+
+	params := files.TSDiagnostics(path)
+	if params.Version != 7 {
+		t.Errorf("diagnostics version = %d, want 7", params.Version)
+	}
+	if len(params.Diagnostics) == 0 {
+		t.Errorf("no diagnostics for %q", "process = ;")
+	}
+}
+
+func TestOutdatedDiagnosticsDropped(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	// Reads the file when it starts, then takes a while to reject it with its content
+	fakeFaust := "#!/bin/sh\n[ \"$1\" = -dspdir ] && exit 0\ncontent=$(cat \"$1\")\necho start >> " + calls + "\nsleep 1\necho \"$1 : 1 : ERROR : $content\" >&2\nexit 1\n"
+	os.WriteFile(filepath.Join(root, "fakefaust"), []byte(fakeFaust), 0755)
+	config := `{"command": "./fakefaust", "process_files": ["main.dsp"], "diagnostics": {"compiler": {"mode": "on-save"}}}`
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(config), 0644)
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: uri, LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+	for start := time.Now(); !util.IsValidPath(calls); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("compiler didn't start")
+		}
+	}
+	// Edited while the first version is compiled
+	change, _ := json.Marshal(transport.DidChangeTextDocumentParams{
+		TextDocument: transport.VersionedTextDocumentIdentifier{TextDocumentIdentifier: transport.TextDocumentIdentifier{URI: uri}, Version: 2},
+		ContentChanges: []transport.TextDocumentContentChangeEvent{{
+			Range: &transport.Range{Start: transport.Position{Line: 0, Character: 11}, End: transport.Position{Line: 0, Character: 11}},
+			Text:  ",_",
+		}},
+	})
+	tr.WriteNotif("textDocument/didChange", change)
+	readUntil(t, tr, "diagnostics of version 2", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		return m.Method == "textDocument/publishDiagnostics" && params.URI == uri && params.Version == 2
+	})
+	params, _ := json.Marshal(server.DiagnoseParams{URI: uri})
+	tr.WriteRequest(3, "faustlsp/diagnose", params)
+
+	// The compiler diagnostics of the first version aren't published as the ones of the second
+	readUntil(t, tr, "compiler diagnostics", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		if m.Method != "textDocument/publishDiagnostics" || params.URI != uri || len(params.Diagnostics) == 0 || params.Diagnostics[0].Source != "faust" {
+			return false
+		}
+		if !strings.Contains(params.Diagnostics[0].Message, "process = _,_;") || params.Version != 2 {
+			t.Errorf("version %d published with the compiler diagnostic %q", params.Version, params.Diagnostics[0].Message)
+		}
+		return true
+	})
+}
+
+func TestChangesApplied(t *testing.T) {
+	logging.Init()
+	var files server.Files
+	files.Init(context.Background(), transport.UTF16)
+	path := "/ws/main.dsp"
+	files.AddFromURI(util.Path2URI(path), []byte("process = _;"))
+
+	// Changes without a range replace the content, the following ones edit the replacement
+	files.ApplyChanges(path, 1, []transport.TextDocumentContentChangeEvent{
+		{Text: "process = 1;"},
+		{Range: &transport.Range{Start: transport.Position{Character: 11}, End: transport.Position{Character: 11}}, Text: ",2"},
+	})
+	// Stale
+	if files.ApplyChanges(path, 1, []transport.TextDocumentContentChangeEvent{{Text: "process = 3;"}}) {
+		t.Errorf("ApplyChanges of a stale version = true, want false")
+	}
+	f, _ := files.GetFromPath(path)
+	if got := string(f.Content); got != "process = 1,2;" {
+		t.Errorf("content %q, want %q", got, "process = 1,2;")
+	}
+}
+
+func TestPipelinedChanges(t *testing.T) {
+	logging.Init()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "main.dsp"), []byte("process = _;\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".faustcfg.json"), []byte(`{"compiler_diagnostics": false}`), 0644)
+
+	tr, stop := startTestServer(t, root)
+	defer stop()
+	uri := transport.DocumentURI(util.Path2URI(filepath.Join(root, "main.dsp")))
+	open, _ := json.Marshal(transport.DidOpenTextDocumentParams{TextDocument: transport.TextDocumentItem{URI: uri, LanguageID: "faust", Version: 1, Text: "process = _;\n"}})
+	tr.WriteNotif("textDocument/didOpen", open)
+
+	// Each change inserts before the semicolon the previous ones moved, so a change that is lost or applied out of
+	// order leaves a syntax error
+	const last = 30
+	for version := int32(2); version <= last; version++ {
+		at := transport.Position{Character: 11 + 4*uint32(version-2)}
+		change, _ := json.Marshal(transport.DidChangeTextDocumentParams{
+			TextDocument:   transport.VersionedTextDocumentIdentifier{TextDocumentIdentifier: transport.TextDocumentIdentifier{URI: uri}, Version: version},
+			ContentChanges: []transport.TextDocumentContentChangeEvent{{Range: &transport.Range{Start: at, End: at}, Text: " : _"}},
+		})
+		tr.WriteNotif("textDocument/didChange", change)
+	}
+	readUntil(t, tr, "diagnostics of the last version", func(msg []byte) bool {
+		var m transport.NotificationMessage
+		json.Unmarshal(msg, &m)
+		var params transport.PublishDiagnosticsParams
+		json.Unmarshal(m.Params, &params)
+		if m.Method != "textDocument/publishDiagnostics" || params.URI != uri || params.Version != last {
+			return false
+		}
+		if len(params.Diagnostics) != 0 {
+			t.Errorf("changes lost or applied out of order: %s", params.Diagnostics[0].Message)
+		}
+		return true
+	})
+}
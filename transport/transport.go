@@ -3,12 +3,16 @@ package transport
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/carn181/faustlsp/logging"
 )
@@ -33,13 +37,47 @@ type Transport struct {
 	Type    TransportType   // client or server
 	Method  TransportMethod // type of stream
 	Scanner *bufio.Scanner  // reader (scanner)
-	conn    net.Conn        // connection to close for client
+	conn    net.Conn        // connection to close
 	ln      net.Listener    // listener to close for server
 	Writer  io.Writer       // writer
 	Closed  bool
+	writeMu sync.Mutex // messages can be written from multiple goroutines
+
+	// Messages scanned in the background, so that reads can be cancelled
+	messages chan readResult
+	readOnce sync.Once
+
+	// State of split, which only runs in the scanning goroutine:
+	// why the message just scanned was rejected
+	invalid error
+	// bytes of an oversized message that are still to be skipped
+	discard int
+	// looking for the next header after a broken one
+	resync bool
+}
+
+// One message (or the error that ended scanning) read by the background reader
+type readResult struct {
+	msg    []byte
+	err    error
+	closed bool
 }
 
-func (t *Transport) Init(ttype TransportType, method TransportMethod) {
+// Number of times a client retries connecting to the server socket
+const dialAttempts = 20
+
+const (
+	// Largest message content that is read, bigger messages are skipped
+	maxMessageSize = 1024 * 1024 * 10 // 10 MB
+	// Largest header that is read, a longer one is treated as broken
+	maxHeaderSize = 4096
+)
+
+// ErrInvalidMessage is returned by reads for a message that was skipped because
+// its header is broken or it is too big. Reading can continue with the next message.
+var ErrInvalidMessage = errors.New("invalid message")
+
+func (t *Transport) Init(ttype TransportType, method TransportMethod) error {
 	t.Method = method
 	t.Type = ttype
 	var r io.Reader
@@ -61,54 +99,99 @@ func (t *Transport) Init(ttype TransportType, method TransportMethod) {
 			t.ln, err = net.Listen("tcp", ":5007")
 			if err != nil {
 				logging.Logger.Error("Connection error", "error", err)
+				return fmt.Errorf("couldn't listen on port 5007: %w", err)
 			}
 			conn, err = t.ln.Accept()
 			if err != nil {
 				logging.Logger.Error("Connection error", "error", err)
+				t.ln.Close()
+				return fmt.Errorf("couldn't accept connection: %w", err)
 			}
-		case Client:
-			var err error
-			conn, err = net.Dial("tcp", "localhost:5007")
 			t.conn = conn
+		case Client:
+			// The server might not be listening yet
+			for attempt := 1; ; attempt++ {
+				conn, err = net.Dial("tcp", "localhost:5007")
+				if err == nil || attempt == dialAttempts {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
 			if err != nil {
 				logging.Logger.Error("Connection error", "error", err)
+				return fmt.Errorf("couldn't connect to port 5007: %w", err)
 			}
+			t.conn = conn
 		}
 		r = conn
 		t.Writer = conn
 	}
 
 	// TODO: Find dynamic buffer for handling large files
-	const maxBufferSize = 1024 * 1024 * 10 // 10 MB
-	buf := make([]byte, maxBufferSize)
+	const maxBufferSize = maxHeaderSize + 4 + maxMessageSize
 	scanner := bufio.NewScanner(r)
-	scanner.Buffer(buf, maxBufferSize)
-	scanner.Split(split)
+	scanner.Buffer(make([]byte, 64*1024), maxBufferSize)
+	scanner.Split(t.split)
 	t.Scanner = scanner
+	return nil
 }
 
 // Reads one JSON RPC message from the stream
 func (t *Transport) Read() ([]byte, error) {
-	hasError := !t.Scanner.Scan()
-	if hasError {
-		if t.Scanner.Err() == nil {
+	return t.ReadContext(context.Background())
+}
+
+// Reads one JSON RPC message from the stream, or returns ctx.Err() as soon as ctx is cancelled.
+// Scanning happens in a background goroutine, as a blocked Scan can't be interrupted.
+// A message that arrives after cancellation is returned by the next read.
+func (t *Transport) ReadContext(ctx context.Context) ([]byte, error) {
+	t.readOnce.Do(func() {
+		t.messages = make(chan readResult)
+		go t.scan()
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result, ok := <-t.messages:
+		if !ok {
 			t.Closed = true
+			return nil, nil
 		}
+		if result.closed {
+			t.Closed = true
+		}
+		return result.msg, result.err
 	}
+}
 
-	rawMessage := t.Scanner.Bytes()
-	err := t.Scanner.Err()
-	if err != nil {
-		return rawMessage, err
-	}
+// Scans messages into t.messages until the stream ends
+func (t *Transport) scan() {
+	defer close(t.messages)
+	for {
+		ok := t.Scanner.Scan()
+		err := t.Scanner.Err()
+		if !ok {
+			t.messages <- readResult{msg: t.Scanner.Bytes(), err: err, closed: err == nil}
+			return
+		}
+		if t.invalid != nil {
+			t.messages <- readResult{err: t.invalid}
+			t.invalid = nil
+			continue
+		}
 
-	_, content, _ := bytes.Cut(rawMessage, []byte{'\r', '\n', '\r', '\n'})
-	return content, nil
+		// The scanner reuses its buffer for the next message
+		_, content, _ := bytes.Cut(t.Scanner.Bytes(), []byte{'\r', '\n', '\r', '\n'})
+		t.messages <- readResult{msg: bytes.Clone(content)}
+	}
 }
 
 // Writes JSON RPC message
 func (t *Transport) Write(msg []byte) error {
 	header := []byte("Content-Length: " + strconv.Itoa(len(msg)) + "\r\n\r\n")
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
 	_, err := t.Writer.Write(append(header, msg...))
 	return err
 }
@@ -167,29 +250,60 @@ func (t *Transport) WriteResponse(id any, response json.RawMessage, responseErro
 
 func (t *Transport) Close() {
 	if t.Method == Socket {
-		if t.Type == Client {
+		if t.conn != nil {
 			t.conn.Close()
-		} else {
+		}
+		if t.ln != nil {
 			t.ln.Close()
 		}
 	}
 }
 
-// Split function for scanner to parse a JSON RPC message
-func split(data []byte, _ bool) (advance int, token []byte, err error) {
+// Split function for scanner to parse a JSON RPC message.
+// Messages that can't be read are skipped and returned as an empty token, with t.invalid set to the reason,
+// so that a single broken message doesn't end the session.
+func (t *Transport) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if t.discard > 0 {
+		n := min(len(data), t.discard)
+		t.discard -= n
+		if t.discard > 0 {
+			return n, nil, nil
+		}
+		return n, []byte{}, nil
+	}
+	if t.resync {
+		// Skip to the next header, keeping what could be the start of one
+		i := bytes.Index(data, []byte("Content-Length:"))
+		if i < 0 {
+			if atEOF {
+				return len(data), nil, nil
+			}
+			return max(0, len(data)-len("Content-Length:")), nil, nil
+		}
+		t.resync = false
+		if i > 0 {
+			// The scanner stops at the end of the stream without a token, so go on with the header right away
+			advance, token, err := t.split(data[i:], atEOF)
+			return i + advance, token, err
+		}
+	}
+
 	header, content, found := bytes.Cut(data, []byte{'\r', '\n', '\r', '\n'})
 	if !found {
+		if len(data) > maxHeaderSize {
+			return t.reject(len(data), fmt.Errorf("%w: no end of header", ErrInvalidMessage))
+		}
 		return 0, nil, nil
 	}
 
-	// Content-Length: <number>
-	if len(header) < len("Content-Length: ") {
-		return 0, nil, errors.New("invalid Header: " + string(header))
-	}
-	contentLengthBytes := header[len("Content-Length: "):]
-	contentLength, err := strconv.Atoi(string(contentLengthBytes))
+	contentLength, err := parseHeader(header)
 	if err != nil {
-		return 0, nil, errors.New("invalid Content Length")
+		return t.reject(len(header)+4, fmt.Errorf("%w: %v", ErrInvalidMessage, err))
+	}
+	if contentLength > maxMessageSize {
+		t.invalid = fmt.Errorf("%w: content length %d exceeds the limit of %d bytes", ErrInvalidMessage, contentLength, maxMessageSize)
+		t.discard = contentLength
+		return len(header) + 4, nil, nil
 	}
 
 	if len(content) < contentLength {
@@ -200,6 +314,36 @@ func split(data []byte, _ bool) (advance int, token []byte, err error) {
 	return totalLength, data[:totalLength], nil
 }
 
+// Skips n bytes of a broken header and the content that follows it, which has no known length
+func (t *Transport) reject(n int, reason error) (int, []byte, error) {
+	t.invalid = reason
+	t.resync = true
+	return n, []byte{}, nil
+}
+
+// Returns the content length of a message header. Other header fields, like Content-Type, are ignored.
+func parseHeader(header []byte) (int, error) {
+	contentLength := -1
+	for _, field := range bytes.Split(header, []byte{'\r', '\n'}) {
+		name, value, found := bytes.Cut(field, []byte{':'})
+		if !found {
+			return 0, fmt.Errorf("invalid header field %q", field)
+		}
+		if !bytes.EqualFold(bytes.TrimSpace(name), []byte("Content-Length")) {
+			continue
+		}
+		n, err := strconv.Atoi(string(bytes.TrimSpace(value)))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid content length %q", value)
+		}
+		contentLength = n
+	}
+	if contentLength < 0 {
+		return 0, errors.New("missing Content-Length header")
+	}
+	return contentLength, nil
+}
+
 func GetMethod(content []byte) (string, error) {
 	var msg RPCMessage
 
@@ -3,6 +3,8 @@ package util
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 
@@ -18,3 +20,15 @@ func IsValidPath(path Path) bool{
 		return true
 	}
 }
+
+// Expands a leading ~ to the user's home directory and $VAR or ${VAR} to the value of environment variables.
+// Unset variables expand to an empty string, like in a shell.
+func ExpandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = home + path[1:]
+		}
+	}
+	return os.ExpandEnv(path)
+}
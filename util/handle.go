@@ -3,7 +3,6 @@ package util
 import (
 	"net/url"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"unicode"
 )
@@ -16,35 +15,92 @@ type Handle struct {
 	Path Path
 }
 
+// Handles are compared as map keys, so both fields are normalized: the same file gives the same handle
+// whether it comes from a walked path or from a URI sent by the editor.
 func FromPath(path string) Handle {
+	path = NormalizePath(path)
 	return Handle{Path2URI(path), path}
 }
 
 func FromURI(uri string) (Handle, error) {
 	path, err := URI2path(uri)
-	return Handle{uri, path}, err
+	if err != nil {
+		return Handle{uri, path}, err
+	}
+	return Handle{Path2URI(path), path}, nil
+}
+
+// Documents with a URI scheme other than file (e.g. untitled buffers, or remote and archive documents) can't be read
+// from disk, so they only exist in memory. Their path is the URI itself, which can't clash with file paths and
+// converts back to the same URI.
+func IsMemoryPath(path Path) bool {
+	scheme := URIScheme(path)
+	// Single letters are Windows drives
+	return len(scheme) > 1 && scheme != "file"
+}
+
+// Schemes whose documents are fully supported. Documents of other schemes only get in-memory features.
+func SupportedScheme(scheme string) bool {
+	return scheme == "file" || scheme == "untitled"
+}
+
+// Returns the lower case scheme of uri, or "" if it has none
+func URIScheme(uri URI) string {
+	scheme, _, ok := strings.Cut(uri, ":")
+	if !ok || scheme == "" {
+		return ""
+	}
+	for i, c := range scheme {
+		valid := unicode.IsLetter(c) || (i > 0 && (unicode.IsDigit(c) || c == '+' || c == '-' || c == '.'))
+		if !valid || c > unicode.MaxASCII {
+			return ""
+		}
+	}
+	return strings.ToLower(scheme)
 }
 
 // Converting functions
 
+// Returns the canonical form of path: cleaned, without trailing separators and with an upper case
+// Windows drive letter. Memory paths are returned as is.
+func NormalizePath(path Path) Path {
+	if path == "" || IsMemoryPath(path) {
+		return path
+	}
+	path = filepath.Clean(path)
+	if IsWindowsDrivePath(path) {
+		path = strings.ToUpper(path[:1]) + path[1:]
+	}
+	return path
+}
+
+// Converts a URI to a normalized path. Percent-encoded characters are decoded.
 func URI2path(uri string) (string, error) {
+	if IsMemoryPath(uri) {
+		return uri, nil
+	}
 	url, err := url.Parse(uri)
 	if err != nil {
 		return "", err
 	}
 	//	url.Path
 	if IsWindowsDriveURIPath(url.Path) {
-		url.Path = strings.ToUpper(string(url.Path[1])) + url.Path[2:]
+		url.Path = url.Path[1:]
 	}
-	return filepath.FromSlash(url.Path), nil
+	return NormalizePath(filepath.FromSlash(url.Path)), nil
 }
 
+// Converts a path to a file URI, percent-encoding the characters that need it
 func Path2URI(path string) URI {
-	scheme := "file://"
-	if runtime.GOOS == "windows" {
-		path = "/" + strings.Replace(path, "\\", "/", -1)
+	if IsMemoryPath(path) {
+		return path
+	}
+	path = filepath.ToSlash(NormalizePath(path))
+	if IsWindowsDrivePath(path) {
+		path = "/" + path
 	}
-	return scheme + path
+	uri := url.URL{Scheme: "file", Path: path}
+	return uri.String()
 }
 
 func IsWindowsDriveURIPath(uri string) bool {